@@ -0,0 +1,410 @@
+// Package apitest provides a fake netmaker api server for testing the flows of the netclient that call the api
+//
+// the server implements the routes used by the netclient: authenticate, node join, node get, node delete,
+// migrate and getip; the default handlers keep hosts and nodes in memory, a scripted response replaces
+// the default handling of a request and all requests are recorded
+package apitest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/gravitl/netmaker/models"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Route - a route of the api
+type Route string
+
+const (
+	// RouteAuthenticate - POST /api/hosts/adm/authenticate
+	RouteAuthenticate Route = "authenticate"
+	// RouteJoin - POST /api/nodes/{network}
+	RouteJoin Route = "join"
+	// RouteGetNode - GET /api/nodes/{network}/{nodeid}
+	RouteGetNode Route = "getnode"
+	// RouteDeleteNode - DELETE /api/nodes/{network}/{nodeid}
+	RouteDeleteNode Route = "deletenode"
+	// RouteMigrate - POST /api/nodes/{network}/{nodeid}/migrate
+	RouteMigrate Route = "migrate"
+	// RouteGetIP - GET /api/getip
+	RouteGetIP Route = "getip"
+	// RouteUnknown - requests not matching any route, answered with 404
+	RouteUnknown Route = "unknown"
+)
+
+// Request - a request received by the server
+type Request struct {
+	Route  Route
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// Request.Decode - decodes the json body of the request into v
+func (r *Request) Decode(v any) error {
+	return json.Unmarshal(r.Body, v)
+}
+
+// Response - a scripted response; a Body of type string or []byte is sent as is, any other is encoded as json
+type Response struct {
+	Status int
+	Body   any
+}
+
+// State - hosts, nodes and settings of the server
+type State struct {
+	ServerConfig models.ServerConfig        // returned by join, get node and migrate; API defaults to the address of the server
+	Networks     map[string]models.Network  // networks that can be joined, by name
+	AccessKey    string                     // key required to join; any key is accepted if empty
+	Hosts        map[uuid.UUID]models.Host  // registered hosts, a host authenticates with its HostPass
+	Nodes        map[uuid.UUID]models.Node  // nodes of the hosts
+	Peers        []wgtypes.PeerConfig       // peers sent to every node
+	PublicIP     string                     // returned by getip
+	Tokens       map[string]uuid.UUID       // auth tokens issued to the hosts
+	Migrations   map[string]models.JoinData // migrated legacy nodes, by legacy node id
+}
+
+// Server - a fake netmaker api server
+type Server struct {
+	*httptest.Server
+	mutex     sync.Mutex
+	state     State
+	scripted  map[Route][]Response
+	requests  []Request
+	addresses int // addresses handed out
+}
+
+// NewServer - starts a fake api server with the default server config, which must be closed by the caller
+func NewServer() *Server {
+	s := &Server{
+		state: State{
+			ServerConfig: models.ServerConfig{
+				Server:  "netmaker.test",
+				Broker:  "broker.netmaker.test",
+				MQPort:  "8883",
+				Version: "v0.18.0",
+			},
+			Networks:   make(map[string]models.Network),
+			Hosts:      make(map[uuid.UUID]models.Host),
+			Nodes:      make(map[uuid.UUID]models.Node),
+			Tokens:     make(map[string]uuid.UUID),
+			Migrations: make(map[string]models.JoinData),
+			PublicIP:   "203.0.113.10",
+		},
+		scripted: make(map[Route][]Response),
+	}
+	s.Server = httptest.NewServer(s)
+	s.state.ServerConfig.API = s.URL
+	return s
+}
+
+// Server.Update - changes the state of the server
+func (s *Server) Update(f func(*State)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f(&s.state)
+}
+
+// Server.AddNetwork - adds a network that can be joined
+func (s *Server) AddNetwork(name, addressRange string) {
+	s.Update(func(state *State) {
+		state.Networks[name] = models.Network{NetID: name, AddressRange: addressRange}
+	})
+}
+
+// Server.Host - registered host
+func (s *Server) Host(id uuid.UUID) (models.Host, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	host, ok := s.state.Hosts[id]
+	return host, ok
+}
+
+// Server.Node - node of a host
+func (s *Server) Node(id uuid.UUID) (models.Node, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	node, ok := s.state.Nodes[id]
+	return node, ok
+}
+
+// Server.Respond - queues a response for the next request of route, replacing its default handling
+func (s *Server) Respond(route Route, status int, body any) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.scripted[route] = append(s.scripted[route], Response{Status: status, Body: body})
+}
+
+// Server.RespondError - queues an error response for the next request of route, as sent by netmaker
+func (s *Server) RespondError(route Route, status int, message string) {
+	s.Respond(route, status, models.ErrorResponse{Code: status, Message: message})
+}
+
+// Server.Requests - the requests received, in order
+func (s *Server) Requests() []Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Request{}, s.requests...)
+}
+
+// Server.RequestsOf - the requests received for route, in order
+func (s *Server) RequestsOf(route Route) []Request {
+	var requests []Request
+	for _, r := range s.Requests() {
+		if r.Route == route {
+			requests = append(requests, r)
+		}
+	}
+	return requests
+}
+
+// Server.ServeHTTP - records the request and answers it with the next scripted response of its route
+// or the default handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	route, params := match(r.Method, r.URL.Path)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	request := Request{Route: route, Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone(), Body: body}
+	s.requests = append(s.requests, request)
+	if scripted := s.scripted[route]; len(scripted) > 0 {
+		s.scripted[route] = scripted[1:]
+		write(w, scripted[0].Status, scripted[0].Body)
+		return
+	}
+	var status int
+	var response any
+	switch route {
+	case RouteAuthenticate:
+		status, response = s.authenticate(&request)
+	case RouteJoin:
+		status, response = s.join(&request, params[0])
+	case RouteGetNode:
+		status, response = s.getNode(&request, params[0], params[1])
+	case RouteDeleteNode:
+		status, response = s.deleteNode(&request, params[0], params[1])
+	case RouteMigrate:
+		status, response = s.migrate(&request, params[0], params[1])
+	case RouteGetIP:
+		status, response = http.StatusOK, s.state.PublicIP
+	default:
+		status, response = errorResponse(http.StatusNotFound, "no such route")
+	}
+	write(w, status, response)
+}
+
+// match - the route of a request and the parameters in its path
+func match(method, path string) (Route, []string) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case method == http.MethodPost && path == "/api/hosts/adm/authenticate":
+		return RouteAuthenticate, nil
+	case method == http.MethodGet && path == "/api/getip":
+		return RouteGetIP, nil
+	case len(parts) < 3 || parts[0] != "api" || parts[1] != "nodes":
+		return RouteUnknown, nil
+	case method == http.MethodPost && len(parts) == 3:
+		return RouteJoin, parts[2:]
+	case method == http.MethodGet && len(parts) == 4:
+		return RouteGetNode, parts[2:]
+	case method == http.MethodDelete && len(parts) == 4:
+		return RouteDeleteNode, parts[2:]
+	case method == http.MethodPost && len(parts) == 5 && parts[4] == "migrate":
+		return RouteMigrate, parts[2:4]
+	}
+	return RouteUnknown, nil
+}
+
+// write - writes a response; strings and byte slices are written as is, anything else as json
+func write(w http.ResponseWriter, status int, body any) {
+	var data []byte
+	switch body := body.(type) {
+	case string:
+		data = []byte(body)
+	case []byte:
+		data = body
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data = buf.Bytes()
+	}
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// errorResponse - an error response as sent by netmaker
+func errorResponse(status int, message string) (int, any) {
+	return status, models.ErrorResponse{Code: status, Message: message}
+}
+
+// Server.authenticate - issues a token to a registered host presenting its password
+func (s *Server) authenticate(r *Request) (int, any) {
+	var params models.AuthParams
+	if err := r.Decode(&params); err != nil {
+		return errorResponse(http.StatusBadRequest, err.Error())
+	}
+	id, err := uuid.Parse(params.ID)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, "invalid host id")
+	}
+	host, ok := s.state.Hosts[id]
+	if !ok || host.HostPass != params.Password {
+		return errorResponse(http.StatusUnauthorized, "incorrect credentials")
+	}
+	token := uuid.NewString()
+	s.state.Tokens[token] = id
+	return http.StatusOK, models.SuccessResponse{
+		Code:     http.StatusOK,
+		Message:  "host authenticated",
+		Response: map[string]any{"AuthToken": token, "ID": id.String()},
+	}
+}
+
+// Server.authorized - host authenticated by the bearer token of a request
+func (s *Server) authorized(r *Request) (uuid.UUID, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	id, ok := s.state.Tokens[token]
+	return id, ok
+}
+
+// Server.join - creates a node in a network for the host of the join data
+func (s *Server) join(r *Request, network string) (int, any) {
+	key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if key == "" || (s.state.AccessKey != "" && key != s.state.AccessKey) {
+		return errorResponse(http.StatusUnauthorized, "invalid access key")
+	}
+	var data models.JoinData
+	if err := r.Decode(&data); err != nil {
+		return errorResponse(http.StatusBadRequest, err.Error())
+	}
+	if _, ok := s.state.Networks[network]; !ok {
+		return errorResponse(http.StatusNotFound, "network "+network+" not found")
+	}
+	node := s.addNode(network, &data.Host, &data.Node)
+	return http.StatusOK, s.joinResponse(node)
+}
+
+// Server.getNode - the node with its host, peers and the server config
+func (s *Server) getNode(r *Request, network, id string) (int, any) {
+	hostID, ok := s.authorized(r)
+	if !ok {
+		return errorResponse(http.StatusUnauthorized, "unauthorized")
+	}
+	node, ok := s.findNode(network, id)
+	if !ok || node.HostID != hostID {
+		return errorResponse(http.StatusNotFound, "node not found")
+	}
+	host := s.state.Hosts[hostID]
+	netSettings := s.state.Networks[network]
+	return http.StatusOK, models.NodeGet{
+		Node:         *node.Legacy(&host, &s.state.ServerConfig, &netSettings),
+		Host:         host,
+		Peers:        s.state.Peers,
+		HostPeers:    s.state.Peers,
+		ServerConfig: s.state.ServerConfig,
+	}
+}
+
+// Server.deleteNode - deletes a node of the authenticated host
+func (s *Server) deleteNode(r *Request, network, id string) (int, any) {
+	hostID, ok := s.authorized(r)
+	if !ok {
+		return errorResponse(http.StatusUnauthorized, "unauthorized")
+	}
+	node, ok := s.findNode(network, id)
+	if !ok || node.HostID != hostID {
+		return errorResponse(http.StatusNotFound, "node not found")
+	}
+	delete(s.state.Nodes, node.ID)
+	return http.StatusOK, "node deleted"
+}
+
+// Server.migrate - replaces a legacy node, authenticated by its password, with a node of the host of the join data
+func (s *Server) migrate(r *Request, network, legacyID string) (int, any) {
+	var data models.MigrationData
+	if err := r.Decode(&data); err != nil {
+		return errorResponse(http.StatusBadRequest, err.Error())
+	}
+	if data.LegacyNodeID != legacyID || data.Password == "" {
+		return errorResponse(http.StatusUnauthorized, "invalid legacy node credentials")
+	}
+	if _, ok := s.state.Networks[network]; !ok {
+		return errorResponse(http.StatusNotFound, "network "+network+" not found")
+	}
+	data.JoinData.Node.Network = network
+	node := s.addNode(network, &data.JoinData.Host, &data.JoinData.Node)
+	s.state.Migrations[legacyID] = data.JoinData
+	return http.StatusOK, s.joinResponse(node)
+}
+
+// Server.addNode - registers the host and creates the node with an address of the network
+func (s *Server) addNode(network string, host *models.Host, node *models.Node) *models.Node {
+	if existing, ok := s.state.Hosts[host.ID]; ok && host.HostPass == "" {
+		host.HostPass = existing.HostPass
+	}
+	s.state.Hosts[host.ID] = *host
+	node.ID = uuid.New()
+	node.HostID = host.ID
+	node.Network = network
+	node.Server = s.state.ServerConfig.Server
+	node.Connected = true
+	node.NetworkSettings(s.state.Networks[network])
+	if node.NetworkRange.IP != nil {
+		s.addresses++
+		node.Address = net.IPNet{IP: nthAddress(node.NetworkRange.IP, s.addresses), Mask: node.NetworkRange.Mask}
+	}
+	s.state.Nodes[node.ID] = *node
+	return node
+}
+
+// Server.joinResponse - response to a join or migrate
+func (s *Server) joinResponse(node *models.Node) models.NodeJoinResponse {
+	return models.NodeJoinResponse{
+		Node:         *node,
+		Host:         s.state.Hosts[node.HostID],
+		ServerConfig: s.state.ServerConfig,
+		Peers:        s.state.Peers,
+	}
+}
+
+// Server.findNode - a node of a network by id
+func (s *Server) findNode(network, id string) (*models.Node, bool) {
+	nodeID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, false
+	}
+	node, ok := s.state.Nodes[nodeID]
+	if !ok || node.Network != network {
+		return nil, false
+	}
+	return &node, true
+}
+
+// nthAddress - the address n after ip
+func nthAddress(ip net.IP, n int) net.IP {
+	address := make(net.IP, len(ip))
+	copy(address, ip)
+	for i := len(address) - 1; i >= 0 && n > 0; i-- {
+		sum := int(address[i]) + n
+		address[i] = byte(sum)
+		n = sum >> 8
+	}
+	return address
+}
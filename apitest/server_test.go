@@ -0,0 +1,59 @@
+package apitest
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		route  Route
+		params []string
+	}{
+		{http.MethodPost, "/api/hosts/adm/authenticate", RouteAuthenticate, nil},
+		{http.MethodGet, "/api/getip", RouteGetIP, nil},
+		{http.MethodPost, "/api/nodes/net1", RouteJoin, []string{"net1"}},
+		{http.MethodGet, "/api/nodes/net1/node1", RouteGetNode, []string{"net1", "node1"}},
+		{http.MethodDelete, "/api/nodes/net1/node1", RouteDeleteNode, []string{"net1", "node1"}},
+		{http.MethodPost, "/api/nodes/net1/node1/migrate", RouteMigrate, []string{"net1", "node1"}},
+		{http.MethodGet, "/api/nodes/net1", RouteUnknown, nil},
+		{http.MethodGet, "/api/hosts", RouteUnknown, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.method+" "+test.path, func(t *testing.T) {
+			is := is.New(t)
+			route, params := match(test.method, test.path)
+			is.Equal(route, test.route)
+			is.Equal(params, test.params)
+		})
+	}
+}
+
+func TestScriptedResponse(t *testing.T) {
+	is := is.New(t)
+	s := NewServer()
+	defer s.Close()
+	s.Respond(RouteGetIP, http.StatusServiceUnavailable, "try later")
+	for _, expected := range []string{"try later", "203.0.113.10"} {
+		response, err := http.Get(s.URL + "/api/getip")
+		is.NoErr(err)
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		is.NoErr(err)
+		is.Equal(string(body), expected) // scripted response, then the default handler
+	}
+	is.Equal(len(s.RequestsOf(RouteGetIP)), 2)
+}
+
+func TestNthAddress(t *testing.T) {
+	is := is.New(t)
+	is.Equal(nthAddress(net.ParseIP("10.0.0.0").To4(), 5).String(), "10.0.0.5")
+	is.Equal(nthAddress(net.ParseIP("10.0.0.250").To4(), 10).String(), "10.0.1.4")
+	is.Equal(nthAddress(net.ParseIP("fd00::"), 1).String(), "fd00::1")
+}
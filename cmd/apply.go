@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"github.com/gravitl/netclient/functions"
+	"github.com/gravitl/netmaker/logger"
+	"github.com/spf13/cobra"
+)
+
+// applyCmd represents the apply command
+var applyCmd = &cobra.Command{
+	Use:   "apply -f <file>",
+	Args:  cobra.NoArgs,
+	Short: "converge host to a desired state file",
+	Long: `converge the host to the servers, networks and host settings listed in a desired state file
+networks that are not joined are joined using their token, networks that are not listed are left
+and host settings are updated; the planned changes are displayed before they are made
+a server is matched to a configured server by name, or else by the api address in its tokens;
+a server that matches neither and has no tokens is reported as an error and its networks are kept
+For example:
+netclient apply -f state.yml             //apply desired state
+netclient apply -f state.yml --dry-run   //display planned changes without making them
+
+example desired state file:
+host:
+  name: web-01
+  mtu: 1420
+  listenport: 51821
+  endpoint: 203.0.113.10   # static endpoint
+  proxy: false
+servers:
+  - name: netmaker.example.com
+    networks:
+      - name: net1
+        token: <enrollment token>
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		file, _ := cmd.Flags().GetString("file")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		if file == "" {
+			cmd.Usage()
+			return
+		}
+		if err := functions.Apply(file, dryRun); err != nil {
+			logger.FatalLog("apply failed:", err.Error())
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(applyCmd)
+	applyCmd.Flags().StringP("file", "f", "", "desired state file")
+	applyCmd.Flags().Bool("dry-run", false, "display planned changes without making them")
+}
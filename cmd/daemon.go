@@ -7,6 +7,7 @@ import (
 	"fmt"
 
 	"github.com/gravitl/netclient/functions"
+	"github.com/gravitl/netmaker/logger"
 	"github.com/spf13/cobra"
 )
 
@@ -14,15 +15,23 @@ import (
 var daemonCmd = &cobra.Command{
 	Use:   "daemon",
 	Short: "netclient daemon",
-	Long:  `netclient daemon gets and sends updates to netmaker server"`,
+	Long: `netclient daemon gets and sends updates to netmaker server
+the netmaker interface uses kernel wireguard if available and userspace wireguard otherwise,
+unless a mode is set with --wireguard-mode or wireguardmode in netclient.yml`,
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("daemon called")
+		if mode, _ := cmd.Flags().GetString("wireguard-mode"); mode != "" {
+			if err := functions.SetWireGuardMode(mode); err != nil {
+				logger.FatalLog(err.Error())
+			}
+		}
 		functions.Daemon()
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(daemonCmd)
+	daemonCmd.Flags().String("wireguard-mode", "", "wireguard implementation: auto, kernel or userspace (default from netclient.yml, else auto)")
 
 	// Here you will define your flags and configuration settings.
 
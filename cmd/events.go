@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gravitl/netclient/functions"
+	"github.com/spf13/cobra"
+)
+
+// eventsCmd represents the events command
+var eventsCmd = &cobra.Command{
+	Use:   "events",
+	Args:  cobra.NoArgs,
+	Short: "stream events of the daemon",
+	Long: `stream the events published by the running daemon as json lines, one event per line,
+such as peers added or removed, nodes joined or deleted and broker connection changes
+For example:
+netclient events                                          //stream all events
+netclient events --kind peer_added --kind peer_removed    //stream peer changes only
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		kinds, _ := cmd.Flags().GetStringArray("kind")
+		if err := functions.StreamEvents(os.Stdout, kinds); err != nil {
+			fmt.Println("failed to stream events:", err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(eventsCmd)
+	eventsCmd.Flags().StringArrayP("kind", "k", nil, "kind of events to stream, may be repeated")
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gravitl/netclient/functions"
+	"github.com/spf13/cobra"
+)
+
+// keysCmd represents the keys command
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "manage the keys of the host",
+	Long:  `manage the keys used to encrypt messages exchanged with netmaker servers`,
+}
+
+// keysRotateTrafficCmd represents the keys rotate-traffic command
+var keysRotateTrafficCmd = &cobra.Command{
+	Use:   "rotate-traffic",
+	Args:  cobra.NoArgs,
+	Short: "rotate the traffic keys",
+	Long: `generate new traffic keys and announce the new public key to all servers
+messages to a server are encrypted with the previous key until the server confirms the new key,
+the previous key is removed an hour after all servers confirmed the new key
+For example:
+netclient keys rotate-traffic                    //rotate the traffic keys now
+netclient keys rotate-traffic --schedule 720h    //rotate the traffic keys every 30 days, starting now
+netclient keys rotate-traffic --schedule 0 --now=false  //disable scheduled rotation
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		now, _ := cmd.Flags().GetBool("now")
+		var interval *time.Duration
+		if cmd.Flags().Changed("schedule") {
+			schedule, _ := cmd.Flags().GetDuration("schedule")
+			interval = &schedule
+		}
+		status, err := functions.TrafficKeys(now, interval)
+		if err != nil {
+			fmt.Println("failed to rotate traffic keys:", err)
+			return
+		}
+		if now {
+			fmt.Println("traffic keys rotated")
+		}
+		if len(status.Pending) > 0 {
+			fmt.Println("waiting for servers to confirm the new key:", strings.Join(status.Pending, ", "))
+		}
+		if status.Interval > 0 {
+			fmt.Println("traffic keys are rotated every", status.Interval)
+		} else {
+			fmt.Println("scheduled rotation is disabled")
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+	keysCmd.AddCommand(keysRotateTrafficCmd)
+	keysRotateTrafficCmd.Flags().Bool("now", true, "rotate the traffic keys now")
+	keysRotateTrafficCmd.Flags().Duration("schedule", 0, "interval at which the daemon rotates the traffic keys, 0 disables scheduled rotation")
+}
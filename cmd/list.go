@@ -15,7 +15,8 @@ var listCmd = &cobra.Command{
 	Args:  cobra.RangeArgs(0, 1),
 	Short: "display list of netmaker networks",
 	Long: `display details of netmaker networks
-long flag provide additional details For example:
+long flag provide additional details, including peer ranges and routes after the split-tunnel policy of the host
+For example:
 netclient list mynet    //display details of mynet network
 netclient list mynet -l //display extended details of mynet network
 netclient list          //display details of all networks
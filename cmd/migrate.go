@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/gravitl/netclient/functions"
+	"github.com/spf13/cobra"
+)
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Args:  cobra.NoArgs,
+	Short: "migrate config files to the current format",
+	Long: `migrate config files written by older versions of netclient to the current schema version
+the first step converts the config of pre v0.18.0 versions in /etc/netclient/config, migrating its nodes through their servers
+migrations are normally applied automatically; the original files are backed up to /etc/netclient/backup
+For example:
+netclient migrate             //apply pending migrations
+netclient migrate --dry-run   //display pending migrations without making changes
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		if err := functions.MigrateConfig(dryRun); err != nil {
+			fmt.Println("failed to migrate config:", err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+	migrateCmd.Flags().Bool("dry-run", false, "display pending migrations without making changes")
+}
@@ -8,7 +8,6 @@ import (
 	"os"
 
 	"github.com/gravitl/netclient/config"
-	"github.com/gravitl/netclient/functions"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -35,7 +34,7 @@ func Execute() {
 }
 
 func init() {
-	cobra.OnInitialize(initConfig, functions.Migrate)
+	cobra.OnInitialize(initConfig)
 	// Here you will define your flags and configuration settings.
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
@@ -48,6 +47,10 @@ func init() {
 }
 
 func initConfig() {
+	// the migrate command runs the migrations itself so they can be previewed with --dry-run
+	if cmd, _, err := rootCmd.Find(os.Args[1:]); err == nil && cmd == migrateCmd {
+		return
+	}
 	flags := viper.New()
 	flags.BindPFlags(rootCmd.Flags())
 	config.InitConfig(flags)
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gravitl/netclient/functions"
+	"github.com/gravitl/netclient/secrets"
+	"github.com/spf13/cobra"
+)
+
+// secretsCmd represents the secrets command
+var secretsCmd = &cobra.Command{
+	Use:   "secrets",
+	Short: "manage encryption of secrets in config files",
+	Long: `manage encryption of the private keys and passwords stored in the netclient config files
+secrets are encrypted with a key that is protected by a key encryption key from one of the providers
+  file        key stored in /etc/netclient/secrets.kek (default)
+  passphrase  key derived from the passphrase in ` + secrets.PassphraseEnv + `
+  systemd     key derived from the systemd credential ` + secrets.CredentialName + `, passed to the daemon by its unit
+              and decrypted from ` + secrets.CredentialStores[0] + ` with systemd-creds by other commands
+  keyring     key derived from the user key ` + secrets.KeyringDescription + ` in the root user keyring
+the key encryption key must be available to the daemon and to every netclient command`,
+}
+
+// secretsMigrateCmd represents the secrets migrate command
+var secretsMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Args:  cobra.NoArgs,
+	Short: "re-encrypt secrets with a new key",
+	Long: `re-encrypt the secrets in the config files with a new key protected by the specified provider
+For example:
+netclient secrets migrate                        //re-encrypt secrets using the current provider
+netclient secrets migrate --provider keyring     //re-encrypt secrets using the kernel keyring
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		provider, _ := cmd.Flags().GetString("provider")
+		if err := functions.MigrateSecrets(provider); err != nil {
+			fmt.Println("failed to migrate secrets:", err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(secretsCmd)
+	secretsCmd.AddCommand(secretsMigrateCmd)
+	secretsMigrateCmd.Flags().String("provider", "", "key encryption key provider, one of "+strings.Join(secrets.Providers, ", "))
+}
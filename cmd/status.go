@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gravitl/netclient/functions"
+	"github.com/spf13/cobra"
+)
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Args:  cobra.NoArgs,
+	Short: "display live status of brokers and peers",
+	Long: `display the broker each server is connected through and the live status
+of the peers on the netmaker interface including last handshake, traffic, endpoint, proxy mode and networks
+For example:
+netclient status             //display peer status
+netclient status --json      //display peer status as json
+netclient status --watch     //refresh peer status until interrupted
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		jsonOut, _ := cmd.Flags().GetBool("json")
+		watch, _ := cmd.Flags().GetBool("watch")
+		interval, _ := cmd.Flags().GetDuration("interval")
+		if err := functions.Status(jsonOut, watch, interval); err != nil {
+			fmt.Println("failed to get status:", err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+	statusCmd.Flags().Bool("json", false, "display status as json")
+	statusCmd.Flags().BoolP("watch", "w", false, "refresh status until interrupted")
+	statusCmd.Flags().Duration("interval", time.Second*2, "refresh interval used with --watch")
+}
@@ -2,7 +2,7 @@
 package config
 
 import (
-	"crypto/rand"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"net"
@@ -10,17 +10,15 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gravitl/netclient/lock"
 	"github.com/gravitl/netclient/ncutils"
 	"github.com/gravitl/netmaker/logger"
 	"github.com/gravitl/netmaker/models"
 	"github.com/spf13/viper"
-	"golang.org/x/crypto/nacl/box"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
-	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -30,10 +28,14 @@ const (
 	MacAppDataPath = "/Applications/Netclient/"
 	// WindowsAppDataPath - windows path
 	WindowsAppDataPath = "C:\\Program Files (x86)\\Netclient\\"
-	// Timeout timelimit for obtaining/releasing lockfile
+	// ConfigDirEnv - environment variable overriding the config directory, eg. NETCLIENT_CONFIG_DIR=/tmp/netclient
+	// the config files, secrets key, outbox, replay state and wireguard config are all kept in it; used by tests and
+	// to run a scratch netclient next to an installed one, together with lock.RuntimeDirEnv
+	ConfigDirEnv = "NETCLIENT_CONFIG_DIR"
+	// Timeout timelimit for obtaining a lock on a config file
 	Timeout = time.Second * 5
-	// ConfigLockfile lockfile to control access to config file
-	ConfigLockfile = "config.lck"
+	// ConfigLockfile name of the lock controlling access to the config file
+	ConfigLockfile = "config"
 	// MaxNameLength maximum length of a node name
 	MaxNameLength = 62
 	// DefaultListenPort default port for wireguard
@@ -42,12 +44,8 @@ const (
 	DefaultMTU = 1420
 )
 
-var (
-	// Netclient contains the netclient config
-	netclient Config
-	// Version - default version string
-	Version = "dev"
-)
+// Version - default version string
+var Version = "dev"
 
 // Config configuration for netclient and host as a whole
 type Config struct {
@@ -58,29 +56,43 @@ type Config struct {
 	TrafficKeyPublic  []byte                          `json:"traffickeypublic" yaml:"trafficekeypublic"`
 	InternetGateway   net.UDPAddr                     `json:"internetgateway" yaml:"internetgateway"`
 	HostPeers         map[string][]wgtypes.PeerConfig `json:"peers" yaml:"peers"`
+	PeerIDs           map[string]models.HostPeerMap   `json:"peerids" yaml:"peerids"`
+	// TrafficKeyCreated - time the traffic keys were generated, zero for keys generated by older versions
+	TrafficKeyCreated time.Time `json:"traffickeycreated,omitempty" yaml:"traffickeycreated,omitempty"`
+	// TrafficKeyInterval - interval at which the traffic keys are rotated, no scheduled rotation if 0
+	TrafficKeyInterval time.Duration `json:"traffickeyinterval,omitempty" yaml:"traffickeyinterval,omitempty"`
+	// TrafficKeyRotation - state of the traffic key rotation in progress, if any
+	TrafficKeyRotation *TrafficKeyRotation `json:"traffickeyrotation,omitempty" yaml:"traffickeyrotation,omitempty"`
+	// WireGuardMode - auto, kernel or userspace, auto if empty
+	WireGuardMode string `json:"wireguardmode,omitempty" yaml:"wireguardmode,omitempty"`
+	// RouteTable - routing table of the routes to peers on linux, 51821 if 0
+	RouteTable int `json:"routetable,omitempty" yaml:"routetable,omitempty"`
+	// FirewallMark - fwmark of the packets sent by the netmaker interface on linux, 51821 if 0
+	FirewallMark int `json:"firewallmark,omitempty" yaml:"firewallmark,omitempty"`
+	// KillSwitch - drop traffic meant for an internet gateway while the tunnel to it is down, instead of sending
+	// it through the uplink
+	KillSwitch bool `json:"killswitch,omitempty" yaml:"killswitch,omitempty"`
 }
 
-func init() {
-	Servers = make(map[string]Server)
-	Nodes = make(map[string]Node)
-	netclient.HostPeers = make(map[string][]wgtypes.PeerConfig)
-}
-
-// UpdateNetcllient updates the in memory version of the host configuration
+// UpdateNetclient updates the in memory version of the host configuration
 func UpdateNetclient(c Config) {
-	netclient = c
+	modify(func(s *State) error {
+		s.Host = c
+		return nil
+	}, false)
 }
 
-// Netclient returns a pointer to the im memory version of the host configuration
+// Netclient returns a pointer to the in memory version of the host configuration
+// the configuration must not be modified through the pointer, use Update or UpdateNetclient
 func Netclient() *Config {
-	return &netclient
+	return &snapshot().Host
 }
 
 // GetHostPeerList - gets the combined list of peers for the host
 func GetHostPeerList() (allPeers []wgtypes.PeerConfig) {
 
 	peerMap := make(map[string]int)
-	for _, serverPeers := range netclient.HostPeers {
+	for _, serverPeers := range Netclient().HostPeers {
 		for i, peerI := range serverPeers {
 			if ind, ok := peerMap[peerI.PublicKey.String()]; ok {
 				allPeers[ind].AllowedIPs = getUniqueAllowedIPList(allPeers[ind].AllowedIPs, peerI.AllowedIPs)
@@ -96,21 +108,38 @@ func GetHostPeerList() (allPeers []wgtypes.PeerConfig) {
 
 // UpdateHostPeers - updates host peer map in the netclient config
 func UpdateHostPeers(server string, peers []wgtypes.PeerConfig) {
-	hostPeerMap := netclient.HostPeers
-	if hostPeerMap == nil {
-		hostPeerMap = make(map[string][]wgtypes.PeerConfig)
+	modify(func(s *State) error {
+		s.Host.HostPeers[server] = peers
+		return nil
+	}, false)
+}
+
+// UpdateHostPeerIDs - updates the peer/node ids received from the server in the netclient config
+func UpdateHostPeerIDs(server string, peerIDs models.HostPeerMap) {
+	modify(func(s *State) error {
+		s.Host.PeerIDs[server] = peerIDs
+		return nil
+	}, false)
+}
+
+// GetHostPeerIDs - gets the peer/node ids of a peer for all servers, indexed by node id
+func GetHostPeerIDs(peerKey string) map[string]models.IDandAddr {
+	ids := make(map[string]models.IDandAddr)
+	for _, serverPeers := range Netclient().PeerIDs {
+		for nodeID, idAndAddr := range serverPeers[peerKey] {
+			ids[nodeID] = idAndAddr
+		}
 	}
-	hostPeerMap[server] = peers
-	netclient.HostPeers = hostPeerMap
+	return ids
 }
 
 // DeleteServerHostPeerCfg - deletes the host peers for the server
 func DeleteServerHostPeerCfg(server string) {
-	if netclient.HostPeers == nil {
-		netclient.HostPeers = make(map[string][]wgtypes.PeerConfig)
-		return
-	}
-	delete(netclient.HostPeers, server)
+	modify(func(s *State) error {
+		delete(s.Host.PeerIDs, server)
+		delete(s.Host.HostPeers, server)
+		return nil
+	}, false)
 }
 
 func getUniqueAllowedIPList(currIps, newIps []net.IPNet) []net.IPNet {
@@ -136,56 +165,54 @@ func SetVersion(ver string) {
 
 // setLogVerbosity sets the logger verbosity from config
 func setLogVerbosity() {
-	logger.Verbosity = netclient.Verbosity
+	logger.Verbosity = Netclient().Verbosity
 }
 
 // ReadNetclientConfig reads the host configuration file and returns it as an instance.
 func ReadNetclientConfig() (*Config, error) {
-	lockfile := filepath.Join(os.TempDir(), ConfigLockfile)
 	file := GetNetclientPath() + "netclient.yml"
-	if err := Lock(lockfile); err != nil {
-		return nil, err
-	}
-	defer Unlock(lockfile)
-	f, err := os.Open(file)
+	l, err := lock.AcquireTimeout(ConfigLockfile, lock.Shared, Timeout)
 	if err != nil {
 		return nil, err
 	}
-	if err := yaml.NewDecoder(f).Decode(&netclient); err != nil {
+	defer l.Release()
+	var netclientCfg Config
+	if err := readYAMLFile(file, &netclientCfg); err != nil {
 		return nil, err
 	}
-	return &netclient, nil
+	if netclientCfg.HostPeers == nil {
+		netclientCfg.HostPeers = make(map[string][]wgtypes.PeerConfig)
+	}
+	if netclientCfg.PeerIDs == nil {
+		netclientCfg.PeerIDs = make(map[string]models.HostPeerMap)
+	}
+	UpdateNetclient(netclientCfg)
+	return Netclient(), nil
 }
 
-// WriteNetclientConfiig writes the in memory host configuration to disk
+// WriteNetclientConfig writes the in memory host configuration to disk
 func WriteNetclientConfig() error {
-	lockfile := filepath.Join(os.TempDir(), ConfigLockfile)
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+	return writeNetclientConfig(Netclient())
+}
+
+// writeNetclientConfig writes a host configuration to disk
+func writeNetclientConfig(host *Config) error {
 	file := GetNetclientPath() + "netclient.yml"
-	if _, err := os.Stat(file); err != nil {
-		if os.IsNotExist(err) {
-			os.MkdirAll(GetNetclientPath(), os.ModePerm)
-		} else if err != nil {
-			return err
-		}
-	}
-	if Lock(lockfile) != nil {
-		return errors.New("failed to obtain lockfile")
-	}
-	defer Unlock(lockfile)
-	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	err = yaml.NewEncoder(f).Encode(netclient)
+	l, err := lock.AcquireTimeout(ConfigLockfile, lock.Exclusive, Timeout)
 	if err != nil {
 		return err
 	}
-	return f.Sync()
+	defer l.Release()
+	return writeYAMLFile(file, host)
 }
 
-// GetNetclientPath - returns path to netclient config directory
+// GetNetclientPath - returns path to netclient config directory, overridden by ConfigDirEnv
 func GetNetclientPath() string {
+	if dir := os.Getenv(ConfigDirEnv); dir != "" {
+		return filepath.Clean(dir) + string(filepath.Separator)
+	}
 	if runtime.GOOS == "windows" {
 		return WindowsAppDataPath
 	} else if runtime.GOOS == "darwin" {
@@ -207,140 +234,6 @@ func GetNetclientInstallPath() string {
 	}
 }
 
-// Lock creates a lockfile with pid as contents
-// if lockfile exists but belongs to defunct process
-// the existing lockfile will be deleted and new one created
-// if unable to create within TIMEOUT returns error
-func Lock(lockfile string) error {
-	debug := netclient.Debug
-	start := time.Now()
-	pid := os.Getpid()
-	if debug {
-		logger.Log(0, "lock try")
-	}
-	for {
-		if _, err := os.Stat(lockfile); !errors.Is(err, os.ErrNotExist) {
-			if debug {
-				logger.Log(0, "file exists")
-			}
-			bytes, err := os.ReadFile(lockfile)
-			if err == nil {
-				var owner int
-				if json.Unmarshal(bytes, &owner) == nil {
-					if IsPidDead(owner) {
-						if err := os.Remove(lockfile); err != nil {
-							if debug {
-								logger.Log(0, "error removing lockfile", err.Error())
-							}
-						}
-					}
-				}
-				if debug {
-					logger.Log(0, "error unmarhalling data from lockfile", err.Error())
-				}
-			}
-			if debug {
-				logger.Log(0, "error reading lockfile", err.Error())
-			}
-		} else {
-			bytes, _ := json.Marshal(pid)
-			if err := os.WriteFile(lockfile, bytes, os.ModePerm); err == nil {
-				if debug {
-					logger.Log(0, "file locked")
-				}
-				return nil
-			} else {
-				if debug {
-					logger.Log(0, "unable to write: ", err.Error())
-				}
-			}
-		}
-		if debug {
-			logger.Log(0, "unable to get lock")
-		}
-		if time.Since(start) > Timeout {
-			return errors.New("TIMEOUT")
-		}
-		time.Sleep(time.Millisecond * 100)
-	}
-}
-
-// Unlock removes a lockfile if contents of lockfile match current pid
-// also removes lockfile if owner process is no longer running
-// will return TIMEOUT error if timeout exceeded
-func Unlock(lockfile string) error {
-	var pid int
-	debug := netclient.Debug
-	start := time.Now()
-	if debug {
-		logger.Log(0, "unlock try")
-	}
-	for {
-		bytes, err := os.ReadFile(lockfile)
-		if err != nil {
-
-			if errors.Is(err, os.ErrNotExist) {
-				return nil
-			}
-			if debug {
-				logger.Log(0, "error reading file")
-			}
-			return err
-		}
-		if debug {
-			logger.Log(0, "lockfile exists")
-		}
-		if err := json.Unmarshal(bytes, &pid); err == nil {
-			if pid == os.Getpid() {
-				if err := os.Remove(lockfile); err == nil {
-					if debug {
-						logger.Log(0, "removed lockfile")
-
-					}
-					return nil
-				} else {
-					if debug {
-						logger.Log(0, "error removing file", err.Error())
-					}
-				}
-			} else {
-				if debug {
-					logger.Log(0, "wrong pid")
-				}
-				if IsPidDead(pid) {
-					if err := os.Remove(lockfile); err != nil {
-						if debug {
-							logger.Log(0, "error removing lockfile", err.Error())
-						}
-					}
-				}
-			}
-		} else {
-			if debug {
-				logger.Log(0, "unmarshal err ", err.Error())
-			}
-		}
-		if debug {
-			logger.Log(0, "unable to unlock")
-		}
-		if time.Since(start) > Timeout {
-			return errors.New("TIMEOUT")
-		}
-		time.Sleep(time.Millisecond * 100)
-	}
-}
-
-// IsPidDead checks if given pid is not running
-func IsPidDead(pid int) bool {
-	process, err := os.FindProcess(pid)
-	if err != nil {
-		return true
-	}
-	//FindProcess always returns err = nil on linux
-	err = process.Signal(syscall.Signal(0))
-	return errors.Is(err, os.ErrProcessDone)
-}
-
 // FormatName ensures name is in character set and is proper length
 // Sets name to blank on failure
 func FormatName(name string) string {
@@ -371,7 +264,14 @@ func InCharSet(name string) bool {
 // InitConfig reads in config file and ENV variables if set.
 func InitConfig(viper *viper.Viper) {
 	checkUID()
-	ReadNetclientConfig()
+	migrateOnStartup()
+	// never generate a new identity over an existing config that could not be read,
+	// nor over one that could not be locked as another process may be writing it
+	if _, err := ReadNetclientConfig(); errors.Is(err, lock.ErrTimeout) {
+		logger.FatalLog("another netclient process is holding the config lock, refusing to continue:", err.Error())
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.FatalLog("failed to read netclient config, refusing to continue:", err.Error())
+	}
 	setLogVerbosity()
 	ReadNodeConfig()
 	ReadServerConf()
@@ -379,13 +279,14 @@ func InitConfig(viper *viper.Viper) {
 	//check netclient dirs exist
 	if _, err := os.Stat(GetNetclientPath()); err != nil {
 		if os.IsNotExist(err) {
-			if err := os.Mkdir(GetNetclientPath(), os.ModePerm); err != nil {
+			if err := os.Mkdir(GetNetclientPath(), configDirPerm); err != nil {
 				logger.Log(0, "failed to create dirs", err.Error())
 			}
 		} else {
 			logger.FatalLog("could not create /etc/netclient dir" + err.Error())
 		}
 	}
+	migrateLegacyOnStartup()
 	//wireguard.WriteWgConfig(Netclient(), GetNodes())
 }
 
@@ -393,7 +294,7 @@ func InitConfig(viper *viper.Viper) {
 func CheckConfig() {
 	fail := false
 	saveRequired := false
-	netclient := Netclient()
+	netclient := *Netclient()
 	if netclient.OS != runtime.GOOS {
 		logger.Log(0, "setting OS")
 		netclient.OS = runtime.GOOS
@@ -469,20 +370,19 @@ func CheckConfig() {
 
 	if len(netclient.TrafficKeyPrivate) == 0 {
 		logger.Log(0, "setting traffic keys")
-		pub, priv, err := box.GenerateKey(rand.Reader)
+		private, public, err := GenerateTrafficKeys()
 		if err != nil {
 			logger.FatalLog("error generating traffic keys", err.Error())
 		}
-		bytes, err := ncutils.ConvertKeyToBytes(priv)
-		if err != nil {
-			logger.FatalLog("error generating traffic keys", err.Error())
-		}
-		netclient.TrafficKeyPrivate = bytes
-		bytes, err = ncutils.ConvertKeyToBytes(pub)
-		if err != nil {
-			logger.FatalLog("error generating traffic keys", err.Error())
-		}
-		netclient.TrafficKeyPublic = bytes
+		netclient.TrafficKeyPrivate = private
+		netclient.TrafficKeyPublic = public
+		netclient.TrafficKeyCreated = time.Now()
+		saveRequired = true
+	}
+	// the public key is sent to the servers in the embedded host, which is not set by older versions
+	if !bytes.Equal(netclient.Host.TrafficKeyPublic, netclient.TrafficKeyPublic) {
+		logger.Log(0, "setting host traffic key")
+		netclient.Host.TrafficKeyPublic = netclient.TrafficKeyPublic
 		saveRequired = true
 	}
 	// check for nftables present if on Linux
@@ -504,6 +404,7 @@ func CheckConfig() {
 			logger.Log(0, "failed to create netmaker.conf: ", err.Error())
 		}
 	}
+	UpdateNetclient(netclient)
 	if saveRequired {
 		logger.Log(3, "saving netclient configuration")
 		if err := WriteNetclientConfig(); err != nil {
@@ -511,7 +412,7 @@ func CheckConfig() {
 		}
 	}
 	_ = ReadServerConf()
-	for _, server := range Servers {
+	for _, server := range GetServerMap() {
 		if server.MQID != netclient.ID {
 			fail = true
 			logger.Log(0, server.Name, "is misconfigured: MQID/Password does not match hostid/password")
@@ -0,0 +1,20 @@
+package config
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestGetNetclientPath(t *testing.T) {
+	is := is.New(t)
+	t.Setenv(ConfigDirEnv, "")
+	if runtime.GOOS == "linux" {
+		is.Equal(GetNetclientPath(), LinuxAppDataPath)
+	}
+	t.Setenv(ConfigDirEnv, "/tmp/netclient")
+	is.Equal(GetNetclientPath(), "/tmp/netclient/")
+	t.Setenv(ConfigDirEnv, "/tmp/netclient/")
+	is.Equal(GetNetclientPath(), "/tmp/netclient/")
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	"github.com/gravitl/netmaker/logger"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// configFilePerm - permissions of config files, they contain private keys
+	configFilePerm = 0600
+	// configDirPerm - permissions of the netclient config directory
+	configDirPerm = 0700
+	// previousSuffix - suffix of the retained previous generation of a config file
+	previousSuffix = ".prev"
+)
+
+// renameFile - replaces a config file with its new version, replaced by tests to simulate a crash before the rename
+var renameFile = os.Rename
+
+// writeYAMLFile writes value to file as yaml, stamped with the current schema version
+// and with sensitive values encrypted
+func writeYAMLFile(file string, value any) error {
+	var doc yaml.Node
+	if err := doc.Encode(value); err != nil {
+		return err
+	}
+	if err := setSchemaVersion(&doc, SchemaVersion); err != nil {
+		return err
+	}
+	if err := encryptSecrets(file, &doc); err != nil {
+		return err
+	}
+	return writeYAMLNode(file, &doc)
+}
+
+// writeYAMLNode writes a yaml document to file
+// the data is written to a temp file which is synced and renamed over file so a crash
+// never leaves a partially written file; the replaced file is retained as file.prev
+func writeYAMLNode(file string, doc *yaml.Node) error {
+	var buf bytes.Buffer
+	if err := yaml.NewEncoder(&buf).Encode(doc); err != nil {
+		return err
+	}
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, configDirPerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(configFilePerm); err != nil && runtime.GOOS != "windows" {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	retainPrevious(file)
+	if err := renameFile(tmp.Name(), file); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// readYAMLFile decodes the yaml file into value
+// if the file can not be decoded the previous generation is used instead
+func readYAMLFile(file string, value any) error {
+	err := decodeYAMLFile(file, value)
+	if err == nil || errors.Is(err, os.ErrNotExist) || errors.Is(err, ErrNewerSchema) {
+		return err
+	}
+	logger.Log(0, "WARNING: failed to decode", file, err.Error(), "-- falling back to previous version", file+previousSuffix)
+	if prevErr := decodeYAMLFile(file+previousSuffix, value); prevErr != nil {
+		logger.Log(0, "WARNING: failed to decode", file+previousSuffix, prevErr.Error())
+		return fmt.Errorf("could not decode %s or previous version: %w", file, err)
+	}
+	logger.Log(0, "WARNING: recovered configuration from", file+previousSuffix, "-- changes since the last good write may be lost")
+	return nil
+}
+
+// decodeYAMLFile decodes the yaml file into value, refusing files written with a newer schema
+func decodeYAMLFile(file string, value any) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var doc yaml.Node
+	if err := yaml.NewDecoder(f).Decode(&doc); err != nil {
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s is empty", file)
+		}
+		return err
+	}
+	version, err := popSchemaVersion(&doc)
+	if err != nil {
+		return fmt.Errorf("%s %w", file, err)
+	}
+	if version > SchemaVersion {
+		return fmt.Errorf("%s schema version %d: %w", file, version, ErrNewerSchema)
+	}
+	if version < SchemaVersion {
+		logger.Log(1, file, "has not been migrated to schema version", strconv.Itoa(SchemaVersion))
+	}
+	if err := decryptSecrets(file, &doc); err != nil {
+		return err
+	}
+	return doc.Decode(value)
+}
+
+// retainPrevious keeps the current version of file as file.prev, provided it is valid yaml
+// a file that can not be parsed is never retained so the last good generation is not lost
+func retainPrevious(file string) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil || node.Kind == 0 {
+		logger.Log(0, "not retaining invalid configuration file", file)
+		return
+	}
+	prev := file + previousSuffix
+	tmp := prev + ".tmp"
+	os.Remove(tmp)
+	if err := os.Link(file, tmp); err != nil {
+		// hard links are not supported everywhere, fall back to a copy
+		if err := os.WriteFile(tmp, data, configFilePerm); err != nil {
+			logger.Log(0, "failed to retain previous version of", file, err.Error())
+			return
+		}
+	}
+	if err := os.Rename(tmp, prev); err != nil {
+		logger.Log(0, "failed to retain previous version of", file, err.Error())
+		os.Remove(tmp)
+		return
+	}
+	// files written by older versions may be world readable
+	_ = os.Chmod(prev, configFilePerm)
+}
+
+// syncDir flushes directory entries (i.e. a rename) to disk
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
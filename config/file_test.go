@@ -0,0 +1,135 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+// captureOutput - returns what fn printed to stdout, where the logger writes
+func captureOutput(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- data
+	}()
+	defer func() {
+		os.Stdout = stdout
+	}()
+	fn()
+	w.Close()
+	return string(<-done)
+}
+
+// tempFiles - names of the temp files left in dir
+func tempFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ".tmp") {
+			files = append(files, entry.Name())
+		}
+	}
+	return files
+}
+
+func TestWriteYAMLFile(t *testing.T) {
+	is := is.New(t)
+	file := filepath.Join(t.TempDir(), "test.yml")
+	is.NoErr(writeYAMLFile(file, map[string]string{"name": "first"}))
+	info, err := os.Stat(file)
+	is.NoErr(err)
+	is.Equal(info.Mode().Perm(), os.FileMode(configFilePerm))
+	_, err = os.Stat(file + previousSuffix)
+	is.True(errors.Is(err, os.ErrNotExist)) // nothing to retain on the first write
+
+	is.NoErr(writeYAMLFile(file, map[string]string{"name": "second"}))
+	var value map[string]string
+	is.NoErr(readYAMLFile(file, &value))
+	is.Equal(value["name"], "second")
+	// the replaced generation is kept with the same permissions
+	var prev map[string]string
+	is.NoErr(decodeYAMLFile(file+previousSuffix, &prev))
+	is.Equal(prev["name"], "first")
+	info, err = os.Stat(file + previousSuffix)
+	is.NoErr(err)
+	is.Equal(info.Mode().Perm(), os.FileMode(configFilePerm))
+	is.Equal(len(tempFiles(t, filepath.Dir(file))), 0)
+}
+
+func TestWriteYAMLFileCrash(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "test.yml")
+	is.NoErr(writeYAMLFile(file, map[string]string{"name": "first"}))
+	before, err := os.ReadFile(file)
+	is.NoErr(err)
+
+	// the process dies after the new version is written but before it is renamed over the file
+	defer func() { renameFile = os.Rename }()
+	renameFile = func(string, string) error {
+		return errors.New("killed")
+	}
+	is.True(writeYAMLFile(file, map[string]string{"name": "second"}) != nil)
+	after, err := os.ReadFile(file)
+	is.NoErr(err)
+	is.True(bytes.Equal(before, after)) // the file is never partially written
+	is.Equal(len(tempFiles(t, dir)), 0)
+	var value map[string]string
+	is.NoErr(readYAMLFile(file, &value))
+	is.Equal(value["name"], "first")
+}
+
+func TestReadYAMLFileFallback(t *testing.T) {
+	is := is.New(t)
+	file := filepath.Join(t.TempDir(), "test.yml")
+	is.NoErr(writeYAMLFile(file, map[string]string{"name": "first"}))
+	is.NoErr(writeYAMLFile(file, map[string]string{"name": "second"}))
+	is.NoErr(os.WriteFile(file, []byte("name: [unterminated\n"), configFilePerm))
+
+	var value map[string]string
+	output := captureOutput(t, func() {
+		is.NoErr(readYAMLFile(file, &value))
+	})
+	is.Equal(value["name"], "first")
+	is.True(strings.Contains(output, "WARNING: failed to decode "+file))
+	is.True(strings.Contains(output, "WARNING: recovered configuration from "+file+previousSuffix))
+
+	// a corrupt file is not retained over the last good generation
+	is.NoErr(writeYAMLFile(file, map[string]string{"name": "third"}))
+	var prev map[string]string
+	is.NoErr(decodeYAMLFile(file+previousSuffix, &prev))
+	is.Equal(prev["name"], "first")
+
+	// without a usable previous generation the error is returned
+	is.NoErr(os.WriteFile(file, []byte("name: [unterminated\n"), configFilePerm))
+	is.NoErr(os.WriteFile(file+previousSuffix, nil, configFilePerm))
+	is.True(readYAMLFile(file, &value) != nil)
+
+	// an empty file is corrupt rather than an empty config
+	is.NoErr(writeYAMLFile(file, map[string]string{"name": "fourth"}))
+	is.NoErr(writeYAMLFile(file, map[string]string{"name": "fifth"}))
+	is.NoErr(os.WriteFile(file, nil, configFilePerm))
+	value = nil
+	captureOutput(t, func() {
+		is.NoErr(readYAMLFile(file, &value))
+	})
+	is.Equal(value["name"], "fourth")
+}
@@ -0,0 +1,356 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gravitl/netclient/lock"
+	"github.com/gravitl/netmaker/logger"
+	"gopkg.in/yaml.v3"
+)
+
+// SchemaVersion - version of the on disk configuration written by this version of netclient
+// bump this and append a step to migrations whenever the format of a config file changes
+const SchemaVersion = 2
+
+// schemaVersionKey - top level key holding the schema version in each config file
+const schemaVersionKey = "schema_version"
+
+// ErrNewerSchema - returned when a config file was written by a newer version of netclient
+var ErrNewerSchema = errors.New("config file was written by a newer version of netclient")
+
+// configFiles - config files covered by the schema version
+var configFiles = []string{"netclient.yml", "nodes.yml", "servers.yml"}
+
+// LegacyDir - directory in the config directory holding the config of pre v0.18.0 versions of netclient,
+// which predates schema versions and is converted by the first migration step
+const LegacyDir = "config"
+
+// legacyMigration - converts the config in LegacyDir and removes it, registered by the functions package
+// as the networks are migrated by their servers
+var legacyMigration func() error
+
+// SetLegacyMigration - registers the conversion of pre v0.18.0 config applied by the first migration step
+func SetLegacyMigration(convert func() error) {
+	legacyMigration = convert
+}
+
+// Documents - raw yaml documents of the config files being migrated, indexed by file name
+// only files that require the migration step are present
+type Documents map[string]*yaml.Node
+
+// Migration - a step upgrading the config files in a directory from schema Version-1 to Version
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func(dir string, docs Documents) error
+}
+
+// migrations - ordered registry of migration steps
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "convert pre v0.18 network configs and add schema version to v0.18 config files",
+		Apply:       func(string, Documents) error { return nil },
+	},
+	{
+		Version:     2,
+		Description: "encrypt private keys and passwords",
+		Apply:       encryptDocuments,
+	},
+}
+
+// MigrationPlan - migration steps pending for a config file
+type MigrationPlan struct {
+	File  string
+	From  int
+	To    int
+	Steps []Migration
+}
+
+var migrateOnce, legacyOnce sync.Once
+
+// migrateOnStartup - applies pending migrations to the config files, only once per process
+func migrateOnStartup() {
+	migrateOnce.Do(func() {
+		plans, err := migrateFiles(false)
+		if err != nil {
+			logger.Log(0, "failed to migrate config files", err.Error())
+			return
+		}
+		logMigrations(plans)
+	})
+}
+
+// migrateLegacyOnStartup - converts pre v0.18.0 config, only once per process
+// the host config must be loaded as the networks are migrated by their servers
+func migrateLegacyOnStartup() {
+	legacyOnce.Do(func() {
+		plan, err := migrateLegacy(GetNetclientPath(), migrations[0], false)
+		if err != nil {
+			logger.Log(0, "failed to migrate pre v0.18.0 config", err.Error())
+			return
+		}
+		if plan != nil {
+			logMigrations([]MigrationPlan{*plan})
+		}
+	})
+}
+
+// logMigrations - logs the migrations that were applied
+func logMigrations(plans []MigrationPlan) {
+	for _, plan := range plans {
+		logger.Log(0, "migrated", plan.File, "from schema version", strconv.Itoa(plan.From), "to", strconv.Itoa(plan.To))
+	}
+}
+
+// MigrateConfig - brings the config files up to the current schema version and converts pre v0.18.0 config,
+// which requires the host config to be loaded
+// the original files are backed up before any changes are made; with dryRun no changes are made
+// returns the migrations that were (or with dryRun would be) applied
+func MigrateConfig(dryRun bool) ([]MigrationPlan, error) {
+	plans, err := migrateFiles(dryRun)
+	if err != nil {
+		return nil, err
+	}
+	// the conversion saves the migrated networks, so it runs with the config files unlocked
+	legacy, err := migrateLegacy(GetNetclientPath(), migrations[0], dryRun)
+	if err != nil {
+		return nil, err
+	}
+	if legacy != nil {
+		plans = append(plans, *legacy)
+	}
+	return plans, nil
+}
+
+// migrateFiles - brings the config files up to the current schema version, holding the locks of the files
+func migrateFiles(dryRun bool) ([]MigrationPlan, error) {
+	mode := lock.Exclusive
+	if dryRun {
+		mode = lock.Shared
+	}
+	for _, name := range []string{ConfigLockfile, NodeLockfile, ServerLockfile} {
+		l, err := lock.AcquireTimeout(name, mode, Timeout)
+		if err != nil {
+			return nil, err
+		}
+		defer l.Release()
+	}
+	return migrateDir(GetNetclientPath(), migrations, dryRun)
+}
+
+// migrateLegacy - applies step to the pre v0.18.0 config in LegacyDir of dir, if there is any
+// LegacyDir is backed up before the registered conversion is run, which removes it so the step only runs once
+func migrateLegacy(dir string, step Migration, dryRun bool) (*MigrationPlan, error) {
+	info, err := os.Stat(filepath.Join(dir, LegacyDir))
+	if err != nil || !info.IsDir() {
+		return nil, nil
+	}
+	plan := &MigrationPlan{File: LegacyDir + string(filepath.Separator), From: 0, To: step.Version, Steps: []Migration{step}}
+	if dryRun {
+		return plan, nil
+	}
+	if legacyMigration == nil {
+		return nil, errors.New("pre v0.18.0 config found but no conversion is registered")
+	}
+	if err := backupLegacy(dir); err != nil {
+		return nil, fmt.Errorf("failed to backup pre v0.18.0 config %w", err)
+	}
+	if err := legacyMigration(); err != nil {
+		return nil, fmt.Errorf("migration to schema version %d failed: %w", step.Version, err)
+	}
+	return plan, nil
+}
+
+// migrateDir - applies steps to the config files in dir, bringing them to the version of the last step
+func migrateDir(dir string, steps []Migration, dryRun bool) ([]MigrationPlan, error) {
+	target := 0
+	if len(steps) > 0 {
+		target = steps[len(steps)-1].Version
+	}
+	docs := make(Documents)
+	versions := make(map[string]int)
+	for _, file := range configFiles {
+		doc, version, err := readYAMLDocument(filepath.Join(dir, file))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		if version > target {
+			return nil, fmt.Errorf("%s schema version %d: %w", file, version, ErrNewerSchema)
+		}
+		if version < target {
+			docs[file] = doc
+			versions[file] = version
+		}
+	}
+	plans := []MigrationPlan{}
+	for file := range docs {
+		plan := MigrationPlan{File: file, From: versions[file], To: target}
+		for _, step := range steps {
+			if step.Version > plan.From {
+				plan.Steps = append(plan.Steps, step)
+			}
+		}
+		plans = append(plans, plan)
+	}
+	sort.Slice(plans, func(i, j int) bool { return plans[i].File < plans[j].File })
+	if dryRun || len(plans) == 0 {
+		return plans, nil
+	}
+	if err := backupFiles(dir, docs); err != nil {
+		return nil, fmt.Errorf("failed to backup config files %w", err)
+	}
+	for _, step := range steps {
+		stepDocs := make(Documents)
+		for file, doc := range docs {
+			if versions[file] < step.Version {
+				stepDocs[file] = doc
+			}
+		}
+		if len(stepDocs) == 0 {
+			continue
+		}
+		if err := step.Apply(dir, stepDocs); err != nil {
+			return nil, fmt.Errorf("migration to schema version %d failed: %w", step.Version, err)
+		}
+	}
+	for file, doc := range docs {
+		if err := setSchemaVersion(doc, target); err != nil {
+			return nil, fmt.Errorf("%s %w", file, err)
+		}
+		if err := writeYAMLNode(filepath.Join(dir, file), doc); err != nil {
+			return nil, err
+		}
+	}
+	return plans, nil
+}
+
+// backupFiles - copies the original config files to a new directory under dir/backup
+func backupFiles(dir string, docs Documents) error {
+	backup := backupDir(dir)
+	if err := os.MkdirAll(backup, configDirPerm); err != nil {
+		return err
+	}
+	for file := range docs {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(backup, file), data, configFilePerm); err != nil {
+			return err
+		}
+	}
+	logger.Log(0, "backed up config files to", backup)
+	return nil
+}
+
+// backupLegacy - copies the files in LegacyDir to a new directory under dir/backup
+func backupLegacy(dir string) error {
+	backup := filepath.Join(backupDir(dir), LegacyDir)
+	if err := os.MkdirAll(backup, configDirPerm); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, LegacyDir))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, LegacyDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(backup, entry.Name()), data, configFilePerm); err != nil {
+			return err
+		}
+	}
+	logger.Log(0, "backed up pre v0.18.0 config to", backup)
+	return nil
+}
+
+// backupDir - directory under dir/backup for the files replaced by a migration run now
+func backupDir(dir string) string {
+	return filepath.Join(dir, "backup", "migration-"+time.Now().Format("20060102T150405"))
+}
+
+// readYAMLDocument - reads a config file as a raw yaml document along with its schema version
+func readYAMLDocument(file string) (*yaml.Node, int, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, 0, fmt.Errorf("%s %w", file, err)
+	}
+	if documentMapping(&doc) == nil {
+		return nil, 0, fmt.Errorf("%s is not a yaml mapping", file)
+	}
+	version, err := popSchemaVersion(&doc)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s %w", file, err)
+	}
+	return &doc, version, nil
+}
+
+// documentMapping - returns the top level mapping of a yaml document, nil if it is not a mapping
+func documentMapping(doc *yaml.Node) *yaml.Node {
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		doc = doc.Content[0]
+	}
+	if doc.Kind != yaml.MappingNode {
+		return nil
+	}
+	return doc
+}
+
+// popSchemaVersion - removes the schema version from a document and returns it
+// documents without a schema version predate versioning and are version 0
+func popSchemaVersion(doc *yaml.Node) (int, error) {
+	mapping := documentMapping(doc)
+	if mapping == nil {
+		return 0, nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value != schemaVersionKey {
+			continue
+		}
+		version, err := strconv.Atoi(mapping.Content[i+1].Value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid schema version %q", mapping.Content[i+1].Value)
+		}
+		mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+		return version, nil
+	}
+	return 0, nil
+}
+
+// setSchemaVersion - stamps the schema version as the first key of a document
+func setSchemaVersion(doc *yaml.Node, version int) error {
+	mapping := documentMapping(doc)
+	if mapping == nil {
+		return errors.New("can not set schema version, document is not a yaml mapping")
+	}
+	if _, err := popSchemaVersion(doc); err != nil {
+		return err
+	}
+	// empty maps are encoded in flow style
+	mapping.Style = 0
+	mapping.Content = append([]*yaml.Node{
+		{Kind: yaml.ScalarNode, Tag: "!!str", Value: schemaVersionKey},
+		{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(version)},
+	}, mapping.Content...)
+	return nil
+}
@@ -0,0 +1,311 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"gopkg.in/yaml.v3"
+)
+
+// copyFixtures - copies the files of a historical format to a temp dir
+func copyFixtures(t *testing.T, format string) string {
+	t.Helper()
+	dir := t.TempDir()
+	entries, err := os.ReadDir(filepath.Join("testdata", format))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join("testdata", format, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, entry.Name()), data, configFilePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// readFixtures - decodes the config files in dir
+func readFixtures(t *testing.T, dir string) (Config, NodeMap, map[string]Server) {
+	t.Helper()
+	var host Config
+	nodes := make(NodeMap)
+	servers := make(map[string]Server)
+	if err := decodeYAMLFile(filepath.Join(dir, "netclient.yml"), &host); err != nil {
+		t.Fatal(err)
+	}
+	if err := decodeYAMLFile(filepath.Join(dir, "nodes.yml"), &nodes); err != nil {
+		t.Fatal(err)
+	}
+	if err := decodeYAMLFile(filepath.Join(dir, "servers.yml"), &servers); err != nil {
+		t.Fatal(err)
+	}
+	return host, nodes, servers
+}
+
+func TestMigrationRegistry(t *testing.T) {
+	is := is.New(t)
+	is.True(len(migrations) > 0)
+	for i, step := range migrations {
+		is.Equal(step.Version, i+1) // migration steps must be ordered and contiguous
+		is.True(step.Description != "")
+		is.True(step.Apply != nil)
+	}
+	is.Equal(migrations[len(migrations)-1].Version, SchemaVersion)
+}
+
+func TestMigrateV018(t *testing.T) {
+	is := is.New(t)
+	dir := copyFixtures(t, "v0.18")
+	host, nodes, servers := readFixtures(t, dir)
+	is.Equal(host.Name, "host1")
+	is.Equal(nodes["net1"].Server, "netmaker.example.com")
+	is.Equal(servers["netmaker.example.com"].API, "api.netmaker.example.com")
+
+	plans, err := migrateDir(dir, migrations, false)
+	is.NoErr(err)
+	is.Equal(len(plans), 3)
+	for _, plan := range plans {
+		is.Equal(plan.From, 0)
+		is.Equal(plan.To, SchemaVersion)
+		is.Equal(len(plan.Steps), len(migrations))
+	}
+	for _, file := range configFiles {
+		_, version, err := readYAMLDocument(filepath.Join(dir, file))
+		is.NoErr(err)
+		is.Equal(version, SchemaVersion)
+	}
+	// content is unchanged by the migration
+	migratedHost, migratedNodes, migratedServers := readFixtures(t, dir)
+	is.Equal(migratedHost, host)
+	is.Equal(migratedNodes, nodes)
+	is.Equal(migratedServers, servers)
+	// secrets are no longer stored in plain text
+	data, err := os.ReadFile(filepath.Join(dir, "netclient.yml"))
+	is.NoErr(err)
+	is.True(!strings.Contains(string(data), host.HostPass))
+	// originals are backed up
+	backups, err := filepath.Glob(filepath.Join(dir, "backup", "migration-*"))
+	is.NoErr(err)
+	is.Equal(len(backups), 1)
+	for _, file := range configFiles {
+		original, err := os.ReadFile(filepath.Join("testdata", "v0.18", file))
+		is.NoErr(err)
+		backup, err := os.ReadFile(filepath.Join(backups[0], file))
+		is.NoErr(err)
+		is.Equal(backup, original)
+	}
+	// migrations only run once
+	plans, err = migrateDir(dir, migrations, false)
+	is.NoErr(err)
+	is.Equal(len(plans), 0)
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	is := is.New(t)
+	dir := copyFixtures(t, "v0.18")
+	plans, err := migrateDir(dir, migrations, true)
+	is.NoErr(err)
+	is.Equal(len(plans), 3)
+	for _, file := range configFiles {
+		original, err := os.ReadFile(filepath.Join("testdata", "v0.18", file))
+		is.NoErr(err)
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		is.NoErr(err)
+		is.Equal(data, original)
+	}
+	_, err = os.Stat(filepath.Join(dir, "backup"))
+	is.True(errors.Is(err, os.ErrNotExist))
+}
+
+func TestMigrateV1(t *testing.T) {
+	is := is.New(t)
+	dir := copyFixtures(t, "v1")
+	host, nodes, servers := readFixtures(t, dir)
+	plans, err := migrateDir(dir, migrations, false)
+	is.NoErr(err)
+	is.Equal(len(plans), 3)
+	for _, plan := range plans {
+		is.Equal(plan.From, 1)
+		is.Equal(len(plan.Steps), len(migrations)-1)
+	}
+	migratedHost, migratedNodes, migratedServers := readFixtures(t, dir)
+	is.Equal(migratedHost, host)
+	is.Equal(migratedNodes, nodes)
+	is.Equal(migratedServers, servers)
+}
+
+func TestMigrateCurrent(t *testing.T) {
+	is := is.New(t)
+	dir := copyFixtures(t, "v2")
+	plans, err := migrateDir(dir, migrations, false)
+	is.NoErr(err)
+	is.Equal(len(plans), 0)
+	host, nodes, servers := readFixtures(t, dir)
+	is.Equal(host.Name, "host1")
+	is.Equal(host.HostPass, "Zk3hT9pQ2mW7xR4vB8nC1sL6dF0gJ5yA")
+	is.Equal(host.PrivateKey.String(), "8LQbQv9Vd8qDk3Vb2O0fFq2Q0q9vJm0f7m7mS3YbJ1s=")
+	is.Equal(host.TrafficKeyPrivate, []byte{5, 6, 7, 8})
+	is.Equal(len(host.HostPeers["netmaker.example.com"]), 1)
+	is.Equal(len(nodes), 1) // schema version must not be decoded as a network
+	is.True(nodes["net1"].Connected)
+	is.Equal(servers["netmaker.example.com"].MQPort, "8883")
+}
+
+func TestMigrateSteps(t *testing.T) {
+	is := is.New(t)
+	dir := copyFixtures(t, "v0.18")
+	// v1 already applied to nodes.yml
+	data, err := os.ReadFile(filepath.Join(dir, "nodes.yml"))
+	is.NoErr(err)
+	is.NoErr(os.WriteFile(filepath.Join(dir, "nodes.yml"), append([]byte("schema_version: 1\n"), data...), configFilePerm))
+	applied := make(map[int][]string)
+	record := func(version int) func(string, Documents) error {
+		return func(dir string, docs Documents) error {
+			for file, doc := range docs {
+				applied[version] = append(applied[version], file)
+				mapping := documentMapping(doc)
+				mapping.Content = append(mapping.Content,
+					&yaml.Node{Kind: yaml.ScalarNode, Value: "step" + strconv.Itoa(version)},
+					&yaml.Node{Kind: yaml.ScalarNode, Value: "applied"})
+			}
+			return nil
+		}
+	}
+	steps := []Migration{
+		{Version: 1, Description: "one", Apply: record(1)},
+		{Version: 2, Description: "two", Apply: record(2)},
+	}
+	_, err = migrateDir(dir, steps, false)
+	is.NoErr(err)
+	is.Equal(len(applied[1]), 2)
+	is.Equal(len(applied[2]), 3)
+	for _, file := range applied[1] {
+		is.True(file != "nodes.yml")
+	}
+	for _, file := range configFiles {
+		doc, version, err := readYAMLDocument(filepath.Join(dir, file))
+		is.NoErr(err)
+		is.Equal(version, 2)
+		var values map[string]any
+		is.NoErr(doc.Decode(&values))
+		is.Equal(values["step2"], "applied")
+		_, ok := values["step1"]
+		is.Equal(ok, file != "nodes.yml")
+	}
+}
+
+func TestMigrateFailure(t *testing.T) {
+	is := is.New(t)
+	dir := copyFixtures(t, "v0.18")
+	steps := []Migration{
+		{Version: 1, Description: "fails", Apply: func(string, Documents) error { return errors.New("failed") }},
+	}
+	_, err := migrateDir(dir, steps, false)
+	is.True(err != nil)
+	// files are untouched when a step fails
+	for _, file := range configFiles {
+		original, err := os.ReadFile(filepath.Join("testdata", "v0.18", file))
+		is.NoErr(err)
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		is.NoErr(err)
+		is.Equal(data, original)
+	}
+}
+
+func TestNewerSchema(t *testing.T) {
+	is := is.New(t)
+	dir := copyFixtures(t, "v2")
+	file := filepath.Join(dir, "nodes.yml")
+	data, err := os.ReadFile(file)
+	is.NoErr(err)
+	is.NoErr(os.WriteFile(file, []byte(strings.Replace(string(data), "schema_version: 2", "schema_version: 99", 1)), configFilePerm))
+	_, err = migrateDir(dir, migrations, false)
+	is.True(errors.Is(err, ErrNewerSchema))
+	nodes := make(NodeMap)
+	err = readYAMLFile(file, &nodes)
+	is.True(errors.Is(err, ErrNewerSchema))
+}
+
+func TestWriteSchemaVersion(t *testing.T) {
+	is := is.New(t)
+	dir := copyFixtures(t, "v2")
+	_, nodes, _ := readFixtures(t, dir)
+	file := filepath.Join(dir, "nodes.yml")
+	is.NoErr(writeYAMLFile(file, nodes))
+	data, err := os.ReadFile(file)
+	is.NoErr(err)
+	is.True(strings.HasPrefix(string(data), "schema_version: 2\n"))
+	empty := filepath.Join(dir, "empty.yml")
+	is.NoErr(writeYAMLFile(empty, NodeMap{}))
+	decoded := make(NodeMap)
+	is.NoErr(decodeYAMLFile(empty, &decoded))
+	is.Equal(len(decoded), 0)
+}
+
+func TestLegacyConfig(t *testing.T) {
+	is := is.New(t)
+	cfg, err := readClientConfig(filepath.Join("testdata", "legacy", "netconfig-net1"))
+	is.NoErr(err)
+	is.Equal(cfg.Network, "net1")
+	is.Equal(cfg.Node.ID, "7e2d1f0c-1b7a-4a55-8f6e-2c9d3b4a5e61")
+	is.Equal(cfg.Node.Address, "10.101.0.1")
+	is.Equal(cfg.Node.ListenPort, int32(51821))
+	is.Equal(cfg.Server.API, "api.netmaker.example.com")
+	is.Equal(cfg.NetworkSettings.AddressRange, "10.101.0.0/16")
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+	is.NoErr(os.MkdirAll(filepath.Join(dir, LegacyDir), configDirPerm))
+	data, err := os.ReadFile(filepath.Join("testdata", "legacy", "netconfig-net1"))
+	is.NoErr(err)
+	is.NoErr(os.WriteFile(filepath.Join(dir, LegacyDir, "netconfig-net1"), data, configFilePerm))
+	defer func() { legacyMigration = nil }()
+
+	plan, err := migrateLegacy(dir, migrations[0], true)
+	is.NoErr(err)
+	is.Equal(plan.From, 0)
+	is.Equal(plan.To, 1)
+	is.Equal(len(plan.Steps), 1)
+
+	_, err = migrateLegacy(dir, migrations[0], false)
+	is.True(err != nil) // no conversion registered
+
+	converted := 0
+	SetLegacyMigration(func() error {
+		converted++
+		return os.RemoveAll(filepath.Join(dir, LegacyDir))
+	})
+	plan, err = migrateLegacy(dir, migrations[0], false)
+	is.NoErr(err)
+	is.True(plan != nil)
+	is.Equal(converted, 1)
+	backups, err := filepath.Glob(filepath.Join(dir, "backup", "migration-*", LegacyDir, "netconfig-net1"))
+	is.NoErr(err)
+	is.Equal(len(backups), 1)
+	backup, err := os.ReadFile(backups[0])
+	is.NoErr(err)
+	is.Equal(backup, data)
+
+	plan, err = migrateLegacy(dir, migrations[0], false)
+	is.NoErr(err)
+	is.True(plan == nil) // nothing left to convert
+	is.Equal(converted, 1)
+
+	// a failed conversion leaves the old config in place for the next run
+	is.NoErr(os.MkdirAll(filepath.Join(dir, LegacyDir), configDirPerm))
+	SetLegacyMigration(func() error { return errors.New("server unreachable") })
+	_, err = migrateLegacy(dir, migrations[0], false)
+	is.True(err != nil)
+	_, err = os.Stat(filepath.Join(dir, LegacyDir))
+	is.NoErr(err)
+}
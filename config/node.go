@@ -5,25 +5,20 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"net"
-	"os"
-	"path/filepath"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gravitl/netclient/lock"
 	"github.com/gravitl/netclient/ncutils"
 	"github.com/gravitl/netmaker/logger"
 	"github.com/gravitl/netmaker/models"
-	"gopkg.in/yaml.v3"
 )
 
 // NodeMap is an in memory map of the all nodes indexed by network name
 type NodeMap map[string]Node
 
-// Nodes provides a map of node configurations indexed by network name
-var Nodes NodeMap
-
-// NodeLockFile is name of lockfile for controlling access to node config file on disk
-const NodeLockfile = "netclient-nodes.lck"
+// NodeLockfile is the name of the lock controlling access to the node config file on disk
+const NodeLockfile = "nodes"
 
 // Node provides configuration of a node
 type Node struct {
@@ -32,34 +27,34 @@ type Node struct {
 
 // ReadNodeConfig reads node configuration from disk
 func ReadNodeConfig() error {
-	lockfile := filepath.Join(os.TempDir(), NodeLockfile)
 	file := GetNetclientPath() + "nodes.yml"
-	if err := Lock(lockfile); err != nil {
-		return err
-	}
-	defer Unlock(lockfile)
-	f, err := os.Open(file)
+	l, err := lock.AcquireTimeout(NodeLockfile, lock.Shared, Timeout)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	for k := range Nodes {
-		delete(Nodes, k)
-	}
-	if err := yaml.NewDecoder(f).Decode(&Nodes); err != nil {
+	defer l.Release()
+	nodes := make(NodeMap)
+	if err := readYAMLFile(file, &nodes); err != nil {
 		return err
 	}
-	return nil
+	return modify(func(s *State) error {
+		s.Nodes = nodes
+		return nil
+	}, false)
 }
 
 // GetNodes returns a copy of the NodeMap
 func GetNodes() NodeMap {
-	return Nodes
+	nodes := make(NodeMap)
+	for k, v := range snapshot().Nodes {
+		nodes[k] = v
+	}
+	return nodes
 }
 
 // GetNode returns returns the node configuation of the specified network name
 func GetNode(k string) Node {
-	if node, ok := Nodes[k]; ok {
+	if node, ok := snapshot().Nodes[k]; ok {
 		return node
 	}
 	return Node{}
@@ -67,12 +62,18 @@ func GetNode(k string) Node {
 
 // UpdateNodeMap updates the in memory nodemap for the specified network
 func UpdateNodeMap(k string, value Node) {
-	Nodes[k] = value
+	modify(func(s *State) error {
+		s.Nodes[k] = value
+		return nil
+	}, false)
 }
 
 // DeleteNode deletes the node from the nodemap for the specified network
 func DeleteNode(k string) {
-	delete(Nodes, k)
+	modify(func(s *State) error {
+		delete(s.Nodes, k)
+		return nil
+	}, false)
 }
 
 // PrimaryAddress returns the primary address of a node
@@ -85,29 +86,20 @@ func (node *Node) PrimaryAddress() net.IPNet {
 
 // WriteNodeConfig writes the node map to disk
 func WriteNodeConfig() error {
-	lockfile := filepath.Join(os.TempDir(), NodeLockfile)
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+	return writeNodeConfig(snapshot().Nodes)
+}
+
+// writeNodeConfig writes a node map to disk
+func writeNodeConfig(nodes NodeMap) error {
 	file := GetNetclientPath() + "nodes.yml"
-	if _, err := os.Stat(file); err != nil {
-		if os.IsNotExist(err) {
-			os.MkdirAll(GetNetclientPath(), os.ModePerm)
-		} else if err != nil {
-			return err
-		}
-	}
-	if err := Lock(lockfile); err != nil {
-		return err
-	}
-	defer Unlock(lockfile)
-	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	err = yaml.NewEncoder(f).Encode(Nodes)
+	l, err := lock.AcquireTimeout(NodeLockfile, lock.Exclusive, Timeout)
 	if err != nil {
 		return err
 	}
-	return f.Sync()
+	defer l.Release()
+	return writeYAMLFile(file, nodes)
 }
 
 // ConvertNode accepts a netmaker node struct and converts to the structs used by netclient
@@ -129,9 +121,9 @@ func ConvertNode(nodeGet *models.NodeGet) *Node {
 	node.Server = netmakerNode.Server
 	node.Connected = ParseBool(netmakerNode.Connected)
 	//node.MacAddress, _ = net.ParseMAC(netmakerNode.MacAddress)
-	node.Address.IP = net.ParseIP(netmakerNode.Address)
+	node.Address.IP = parseAddress(netmakerNode.Address)
 	node.Address.Mask = node.NetworkRange.Mask
-	node.Address6.IP = net.ParseIP(netmakerNode.Address6)
+	node.Address6.IP = parseAddress(netmakerNode.Address6)
 	node.Address6.Mask = node.NetworkRange6.Mask
 	node.PersistentKeepalive = time.Second * time.Duration(netmakerNode.PersistentKeepalive)
 	node.Action = netmakerNode.Action
@@ -206,6 +198,14 @@ func ToIPNet(cidr string) net.IPNet {
 	return *response
 }
 
+// parseAddress - parses the address of a legacy node, which the server sends either as an ip or in cidr notation
+func parseAddress(address string) net.IP {
+	if ip, _, err := net.ParseCIDR(address); err == nil {
+		return ip
+	}
+	return net.ParseIP(address)
+}
+
 // ToUDPAddr parses and ip address string to return a pointer to net.UDPAddr
 func ToUDPAddr(address string) *net.UDPAddr {
 	addr, _ := net.ResolveUDPAddr("udp", address)
@@ -15,6 +15,7 @@ import (
 
 	"github.com/devilcove/httpclient"
 	"github.com/google/uuid"
+	"github.com/gravitl/netclient/ncutils"
 	"github.com/gravitl/netmaker/models"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"gopkg.in/yaml.v3"
@@ -42,6 +43,11 @@ func ReadConfig(network string) (*ClientConfig, error) {
 	home := GetNetclientPath() + "config/"
 	file := fmt.Sprintf(home + "netconfig-" + network)
 	log.Println("processing ", file)
+	return readClientConfig(file)
+}
+
+// readClientConfig - decodes a pre v0.18.0 client config file
+func readClientConfig(file string) (*ClientConfig, error) {
 	f, err := os.Open(file)
 	if err != nil {
 		return nil, err
@@ -89,7 +95,7 @@ func OldAuthenticate(node *Node, host *Config) (string, error) {
 	}
 	server := GetServer(node.Server)
 	endpoint := httpclient.Endpoint{
-		URL:    "https://" + server.API,
+		URL:    ncutils.APIURL(server.API),
 		Route:  "/api/nodes/adm/" + node.Network + "/authenticate",
 		Method: http.MethodPost,
 		Data:   data,
@@ -115,7 +121,7 @@ func OldAuthenticate(node *Node, host *Config) (string, error) {
 // ConvertOldNode accepts a netmaker node struct and converts to the structs used by netclient
 func ConvertOldNode(nodeGet *models.NodeGet) (*Node, *Server, *Config) {
 	var node Node
-	host := Netclient()
+	host := *Netclient()
 	netmakerNode := nodeGet.Node
 	//server := GetServer(netmakerNode.Server)
 	//if server == nil {
@@ -164,7 +170,8 @@ func ConvertOldNode(nodeGet *models.NodeGet) (*Node, *Server, *Config) {
 	node.DNSOn = ParseBool(netmakerNode.DNSOn)
 	//node.Peers = nodeGet.Peers
 	//add items not provided by server
-	return &node, server, host
+	UpdateNetclient(host)
+	return &node, server, Netclient()
 }
 
 // ConvertOldServerCfg converts a netmaker ServerConfig to netclient server struct
@@ -175,7 +182,7 @@ func ConvertOldServerCfg(cfg *models.ServerConfig) *Server {
 	server.Version = cfg.Version
 	server.Broker = cfg.Server
 	server.MQPort = cfg.MQPort
-	server.MQID = netclient.ID
+	server.MQID = Netclient().ID
 	server.API = cfg.API
 	server.CoreDNSAddr = cfg.CoreDNSAddr
 	server.Is_EE = cfg.Is_EE
@@ -0,0 +1,249 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gravitl/netclient/lock"
+	"github.com/gravitl/netclient/secrets"
+	"gopkg.in/yaml.v3"
+)
+
+// encryptedTag - yaml tag of a value encrypted with the secret store
+const encryptedTag = "!encrypted"
+
+// secretPaths - paths of the sensitive values in each config file, * matches any key
+var secretPaths = map[string][][]string{
+	"netclient.yml": {{"privatekey"}, {"traffickeyprivate"}, {"traffickeyrotation", "previousprivate"}, {"host", "hostpass"}},
+	"servers.yml":   {{"*", "serverconfig", "mq_password"}},
+}
+
+// cachedStore - secret store loaded from a key file, reloaded when the key file changes
+type cachedStore struct {
+	store   *secrets.Store
+	modTime time.Time
+}
+
+var (
+	storeMutex sync.Mutex
+	stores     = make(map[string]cachedStore) // indexed by config directory
+)
+
+// secretStore - returns the secret store for the config files in dir
+// with create a new store is created using the default provider if one does not exist
+func secretStore(dir string, create bool) (*secrets.Store, error) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	info, err := os.Stat(filepath.Join(dir, secrets.KeyFile))
+	if err == nil {
+		if cached, ok := stores[dir]; ok && cached.modTime.Equal(info.ModTime()) {
+			return cached.store, nil
+		}
+		store, err := secrets.Load(dir)
+		if err != nil {
+			return nil, err
+		}
+		stores[dir] = cachedStore{store: store, modTime: info.ModTime()}
+		return store, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) || !create {
+		return nil, fmt.Errorf("failed to load secrets key file %w", err)
+	}
+	store, err := secrets.Create(dir, secrets.DefaultProvider)
+	if err != nil {
+		return nil, err
+	}
+	cacheStore(dir, store)
+	return store, nil
+}
+
+// SecretStore - returns the secret store of the config files, creating it if it does not exist
+func SecretStore() (*secrets.Store, error) {
+	return secretStore(GetNetclientPath(), true)
+}
+
+// cacheStore - caches a store that was just written to disk; the caller must hold storeMutex
+func cacheStore(dir string, store *secrets.Store) {
+	if info, err := os.Stat(filepath.Join(dir, secrets.KeyFile)); err == nil {
+		stores[dir] = cachedStore{store: store, modTime: info.ModTime()}
+	}
+}
+
+// encryptSecrets - replaces the sensitive values in the document of file with encrypted values
+func encryptSecrets(file string, doc *yaml.Node) error {
+	paths := secretPaths[filepath.Base(file)]
+	if len(paths) == 0 {
+		return nil
+	}
+	store, err := secretStore(filepath.Dir(file), true)
+	if err != nil {
+		return err
+	}
+	mapping := documentMapping(doc)
+	if mapping == nil {
+		return fmt.Errorf("%s is not a yaml mapping", file)
+	}
+	for _, path := range paths {
+		for _, node := range findPath(mapping, path) {
+			if node.Tag == encryptedTag {
+				continue
+			}
+			data, err := yaml.Marshal(node)
+			if err != nil {
+				return err
+			}
+			sealed, err := store.Seal(data)
+			if err != nil {
+				return err
+			}
+			*node = yaml.Node{Kind: yaml.ScalarNode, Tag: encryptedTag, Value: sealed}
+		}
+	}
+	return nil
+}
+
+// decryptSecrets - replaces the encrypted values in the document of file with the decrypted values
+// the secret store is only loaded if the document contains encrypted values
+func decryptSecrets(file string, doc *yaml.Node) error {
+	var store *secrets.Store
+	var decrypt func(*yaml.Node) error
+	decrypt = func(node *yaml.Node) error {
+		if node.Kind == yaml.ScalarNode && node.Tag == encryptedTag {
+			if store == nil {
+				var err error
+				if store, err = secretStore(filepath.Dir(file), false); err != nil {
+					return err
+				}
+			}
+			data, err := store.Open(node.Value)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt value in %s %w", file, err)
+			}
+			var value yaml.Node
+			if err := yaml.Unmarshal(data, &value); err != nil {
+				return err
+			}
+			if len(value.Content) == 0 {
+				return fmt.Errorf("failed to decrypt value in %s, empty value", file)
+			}
+			*node = *value.Content[0]
+			return nil
+		}
+		for _, child := range node.Content {
+			if err := decrypt(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return decrypt(doc)
+}
+
+// findPath - returns the values at path in a yaml mapping
+func findPath(mapping *yaml.Node, path []string) []*yaml.Node {
+	if len(path) == 0 {
+		return []*yaml.Node{mapping}
+	}
+	if mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	var found []*yaml.Node
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if path[0] == "*" || mapping.Content[i].Value == path[0] {
+			found = append(found, findPath(mapping.Content[i+1], path[1:])...)
+		}
+	}
+	return found
+}
+
+// encryptDocuments - migration step encrypting the sensitive values of config files written in plain text
+func encryptDocuments(dir string, docs Documents) error {
+	for file, doc := range docs {
+		if err := encryptSecrets(filepath.Join(dir, file), doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReencryptSecrets - encrypts the sensitive values of the config files with a new data encryption key,
+// wrapped by a key encryption key from provider; values encrypted with previous keys can no longer be decrypted
+func ReencryptSecrets(provider string) error {
+	for _, name := range []string{ConfigLockfile, NodeLockfile, ServerLockfile} {
+		l, err := lock.AcquireTimeout(name, lock.Exclusive, Timeout)
+		if err != nil {
+			return err
+		}
+		defer l.Release()
+	}
+	return reencryptDir(GetNetclientPath(), provider)
+}
+
+// reencryptDir - re-encrypts the config files in dir
+func reencryptDir(dir, provider string) error {
+	if _, err := secrets.NewProvider(provider, dir); err != nil {
+		return err
+	}
+	docs := make(Documents)
+	for _, file := range configFiles {
+		path := filepath.Join(dir, file)
+		doc, version, err := readYAMLDocument(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		if version != SchemaVersion {
+			return fmt.Errorf("%s is at schema version %d, run netclient migrate first", file, version)
+		}
+		if err := decryptSecrets(path, doc); err != nil {
+			return err
+		}
+		docs[file] = doc
+	}
+	storeMutex.Lock()
+	store, err := secrets.Load(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		store, err = secrets.Create(dir, provider)
+	} else if err == nil {
+		// previous keys are retained until all files have been rewritten so an interrupted run can be repeated
+		err = store.Rotate(provider)
+	}
+	if err == nil {
+		cacheStore(dir, store)
+	}
+	storeMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, file := range configFiles {
+		doc, ok := docs[file]
+		if !ok {
+			continue
+		}
+		path := filepath.Join(dir, file)
+		if err := setSchemaVersion(doc, SchemaVersion); err != nil {
+			return err
+		}
+		if err := encryptSecrets(path, doc); err != nil {
+			return err
+		}
+		if err := writeYAMLNode(path, doc); err != nil {
+			return err
+		}
+		// the previous generation holds values encrypted with retired keys (or in plain text), replace it
+		retainPrevious(path)
+	}
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	if err := store.Prune(); err != nil {
+		return err
+	}
+	cacheStore(dir, store)
+	return nil
+}
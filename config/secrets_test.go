@@ -0,0 +1,67 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gravitl/netclient/secrets"
+	"github.com/matryer/is"
+)
+
+func TestReencryptSecrets(t *testing.T) {
+	is := is.New(t)
+	dir := copyFixtures(t, "v2")
+	host, nodes, servers := readFixtures(t, dir)
+	before, err := os.ReadFile(filepath.Join(dir, "netclient.yml"))
+	is.NoErr(err)
+
+	t.Setenv(secrets.PassphraseEnv, "correct horse battery staple")
+	is.NoErr(reencryptDir(dir, "passphrase"))
+	reencryptedHost, reencryptedNodes, reencryptedServers := readFixtures(t, dir)
+	is.Equal(reencryptedHost, host)
+	is.Equal(reencryptedNodes, nodes)
+	is.Equal(reencryptedServers, servers)
+	store, err := secrets.Load(dir)
+	is.NoErr(err)
+	is.Equal(store.Provider(), "passphrase")
+	// key material of the file provider is removed
+	_, err = os.Stat(filepath.Join(dir, "secrets.kek"))
+	is.True(errors.Is(err, os.ErrNotExist))
+	// values encrypted with the retired key can not be decrypted
+	is.NoErr(os.WriteFile(filepath.Join(dir, "old.yml"), before, configFilePerm))
+	var old Config
+	is.True(decodeYAMLFile(filepath.Join(dir, "old.yml"), &old) != nil)
+	// previous generation is encrypted with the new key
+	var prev Config
+	is.NoErr(decodeYAMLFile(filepath.Join(dir, "netclient.yml"+previousSuffix), &prev))
+	is.Equal(prev, host)
+
+	// the wrong passphrase is rejected
+	t.Setenv(secrets.PassphraseEnv, "wrong")
+	_, err = secrets.Load(dir)
+	is.True(err != nil)
+}
+
+func TestEncryptSecrets(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+	host := Config{PrivateKey: [32]byte{1, 2, 3}, TrafficKeyPrivate: []byte{4, 5}}
+	host.HostPass = "hostpass"
+	file := filepath.Join(dir, "netclient.yml")
+	is.NoErr(writeYAMLFile(file, host))
+	data, err := os.ReadFile(file)
+	is.NoErr(err)
+	is.True(!strings.Contains(string(data), "hostpass: hostpass"))
+	is.Equal(strings.Count(string(data), encryptedTag), 3)
+	var decoded Config
+	is.NoErr(decodeYAMLFile(file, &decoded))
+	is.Equal(decoded.HostPass, "hostpass")
+	is.Equal(decoded.PrivateKey, host.PrivateKey)
+	is.Equal(decoded.TrafficKeyPrivate, host.TrafficKeyPrivate)
+	// without the key file encrypted values can not be read
+	is.NoErr(os.Remove(filepath.Join(dir, secrets.KeyFile)))
+	is.True(decodeYAMLFile(file, &decoded) != nil)
+}
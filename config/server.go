@@ -2,23 +2,21 @@
 package config
 
 import (
-	"os"
-	"path/filepath"
+	"fmt"
+	"net"
+	"net/url"
 	"strings"
 
 	"github.com/google/uuid"
+	"github.com/gravitl/netclient/lock"
 	"github.com/gravitl/netmaker/models"
-	"gopkg.in/yaml.v3"
 )
 
-// Servers is map of servers indexed by server name
-var Servers map[string]Server
-
 // ServerNodes is a map of node names for a server
 var ServerNodes map[string]struct{}
 
-// ServerLockFile is a lockfile for controlling access to the server map file on disk
-const ServerLockfile = "netclient-servers.lck"
+// ServerLockfile is the name of the lock controlling access to the server map file on disk
+const ServerLockfile = "servers"
 
 // Server represents a server configuration
 type Server struct {
@@ -27,6 +25,63 @@ type Server struct {
 	MQID      uuid.UUID       `json:"mqid" yaml:"mqid"`
 	Nodes     map[string]bool `json:"nodes" yaml:"nodes"`
 	AccessKey string          `json:"accesskey" yaml:"accesskey"`
+	// Brokers - ordered list of broker urls, tried in order when connecting; defaults to wss://<broker>:<mqport>
+	Brokers []string `json:"brokers,omitempty" yaml:"brokers,omitempty"`
+	// Envelope - publish messages to the server as length-prefixed envelopes instead of the legacy delimited chunks;
+	// set once the server decodes envelopes. messages from the server are decoded in either format
+	Envelope bool `json:"envelope,omitempty" yaml:"envelope,omitempty"`
+	// Replay - replay protection of messages from the server: auto (default) accepts messages without a sequence
+	// number until the server sends one, required rejects them and off disables the checks
+	Replay string `json:"replay,omitempty" yaml:"replay,omitempty"`
+	// ReplaySkew - maximum difference in seconds between the timestamp of a message and the local clock, default 300
+	ReplaySkew int `json:"replay_skew,omitempty" yaml:"replay_skew,omitempty"`
+}
+
+// brokerPorts - default port of each supported broker url scheme
+var brokerPorts = map[string]string{
+	"mqtts": "8883",
+	"wss":   "443",
+	"tcp":   "1883",
+}
+
+// ParseBrokerURL - parses a broker url, supported schemes are mqtts, wss and tcp (unencrypted, for lab setups)
+// the default port of the scheme is added if the url has no port
+func ParseBrokerURL(broker string) (*url.URL, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker url %s %w", broker, err)
+	}
+	port, ok := brokerPorts[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("invalid broker url %s, scheme must be one of mqtts, wss or tcp", broker)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid broker url %s, no host", broker)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// Server.BrokerURLs - the ordered broker urls of the server
+func (server *Server) BrokerURLs() ([]*url.URL, error) {
+	brokers := server.Brokers
+	if len(brokers) == 0 {
+		if server.Broker == "" {
+			return nil, fmt.Errorf("no broker configured for server %s", server.Name)
+		}
+		brokers = []string{fmt.Sprintf("wss://%s:%s", server.Broker, server.MQPort)}
+	}
+	urls := []*url.URL{}
+	for _, broker := range brokers {
+		u, err := ParseBrokerURL(broker)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
 }
 
 // OldNetmakerServerConfig - pre v0.18.0 server configuration
@@ -44,67 +99,58 @@ type OldNetmakerServerConfig struct {
 
 // ReadServerConf reads the servers configuration file and populates the server map
 func ReadServerConf() error {
-	lockfile := filepath.Join(os.TempDir(), ServerLockfile)
 	file := GetNetclientPath() + "servers.yml"
-	if err := Lock(lockfile); err != nil {
-		return err
-	}
-	defer Unlock(lockfile)
-	f, err := os.Open(file)
+	l, err := lock.AcquireTimeout(ServerLockfile, lock.Shared, Timeout)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	for k := range Servers {
-		delete(Servers, k)
-	}
-	if err := yaml.NewDecoder(f).Decode(&Servers); err != nil {
+	defer l.Release()
+	servers := make(map[string]Server)
+	if err := readYAMLFile(file, &servers); err != nil {
 		return err
 	}
-	return nil
+	return modify(func(s *State) error {
+		s.Servers = servers
+		return nil
+	}, false)
 }
 
 // WriteServerConfig writes server map to disk
 func WriteServerConfig() error {
-	lockfile := filepath.Join(os.TempDir(), ServerLockfile)
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+	return writeServerConfig(snapshot().Servers)
+}
+
+// writeServerConfig writes a server map to disk
+func writeServerConfig(servers map[string]Server) error {
 	file := GetNetclientPath() + "servers.yml"
-	if _, err := os.Stat(file); err != nil {
-		if os.IsNotExist(err) {
-			os.MkdirAll(GetNetclientPath(), os.ModePerm)
-		} else if err != nil {
-			return err
-		}
-	}
-	if err := Lock(lockfile); err != nil {
-		return err
-	}
-	defer Unlock(lockfile)
-	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	err = yaml.NewEncoder(f).Encode(Servers)
+	l, err := lock.AcquireTimeout(ServerLockfile, lock.Exclusive, Timeout)
 	if err != nil {
 		return err
 	}
-	return f.Sync()
+	defer l.Release()
+	return writeYAMLFile(file, servers)
 }
 
 // SaveServer updates the server map with current server struct and writes map to disk
 func SaveServer(name string, server Server) error {
-	Servers[name] = server
+	UpdateServer(name, server)
 	return WriteServerConfig()
 }
 
 // UpdateServer updates the in-memory server map
 func UpdateServer(name string, server Server) {
-	Servers[name] = server
+	modify(func(s *State) error {
+		s.Servers[name] = server
+		return nil
+	}, false)
 }
 
-// GetServer returns the server struct for the given server name
+// GetServer returns a copy of the server struct for the given server name
 func GetServer(name string) *Server {
-	if server, ok := Servers[name]; ok {
+	if server, ok := snapshot().Servers[name]; ok {
+		server = cloneServer(server)
 		return &server
 	}
 	return nil
@@ -112,15 +158,27 @@ func GetServer(name string) *Server {
 
 // GetServers - gets all the server names host has registered to.
 func GetServers() (servers []string) {
-	for _, server := range Servers {
+	for _, server := range snapshot().Servers {
 		servers = append(servers, server.Name)
 	}
 	return
 }
 
+// GetServerMap returns a copy of the server map
+func GetServerMap() map[string]Server {
+	servers := make(map[string]Server)
+	for name, server := range snapshot().Servers {
+		servers[name] = cloneServer(server)
+	}
+	return servers
+}
+
 // DeleteServer deletes the specified server name from the server map
 func DeleteServer(k string) {
-	delete(Servers, k)
+	modify(func(s *State) error {
+		delete(s.Servers, k)
+		return nil
+	}, false)
 }
 
 // ConvertServerCfg converts a netmaker ServerConfig to netclient server struct
@@ -130,7 +188,7 @@ func ConvertServerCfg(cfg *OldNetmakerServerConfig) *Server {
 	server.Version = cfg.Version
 	server.Broker = cfg.Server
 	server.MQPort = cfg.MQPort
-	server.MQID = netclient.ID
+	server.MQID = Netclient().ID
 	server.API = cfg.API
 	server.CoreDNSAddr = cfg.CoreDNSAddr
 	server.Is_EE = cfg.Is_EE
@@ -144,14 +202,16 @@ func UpdateServerConfig(cfg *models.ServerConfig) {
 	if cfg == nil {
 		return
 	}
-	server, ok := Servers[cfg.Server]
-	if !ok {
-		server = Server{}
-		server.Nodes = make(map[string]bool)
-	}
-	server.Name = cfg.Server
-	server.MQID = netclient.ID
-	server.ServerConfig = *cfg
-
-	Servers[cfg.Server] = server
+	modify(func(s *State) error {
+		server, ok := s.Servers[cfg.Server]
+		if !ok {
+			server = Server{}
+			server.Nodes = make(map[string]bool)
+		}
+		server.Name = cfg.Server
+		server.MQID = s.Host.ID
+		server.ServerConfig = *cfg
+		s.Servers[cfg.Server] = server
+		return nil
+	}, false)
 }
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestBrokerURLs(t *testing.T) {
+	is := is.New(t)
+	server := Server{Name: "netmaker.example.com"}
+	_, err := server.BrokerURLs()
+	is.True(err != nil) // no broker
+
+	server.Broker = "broker.netmaker.example.com"
+	server.MQPort = "8883"
+	urls, err := server.BrokerURLs()
+	is.NoErr(err)
+	is.Equal(len(urls), 1)
+	is.Equal(urls[0].String(), "wss://broker.netmaker.example.com:8883")
+
+	server.Brokers = []string{
+		"mqtts://broker1.netmaker.example.com",
+		"wss://broker2.netmaker.example.com:8443/mqtt",
+		"tcp://10.0.0.1",
+	}
+	urls, err = server.BrokerURLs()
+	is.NoErr(err)
+	is.Equal(len(urls), 3)
+	is.Equal(urls[0].String(), "mqtts://broker1.netmaker.example.com:8883")
+	is.Equal(urls[1].String(), "wss://broker2.netmaker.example.com:8443/mqtt")
+	is.Equal(urls[2].String(), "tcp://10.0.0.1:1883")
+
+	for _, broker := range []string{"http://broker.netmaker.example.com", "broker.netmaker.example.com:8883", "tcp://"} {
+		server.Brokers = []string{broker}
+		_, err = server.BrokerURLs()
+		is.True(err != nil) // invalid broker url
+	}
+}
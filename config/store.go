@@ -0,0 +1,258 @@
+package config
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/gravitl/netmaker/models"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// the in memory host, node and server configuration is an immutable snapshot: readers get the current
+// snapshot, changes are applied to a copy which then replaces it, so readers never see a partial update
+// and need not lock; snapshots must not be modified, Netclient() in particular returns a pointer into one
+
+// State - the host, node and server configuration
+type State struct {
+	Host    Config
+	Nodes   NodeMap
+	Servers map[string]Server
+}
+
+// Change - the parts of the configuration changed by an update
+type Change struct {
+	Host    bool     // host configuration changed
+	Nodes   []string // networks of the nodes added, changed or removed
+	Servers []string // names of the servers added, changed or removed
+}
+
+var (
+	stateMutex sync.RWMutex // guards current
+	current    = newState()
+	// updateMutex - serializes changes to the configuration and writes of the config files, so no change is lost
+	// to a concurrent one and the files are written in the order of the changes
+	updateMutex sync.Mutex
+	watchMutex  sync.Mutex
+	watchers    = make(map[chan Change]bool)
+)
+
+// newState - an empty configuration
+func newState() *State {
+	return &State{
+		Host: Config{
+			HostPeers: make(map[string][]wgtypes.PeerConfig),
+			PeerIDs:   make(map[string]models.HostPeerMap),
+		},
+		Nodes:   make(NodeMap),
+		Servers: make(map[string]Server),
+	}
+}
+
+// snapshot - the current configuration, which must not be modified
+func snapshot() *State {
+	stateMutex.RLock()
+	defer stateMutex.RUnlock()
+	return current
+}
+
+// Snapshot - a copy of the current configuration
+func Snapshot() *State {
+	return snapshot().clone()
+}
+
+// Update - applies update to a copy of the configuration, saves the config files of the parts it changed
+// and then makes the copy current; nothing is changed if update returns an error or a file can not be saved
+// update must not call other functions of this package that change or save the configuration
+func Update(update func(*State) error) error {
+	return modify(update, true)
+}
+
+// Replace - makes a copy of state the in memory configuration, without saving it
+func Replace(state *State) {
+	_ = modify(func(s *State) error {
+		*s = *state.clone()
+		return nil
+	}, false)
+}
+
+// modify - applies update to a copy of the configuration and makes it current, saving the changed parts first
+// if save is set; watchers are notified of the change
+func modify(update func(*State) error, save bool) error {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
+	old := snapshot()
+	next := old.clone()
+	if err := update(next); err != nil {
+		return err
+	}
+	change := diff(old, next)
+	if change.empty() {
+		return nil
+	}
+	if save {
+		if err := next.save(&change); err != nil {
+			return err
+		}
+	}
+	stateMutex.Lock()
+	current = next
+	stateMutex.Unlock()
+	notify(change)
+	return nil
+}
+
+// State.clone - copies the configuration; the maps are copied, slices and pointers in the values are shared
+// so they must be replaced rather than modified
+func (s *State) clone() *State {
+	next := &State{
+		Host:    s.Host,
+		Nodes:   make(NodeMap, len(s.Nodes)),
+		Servers: make(map[string]Server, len(s.Servers)),
+	}
+	next.Host.HostPeers = make(map[string][]wgtypes.PeerConfig, len(s.Host.HostPeers))
+	for server, peers := range s.Host.HostPeers {
+		next.Host.HostPeers[server] = peers
+	}
+	next.Host.PeerIDs = make(map[string]models.HostPeerMap, len(s.Host.PeerIDs))
+	for server, ids := range s.Host.PeerIDs {
+		next.Host.PeerIDs[server] = ids
+	}
+	if s.Host.TrafficKeyRotation != nil {
+		rotation := *s.Host.TrafficKeyRotation
+		rotation.Pending = append([]string{}, rotation.Pending...)
+		next.Host.TrafficKeyRotation = &rotation
+	}
+	for network, node := range s.Nodes {
+		next.Nodes[network] = node
+	}
+	for name, server := range s.Servers {
+		next.Servers[name] = cloneServer(server)
+	}
+	return next
+}
+
+// cloneServer - copies a server, including its node map
+func cloneServer(server Server) Server {
+	nodes := make(map[string]bool, len(server.Nodes))
+	for network, ok := range server.Nodes {
+		nodes[network] = ok
+	}
+	server.Nodes = nodes
+	return server
+}
+
+// State.save - writes the config files of the changed parts of the configuration
+func (s *State) save(change *Change) error {
+	if change.Host {
+		if err := writeNetclientConfig(&s.Host); err != nil {
+			return err
+		}
+	}
+	if len(change.Nodes) > 0 {
+		if err := writeNodeConfig(s.Nodes); err != nil {
+			return err
+		}
+	}
+	if len(change.Servers) > 0 {
+		if err := writeServerConfig(s.Servers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diff - the changes between two configurations
+func diff(old, next *State) Change {
+	change := Change{Host: !reflect.DeepEqual(old.Host, next.Host)}
+	for network := range changedKeys(old.Nodes, next.Nodes) {
+		change.Nodes = append(change.Nodes, network)
+	}
+	for name := range changedKeys(old.Servers, next.Servers) {
+		change.Servers = append(change.Servers, name)
+	}
+	sort.Strings(change.Nodes)
+	sort.Strings(change.Servers)
+	return change
+}
+
+// changedKeys - keys added, removed or changed between two maps
+func changedKeys[V any](old, next map[string]V) map[string]bool {
+	keys := make(map[string]bool)
+	for k, v := range next {
+		if oldV, ok := old[k]; !ok || !reflect.DeepEqual(oldV, v) {
+			keys[k] = true
+		}
+	}
+	for k := range old {
+		if _, ok := next[k]; !ok {
+			keys[k] = true
+		}
+	}
+	return keys
+}
+
+// Change.empty - checks if nothing changed
+func (c *Change) empty() bool {
+	return !c.Host && len(c.Nodes) == 0 && len(c.Servers) == 0
+}
+
+// Change.merge - combines two changes
+func (c Change) merge(other Change) Change {
+	c.Host = c.Host || other.Host
+	c.Nodes = mergeNames(c.Nodes, other.Nodes)
+	c.Servers = mergeNames(c.Servers, other.Servers)
+	return c
+}
+
+// mergeNames - sorted union of two sorted lists of names
+func mergeNames(a, b []string) []string {
+	names := make(map[string]bool, len(a)+len(b))
+	for _, name := range append(append([]string{}, a...), b...) {
+		names[name] = true
+	}
+	merged := make([]string, 0, len(names))
+	for name := range names {
+		merged = append(merged, name)
+	}
+	sort.Strings(merged)
+	if len(merged) == 0 {
+		return nil
+	}
+	return merged
+}
+
+// Watch - returns a channel receiving the changes of the in memory configuration and a function to stop watching
+// changes a watcher has not received yet are merged, so a slow watcher never blocks an update
+func Watch() (<-chan Change, func()) {
+	ch := make(chan Change, 1)
+	watchMutex.Lock()
+	watchers[ch] = true
+	watchMutex.Unlock()
+	return ch, func() {
+		watchMutex.Lock()
+		defer watchMutex.Unlock()
+		delete(watchers, ch)
+	}
+}
+
+// notify - sends a change to the watchers
+func notify(change Change) {
+	watchMutex.Lock()
+	defer watchMutex.Unlock()
+	for ch := range watchers {
+		select {
+		case ch <- change:
+			continue
+		default:
+		}
+		// the watcher has not received the previous change yet, replace it with the merged changes
+		pending := change
+		select {
+		case previous := <-ch:
+			pending = previous.merge(change)
+		default:
+		}
+		ch <- pending
+	}
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/gravitl/netclient/lock"
+	"github.com/matryer/is"
+)
+
+// useTestState - uses an empty configuration and a scratch config directory until the test ends
+func useTestState(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv(ConfigDirEnv, dir)
+	t.Setenv(lock.RuntimeDirEnv, t.TempDir())
+	saved := Snapshot()
+	Replace(newState())
+	t.Cleanup(func() { Replace(saved) })
+	return dir
+}
+
+func TestUpdate(t *testing.T) {
+	is := is.New(t)
+	dir := useTestState(t)
+	is.NoErr(Update(func(s *State) error {
+		s.Servers["server1"] = Server{Name: "server1", Nodes: map[string]bool{"net1": true}}
+		return nil
+	}))
+	is.Equal(GetServer("server1").Name, "server1")
+	_, err := os.Stat(filepath.Join(dir, "servers.yml"))
+	is.NoErr(err) // changed part saved
+	_, err = os.Stat(filepath.Join(dir, "nodes.yml"))
+	is.True(os.IsNotExist(err)) // unchanged part not saved
+
+	// a failed update changes nothing
+	is.True(Update(func(s *State) error {
+		delete(s.Servers, "server1")
+		return fmt.Errorf("failed")
+	}) != nil)
+	is.True(GetServer("server1") != nil)
+
+	// copies returned by the getters do not change the configuration
+	GetServer("server1").Nodes["net2"] = true
+	GetNodes()["net1"] = Node{}
+	is.Equal(len(GetServer("server1").Nodes), 1)
+	is.Equal(len(GetNodes()), 0)
+
+	is.NoErr(ReadServerConf())
+	is.True(GetServer("server1").Nodes["net1"])
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	is := is.New(t)
+	useTestState(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		network := fmt.Sprintf("net%d", i)
+		go func() {
+			defer wg.Done()
+			if err := Update(func(s *State) error {
+				var node Node
+				node.Network = network
+				s.Nodes[network] = node
+				s.Host.ListenPort++
+				return nil
+			}); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			_ = GetNodes()
+			_ = Netclient().ListenPort
+		}()
+	}
+	wg.Wait()
+	is.Equal(len(GetNodes()), 10)
+	is.Equal(Netclient().ListenPort, 10) // no update lost
+	is.NoErr(ReadNodeConfig())
+	is.Equal(len(GetNodes()), 10)
+}
+
+func TestWatch(t *testing.T) {
+	is := is.New(t)
+	useTestState(t)
+	changes, stop := Watch()
+	defer stop()
+	UpdateNodeMap("net1", Node{})
+	UpdateServer("server1", Server{Name: "server1"})
+	UpdateNodeMap("net1", Node{}) // no change, not notified
+	// changes not received yet are merged
+	is.Equal(<-changes, Change{Nodes: []string{"net1"}, Servers: []string{"server1"}})
+	select {
+	case change := <-changes:
+		t.Fatalf("unexpected change %v", change)
+	default:
+	}
+	host := *Netclient()
+	host.MTU = 1280
+	UpdateNetclient(host)
+	is.Equal(<-changes, Change{Host: true})
+	stop()
+	DeleteNode("net1")
+	is.Equal(len(changes), 0)
+}
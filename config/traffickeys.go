@@ -0,0 +1,127 @@
+package config
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gravitl/netclient/ncutils"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// TrafficKeyRotation - state of a traffic key rotation, persisted so an interrupted rotation can be resumed
+// messages to servers that have not confirmed the new key are sealed with the previous key,
+// and messages sealed to either key are accepted until the previous key is removed
+type TrafficKeyRotation struct {
+	PreviousPrivate []byte    `json:"previousprivate" yaml:"previousprivate"`
+	PreviousPublic  []byte    `json:"previouspublic" yaml:"previouspublic"`
+	Started         time.Time `json:"started" yaml:"started"`
+	Pending         []string  `json:"pending" yaml:"pending"`                         // servers that have not confirmed the new key
+	Confirmed       time.Time `json:"confirmed,omitempty" yaml:"confirmed,omitempty"` // time the last server confirmed the new key
+}
+
+// GenerateTrafficKeys - generates a traffic key pair
+func GenerateTrafficKeys() (private, public []byte, err error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if private, err = ncutils.ConvertKeyToBytes(priv); err != nil {
+		return nil, nil, err
+	}
+	if public, err = ncutils.ConvertKeyToBytes(pub); err != nil {
+		return nil, nil, err
+	}
+	return private, public, nil
+}
+
+// Config.RotateTrafficKeys - replaces the traffic keys with a new key pair, keeping the current keys
+// until each of servers confirms the new key
+func (c *Config) RotateTrafficKeys(servers []string, now time.Time) error {
+	if rotation := c.TrafficKeyRotation; rotation != nil && len(rotation.Pending) > 0 {
+		return fmt.Errorf("traffic key rotation started at %s is waiting for %s to confirm the new key",
+			rotation.Started.Format(time.RFC3339), strings.Join(rotation.Pending, ", "))
+	}
+	if len(c.TrafficKeyPrivate) == 0 {
+		return errors.New("no traffic keys to rotate")
+	}
+	private, public, err := GenerateTrafficKeys()
+	if err != nil {
+		return err
+	}
+	c.TrafficKeyRotation = &TrafficKeyRotation{
+		PreviousPrivate: c.TrafficKeyPrivate,
+		PreviousPublic:  c.TrafficKeyPublic,
+		Started:         now,
+		Pending:         append([]string{}, servers...),
+	}
+	if len(servers) == 0 {
+		c.TrafficKeyRotation.Confirmed = now
+	}
+	c.TrafficKeyPrivate = private
+	c.TrafficKeyPublic = public
+	// the host sent to the servers in host updates carries the public key
+	c.Host.TrafficKeyPublic = public
+	c.TrafficKeyCreated = now
+	return nil
+}
+
+// Config.ConfirmTrafficKey - records that server uses the new traffic key, returns false if it was not pending
+func (c *Config) ConfirmTrafficKey(server string, now time.Time) bool {
+	rotation := c.TrafficKeyRotation
+	if rotation == nil {
+		return false
+	}
+	for i, pending := range rotation.Pending {
+		if pending == server {
+			rotation.Pending = append(rotation.Pending[:i], rotation.Pending[i+1:]...)
+			if len(rotation.Pending) == 0 {
+				rotation.Confirmed = now
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Config.TrafficKeyPending - checks if server has not confirmed the new traffic key
+func (c *Config) TrafficKeyPending(server string) bool {
+	if c.TrafficKeyRotation == nil {
+		return false
+	}
+	for _, pending := range c.TrafficKeyRotation.Pending {
+		if pending == server {
+			return true
+		}
+	}
+	return false
+}
+
+// Config.ExpireTrafficKey - removes the previous traffic key once all servers confirmed the new key
+// and overlap has passed since, returns true if the key was removed
+func (c *Config) ExpireTrafficKey(overlap time.Duration, now time.Time) bool {
+	rotation := c.TrafficKeyRotation
+	if rotation == nil || len(rotation.Pending) > 0 || now.Before(rotation.Confirmed.Add(overlap)) {
+		return false
+	}
+	c.TrafficKeyRotation = nil
+	return true
+}
+
+// Config.TrafficKeyFor - private traffic key used to seal messages to server
+func (c *Config) TrafficKeyFor(server string) []byte {
+	if c.TrafficKeyPending(server) {
+		return c.TrafficKeyRotation.PreviousPrivate
+	}
+	return c.TrafficKeyPrivate
+}
+
+// Config.TrafficKeyRotationDue - checks if the traffic keys are due to be rotated by the configured schedule
+func (c *Config) TrafficKeyRotationDue(now time.Time) bool {
+	if c.TrafficKeyInterval <= 0 || c.TrafficKeyRotation != nil {
+		return false
+	}
+	return !now.Before(c.TrafficKeyCreated.Add(c.TrafficKeyInterval))
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestRotateTrafficKeys(t *testing.T) {
+	is := is.New(t)
+	start := time.Now()
+	host := Config{}
+	private, public, err := GenerateTrafficKeys()
+	is.NoErr(err)
+	host.TrafficKeyPrivate, host.TrafficKeyPublic = private, public
+
+	is.NoErr(host.RotateTrafficKeys([]string{"server1", "server2"}, start))
+	is.True(string(host.TrafficKeyPrivate) != string(private))
+	is.Equal(host.TrafficKeyRotation.PreviousPrivate, private)
+	is.Equal(host.TrafficKeyRotation.PreviousPublic, public)
+	is.Equal(host.TrafficKeyCreated, start)
+	is.Equal(host.Host.TrafficKeyPublic, host.TrafficKeyPublic) // sent to the servers in host updates
+	// messages to servers that have not confirmed the new key are sealed with the previous key
+	is.Equal(host.TrafficKeyFor("server1"), private)
+	is.Equal(host.TrafficKeyFor("server3"), host.TrafficKeyPrivate)
+	// only one rotation at a time
+	is.True(host.RotateTrafficKeys([]string{"server1"}, start) != nil)
+
+	is.True(host.ConfirmTrafficKey("server1", start.Add(time.Minute)))
+	is.True(!host.ConfirmTrafficKey("server1", start.Add(time.Minute)))
+	is.Equal(host.TrafficKeyFor("server1"), host.TrafficKeyPrivate)
+	is.True(!host.ExpireTrafficKey(time.Hour, start.Add(time.Hour*2))) // server2 has not confirmed
+	is.True(host.ConfirmTrafficKey("server2", start.Add(time.Minute*2)))
+	is.Equal(host.TrafficKeyRotation.Confirmed, start.Add(time.Minute*2))
+
+	// the previous key is kept for the overlap after the last confirmation
+	is.True(!host.ExpireTrafficKey(time.Hour, start.Add(time.Minute*30)))
+	is.True(host.ExpireTrafficKey(time.Hour, start.Add(time.Minute*62)))
+	is.True(host.TrafficKeyRotation == nil)
+}
+
+func TestTrafficKeyRotationDue(t *testing.T) {
+	is := is.New(t)
+	start := time.Now()
+	host := Config{TrafficKeyCreated: start}
+	is.True(!host.TrafficKeyRotationDue(start.Add(time.Hour * 24 * 365))) // no schedule
+	host.TrafficKeyInterval = time.Hour * 24
+	is.True(!host.TrafficKeyRotationDue(start.Add(time.Hour)))
+	is.True(host.TrafficKeyRotationDue(start.Add(time.Hour * 24)))
+	host.TrafficKeyRotation = &TrafficKeyRotation{Pending: []string{"server1"}}
+	is.True(!host.TrafficKeyRotationDue(start.Add(time.Hour * 48))) // rotation in progress
+}
+
+func TestTrafficKeyRotationPersisted(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+	host := Config{}
+	private, public, err := GenerateTrafficKeys()
+	is.NoErr(err)
+	host.TrafficKeyPrivate, host.TrafficKeyPublic = private, public
+	host.TrafficKeyInterval = time.Hour * 720
+	is.NoErr(host.RotateTrafficKeys([]string{"server1"}, time.Now().Truncate(time.Second)))
+	file := filepath.Join(dir, "netclient.yml")
+	is.NoErr(writeYAMLFile(file, host))
+	data, err := os.ReadFile(file)
+	is.NoErr(err)
+	is.Equal(strings.Count(string(data), encryptedTag), 4) // wireguard key, host password and both private traffic keys
+	var decoded Config
+	is.NoErr(decodeYAMLFile(file, &decoded))
+	is.Equal(decoded.TrafficKeyRotation.PreviousPrivate, private)
+	is.Equal(decoded.TrafficKeyRotation.Pending, []string{"server1"})
+	is.Equal(decoded.TrafficKeyPrivate, host.TrafficKeyPrivate)
+	is.Equal(decoded.TrafficKeyInterval, host.TrafficKeyInterval)
+	is.True(decoded.TrafficKeyRotation.Started.Equal(host.TrafficKeyRotation.Started))
+}
@@ -123,3 +123,8 @@ type MacTemplateData struct {
 	Label    string
 	Interval string
 }
+
+// restart - restarts a system daemon
+func restart() error {
+	return signalReload()
+}
@@ -168,3 +168,8 @@ func removeFreebsdDaemon() error {
 	}
 	return nil
 }
+
+// restart - restarts a system daemon
+func restart() error {
+	return signalReload()
+}
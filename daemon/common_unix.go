@@ -11,8 +11,8 @@ import (
 	"github.com/gravitl/netclient/ncutils"
 )
 
-// restart - restarts a system daemon
-func restart() error {
+// signalReload - signals the running daemon to reload its configuration
+func signalReload() error {
 	pid, err := ncutils.ReadPID()
 	if err != nil {
 		return fmt.Errorf("failed to find pid %w", err)
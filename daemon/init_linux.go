@@ -0,0 +1,317 @@
+package daemon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"text/template"
+	"time"
+
+	"github.com/gravitl/netclient/ncutils"
+	"github.com/gravitl/netclient/secrets"
+	"github.com/gravitl/netmaker/logger"
+)
+
+// InitSystemEnv - environment variable overriding the detected init system, eg. NETCLIENT_INIT_SYSTEM=runit
+const InitSystemEnv = "NETCLIENT_INIT_SYSTEM"
+
+// serviceName - name of the netclient service in all init systems
+const serviceName = "netclient"
+
+// initSystem - an init system able to supervise the netclient daemon
+type initSystem interface {
+	// name of the init system
+	name() string
+	// detect - reports if the init system is running, paths are relative to root
+	detect(root string) bool
+	// render - renders the service definition files, indexed by path
+	render(service serviceConfig) (map[string][]byte, error)
+	// enable - registers the installed service definition with the init system
+	enable() error
+	// disable - unregisters the service from the init system before its definition is removed
+	disable() error
+	start() error
+	stop() error
+	restart() error
+}
+
+// generatedMarker - comment marking the service definitions written by netclient, which are rewritten by install
+// when they differ from the current rendering; definitions without it were written by the administrator and are kept
+const generatedMarker = "# generated by netclient, changes are overwritten on install"
+
+// serviceConfig - values rendered into service definitions
+type serviceConfig struct {
+	Marker  string
+	Binary  string
+	Args    string
+	PidFile string
+	LogFile string
+	// Credential - systemd credential holding the secrets key, loaded from the credential store if it exists
+	Credential string
+}
+
+// initSystems - supported init systems in order of detection
+var initSystems = []initSystem{systemd{}, openrc{}, runit{}, s6{}, sysv{}}
+
+// netclientService - the service definition of the netclient daemon
+func netclientService() serviceConfig {
+	return serviceConfig{
+		Marker:     generatedMarker,
+		Binary:     ExecDir + "netclient",
+		Args:       "daemon",
+		PidFile:    ncutils.PidFile,
+		LogFile:    "/var/log/netclient.log",
+		Credential: secrets.CredentialName,
+	}
+}
+
+// detectInitSystem - returns the init system of the host, or the one named by InitSystemEnv
+func detectInitSystem(root string) (initSystem, error) {
+	if name := os.Getenv(InitSystemEnv); name != "" {
+		for _, system := range initSystems {
+			if system.name() == name {
+				return system, nil
+			}
+		}
+		return nil, fmt.Errorf("unsupported init system %s set by %s", name, InitSystemEnv)
+	}
+	for _, system := range initSystems {
+		if system.detect(root) {
+			return system, nil
+		}
+	}
+	return nil, errors.New("no supported init system (systemd, openrc, runit, s6, sysv) detected")
+}
+
+// hostInitSystem - init system of the running host
+func hostInitSystem() (initSystem, error) {
+	return detectInitSystem("/")
+}
+
+// renderTemplate - renders a service definition template
+func renderTemplate(name, text string, service serviceConfig) ([]byte, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, service); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// isDir - checks if path under root is a directory
+func isDir(root, path string) bool {
+	info, err := os.Stat(filepath.Join(root, path))
+	return err == nil && info.IsDir()
+}
+
+// hasCommand - checks if a command is available in PATH
+func hasCommand(command string) bool {
+	_, err := exec.LookPath(command)
+	return err == nil
+}
+
+func install() error {
+	system, err := hostInitSystem()
+	if err != nil {
+		return fmt.Errorf("%w .. daemon not installed", err)
+	}
+	if err := installBinary(); err != nil {
+		return err
+	}
+	files, err := system.render(netclientService())
+	if err != nil {
+		return err
+	}
+	changed, err := writeServiceFiles(files)
+	if err != nil {
+		return err
+	}
+	logger.Log(0, "installing netclient service for", system.name())
+	// enabling reloads the service definitions of init systems that cache them, eg. systemctl daemon-reload
+	if err := system.enable(); err != nil {
+		return err
+	}
+	if changed {
+		// a running daemon is restarted so the new definition takes effect
+		return system.restart()
+	}
+	return system.start()
+}
+
+// writeServiceFiles - writes the rendered service definitions, indexed by path; returns whether an existing
+// definition was rewritten
+// definitions written by netclient are rewritten when they differ from the rendering, others are kept
+func writeServiceFiles(files map[string][]byte) (bool, error) {
+	changed := false
+	for path, data := range files {
+		existing, err := os.ReadFile(path)
+		if err == nil {
+			if bytes.Equal(existing, data) {
+				continue
+			}
+			if !generatedService(existing) {
+				logger.Log(1, "keeping existing service definition", path)
+				continue
+			}
+			logger.Log(0, "updating service definition", path)
+			changed = true
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return changed, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return changed, err
+		}
+		if err := os.WriteFile(path, data, servicePerm(path)); err != nil {
+			logger.Log(0, err.Error())
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
+// generatedService - checks if a service definition was written by netclient
+func generatedService(data []byte) bool {
+	return bytes.Contains(data, []byte(generatedMarker)) || string(data) == legacySystemdUnit
+}
+
+// servicePerm - permissions of a service definition file; scripts must be executable
+func servicePerm(path string) os.FileMode {
+	if filepath.Ext(path) == ".service" {
+		return 0644
+	}
+	return 0755
+}
+
+// installBinary - copies the running binary to ExecDir
+func installBinary() error {
+	binarypath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if ncutils.FileExists(ExecDir + "netclient") {
+		logger.Log(0, "updating netclient binary in", ExecDir)
+	}
+	if err := ncutils.Copy(binarypath, ExecDir+"netclient"); err != nil {
+		logger.Log(0, err.Error())
+		return err
+	}
+	return nil
+}
+
+// start - starts daemon
+func start() error {
+	system, err := hostInitSystem()
+	if err != nil {
+		return fmt.Errorf("%w .. daemon not started", err)
+	}
+	logger.Log(3, "starting netclient with", system.name())
+	return system.start()
+}
+
+// stop - stops daemon
+func stop() error {
+	system, err := hostInitSystem()
+	if err != nil {
+		return fmt.Errorf("%w .. daemon not stopped", err)
+	}
+	logger.Log(3, "stopping netclient with", system.name())
+	return system.stop()
+}
+
+// restart - reloads the running daemon; the daemon is restarted through the init system if it is not running
+func restart() error {
+	err := signalReload()
+	if err == nil {
+		return nil
+	}
+	system, detectErr := hostInitSystem()
+	if detectErr != nil {
+		return err
+	}
+	logger.Log(1, "could not reload daemon, restarting with", system.name(), err.Error())
+	return system.restart()
+}
+
+// removeService - disables the service and removes its definition
+func removeService() error {
+	system, err := hostInitSystem()
+	if err != nil {
+		return err
+	}
+	var faults string
+	if err := system.disable(); err != nil {
+		faults = faults + err.Error()
+	}
+	files, err := system.render(netclientService())
+	if err != nil {
+		return err
+	}
+	for path := range files {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Log(0, "error removing", path, "please investigate")
+			faults = faults + err.Error()
+		}
+		// service directories used by runit and s6
+		if dir := filepath.Dir(path); filepath.Base(dir) == serviceName {
+			if err := os.RemoveAll(dir); err != nil {
+				faults = faults + err.Error()
+			}
+		}
+	}
+	logger.Log(0, "removed", system.name(), "remnants if any existed")
+	if faults != "" {
+		return errors.New(faults)
+	}
+	return nil
+}
+
+// runCmds - runs commands in order, stopping at the first failure
+func runCmds(commands ...string) error {
+	for _, command := range commands {
+		if out, err := ncutils.RunCmd(command, true); err != nil {
+			return fmt.Errorf("%s failed %w %s", command, err, out)
+		}
+	}
+	return nil
+}
+
+// supervisedTimeout - time a supervision suite (runit, s6) has to pick up a new service directory
+const supervisedTimeout = time.Second * 10
+
+// waitSupervised - waits for a supervisor to be started for the service directory dir
+func waitSupervised(dir string) error {
+	deadline := time.Now().Add(supervisedTimeout)
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "supervise", "control")); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service %s was not picked up by the supervisor", dir)
+		}
+		time.Sleep(time.Millisecond * 250)
+	}
+}
+
+// firstDir - returns the first of paths that is a directory under root, or the first path if none exist
+func firstDir(root string, paths ...string) string {
+	for _, path := range paths {
+		if isDir(root, path) {
+			return path
+		}
+	}
+	return paths[0]
+}
+
+// linkService - links a service definition directory into a scan directory
+func linkService(definition, link string) error {
+	if target, err := os.Readlink(link); err == nil && target == definition {
+		return nil
+	}
+	return os.Symlink(definition, link)
+}
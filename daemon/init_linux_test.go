@@ -0,0 +1,160 @@
+package daemon
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+var testService = serviceConfig{
+	Marker:     generatedMarker,
+	Binary:     "/usr/local/bin/netclient",
+	Args:       "daemon",
+	PidFile:    "/run/netclient.pid",
+	LogFile:    "/var/log/netclient.log",
+	Credential: "netclient-secrets",
+}
+
+func TestRender(t *testing.T) {
+	expected := map[string]struct {
+		path     string
+		contains []string
+	}{
+		"systemd": {systemdUnit, []string{"Type=notify", "ExecStart=/usr/local/bin/netclient daemon", "WatchdogSec=", "TimeoutStartSec=", "ExecReload=/bin/kill -HUP $MAINPID", "LoadCredentialEncrypted=netclient-secrets\n"}},
+		"openrc":  {openrcScript, []string{"#!/sbin/openrc-run", `command="/usr/local/bin/netclient"`, `command_args="daemon"`, `pidfile="/run/netclient.pid"`}},
+		"runit":   {"/etc/sv/netclient/run", []string{"exec /usr/local/bin/netclient daemon 2>&1"}},
+		"s6":      {"/etc/s6/sv/netclient/run", []string{"exec /usr/local/bin/netclient daemon 2>&1"}},
+		"sysv":    {sysvScript, []string{"# Provides:          netclient", `DAEMON="/usr/local/bin/netclient"`, `PIDFILE="/run/netclient.pid"`}},
+	}
+	for _, system := range initSystems {
+		system := system
+		t.Run(system.name(), func(t *testing.T) {
+			is := is.New(t)
+			files, err := system.render(testService)
+			is.NoErr(err)
+			want, ok := expected[system.name()]
+			is.True(ok) // every init system is tested
+			is.Equal(len(files), 1)
+			data, ok := files[want.path]
+			is.True(ok)
+			for _, s := range want.contains {
+				is.True(strings.Contains(string(data), s))
+			}
+			is.True(!strings.Contains(string(data), "<no value>"))
+			is.True(generatedService(data)) // rewritten by later installs
+			if strings.HasPrefix(string(data), "#!/bin/sh") {
+				is.Equal(servicePerm(want.path), os.FileMode(0755))
+				checkShell(t, data)
+			}
+		})
+	}
+}
+
+// checkShell - checks a rendered script is valid shell syntax
+func checkShell(t *testing.T, script []byte) {
+	t.Helper()
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not available")
+	}
+	file := filepath.Join(t.TempDir(), "script")
+	if err := os.WriteFile(file, script, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command(sh, "-n", file).CombinedOutput(); err != nil {
+		t.Fatalf("invalid shell script %v %s", err, out)
+	}
+}
+
+func TestDetectInitSystem(t *testing.T) {
+	// commands used for detection are not available
+	t.Setenv("PATH", t.TempDir())
+	t.Setenv(InitSystemEnv, "")
+	tests := []struct {
+		dirs   []string
+		system string
+	}{
+		{[]string{"run/systemd/system", "etc/init.d"}, "systemd"},
+		{[]string{"run/openrc", "etc/init.d"}, "openrc"},
+		{[]string{"run/runit", "etc/init.d"}, "runit"},
+		{[]string{"etc/init.d"}, "sysv"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.system, func(t *testing.T) {
+			is := is.New(t)
+			root := t.TempDir()
+			for _, dir := range test.dirs {
+				is.NoErr(os.MkdirAll(filepath.Join(root, dir), 0755))
+			}
+			system, err := detectInitSystem(root)
+			is.NoErr(err)
+			is.Equal(system.name(), test.system)
+		})
+	}
+	t.Run("none", func(t *testing.T) {
+		is := is.New(t)
+		_, err := detectInitSystem(t.TempDir())
+		is.True(err != nil)
+	})
+	t.Run("override", func(t *testing.T) {
+		is := is.New(t)
+		root := t.TempDir()
+		is.NoErr(os.MkdirAll(filepath.Join(root, "run/systemd/system"), 0755))
+		t.Setenv(InitSystemEnv, "s6")
+		system, err := detectInitSystem(root)
+		is.NoErr(err)
+		is.Equal(system.name(), "s6")
+		t.Setenv(InitSystemEnv, "upstart")
+		_, err = detectInitSystem(root)
+		is.True(err != nil)
+	})
+}
+
+func TestWriteServiceFiles(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+	unit := filepath.Join(dir, "system", "netclient.service")
+	custom := filepath.Join(dir, "custom.service")
+	legacy := filepath.Join(dir, "legacy.service")
+	is.NoErr(os.WriteFile(custom, []byte("[Service]\nExecStart=/opt/netclient daemon\n"), 0644))
+	is.NoErr(os.WriteFile(legacy, []byte(legacySystemdUnit), 0644))
+	rendered, err := systemd{}.render(testService)
+	is.NoErr(err)
+	data := rendered[systemdUnit]
+
+	// new definitions are written, without a restart
+	changed, err := writeServiceFiles(map[string][]byte{unit: data})
+	is.NoErr(err)
+	is.True(!changed)
+	written, err := os.ReadFile(unit)
+	is.NoErr(err)
+	is.Equal(written, data)
+	changed, err = writeServiceFiles(map[string][]byte{unit: data})
+	is.NoErr(err)
+	is.True(!changed) // unchanged
+
+	// a definition written by an older netclient is upgraded
+	old := strings.Replace(string(data), "TimeoutStartSec=5min\n", "", 1)
+	is.NoErr(os.WriteFile(unit, []byte(old), 0644))
+	changed, err = writeServiceFiles(map[string][]byte{unit: data, legacy: data})
+	is.NoErr(err)
+	is.True(changed)
+	for _, path := range []string{unit, legacy} {
+		written, err := os.ReadFile(path)
+		is.NoErr(err)
+		is.Equal(written, data)
+	}
+
+	// a definition written by the administrator is kept
+	changed, err = writeServiceFiles(map[string][]byte{custom: data})
+	is.NoErr(err)
+	is.True(!changed)
+	written, err = os.ReadFile(custom)
+	is.NoErr(err)
+	is.Equal(string(written), "[Service]\nExecStart=/opt/netclient daemon\n")
+}
@@ -0,0 +1,68 @@
+package daemon
+
+const openrcScript = "/etc/init.d/netclient"
+
+const openrcTemplate = `#!/sbin/openrc-run
+{{.Marker}}
+
+name="netclient"
+description="Netclient Daemon"
+command="{{.Binary}}"
+command_args="{{.Args}}"
+command_background="yes"
+pidfile="{{.PidFile}}"
+output_log="{{.LogFile}}"
+error_log="{{.LogFile}}"
+extra_started_commands="reload"
+
+depend() {
+	need net
+	after firewall
+}
+
+reload() {
+	ebegin "Reloading ${RC_SVCNAME}"
+	start-stop-daemon --signal HUP --pidfile "${pidfile}"
+	eend $?
+}
+`
+
+// openrc - OpenRC init script, used by Alpine and Gentoo
+type openrc struct{}
+
+func (openrc) name() string {
+	return "openrc"
+}
+
+// openrc.detect - OpenRC creates its runtime directory at boot
+func (openrc) detect(root string) bool {
+	return isDir(root, "run/openrc")
+}
+
+func (openrc) render(service serviceConfig) (map[string][]byte, error) {
+	script, err := renderTemplate("openrc", openrcTemplate, service)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{openrcScript: script}, nil
+}
+
+func (openrc) enable() error {
+	return runCmds("rc-update add netclient default")
+}
+
+func (openrc) disable() error {
+	return runCmds("rc-update del netclient default")
+}
+
+func (openrc) start() error {
+	return runCmds("rc-service netclient start")
+}
+
+func (openrc) stop() error {
+	return runCmds("rc-service netclient stop")
+}
+
+func (openrc) restart() error {
+	return runCmds("rc-service netclient restart")
+}
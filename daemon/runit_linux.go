@@ -0,0 +1,72 @@
+package daemon
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// runitDefinition - directory holding the netclient runit service definition
+const runitDefinition = "/etc/sv/netclient"
+
+const runitTemplate = `#!/bin/sh
+{{.Marker}}
+# netclient runit service, logs are written to stdout for the log service of runsvdir
+exec {{.Binary}} {{.Args}} 2>&1
+`
+
+// runit - runit service directory, used by Void and Artix
+type runit struct{}
+
+func (runit) name() string {
+	return "runit"
+}
+
+// runit.detect - runit creates its runtime directory at boot
+func (runit) detect(root string) bool {
+	return isDir(root, "run/runit") || (isDir(root, "etc/runit") && hasCommand("runsvdir"))
+}
+
+func (runit) render(service serviceConfig) (map[string][]byte, error) {
+	run, err := renderTemplate("runit", runitTemplate, service)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{filepath.Join(runitDefinition, "run"): run}, nil
+}
+
+// runitServiceDir - the directory runsvdir scans for services: Void uses /var/service, Artix /run/runit/service
+func runitServiceDir() string {
+	return "/" + firstDir("/", "var/service", "run/runit/service", "etc/service")
+}
+
+// runitService - the enabled netclient service
+func runitService() string {
+	return filepath.Join(runitServiceDir(), serviceName)
+}
+
+func (runit) enable() error {
+	if err := linkService(runitDefinition, runitService()); err != nil {
+		return err
+	}
+	return waitSupervised(runitService())
+}
+
+func (runit) disable() error {
+	if err := os.Remove(runitService()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (runit) start() error {
+	return runCmds("sv up " + runitService())
+}
+
+func (runit) stop() error {
+	return runCmds("sv down " + runitService())
+}
+
+func (runit) restart() error {
+	return runCmds("sv restart " + runitService())
+}
@@ -0,0 +1,77 @@
+package daemon
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// s6Definition - directory holding the netclient s6 service definition
+const s6Definition = "/etc/s6/sv/netclient"
+
+const s6Template = `#!/bin/sh
+{{.Marker}}
+# netclient s6 service, logs are written to stdout for the catch-all logger
+exec {{.Binary}} {{.Args}} 2>&1
+`
+
+// s6 - s6 service directory supervised by s6-svscan
+// scan directories under /run do not persist, the link must be recreated at boot by the s6 setup
+type s6 struct{}
+
+func (s6) name() string {
+	return "s6"
+}
+
+// s6.detect - s6-svscan is installed and a scan directory exists
+func (s6) detect(root string) bool {
+	return hasCommand("s6-svscan") && (isDir(root, "run/service") || isDir(root, "service"))
+}
+
+func (s6) render(service serviceConfig) (map[string][]byte, error) {
+	run, err := renderTemplate("s6", s6Template, service)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{filepath.Join(s6Definition, "run"): run}, nil
+}
+
+// s6ScanDir - the directory s6-svscan scans for services
+func s6ScanDir() string {
+	return "/" + firstDir("/", "run/service", "service")
+}
+
+// s6Service - the enabled netclient service
+func s6Service() string {
+	return filepath.Join(s6ScanDir(), serviceName)
+}
+
+func (s6) enable() error {
+	if err := linkService(s6Definition, s6Service()); err != nil {
+		return err
+	}
+	if err := runCmds("s6-svscanctl -a " + s6ScanDir()); err != nil {
+		return err
+	}
+	return waitSupervised(s6Service())
+}
+
+func (s6) disable() error {
+	if err := os.Remove(s6Service()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	// rescan and stop the supervisor of the removed service
+	return runCmds("s6-svscanctl -an " + s6ScanDir())
+}
+
+func (s6) start() error {
+	return runCmds("s6-svc -u " + s6Service())
+}
+
+func (s6) stop() error {
+	return runCmds("s6-svc -d " + s6Service())
+}
+
+func (s6) restart() error {
+	return runCmds("s6-svc -r " + s6Service())
+}
@@ -0,0 +1,84 @@
+package daemon
+
+const systemdUnit = "/etc/systemd/system/netclient.service"
+
+const systemdTemplate = `{{.Marker}}, override settings in a drop-in under netclient.service.d
+[Unit]
+Description=Netclient Daemon
+Documentation=https://docs.netmaker.org https://k8s.netmaker.org
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+User=root
+Type=notify
+ExecStart={{.Binary}} {{.Args}}
+ExecReload=/bin/kill -HUP $MAINPID
+LoadCredentialEncrypted={{.Credential}}
+TimeoutStartSec=5min
+WatchdogSec=60s
+Restart=on-failure
+RestartSec=15s
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// legacySystemdUnit - unit written by netclient before service definitions were marked as generated
+const legacySystemdUnit = `[Unit]
+Description=Netclient Daemon
+Documentation=https://docs.netmaker.org https://k8s.netmaker.org
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+User=root
+Type=simple
+ExecStartPre=/bin/sleep 17
+ExecStart=/sbin/netclient daemon
+Restart=on-failure
+RestartSec=15s
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// systemd - systemd service unit
+type systemd struct{}
+
+func (systemd) name() string {
+	return "systemd"
+}
+
+// systemd.detect - systemd is running if its runtime directory exists, see sd_booted(3)
+func (systemd) detect(root string) bool {
+	return isDir(root, "run/systemd/system")
+}
+
+func (systemd) render(service serviceConfig) (map[string][]byte, error) {
+	unit, err := renderTemplate("systemd", systemdTemplate, service)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{systemdUnit: unit}, nil
+}
+
+func (systemd) enable() error {
+	return runCmds("systemctl daemon-reload", "systemctl enable netclient.service")
+}
+
+func (systemd) disable() error {
+	return runCmds("systemctl disable netclient.service", "systemctl reset-failed")
+}
+
+func (systemd) start() error {
+	return runCmds("systemctl start netclient.service")
+}
+
+func (systemd) stop() error {
+	return runCmds("systemctl stop netclient.service")
+}
+
+func (systemd) restart() error {
+	return runCmds("systemctl restart netclient.service")
+}
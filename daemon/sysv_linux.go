@@ -0,0 +1,142 @@
+package daemon
+
+import (
+	"errors"
+
+	"github.com/gravitl/netmaker/logger"
+)
+
+const sysvScript = "/etc/init.d/netclient"
+
+const sysvTemplate = `#!/bin/sh
+{{.Marker}}
+### BEGIN INIT INFO
+# Provides:          netclient
+# Required-Start:    $network $remote_fs $syslog
+# Required-Stop:     $network $remote_fs $syslog
+# Default-Start:     2 3 4 5
+# Default-Stop:      0 1 6
+# Short-Description: Netclient Daemon
+### END INIT INFO
+# chkconfig: 2345 90 10
+# description: Netclient Daemon
+
+DAEMON="{{.Binary}}"
+DAEMON_ARGS="{{.Args}}"
+PIDFILE="{{.PidFile}}"
+LOGFILE="{{.LogFile}}"
+
+is_running() {
+	[ -f "$PIDFILE" ] && kill -0 "$(cat "$PIDFILE")" 2>/dev/null
+}
+
+start() {
+	if is_running; then
+		echo "netclient is already running"
+		return 0
+	fi
+	echo "starting netclient"
+	nohup "$DAEMON" $DAEMON_ARGS >>"$LOGFILE" 2>&1 &
+	echo $! >"$PIDFILE"
+}
+
+stop() {
+	if ! is_running; then
+		echo "netclient is not running"
+		rm -f "$PIDFILE"
+		return 0
+	fi
+	echo "stopping netclient"
+	kill "$(cat "$PIDFILE")"
+	i=0
+	while is_running && [ $i -lt 30 ]; do
+		sleep 1
+		i=$((i + 1))
+	done
+	if is_running; then
+		kill -9 "$(cat "$PIDFILE")"
+	fi
+	rm -f "$PIDFILE"
+}
+
+case "$1" in
+start)
+	start
+	;;
+stop)
+	stop
+	;;
+restart)
+	stop
+	start
+	;;
+reload)
+	is_running && kill -HUP "$(cat "$PIDFILE")"
+	;;
+status)
+	if is_running; then
+		echo "netclient is running"
+	else
+		echo "netclient is not running"
+		exit 3
+	fi
+	;;
+*)
+	echo "Usage: $0 {start|stop|restart|reload|status}"
+	exit 1
+	;;
+esac
+`
+
+// sysv - SysV init script, the fallback when no other init system is detected
+type sysv struct{}
+
+func (sysv) name() string {
+	return "sysv"
+}
+
+func (sysv) detect(root string) bool {
+	return isDir(root, "etc/init.d")
+}
+
+func (sysv) render(service serviceConfig) (map[string][]byte, error) {
+	script, err := renderTemplate("sysv", sysvTemplate, service)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{sysvScript: script}, nil
+}
+
+// sysv.enable - links the script into the runlevels with the tool provided by the distribution
+func (sysv) enable() error {
+	switch {
+	case hasCommand("update-rc.d"):
+		return runCmds("update-rc.d netclient defaults")
+	case hasCommand("chkconfig"):
+		return runCmds("chkconfig --add netclient")
+	}
+	logger.Log(0, "could not enable netclient at boot, add", sysvScript, "to the default runlevel")
+	return nil
+}
+
+func (sysv) disable() error {
+	switch {
+	case hasCommand("update-rc.d"):
+		return runCmds("update-rc.d -f netclient remove")
+	case hasCommand("chkconfig"):
+		return runCmds("chkconfig --del netclient")
+	}
+	return errors.New("could not disable netclient, remove it from the runlevels")
+}
+
+func (sysv) start() error {
+	return runCmds(sysvScript + " start")
+}
+
+func (sysv) stop() error {
+	return runCmds(sysvScript + " stop")
+}
+
+func (sysv) restart() error {
+	return runCmds(sysvScript + " restart")
+}
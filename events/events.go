@@ -0,0 +1,380 @@
+// Package events is the in-process event bus of the daemon
+//
+// the message handlers publish what changed as typed events and the subsystems of the daemon, the wireguard
+// interface, the proxy, dns and the firewall, subscribe to the kinds they act on. subscribers are called in the
+// order they subscribed, so a subsystem sees the effects of the ones that subscribed before it. consumers that
+// only observe, such as the gui, metrics and hooks, listen on a channel and never delay the handlers.
+package events
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravitl/netmaker/logger"
+	"github.com/gravitl/netmaker/models"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Kind - the type of an event
+type Kind string
+
+const (
+	// KindPeerAdded - a server added a peer to the host
+	KindPeerAdded Kind = "peer_added"
+	// KindPeerRemoved - a server removed a peer of the host
+	KindPeerRemoved Kind = "peer_removed"
+	// KindPeerEndpointChanged - the endpoint of a peer changed
+	KindPeerEndpointChanged Kind = "peer_endpoint_changed"
+	// KindPeersUpdated - a server sent the peers of the host, after the peer events of the update
+	KindPeersUpdated Kind = "peers_updated"
+	// KindNodeJoined - the host joined a network
+	KindNodeJoined Kind = "node_joined"
+	// KindNodeUpdated - a server updated the node of a network
+	KindNodeUpdated Kind = "node_updated"
+	// KindNodeDeleted - the node of a network was deleted
+	KindNodeDeleted Kind = "node_deleted"
+	// KindBrokerStateChanged - the state of the broker connection of a server changed
+	KindBrokerStateChanged Kind = "broker_state_changed"
+	// KindEndpointIPChanged - the public endpoint of the host changed
+	KindEndpointIPChanged Kind = "endpoint_ip_changed"
+	// KindProxyStateChanged - the proxy was switched on or off
+	KindProxyStateChanged Kind = "proxy_state_changed"
+	// KindGatewayRoleChanged - a node became or stopped being an ingress or egress gateway
+	KindGatewayRoleChanged Kind = "gateway_role_changed"
+	// KindHostUpdated - a server updated the settings of the host
+	KindHostUpdated Kind = "host_updated"
+	// KindHostDeleted - a server deleted the host, its nodes on the server are deleted before
+	KindHostDeleted Kind = "host_deleted"
+)
+
+// Event - an event published on the bus
+type Event interface {
+	Kind() Kind
+}
+
+// PeerAdded - a server added a peer to the host
+type PeerAdded struct {
+	Server     string   `json:"server"`
+	PublicKey  string   `json:"public_key"`
+	Endpoint   string   `json:"endpoint,omitempty"`
+	AllowedIPs []string `json:"allowed_ips,omitempty"`
+}
+
+// PeerRemoved - a server removed a peer of the host
+type PeerRemoved struct {
+	Server    string `json:"server"`
+	PublicKey string `json:"public_key"`
+}
+
+// PeerEndpointChanged - the endpoint of a peer changed
+type PeerEndpointChanged struct {
+	Server    string `json:"server"`
+	PublicKey string `json:"public_key"`
+	Old       string `json:"old,omitempty"`
+	New       string `json:"new,omitempty"`
+}
+
+// PeersUpdated - a server sent the peers of the host
+type PeersUpdated struct {
+	Server string `json:"server"`
+	Peers  int    `json:"peers"`
+	// Update - the update as sent by the server, not streamed to clients
+	Update *models.HostPeerUpdate `json:"-"`
+}
+
+// NodeJoined - the host joined a network
+type NodeJoined struct {
+	Network string `json:"network"`
+	Server  string `json:"server"`
+	NodeID  string `json:"node_id"`
+}
+
+// NodeUpdated - a server updated the node of a network
+type NodeUpdated struct {
+	Network          string `json:"network"`
+	Server           string `json:"server"`
+	NodeID           string `json:"node_id"`
+	InterfaceChanged bool   `json:"interface_changed"` // addresses, gateway roles, keepalive, dns or connection changed
+	KeepaliveChanged bool   `json:"keepalive_changed"`
+	DNSChanged       bool   `json:"dns_changed"`
+}
+
+// NodeDeleted - the node of a network was deleted
+type NodeDeleted struct {
+	Network string `json:"network"`
+	Server  string `json:"server"`
+	NodeID  string `json:"node_id,omitempty"`
+}
+
+// BrokerStateChanged - the state of the broker connection of a server changed
+type BrokerStateChanged struct {
+	Server string `json:"server"`
+	Broker string `json:"broker,omitempty"` // url of the broker in use, when connected
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Error  string `json:"error,omitempty"`
+}
+
+// EndpointIPChanged - the public endpoint of the host changed
+type EndpointIPChanged struct {
+	Old string `json:"old,omitempty"`
+	New string `json:"new"`
+}
+
+// ProxyStateChanged - the proxy was switched on or off
+type ProxyStateChanged struct {
+	Enabled bool `json:"enabled"`
+}
+
+// GatewayRoleChanged - a node became or stopped being an ingress or egress gateway
+type GatewayRoleChanged struct {
+	Network      string   `json:"network"`
+	Ingress      bool     `json:"ingress"`
+	Egress       bool     `json:"egress"`
+	EgressRanges []string `json:"egress_ranges,omitempty"`
+}
+
+// HostUpdated - a server updated the settings of the host
+type HostUpdated struct {
+	Server       string `json:"server"`
+	PortsChanged bool   `json:"ports_changed"` // listen or proxy listen port changed, the daemon is restarted
+	MTUChanged   bool   `json:"mtu_changed"`
+}
+
+// HostDeleted - a server deleted the host
+type HostDeleted struct {
+	Server string `json:"server"`
+}
+
+func (PeerAdded) Kind() Kind           { return KindPeerAdded }
+func (PeerRemoved) Kind() Kind         { return KindPeerRemoved }
+func (PeerEndpointChanged) Kind() Kind { return KindPeerEndpointChanged }
+func (PeersUpdated) Kind() Kind        { return KindPeersUpdated }
+func (NodeJoined) Kind() Kind          { return KindNodeJoined }
+func (NodeUpdated) Kind() Kind         { return KindNodeUpdated }
+func (NodeDeleted) Kind() Kind         { return KindNodeDeleted }
+func (BrokerStateChanged) Kind() Kind  { return KindBrokerStateChanged }
+func (EndpointIPChanged) Kind() Kind   { return KindEndpointIPChanged }
+func (ProxyStateChanged) Kind() Kind   { return KindProxyStateChanged }
+func (GatewayRoleChanged) Kind() Kind  { return KindGatewayRoleChanged }
+func (HostUpdated) Kind() Kind         { return KindHostUpdated }
+func (HostDeleted) Kind() Kind         { return KindHostDeleted }
+
+// Record - an event with its kind and the time it was published, as streamed to clients of the daemon
+type Record struct {
+	Time  time.Time `json:"time"`
+	Kind  Kind      `json:"kind"`
+	Event Event     `json:"event"`
+}
+
+// Handler - handles an event delivered to a subscriber
+type Handler func(Event)
+
+// subscriber - a subsystem called for each event, or a listener receiving events on a channel
+type subscriber struct {
+	name    string
+	kinds   map[Kind]bool // nil for all kinds
+	handler Handler
+	ch      chan Record
+}
+
+// Bus - delivers published events to subscribers and listeners
+type Bus struct {
+	mutex       sync.RWMutex
+	subscribers []*subscriber
+	dropped     atomic.Uint64 // events not delivered to a listener with a full channel
+}
+
+// New - creates an event bus
+func New() *Bus {
+	return &Bus{}
+}
+
+// newSubscriber - a subscriber to events of the given kinds, or of all kinds if none are given
+func newSubscriber(name string, kinds []Kind) *subscriber {
+	s := &subscriber{name: name}
+	if len(kinds) > 0 {
+		s.kinds = make(map[Kind]bool, len(kinds))
+		for _, kind := range kinds {
+			s.kinds[kind] = true
+		}
+	}
+	return s
+}
+
+// subscriber.wants - checks if the subscriber receives events of a kind
+func (s *subscriber) wants(kind Kind) bool {
+	return s.kinds == nil || s.kinds[kind]
+}
+
+// Bus.add - adds a subscriber and returns the function removing it
+func (b *Bus) add(s *subscriber) func() {
+	b.mutex.Lock()
+	b.subscribers = append(b.subscribers, s)
+	b.mutex.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mutex.Lock()
+			defer b.mutex.Unlock()
+			for i := range b.subscribers {
+				if b.subscribers[i] == s {
+					b.subscribers = append(b.subscribers[:i:i], b.subscribers[i+1:]...)
+					break
+				}
+			}
+			if s.ch != nil {
+				close(s.ch)
+			}
+		})
+	}
+}
+
+// Bus.Subscribe - calls handler with each published event of the given kinds, or of all kinds if none are given,
+// and returns the function to unsubscribe
+// handlers are called by the publishing goroutine in the order they subscribed, so they should not block for long
+func (b *Bus) Subscribe(name string, handler Handler, kinds ...Kind) func() {
+	s := newSubscriber(name, kinds)
+	s.handler = handler
+	return b.add(s)
+}
+
+// Bus.Listen - returns a channel receiving the published events of the given kinds, or of all kinds if none are
+// given, and the function to stop listening, which closes the channel
+// events are dropped rather than delaying the publisher when the channel is full
+func (b *Bus) Listen(size int, kinds ...Kind) (<-chan Record, func()) {
+	s := newSubscriber("listener", kinds)
+	s.ch = make(chan Record, size)
+	return s.ch, b.add(s)
+}
+
+// Bus.Publish - delivers events in order to the subscribers and listeners of their kinds
+func (b *Bus) Publish(events ...Event) {
+	b.mutex.RLock()
+	subscribers := append([]*subscriber{}, b.subscribers...)
+	b.mutex.RUnlock()
+	for _, event := range events {
+		record := Record{Time: time.Now(), Kind: event.Kind(), Event: event}
+		for _, s := range subscribers {
+			if !s.wants(record.Kind) {
+				continue
+			}
+			if s.handler != nil {
+				s.call(event)
+				continue
+			}
+			b.send(s, record)
+		}
+	}
+}
+
+// subscriber.call - calls the handler of a subscriber, a panic is logged rather than stopping the publisher
+func (s *subscriber) call(event Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Log(0, "event subscriber", s.name, "failed to handle", string(event.Kind()), "event:", fmt.Sprint(r))
+		}
+	}()
+	s.handler(event)
+}
+
+// Bus.send - sends a record to a listener unless its channel is full or it stopped listening
+func (b *Bus) send(s *subscriber, record Record) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for _, current := range b.subscribers {
+		if current != s {
+			continue
+		}
+		select {
+		case s.ch <- record:
+		default:
+			b.dropped.Add(1)
+		}
+		return
+	}
+}
+
+// Bus.Dropped - number of events not delivered to listeners that were not keeping up
+func (b *Bus) Dropped() uint64 {
+	return b.dropped.Load()
+}
+
+// PeerChanges - the peers added, removed and with a changed endpoint between two peer lists of a server,
+// ordered by public key
+func PeerChanges(server string, old, next []wgtypes.PeerConfig) []Event {
+	oldPeers := make(map[wgtypes.Key]wgtypes.PeerConfig, len(old))
+	for _, peer := range old {
+		oldPeers[peer.PublicKey] = peer
+	}
+	nextPeers := make(map[wgtypes.Key]wgtypes.PeerConfig, len(next))
+	for _, peer := range next {
+		nextPeers[peer.PublicKey] = peer
+	}
+	var added, removed, changed []Event
+	for key, peer := range nextPeers {
+		oldPeer, ok := oldPeers[key]
+		if !ok {
+			added = append(added, PeerAdded{
+				Server:     server,
+				PublicKey:  key.String(),
+				Endpoint:   endpoint(peer.Endpoint),
+				AllowedIPs: allowedIPs(peer.AllowedIPs),
+			})
+			continue
+		}
+		if endpoint(oldPeer.Endpoint) != endpoint(peer.Endpoint) {
+			changed = append(changed, PeerEndpointChanged{
+				Server:    server,
+				PublicKey: key.String(),
+				Old:       endpoint(oldPeer.Endpoint),
+				New:       endpoint(peer.Endpoint),
+			})
+		}
+	}
+	for key := range oldPeers {
+		if _, ok := nextPeers[key]; !ok {
+			removed = append(removed, PeerRemoved{Server: server, PublicKey: key.String()})
+		}
+	}
+	var changes []Event
+	for _, events := range [][]Event{removed, added, changed} {
+		sort.Slice(events, func(i, j int) bool { return peerKey(events[i]) < peerKey(events[j]) })
+		changes = append(changes, events...)
+	}
+	return changes
+}
+
+// peerKey - the public key of the peer of a peer event
+func peerKey(event Event) string {
+	switch e := event.(type) {
+	case PeerAdded:
+		return e.PublicKey
+	case PeerRemoved:
+		return e.PublicKey
+	case PeerEndpointChanged:
+		return e.PublicKey
+	}
+	return ""
+}
+
+// endpoint - the endpoint of a peer as text, empty if it has none
+func endpoint(addr *net.UDPAddr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// allowedIPs - the allowed ips of a peer as text
+func allowedIPs(ranges []net.IPNet) []string {
+	ips := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		ips = append(ips, r.String())
+	}
+	return ips
+}
@@ -0,0 +1,67 @@
+package events
+
+import (
+	"net"
+	"testing"
+
+	"github.com/matryer/is"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestSubscribe(t *testing.T) {
+	is := is.New(t)
+	bus := New()
+	var calls []string
+	bus.Subscribe("first", func(e Event) { calls = append(calls, "first "+string(e.Kind())) })
+	unsubscribe := bus.Subscribe("second", func(e Event) { calls = append(calls, "second "+string(e.Kind())) },
+		KindNodeJoined)
+	bus.Subscribe("failing", func(e Event) { panic("failed") })
+	bus.Publish(NodeJoined{Network: "net1"}, NodeDeleted{Network: "net1"})
+	// called in the order subscribed, for the kinds subscribed to, after a subscriber panicked
+	is.Equal(calls, []string{"first node_joined", "second node_joined", "first node_deleted"})
+
+	calls = nil
+	unsubscribe()
+	unsubscribe()
+	bus.Publish(NodeJoined{Network: "net1"})
+	is.Equal(calls, []string{"first node_joined"})
+}
+
+func TestListen(t *testing.T) {
+	is := is.New(t)
+	bus := New()
+	records, stop := bus.Listen(1, KindProxyStateChanged)
+	bus.Publish(NodeJoined{}, ProxyStateChanged{Enabled: true}, ProxyStateChanged{Enabled: false})
+	record := <-records
+	is.Equal(record.Kind, KindProxyStateChanged)
+	is.Equal(record.Event, ProxyStateChanged{Enabled: true})
+	is.True(!record.Time.IsZero())
+	is.Equal(bus.Dropped(), uint64(1)) // channel full
+	stop()
+	_, ok := <-records
+	is.True(!ok) // closed
+	bus.Publish(ProxyStateChanged{})
+}
+
+func TestPeerChanges(t *testing.T) {
+	is := is.New(t)
+	peer := func(seed byte, endpoint string) wgtypes.PeerConfig {
+		p := wgtypes.PeerConfig{PublicKey: wgtypes.Key{seed}}
+		if endpoint != "" {
+			p.Endpoint, _ = net.ResolveUDPAddr("udp", endpoint)
+		}
+		p.AllowedIPs = []net.IPNet{{IP: net.IPv4(10, 0, 0, seed), Mask: net.CIDRMask(32, 32)}}
+		return p
+	}
+	old := []wgtypes.PeerConfig{peer(1, "203.0.113.1:51821"), peer(2, "203.0.113.2:51821"), peer(3, "")}
+	next := []wgtypes.PeerConfig{peer(2, "203.0.113.20:51821"), peer(3, ""), peer(4, "203.0.113.4:51821")}
+	changes := PeerChanges("server1", old, next)
+	is.Equal(changes, []Event{
+		PeerRemoved{Server: "server1", PublicKey: wgtypes.Key{1}.String()},
+		PeerAdded{Server: "server1", PublicKey: wgtypes.Key{4}.String(), Endpoint: "203.0.113.4:51821",
+			AllowedIPs: []string{"10.0.0.4/32"}},
+		PeerEndpointChanged{Server: "server1", PublicKey: wgtypes.Key{2}.String(),
+			Old: "203.0.113.2:51821", New: "203.0.113.20:51821"},
+	})
+	is.Equal(len(PeerChanges("server1", next, next)), 0)
+}
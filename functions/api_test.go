@@ -0,0 +1,439 @@
+package functions
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gravitl/netclient/apitest"
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/lock"
+	"github.com/gravitl/netclient/wireguard"
+	"github.com/gravitl/netmaker/models"
+	"github.com/matryer/is"
+	"github.com/spf13/viper"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gopkg.in/yaml.v3"
+)
+
+// startTestAPI - writes the config of a host without nodes and starts a fake api server with network net1
+func startTestAPI(t *testing.T) *apitest.Server {
+	is := is.New(t)
+	t.Setenv(config.ConfigDirEnv, t.TempDir())
+	t.Setenv(lock.RuntimeDirEnv, t.TempDir())
+	restoreGlobals(t)
+	restartDaemon = func() error { return nil }
+	api := apitest.NewServer()
+	t.Cleanup(api.Close)
+	api.AddNetwork("net1", "10.10.0.0/24")
+
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	is.NoErr(err)
+	host := config.Config{
+		PrivateKey: privateKey,
+		HostPeers:  make(map[string][]wgtypes.PeerConfig),
+		PeerIDs:    make(map[string]models.HostPeerMap),
+	}
+	host.ID = uuid.New()
+	host.Name = "host1"
+	host.ListenPort = 51821
+	host.MTU = 1420
+	host.HostPass = "hostpass"
+	config.Replace(&config.State{Host: host, Nodes: make(config.NodeMap), Servers: make(map[string]config.Server)})
+	is.NoErr(config.WriteNetclientConfig())
+	is.NoErr(wireguard.WriteWgConfig(config.Netclient(), config.GetNodes()))
+	return api
+}
+
+// addTestNode - registers the host and a node in network with the api server and adds them to the config
+func addTestNode(api *apitest.Server, network string) config.Node {
+	host := config.Netclient()
+	var node config.Node
+	node.ID = uuid.New()
+	node.HostID = host.ID
+	node.Network = network
+	node.Address = net.IPNet{IP: net.ParseIP("10.10.0.5"), Mask: net.CIDRMask(24, 32)}
+	node.Connected = true
+	var serverConfig models.ServerConfig
+	api.Update(func(state *apitest.State) {
+		state.Hosts[host.ID] = models.Host{ID: host.ID, Name: host.Name, HostPass: host.HostPass}
+		node.Server = state.ServerConfig.Server
+		state.Nodes[node.ID] = models.Node{CommonNode: node.CommonNode}
+		serverConfig = state.ServerConfig
+	})
+	config.UpdateServerConfig(&serverConfig)
+	server := config.GetServer(serverConfig.Server)
+	server.Nodes[network] = true
+	config.UpdateServer(server.Name, *server)
+	config.UpdateNodeMap(network, node)
+	return node
+}
+
+// testPeer - a peer sent by the api server
+func testPeer(t *testing.T) wgtypes.PeerConfig {
+	is := is.New(t)
+	key, err := wgtypes.GeneratePrivateKey()
+	is.NoErr(err)
+	return wgtypes.PeerConfig{
+		PublicKey:  key.PublicKey(),
+		Endpoint:   &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51821},
+		AllowedIPs: []net.IPNet{{IP: net.ParseIP("10.10.0.7"), Mask: net.CIDRMask(32, 32)}},
+	}
+}
+
+// testJoinFlags - flags of a join of net1 at the api server
+func testJoinFlags(api *apitest.Server) *viper.Viper {
+	flags := viper.New()
+	flags.Set("network", "net1")
+	flags.Set("server", "netmaker.test")
+	flags.Set("apiconn", api.URL)
+	flags.Set("accesskey", "joinkey")
+	flags.Set("name", "host1")
+	return flags
+}
+
+func TestAuthenticate(t *testing.T) {
+	api := startTestAPI(t)
+	addTestNode(api, "net1")
+	t.Run("valid", func(t *testing.T) {
+		is := is.New(t)
+		token, err := Authenticate(api.URL, config.Netclient())
+		is.NoErr(err)
+		is.True(token != "")
+		requests := api.RequestsOf(apitest.RouteAuthenticate)
+		var params models.AuthParams
+		is.NoErr(requests[len(requests)-1].Decode(&params))
+		is.Equal(params.ID, config.Netclient().ID.String())
+		is.Equal(params.Password, "hostpass")
+	})
+	t.Run("wrong password", func(t *testing.T) {
+		is := is.New(t)
+		host := *config.Netclient()
+		host.HostPass = "wrong"
+		_, err := Authenticate(api.URL, &host)
+		is.True(err != nil)
+		is.True(strings.Contains(err.Error(), "401"))
+	})
+	t.Run("server error", func(t *testing.T) {
+		is := is.New(t)
+		api.RespondError(apitest.RouteAuthenticate, http.StatusInternalServerError, "database unavailable")
+		_, err := Authenticate(api.URL, config.Netclient())
+		is.True(err != nil)
+		is.True(strings.Contains(err.Error(), "database unavailable"))
+	})
+	t.Run("unreachable", func(t *testing.T) {
+		is := is.New(t)
+		_, err := Authenticate("http://127.0.0.1:1", config.Netclient())
+		is.True(err != nil)
+	})
+}
+
+func TestJoinNetwork(t *testing.T) {
+	t.Run("join", func(t *testing.T) {
+		is := is.New(t)
+		api := startTestAPI(t)
+		peer := testPeer(t)
+		api.Update(func(state *apitest.State) {
+			state.AccessKey = "joinkey"
+			state.Peers = []wgtypes.PeerConfig{peer}
+		})
+		node, server, err := JoinNetwork(testJoinFlags(api))
+		is.NoErr(err)
+		// the endpoint is retrieved from the api server
+		is.Equal(config.Netclient().EndpointIP.String(), "203.0.113.10")
+		is.Equal(len(api.RequestsOf(apitest.RouteGetIP)), 1)
+
+		requests := api.RequestsOf(apitest.RouteJoin)
+		is.Equal(len(requests), 1)
+		is.Equal(requests[0].Path, "/api/nodes/net1")
+		is.Equal(requests[0].Header.Get("Authorization"), "Bearer joinkey")
+		is.Equal(requests[0].Header.Get("requestfrom"), "node")
+		var joinData models.JoinData
+		is.NoErr(requests[0].Decode(&joinData))
+		is.Equal(joinData.Host.ID, config.Netclient().ID)
+		is.Equal(joinData.Node.Network, "net1")
+
+		serverNode, ok := api.Node(node.ID)
+		is.True(ok) // node created on the server
+		is.Equal(node.Address.String(), serverNode.Address.String())
+		is.Equal(node.Network, "net1")
+		is.True(node.Connected)
+		is.Equal(server.Name, "netmaker.test")
+		is.Equal(server.API, api.URL)
+		is.True(server.Nodes["net1"])
+		is.Equal(len(config.Netclient().HostPeers[server.Name]), 1)
+		wgConf, err := os.ReadFile(config.GetNetclientPath() + "netmaker.conf")
+		is.NoErr(err)
+		is.True(strings.Contains(string(wgConf), peer.PublicKey.String()))
+	})
+	t.Run("invalid access key", func(t *testing.T) {
+		is := is.New(t)
+		api := startTestAPI(t)
+		api.Update(func(state *apitest.State) { state.AccessKey = "otherkey" })
+		flags := testJoinFlags(api)
+		flags.Set("endpoint", "203.0.113.20")
+		_, _, err := JoinNetwork(flags)
+		is.True(err != nil)
+		is.Equal(len(api.RequestsOf(apitest.RouteGetIP)), 0) // endpoint provided
+		is.Equal(config.GetServer("netmaker.test"), nil)     // server not added
+	})
+	t.Run("no such network", func(t *testing.T) {
+		is := is.New(t)
+		api := startTestAPI(t)
+		flags := testJoinFlags(api)
+		flags.Set("network", "net2")
+		flags.Set("endpoint", "203.0.113.20")
+		_, _, err := JoinNetwork(flags)
+		is.True(err != nil)
+		is.Equal(len(api.RequestsOf(apitest.RouteJoin)), 1)
+	})
+	t.Run("incompatible server", func(t *testing.T) {
+		is := is.New(t)
+		api := startTestAPI(t)
+		api.Update(func(state *apitest.State) { state.ServerConfig.Version = "v0.17.1" })
+		flags := testJoinFlags(api)
+		flags.Set("endpoint", "203.0.113.20")
+		_, _, err := JoinNetwork(flags)
+		is.True(err != nil)
+		is.Equal(err.Error(), "incompatible server version")
+	})
+	t.Run("already joined", func(t *testing.T) {
+		is := is.New(t)
+		api := startTestAPI(t)
+		addTestNode(api, "net1")
+		_, _, err := JoinNetwork(testJoinFlags(api))
+		is.True(err != nil)
+		is.Equal(len(api.Requests()), 0)
+	})
+}
+
+func TestPull(t *testing.T) {
+	t.Run("pull", func(t *testing.T) {
+		is := is.New(t)
+		api := startTestAPI(t)
+		node := addTestNode(api, "net1")
+		peer := testPeer(t)
+		api.Update(func(state *apitest.State) { state.Peers = []wgtypes.PeerConfig{peer} })
+		pulled, err := pull("net1")
+		is.NoErr(err)
+		is.Equal(pulled.ID, node.ID)
+		is.Equal(pulled.Server, node.Server)
+		is.Equal(pulled.Address.String(), "10.10.0.5/24")
+		is.Equal(pulled.NetworkRange.String(), "10.10.0.0/24")
+		requests := api.RequestsOf(apitest.RouteGetNode)
+		is.Equal(len(requests), 1)
+		is.Equal(requests[0].Path, "/api/nodes/net1/"+node.ID.String())
+
+		// saved to the config files
+		is.NoErr(config.ReadNodeConfig())
+		is.Equal(config.GetNode("net1").ID, node.ID)
+		host, err := config.ReadNetclientConfig()
+		is.NoErr(err)
+		is.Equal(len(host.HostPeers[node.Server]), 1)
+		is.Equal(host.HostPeers[node.Server][0].PublicKey, peer.PublicKey)
+	})
+	t.Run("no such network", func(t *testing.T) {
+		is := is.New(t)
+		api := startTestAPI(t)
+		_, err := pull("net1")
+		is.True(err != nil)
+		is.Equal(len(api.Requests()), 0)
+	})
+	t.Run("node deleted on server", func(t *testing.T) {
+		is := is.New(t)
+		api := startTestAPI(t)
+		node := addTestNode(api, "net1")
+		api.Update(func(state *apitest.State) { delete(state.Nodes, node.ID) })
+		_, err := pull("net1")
+		is.True(err != nil)
+		is.Equal(len(api.RequestsOf(apitest.RouteGetNode)), 1)
+		is.Equal(config.GetNode("net1").ID, node.ID) // local node unchanged
+	})
+	t.Run("authentication failed", func(t *testing.T) {
+		is := is.New(t)
+		api := startTestAPI(t)
+		addTestNode(api, "net1")
+		api.RespondError(apitest.RouteAuthenticate, http.StatusUnauthorized, "incorrect credentials")
+		_, err := pull("net1")
+		is.True(err != nil)
+		is.Equal(len(api.RequestsOf(apitest.RouteGetNode)), 0)
+	})
+}
+
+func TestGetNodePeers(t *testing.T) {
+	is := is.New(t)
+	api := startTestAPI(t)
+	node := addTestNode(api, "net1")
+	peer := testPeer(t)
+	api.Update(func(state *apitest.State) { state.Peers = []wgtypes.PeerConfig{peer} })
+	peers, err := GetNodePeers(node)
+	is.NoErr(err)
+	is.Equal(len(peers), 1)
+	is.Equal(peers[0].PublicKey, peer.PublicKey)
+	is.Equal(peers[0].Endpoint.String(), "203.0.113.7:51821")
+
+	api.RespondError(apitest.RouteGetNode, http.StatusInternalServerError, "database unavailable")
+	_, err = GetNodePeers(node)
+	is.True(err != nil)
+}
+
+func TestDeleteNodeFromServer(t *testing.T) {
+	is := is.New(t)
+	api := startTestAPI(t)
+	node := addTestNode(api, "net1")
+	is.NoErr(deleteNodeFromServer(&node))
+	_, ok := api.Node(node.ID)
+	is.True(!ok) // node deleted on the server
+	requests := api.RequestsOf(apitest.RouteDeleteNode)
+	is.Equal(len(requests), 1)
+	is.Equal(requests[0].Path, "/api/nodes/net1/"+node.ID.String())
+	is.Equal(requests[0].Header.Get("requestfrom"), "node")
+
+	// the node no longer exists
+	err := deleteNodeFromServer(&node)
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "404"))
+
+	api.RespondError(apitest.RouteAuthenticate, http.StatusUnauthorized, "incorrect credentials")
+	err = deleteNodeFromServer(&node)
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "unable to authenticate"))
+}
+
+func TestLeaveNetwork(t *testing.T) {
+	is := is.New(t)
+	api := startTestAPI(t)
+	api.AddNetwork("net2", "10.20.0.0/24")
+	node1 := addTestNode(api, "net1")
+	node2 := addTestNode(api, "net2")
+	config.UpdateHostPeers("netmaker.test", []wgtypes.PeerConfig{testPeer(t)})
+
+	// leaving one of the networks of a server keeps the server and its peers
+	_, err := LeaveNetwork("net1", false)
+	is.NoErr(err)
+	_, ok := api.Node(node1.ID)
+	is.True(!ok) // node deleted on the server
+	is.NoErr(config.ReadNodeConfig())
+	is.NoErr(config.ReadServerConf())
+	_, ok = config.GetNodes()["net1"]
+	is.True(!ok)
+	server := config.GetServer("netmaker.test")
+	is.Equal(server.Nodes, map[string]bool{"net2": true}) // saved without the network that was left
+	is.Equal(len(config.Netclient().HostPeers["netmaker.test"]), 1)
+
+	// leaving the last network of the server removes its peers
+	_, err = LeaveNetwork("net2", false)
+	is.NoErr(err)
+	_, ok = api.Node(node2.ID)
+	is.True(!ok)
+	is.NoErr(config.ReadServerConf())
+	is.Equal(len(config.GetServer("netmaker.test").Nodes), 0)
+	is.Equal(len(config.GetNodes()), 0)
+	_, ok = config.Netclient().HostPeers["netmaker.test"]
+	is.True(!ok)
+	_, err = os.Stat(config.GetNetclientPath() + "netmaker.conf")
+	is.True(os.IsNotExist(err)) // wireguard config removed with the last network
+
+	_, err = LeaveNetwork("net2", false)
+	is.True(err != nil) // not a member of the network
+}
+
+// writeLegacyConfig - writes the config of a pre v0.18.0 netclient with a node in network
+func writeLegacyConfig(t *testing.T, api *apitest.Server, network, legacyID string) {
+	is := is.New(t)
+	is.NoErr(os.MkdirAll(legacyConfigPath(), 0700))
+	var cfg config.ClientConfig
+	api.Update(func(state *apitest.State) { cfg.Server = state.ServerConfig })
+	cfg.Network = network
+	cfg.Node = models.LegacyNode{ID: legacyID, Network: network, Address: "10.10.0.9", Connected: "yes"}
+	data, err := yaml.Marshal(&cfg)
+	is.NoErr(err)
+	is.NoErr(os.WriteFile(legacyConfigPath()+"/netconfig-"+network, data, 0600))
+	is.NoErr(os.WriteFile(legacyConfigPath()+"/secret-"+network, []byte("legacypass"), 0600))
+}
+
+func TestMigrate(t *testing.T) {
+	t.Run("migrate", func(t *testing.T) {
+		is := is.New(t)
+		api := startTestAPI(t)
+		stopped := false
+		stopDaemon = func() error {
+			stopped = true
+			return nil
+		}
+		legacyID := uuid.NewString()
+		writeLegacyConfig(t, api, "net1", legacyID)
+		// the conversion is the first step of the migration registry
+		plans, err := config.MigrateConfig(true)
+		is.NoErr(err)
+		is.Equal(len(plans), 1)
+		is.Equal(plans[0].File, config.LegacyDir+string(filepath.Separator))
+		is.Equal(plans[0].From, 0)
+		is.Equal(plans[0].To, 1)
+		is.True(!stopped)
+		is.Equal(len(api.RequestsOf(apitest.RouteMigrate)), 0) // nothing is done by a dry run
+
+		plans, err = config.MigrateConfig(false)
+		is.NoErr(err)
+		is.Equal(len(plans), 1)
+		is.True(stopped)
+		backups, err := filepath.Glob(filepath.Join(config.GetNetclientPath(), "backup", "migration-*", config.LegacyDir, "secret-net1"))
+		is.NoErr(err)
+		is.Equal(len(backups), 1) // the old config is backed up
+		requests := api.RequestsOf(apitest.RouteMigrate)
+		is.Equal(len(requests), 1)
+		is.Equal(requests[0].Path, "/api/nodes/net1/"+legacyID+"/migrate")
+		var data models.MigrationData
+		is.NoErr(requests[0].Decode(&data))
+		is.Equal(data.LegacyNodeID, legacyID)
+		is.Equal(data.Password, "legacypass")
+		is.Equal(data.JoinData.Host.ID, config.Netclient().ID)
+
+		// the node created by the server is saved
+		is.NoErr(config.ReadNodeConfig())
+		node := config.GetNode("net1")
+		serverNode, ok := api.Node(node.ID)
+		is.True(ok)
+		is.Equal(node.Address.String(), serverNode.Address.String())
+		is.NoErr(config.ReadServerConf())
+		server := config.GetServer(node.Server)
+		is.True(server != nil)
+		is.True(server.Nodes["net1"])
+		_, err = os.Stat(legacyConfigPath())
+		is.True(os.IsNotExist(err)) // legacy config removed
+		// the step only runs once
+		plans, err = config.MigrateConfig(false)
+		is.NoErr(err)
+		is.Equal(len(plans), 0)
+		is.Equal(len(api.RequestsOf(apitest.RouteMigrate)), 1)
+	})
+	t.Run("rejected", func(t *testing.T) {
+		is := is.New(t)
+		api := startTestAPI(t)
+		stopDaemon = func() error { return nil }
+		writeLegacyConfig(t, api, "net1", uuid.NewString())
+		api.RespondError(apitest.RouteMigrate, http.StatusUnauthorized, "invalid legacy node credentials")
+		is.NoErr(migrateLegacy())
+		is.Equal(len(api.RequestsOf(apitest.RouteMigrate)), 1)
+		_, ok := config.GetNodes()["net1"]
+		is.True(!ok)
+		is.Equal(len(config.GetServers()), 0)
+	})
+	t.Run("nothing to migrate", func(t *testing.T) {
+		is := is.New(t)
+		api := startTestAPI(t)
+		stopDaemon = func() error {
+			t.Fatal("daemon stopped")
+			return nil
+		}
+		is.NoErr(migrateLegacy())
+		plans, err := config.MigrateConfig(true)
+		is.NoErr(err)
+		is.Equal(len(plans), 0)
+		is.Equal(len(api.Requests()), 0)
+	})
+}
@@ -0,0 +1,397 @@
+package functions
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/ncutils"
+	"github.com/gravitl/netmaker/logger"
+	"github.com/gravitl/netmaker/models"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// DesiredState - declarative configuration of a host, converged by netclient apply
+type DesiredState struct {
+	Host    HostSettings    `yaml:"host"`
+	Servers []DesiredServer `yaml:"servers"`
+}
+
+// DesiredServer - a netmaker server and the networks the host should be a member of
+type DesiredServer struct {
+	Name     string           `yaml:"name"`
+	Networks []DesiredNetwork `yaml:"networks"`
+}
+
+// DesiredNetwork - a network and the enrollment token used to join it
+type DesiredNetwork struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+}
+
+// HostSettings - host settings managed by netclient apply; settings that are not set are left unchanged
+type HostSettings struct {
+	Name       string `yaml:"name,omitempty" json:"name,omitempty"`
+	MTU        int    `yaml:"mtu,omitempty" json:"mtu,omitempty"`
+	ListenPort int    `yaml:"listenport,omitempty" json:"listenport,omitempty"`
+	Endpoint   string `yaml:"endpoint,omitempty" json:"endpoint,omitempty"` // static endpoint
+	Proxy      *bool  `yaml:"proxy,omitempty" json:"proxy,omitempty"`
+}
+
+// applyPlan - changes required to converge the host to the desired state
+type applyPlan struct {
+	Host   []string // descriptions of host setting changes
+	Leave  []*config.Node
+	Join   []joinAction
+	Errors []error // desired networks that can not be joined
+}
+
+// joinAction - a network to be joined
+type joinAction struct {
+	Network string
+	Server  string
+	Token   string
+}
+
+// Apply - converges the host to the desired state in file: joins missing networks,
+// leaves networks that are not listed and updates host settings
+// the plan is always displayed; with dryRun no changes are made
+func Apply(file string, dryRun bool) error {
+	state, err := ReadDesiredState(file)
+	if err != nil {
+		return err
+	}
+	plan := planApply(state)
+	printPlan(plan)
+	if dryRun {
+		fmt.Println("dry run, no changes made")
+		return applyError(plan.Errors)
+	}
+	faults := plan.Errors
+	if len(plan.Host) > 0 {
+		if err := updateHostSettings(&state.Host); err != nil {
+			faults = append(faults, fmt.Errorf("failed to update host settings %w", err))
+		}
+	}
+	for _, node := range plan.Leave {
+		if _, err := LeaveNetwork(node.Network, false); err != nil {
+			faults = append(faults, fmt.Errorf("failed to leave %s %w", node.Network, err))
+		}
+	}
+	for _, join := range plan.Join {
+		if err := Join(joinFlags(join, &state.Host)); err != nil {
+			faults = append(faults, fmt.Errorf("failed to join %s %w", join.Network, err))
+		}
+	}
+	return applyError(faults)
+}
+
+// applyError - logs the faults encountered and returns an error if there were any
+func applyError(faults []error) error {
+	if len(faults) == 0 {
+		return nil
+	}
+	for _, fault := range faults {
+		logger.Log(0, fault.Error())
+	}
+	return fmt.Errorf("%d error(s) applying desired state", len(faults))
+}
+
+// ReadDesiredState - reads and validates a desired state file
+func ReadDesiredState(file string) (*DesiredState, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var state DesiredState
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&state); err != nil {
+		return nil, fmt.Errorf("invalid desired state file %s %w", file, err)
+	}
+	if err := state.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid desired state file %s %w", file, err)
+	}
+	return &state, nil
+}
+
+// DesiredState.Validate - checks the desired state is consistent
+func (state *DesiredState) Validate() error {
+	if err := state.Host.Validate(); err != nil {
+		return err
+	}
+	networks := make(map[string]struct{})
+	for _, server := range state.Servers {
+		if server.Name == "" {
+			return errors.New("server name is required")
+		}
+		for _, network := range server.Networks {
+			if network.Name == "" {
+				return fmt.Errorf("network name is required for server %s", server.Name)
+			}
+			if _, ok := networks[network.Name]; ok {
+				return fmt.Errorf("network %s is listed more than once", network.Name)
+			}
+			networks[network.Name] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// HostSettings.Validate - checks the host settings are valid
+func (settings *HostSettings) Validate() error {
+	if settings.Name != "" && config.FormatName(settings.Name) != settings.Name {
+		return fmt.Errorf("invalid host name %s", settings.Name)
+	}
+	if settings.MTU != 0 && (settings.MTU < 576 || settings.MTU > 9000) {
+		return fmt.Errorf("invalid mtu %d", settings.MTU)
+	}
+	if settings.ListenPort < 0 || settings.ListenPort > 65535 {
+		return fmt.Errorf("invalid listen port %d", settings.ListenPort)
+	}
+	if settings.Endpoint != "" && net.ParseIP(settings.Endpoint) == nil {
+		return fmt.Errorf("invalid endpoint %s, must be an ip address", settings.Endpoint)
+	}
+	return nil
+}
+
+// planApply - diffs the desired state against the current config
+func planApply(state *DesiredState) applyPlan {
+	plan := applyPlan{
+		Host: hostChanges(&state.Host),
+	}
+	desired := make(map[string]string) // server indexed by network
+	for _, server := range state.Servers {
+		for _, network := range server.Networks {
+			desired[network.Name] = server.Name
+		}
+		name := resolveServer(&server)
+		if name == "" && !hasTokens(&server) {
+			plan.Errors = append(plan.Errors, fmt.Errorf("server %s is not configured and no tokens are given to join it", server.Name))
+			continue
+		}
+		if name != "" && name != server.Name {
+			logger.Log(0, "server", server.Name, "of the desired state is configured as", name)
+		}
+		for _, network := range server.Networks {
+			node, joined := config.GetNodes()[network.Name]
+			if joined && node.Server == name {
+				continue
+			}
+			if network.Token == "" {
+				plan.Errors = append(plan.Errors, fmt.Errorf("no token to join network %s", network.Name))
+				continue
+			}
+			accessToken, err := config.ParseAccessToken(network.Token)
+			if err != nil {
+				plan.Errors = append(plan.Errors, fmt.Errorf("invalid token for network %s %w", network.Name, err))
+				continue
+			}
+			if accessToken.ClientConfig.Network != network.Name {
+				plan.Errors = append(plan.Errors, fmt.Errorf("token for network %s is for network %s", network.Name, accessToken.ClientConfig.Network))
+				continue
+			}
+			if joined {
+				if serverByAPI(accessToken.APIConnString) == node.Server {
+					// the token is for the server the host is a member of, under another name
+					logger.Log(0, "network", network.Name, "is joined on server", node.Server, "not", server.Name, "keeping it")
+					continue
+				}
+				// member of the network on another server, leave before joining
+				node := node
+				plan.Leave = append(plan.Leave, &node)
+			}
+			plan.Join = append(plan.Join, joinAction{Network: network.Name, Server: server.Name, Token: network.Token})
+		}
+	}
+	for network, node := range config.GetNodes() {
+		if _, ok := desired[network]; !ok {
+			node := node
+			plan.Leave = append(plan.Leave, &node)
+		}
+	}
+	sort.Slice(plan.Leave, func(i, j int) bool { return plan.Leave[i].Network < plan.Leave[j].Network })
+	sort.Slice(plan.Join, func(i, j int) bool { return plan.Join[i].Network < plan.Join[j].Network })
+	return plan
+}
+
+// resolveServer - the name of the configured server a desired server refers to, matched by name or else by
+// the api address in the tokens of its networks; empty if the server is not configured
+func resolveServer(server *DesiredServer) string {
+	if config.GetServer(server.Name) != nil {
+		return server.Name
+	}
+	for _, network := range server.Networks {
+		if network.Token == "" {
+			continue
+		}
+		accessToken, err := config.ParseAccessToken(network.Token)
+		if err != nil {
+			continue
+		}
+		if name := serverByAPI(accessToken.APIConnString); name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// hasTokens - checks if a token is given for any network of a desired server
+func hasTokens(server *DesiredServer) bool {
+	for _, network := range server.Networks {
+		if network.Token != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// serverByAPI - the name of the configured server with the api address, empty if there is none
+func serverByAPI(api string) string {
+	for name, server := range config.GetServerMap() {
+		if sameAPI(server.API, api) {
+			return name
+		}
+	}
+	return ""
+}
+
+// sameAPI - checks if two api addresses are the same host and port, https is assumed if there is no scheme
+func sameAPI(a, b string) bool {
+	urlA, err := url.Parse(ncutils.APIURL(a))
+	if err != nil {
+		return false
+	}
+	urlB, err := url.Parse(ncutils.APIURL(b))
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(urlA.Hostname(), urlB.Hostname()) && apiPort(urlA) == apiPort(urlB)
+}
+
+// apiPort - the port of an api url, the default port of its scheme if none is given
+func apiPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if u.Scheme == "http" {
+		return "80"
+	}
+	return "443"
+}
+
+// hostChanges - describes the changes required to the host settings
+func hostChanges(settings *HostSettings) []string {
+	host := config.Netclient()
+	changes := []string{}
+	if settings.Name != "" && settings.Name != host.Name {
+		changes = append(changes, fmt.Sprintf("name %s -> %s", host.Name, settings.Name))
+	}
+	if settings.MTU != 0 && settings.MTU != host.MTU {
+		changes = append(changes, fmt.Sprintf("mtu %d -> %d", host.MTU, settings.MTU))
+	}
+	if settings.ListenPort != 0 && settings.ListenPort != host.ListenPort {
+		changes = append(changes, fmt.Sprintf("listen port %d -> %d", host.ListenPort, settings.ListenPort))
+	}
+	if settings.Endpoint != "" && (!host.IsStatic || !net.ParseIP(settings.Endpoint).Equal(host.EndpointIP)) {
+		changes = append(changes, fmt.Sprintf("static endpoint %s -> %s", host.EndpointIP, settings.Endpoint))
+	}
+	if settings.Proxy != nil && *settings.Proxy != host.ProxyEnabled {
+		changes = append(changes, fmt.Sprintf("proxy %t -> %t", host.ProxyEnabled, *settings.Proxy))
+	}
+	return changes
+}
+
+func printPlan(plan applyPlan) {
+	if len(plan.Host)+len(plan.Leave)+len(plan.Join)+len(plan.Errors) == 0 {
+		fmt.Println("no changes, host is up to date")
+		return
+	}
+	fmt.Println("plan:")
+	for _, change := range plan.Host {
+		fmt.Println("  ~ host", change)
+	}
+	for _, node := range plan.Leave {
+		fmt.Printf("  - leave %s (%s)\n", node.Network, node.Server)
+	}
+	for _, join := range plan.Join {
+		fmt.Printf("  + join %s (%s)\n", join.Network, join.Server)
+	}
+	for _, err := range plan.Errors {
+		fmt.Println("  ! error", err)
+	}
+}
+
+// updateHostSettings - applies host settings, using the daemon if it is running
+func updateHostSettings(settings *HostSettings) error {
+	if daemonRunning() {
+		return callDaemon(http.MethodPost, controlHost, &controlRequest{Host: settings}, nil)
+	}
+	for _, server := range config.GetServers() {
+		serverCfg := config.GetServer(server)
+		if serverCfg == nil {
+			continue
+		}
+		if err := setupMQTTSingleton(serverCfg, true); err != nil {
+			logger.Log(0, "failed to set up mq conn for server ", server)
+		}
+	}
+	return setHostSettings(settings)
+}
+
+// setHostSettings - updates the host config and publishes the changes to all servers
+func setHostSettings(settings *HostSettings) error {
+	if len(hostChanges(settings)) == 0 {
+		return nil
+	}
+	if err := config.Update(func(state *config.State) error {
+		host := &state.Host
+		if settings.Name != "" {
+			host.Name = settings.Name
+		}
+		if settings.MTU != 0 {
+			host.MTU = settings.MTU
+		}
+		if settings.ListenPort != 0 {
+			host.ListenPort = settings.ListenPort
+		}
+		if settings.Endpoint != "" {
+			host.EndpointIP = net.ParseIP(settings.Endpoint)
+			host.IsStatic = true
+		}
+		if settings.Proxy != nil {
+			host.ProxyEnabled = *settings.Proxy
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return PublishGlobalHostUpdate(models.UpdateHost)
+}
+
+// joinFlags - flags for joining a network with a token
+func joinFlags(join joinAction, settings *HostSettings) *viper.Viper {
+	host := config.Netclient()
+	flags := viper.New()
+	flags.Set("server", "")
+	flags.Set("token", join.Token)
+	flags.Set("name", host.Name)
+	if settings.Name != "" {
+		flags.Set("name", settings.Name)
+	}
+	// keep a static endpoint rather than looking up the public ip
+	if settings.Endpoint != "" {
+		flags.Set("endpoint", settings.Endpoint)
+	} else if host.IsStatic && host.EndpointIP != nil {
+		flags.Set("endpoint", host.EndpointIP.String())
+	}
+	return flags
+}
@@ -0,0 +1,216 @@
+package functions
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gravitl/netclient/apitest"
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netmaker/models"
+	"github.com/matryer/is"
+	"gopkg.in/yaml.v3"
+)
+
+// testToken - an enrollment token for network at the api address
+func testToken(t *testing.T, api, network string) string {
+	is := is.New(t)
+	data, err := json.Marshal(models.AccessToken{
+		APIConnString: api,
+		ClientConfig:  models.ClientConfig{Network: network, Key: "joinkey"},
+	})
+	is.NoErr(err)
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// writeDesiredState - writes a desired state file and returns its path
+func writeDesiredState(t *testing.T, state *DesiredState) string {
+	is := is.New(t)
+	data, err := yaml.Marshal(state)
+	is.NoErr(err)
+	file := filepath.Join(t.TempDir(), "desired.yml")
+	is.NoErr(os.WriteFile(file, data, 0600))
+	return file
+}
+
+func TestDesiredStateValidate(t *testing.T) {
+	cases := []struct {
+		name  string
+		state DesiredState
+		valid bool
+	}{
+		{"empty", DesiredState{}, true},
+		{"valid", DesiredState{
+			Host:    HostSettings{Name: "host1", MTU: 1420, ListenPort: 51821, Endpoint: "203.0.113.20"},
+			Servers: []DesiredServer{{Name: "netmaker.test", Networks: []DesiredNetwork{{Name: "net1"}, {Name: "net2"}}}},
+		}, true},
+		{"missing server name", DesiredState{Servers: []DesiredServer{{Networks: []DesiredNetwork{{Name: "net1"}}}}}, false},
+		{"missing network name", DesiredState{Servers: []DesiredServer{{Name: "netmaker.test", Networks: []DesiredNetwork{{}}}}}, false},
+		{"network listed twice", DesiredState{Servers: []DesiredServer{
+			{Name: "netmaker.test", Networks: []DesiredNetwork{{Name: "net1"}}},
+			{Name: "other.test", Networks: []DesiredNetwork{{Name: "net1"}}},
+		}}, false},
+		{"invalid host name", DesiredState{Host: HostSettings{Name: "host 1"}}, false},
+		{"mtu too small", DesiredState{Host: HostSettings{MTU: 500}}, false},
+		{"mtu too large", DesiredState{Host: HostSettings{MTU: 9001}}, false},
+		{"invalid listen port", DesiredState{Host: HostSettings{ListenPort: 70000}}, false},
+		{"endpoint not an ip", DesiredState{Host: HostSettings{Endpoint: "host.example"}}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			err := tc.state.Validate()
+			is.Equal(err == nil, tc.valid)
+		})
+	}
+}
+
+func TestHostChanges(t *testing.T) {
+	startTestAPI(t)
+	enabled, disabled := true, false
+	cases := []struct {
+		name     string
+		settings HostSettings
+		changes  []string
+	}{
+		{"unset", HostSettings{}, []string{}},
+		{"unchanged", HostSettings{Name: "host1", MTU: 1420, ListenPort: 51821, Proxy: &disabled}, []string{}},
+		{"name", HostSettings{Name: "host2"}, []string{"name host1 -> host2"}},
+		{"mtu and port", HostSettings{MTU: 1380, ListenPort: 51822}, []string{"mtu 1420 -> 1380", "listen port 51821 -> 51822"}},
+		{"static endpoint", HostSettings{Endpoint: "203.0.113.20"}, []string{"static endpoint <nil> -> 203.0.113.20"}},
+		{"proxy", HostSettings{Proxy: &enabled}, []string{"proxy false -> true"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(hostChanges(&tc.settings), tc.changes)
+		})
+	}
+}
+
+func TestPlanApply(t *testing.T) {
+	api := startTestAPI(t)
+	addTestNode(api, "net1")
+	cases := []struct {
+		name    string
+		servers []DesiredServer
+		leave   []string
+		join    []string
+		errors  int
+	}{
+		{
+			name:    "up to date",
+			servers: []DesiredServer{{Name: "netmaker.test", Networks: []DesiredNetwork{{Name: "net1"}}}},
+		},
+		{
+			name:    "network not listed",
+			servers: []DesiredServer{},
+			leave:   []string{"net1"},
+		},
+		{
+			name: "join",
+			servers: []DesiredServer{{Name: "netmaker.test", Networks: []DesiredNetwork{
+				{Name: "net1"}, {Name: "net2", Token: testToken(t, api.URL, "net2")},
+			}}},
+			join: []string{"net2"},
+		},
+		{
+			// the server is found by the api address of the token, so the host is not moved every run
+			name: "server named differently",
+			servers: []DesiredServer{{Name: "api.netmaker.test", Networks: []DesiredNetwork{
+				{Name: "net1", Token: testToken(t, api.URL, "net1")},
+			}}},
+		},
+		{
+			name:    "unknown server without tokens",
+			servers: []DesiredServer{{Name: "api.netmaker.test", Networks: []DesiredNetwork{{Name: "net1"}}}},
+			errors:  1,
+		},
+		{
+			name: "move to another server",
+			servers: []DesiredServer{{Name: "other.test", Networks: []DesiredNetwork{
+				{Name: "net1", Token: testToken(t, "api.other.test", "net1")},
+			}}},
+			leave: []string{"net1"},
+			join:  []string{"net1"},
+		},
+		{
+			name: "missing token",
+			servers: []DesiredServer{{Name: "netmaker.test", Networks: []DesiredNetwork{
+				{Name: "net1"}, {Name: "net2"},
+			}}},
+			errors: 1,
+		},
+		{
+			name: "invalid token",
+			servers: []DesiredServer{{Name: "netmaker.test", Networks: []DesiredNetwork{
+				{Name: "net1"}, {Name: "net2", Token: "not a token"},
+			}}},
+			errors: 1,
+		},
+		{
+			name: "token for another network",
+			servers: []DesiredServer{{Name: "netmaker.test", Networks: []DesiredNetwork{
+				{Name: "net1"}, {Name: "net2", Token: testToken(t, api.URL, "net3")},
+			}}},
+			errors: 1,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+			plan := planApply(&DesiredState{Servers: tc.servers})
+			leave := []string{}
+			for _, node := range plan.Leave {
+				leave = append(leave, node.Network)
+			}
+			join := []string{}
+			for _, action := range plan.Join {
+				join = append(join, action.Network)
+			}
+			is.Equal(len(plan.Host), 0)
+			is.Equal(leave, append([]string{}, tc.leave...))
+			is.Equal(join, append([]string{}, tc.join...))
+			is.Equal(len(plan.Errors), tc.errors)
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	is := is.New(t)
+	api := startTestAPI(t)
+	api.Update(func(state *apitest.State) { state.AccessKey = "joinkey" })
+	joined := writeDesiredState(t, &DesiredState{
+		Host: HostSettings{Endpoint: "203.0.113.20"},
+		Servers: []DesiredServer{{Name: "netmaker.test", Networks: []DesiredNetwork{
+			{Name: "net1", Token: testToken(t, api.URL, "net1")},
+		}}},
+	})
+
+	// a dry run makes no changes
+	is.NoErr(Apply(joined, true))
+	is.Equal(len(api.Requests()), 0)
+	is.Equal(len(config.GetNodes()), 0)
+
+	is.NoErr(Apply(joined, false))
+	node, ok := config.GetNodes()["net1"]
+	is.True(ok) // joined net1
+	is.Equal(node.Server, "netmaker.test")
+	_, ok = api.Node(node.ID)
+	is.True(ok) // node created on the server
+	is.True(config.Netclient().IsStatic)
+	is.Equal(len(api.RequestsOf(apitest.RouteJoin)), 1)
+
+	// converged, a second run does nothing
+	is.NoErr(Apply(joined, false))
+	is.Equal(len(api.RequestsOf(apitest.RouteJoin)), 1)
+	is.Equal(len(api.RequestsOf(apitest.RouteDeleteNode)), 0)
+
+	is.NoErr(Apply(writeDesiredState(t, &DesiredState{}), false))
+	is.Equal(len(config.GetNodes()), 0)
+	_, ok = api.Node(node.ID)
+	is.True(!ok) // node deleted on the server
+	is.Equal(len(config.GetServer("netmaker.test").Nodes), 0)
+}
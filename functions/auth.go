@@ -9,6 +9,7 @@ import (
 
 	"github.com/devilcove/httpclient"
 	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/ncutils"
 	"github.com/gravitl/netmaker/models"
 )
 
@@ -20,7 +21,7 @@ func Authenticate(url string, host *config.Config) (string, error) {
 		Password:   host.HostPass,
 	}
 	endpoint := httpclient.Endpoint{
-		URL:    "https://" + url,
+		URL:    ncutils.APIURL(url),
 		Route:  "/api/hosts/adm/authenticate",
 		Method: http.MethodPost,
 		Data:   data,
@@ -0,0 +1,292 @@
+package functions
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/transport"
+	"github.com/gravitl/netmaker/logger"
+)
+
+const (
+	// brokerBackoff - time a failed broker is skipped for while other brokers are available, doubled for each consecutive failure
+	brokerBackoff = time.Second * 15
+	// maxBrokerBackoff - upper limit of the time a failed broker is skipped for
+	maxBrokerBackoff = time.Minute * 5
+)
+
+// errBrokerSkipped - returned when connecting to a broker that recently failed while other brokers are available
+var errBrokerSkipped = errors.New("broker skipped after recent failures")
+
+// BrokerHealth - connection health of a broker url
+type BrokerHealth struct {
+	URL           string    `json:"url"`
+	Failures      int       `json:"failures"` // consecutive failures
+	LastError     string    `json:"last_error,omitempty"`
+	LastFailure   time.Time `json:"last_failure,omitempty"`
+	LastConnected time.Time `json:"last_connected,omitempty"`
+}
+
+// BrokerStatus - broker connection of a server
+type BrokerStatus struct {
+	Connected  bool           `json:"connected"`
+	Active     string         `json:"active,omitempty"` // url of the broker in use
+	Brokers    []BrokerHealth `json:"brokers"`
+	Connection *ConnHealth    `json:"connection,omitempty"` // state of the connection managed by the daemon
+}
+
+// brokerPool - the brokers of a server, with their health used to fail over between them
+type brokerPool struct {
+	mutex   sync.Mutex
+	brokers []*BrokerHealth
+	active  string
+	lastErr error // most recent failure, see takeError
+}
+
+var (
+	brokerPoolsMutex sync.Mutex
+	brokerPools      = make(map[string]*brokerPool) // indexed by server name
+)
+
+// getBrokerPool - returns the broker pool of a server, keeping the health of brokers that are still configured
+func getBrokerPool(server *config.Server) (*brokerPool, error) {
+	urls, err := server.BrokerURLs()
+	if err != nil {
+		return nil, err
+	}
+	brokerPoolsMutex.Lock()
+	defer brokerPoolsMutex.Unlock()
+	pool, ok := brokerPools[server.Name]
+	if !ok {
+		pool = &brokerPool{}
+		brokerPools[server.Name] = pool
+	}
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	health := make(map[string]*BrokerHealth)
+	for _, broker := range pool.brokers {
+		health[broker.URL] = broker
+	}
+	pool.brokers = nil
+	for _, u := range urls {
+		broker, ok := health[u.String()]
+		if !ok {
+			broker = &BrokerHealth{URL: u.String()}
+		}
+		pool.brokers = append(pool.brokers, broker)
+	}
+	return pool, nil
+}
+
+// brokerPool.ordered - broker urls in configured order, brokers that are backing off after failures last
+func (pool *brokerPool) ordered() []*url.URL {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	brokers := make([]*BrokerHealth, len(pool.brokers))
+	copy(brokers, pool.brokers)
+	now := time.Now()
+	sort.SliceStable(brokers, func(i, j int) bool {
+		return !brokers[i].backingOff(now) && brokers[j].backingOff(now)
+	})
+	urls := []*url.URL{}
+	for _, broker := range brokers {
+		if u, err := url.Parse(broker.URL); err == nil {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// BrokerHealth.backingOff - checks if the broker failed recently
+func (broker *BrokerHealth) backingOff(now time.Time) bool {
+	if broker.Failures == 0 {
+		return false
+	}
+	backoff := maxBrokerBackoff
+	if broker.Failures < 10 {
+		backoff = brokerBackoff << (broker.Failures - 1)
+	}
+	if backoff > maxBrokerBackoff {
+		backoff = maxBrokerBackoff
+	}
+	return now.Before(broker.LastFailure.Add(backoff))
+}
+
+// brokerPool.skip - checks if a broker should be skipped because it failed recently and another broker is available
+func (pool *brokerPool) skip(broker string) bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	now := time.Now()
+	skip := false
+	available := false
+	for _, b := range pool.brokers {
+		if b.URL == broker {
+			skip = b.backingOff(now)
+		} else if !b.backingOff(now) {
+			available = true
+		}
+	}
+	return skip && available
+}
+
+// brokerPool.failed - records a failure to connect to a broker, or the loss of its connection
+func (pool *brokerPool) failed(broker string, err error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.active == broker {
+		pool.active = ""
+	}
+	if err != nil {
+		pool.lastErr = err
+	}
+	for _, b := range pool.brokers {
+		if b.URL == broker {
+			b.Failures++
+			b.LastFailure = time.Now()
+			if err != nil {
+				b.LastError = err.Error()
+			}
+		}
+	}
+}
+
+// brokerPool.takeError - returns and clears the most recent failure
+func (pool *brokerPool) takeError() error {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	err := pool.lastErr
+	pool.lastErr = nil
+	return err
+}
+
+// brokerPool.connected - records a successful connection to a broker
+func (pool *brokerPool) connected(broker string) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.active = broker
+	for _, b := range pool.brokers {
+		if b.URL == broker {
+			b.Failures = 0
+			b.LastError = ""
+			b.LastConnected = time.Now()
+		}
+	}
+}
+
+// brokerPool.status - the active broker and the health of all brokers
+func (pool *brokerPool) status(connected bool) BrokerStatus {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	status := BrokerStatus{Connected: connected, Active: pool.active}
+	if !connected {
+		status.Active = ""
+	}
+	for _, broker := range pool.brokers {
+		status.Brokers = append(status.Brokers, *broker)
+	}
+	return status
+}
+
+// setBrokers - configures the mqtt client options to connect to the brokers of a server, failing over between them
+// paho tries the brokers in order on each connection attempt; brokers that recently failed are tried last or skipped
+func setBrokers(opts *mqtt.ClientOptions, server *config.Server) error {
+	pool, err := getBrokerPool(server)
+	if err != nil {
+		return err
+	}
+	for _, u := range pool.ordered() {
+		opts.AddBroker(u.String())
+	}
+	// the broker of the current connection attempt, reported as connected by the connect handler
+	var attemptMutex sync.Mutex
+	var attempt string
+	opts.SetCustomOpenConnectionFn(func(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+		broker := uri.String()
+		if pool.skip(broker) {
+			return nil, errBrokerSkipped
+		}
+		conn, err := openBrokerConn(uri, &options)
+		if err != nil {
+			logger.Log(0, "unable to connect to broker", broker, err.Error())
+			pool.failed(broker, err)
+			return nil, err
+		}
+		attemptMutex.Lock()
+		attempt = broker
+		attemptMutex.Unlock()
+		return conn, nil
+	})
+	onConnect := opts.OnConnect
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		attemptMutex.Lock()
+		broker := attempt
+		attemptMutex.Unlock()
+		logger.Log(0, "connected to broker", broker, "for server", server.Name)
+		pool.connected(broker)
+		if onConnect != nil {
+			onConnect(client)
+		}
+	})
+	opts.SetConnectionLostHandler(func(c mqtt.Client, e error) {
+		attemptMutex.Lock()
+		broker := attempt
+		attemptMutex.Unlock()
+		logger.Log(0, "detected broker connection lost for", broker)
+		pool.failed(broker, e)
+	})
+	return nil
+}
+
+// openBrokerConn - opens the network connection to a broker
+func openBrokerConn(uri *url.URL, options *mqtt.ClientOptions) (net.Conn, error) {
+	timeout := options.ConnectTimeout
+	if timeout == 0 {
+		timeout = time.Second * 30
+	}
+	tlsConfig := options.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	switch uri.Scheme {
+	case "wss":
+		return mqtt.NewWebsocket(uri.String(), tlsConfig, timeout, options.HTTPHeaders, options.WebsocketOptions)
+	case "mqtts":
+		tlsConfig = tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = uri.Hostname()
+		}
+		return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", uri.Host, tlsConfig)
+	case "tcp":
+		return net.DialTimeout("tcp", uri.Host, timeout)
+	}
+	return nil, fmt.Errorf("unsupported broker scheme %s", uri.Scheme)
+}
+
+// getBrokerStatus - broker status of each server the daemon is connected to
+func getBrokerStatus() map[string]BrokerStatus {
+	brokerPoolsMutex.Lock()
+	defer brokerPoolsMutex.Unlock()
+	status := make(map[string]BrokerStatus)
+	for server, mqclient := range serverClients() {
+		connected := mqclient != nil && mqclient.State() == transport.StateConnected
+		if pool, ok := brokerPools[server]; ok {
+			status[server] = pool.status(connected)
+		} else {
+			status[server] = BrokerStatus{Connected: connected}
+		}
+		if health, ok := getConnHealth(server); ok {
+			s := status[server]
+			s.Connection = &health
+			status[server] = s
+		}
+	}
+	return status
+}
@@ -0,0 +1,70 @@
+package functions
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/matryer/is"
+)
+
+func urlStrings(pool *brokerPool) []string {
+	urls := []string{}
+	for _, u := range pool.ordered() {
+		urls = append(urls, u.String())
+	}
+	return urls
+}
+
+func TestBrokerPool(t *testing.T) {
+	is := is.New(t)
+	server := config.Server{Name: "pool.example.com"}
+	server.Brokers = []string{"mqtts://broker1:8883", "wss://broker2:443", "tcp://broker3:1883"}
+	pool, err := getBrokerPool(&server)
+	is.NoErr(err)
+	is.Equal(urlStrings(pool), server.Brokers)
+	is.True(!pool.skip("mqtts://broker1:8883"))
+
+	// a failed broker is tried last and skipped while others are available
+	pool.failed("mqtts://broker1:8883", errors.New("connection refused"))
+	is.Equal(urlStrings(pool), []string{"wss://broker2:443", "tcp://broker3:1883", "mqtts://broker1:8883"})
+	is.True(pool.skip("mqtts://broker1:8883"))
+
+	pool.connected("wss://broker2:443")
+	status := pool.status(true)
+	is.Equal(status.Active, "wss://broker2:443")
+	is.Equal(status.Brokers[0].Failures, 1)
+	is.Equal(status.Brokers[0].LastError, "connection refused")
+	is.True(!status.Brokers[1].LastConnected.IsZero())
+	is.Equal(pool.status(false).Active, "")
+
+	// when all brokers are failing none are skipped
+	pool.failed("wss://broker2:443", nil)
+	pool.failed("tcp://broker3:1883", nil)
+	is.True(!pool.skip("mqtts://broker1:8883"))
+	is.Equal(pool.status(true).Active, "")
+
+	// health is kept for brokers that are still configured
+	server.Brokers = []string{"tcp://broker3:1883", "mqtts://broker4:8883"}
+	pool, err = getBrokerPool(&server)
+	is.NoErr(err)
+	status = pool.status(false)
+	is.Equal(len(status.Brokers), 2)
+	is.Equal(status.Brokers[0].Failures, 1)
+	is.Equal(status.Brokers[1].Failures, 0)
+	is.Equal(urlStrings(pool), []string{"mqtts://broker4:8883", "tcp://broker3:1883"})
+}
+
+func TestBrokerBackoff(t *testing.T) {
+	is := is.New(t)
+	now := time.Now()
+	broker := BrokerHealth{Failures: 1, LastFailure: now}
+	is.True(broker.backingOff(now.Add(brokerBackoff - time.Second)))
+	is.True(!broker.backingOff(now.Add(brokerBackoff)))
+	broker.Failures = 3
+	is.True(broker.backingOff(now.Add(brokerBackoff * 3)))
+	broker.Failures = 100
+	is.True(broker.backingOff(now.Add(maxBrokerBackoff - time.Second)))
+	is.True(!broker.backingOff(now.Add(maxBrokerBackoff)))
+}
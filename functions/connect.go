@@ -3,6 +3,7 @@ package functions
 import (
 	"errors"
 	"fmt"
+	"net/http"
 
 	"github.com/gravitl/netclient/config"
 	"github.com/gravitl/netclient/daemon"
@@ -10,27 +11,21 @@ import (
 
 // Disconnect disconnects a node from the given network
 func Disconnect(network string) error {
-	nodes := config.GetNodes()
-	node, ok := nodes[network]
-	if !ok {
-		return errors.New("no such network")
-	}
-	if !node.Connected {
-		return errors.New("node is already disconnected")
+	if daemonRunning() {
+		return callDaemon(http.MethodPost, controlDisconnect, &controlRequest{Network: network}, nil)
 	}
-	node.Connected = false
-	config.UpdateNodeMap(node.Network, node)
-	if err := config.WriteNodeConfig(); err != nil {
-		return fmt.Errorf("error writing node config %w", err)
+	node, err := setConnected(network, false)
+	if err != nil {
+		return err
 	}
 	server := config.GetServer(node.Server)
 	if err := setupMQTTSingleton(server, true); err != nil {
 		return err
 	}
-	if err := PublishNodeUpdate(&node); err != nil {
+	if err := PublishNodeUpdate(node); err != nil {
 		return err
 	}
-	if err := daemon.Restart(); err != nil {
+	if err := restartDaemon(); err != nil {
 		fmt.Println("daemon restart failed", err)
 		if err := daemon.Start(); err != nil {
 			fmt.Println("daemon failed to start", err)
@@ -41,30 +36,45 @@ func Disconnect(network string) error {
 
 // Connect will attempt to connect a node on given network
 func Connect(network string) error {
-	nodes := config.GetNodes()
-	node, ok := nodes[network]
-	if !ok {
-		return errors.New("no such network")
+	if daemonRunning() {
+		return callDaemon(http.MethodPost, controlConnect, &controlRequest{Network: network}, nil)
 	}
-	if node.Connected {
-		return errors.New("node already connected")
-	}
-	node.Connected = true
-	config.UpdateNodeMap(node.Network, node)
-	if err := config.WriteNodeConfig(); err != nil {
-		return fmt.Errorf("error writing node config %w", err)
+	node, err := setConnected(network, true)
+	if err != nil {
+		return err
 	}
 	server := config.GetServer(node.Server)
 	if err := setupMQTTSingleton(server, true); err != nil {
 		return err
 	}
-	if err := PublishNodeUpdate(&node); err != nil {
+	if err := PublishNodeUpdate(node); err != nil {
 		return err
 	}
-	if err := daemon.Restart(); err != nil {
+	if err := restartDaemon(); err != nil {
 		if err := daemon.Start(); err != nil {
 			return fmt.Errorf("daemon restart failed %w", err)
 		}
 	}
 	return nil
 }
+
+// setConnected - sets the connected status of the node on the given network and saves the node map
+func setConnected(network string, connected bool) (*config.Node, error) {
+	nodes := config.GetNodes()
+	node, ok := nodes[network]
+	if !ok {
+		return nil, errors.New("no such network")
+	}
+	if node.Connected == connected {
+		if connected {
+			return nil, errors.New("node already connected")
+		}
+		return nil, errors.New("node is already disconnected")
+	}
+	node.Connected = connected
+	config.UpdateNodeMap(node.Network, node)
+	if err := config.WriteNodeConfig(); err != nil {
+		return nil, fmt.Errorf("error writing node config %w", err)
+	}
+	return &node, nil
+}
@@ -0,0 +1,330 @@
+package functions
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/events"
+	"github.com/gravitl/netclient/transport"
+	"github.com/gravitl/netclient/wireguard"
+	"github.com/gravitl/netmaker/logger"
+)
+
+// ConnState - state of the broker connection of a server
+type ConnState string
+
+const (
+	// ConnConnecting - a connection attempt to the brokers of the server is in progress
+	ConnConnecting ConnState = "connecting"
+	// ConnConnected - connected to one of the brokers of the server
+	ConnConnected ConnState = "connected"
+	// ConnBackoff - waiting to retry after a failed connection attempt or the loss of the connection
+	ConnBackoff ConnState = "backoff"
+	// ConnAuthFailed - the broker rejected the credentials, retried at a long interval
+	ConnAuthFailed ConnState = "auth-failed"
+)
+
+// FailureKind - class of a broker connection failure
+type FailureKind string
+
+const (
+	// FailureDNS - the broker name could not be resolved
+	FailureDNS FailureKind = "dns"
+	// FailureTCP - the broker could not be reached, or the connection was reset or timed out
+	FailureTCP FailureKind = "tcp"
+	// FailureTLS - the tls handshake or certificate verification failed
+	FailureTLS FailureKind = "tls"
+	// FailureAuth - the broker rejected the credentials
+	FailureAuth FailureKind = "auth"
+	// FailureOther - any other failure, eg. the broker refused the connection
+	FailureOther FailureKind = "other"
+)
+
+const (
+	// connBackoff - delay before the first retry, doubled for each consecutive failure
+	connBackoff = time.Second * 2
+	// maxConnBackoff - upper limit of the delay between connection attempts
+	maxConnBackoff = time.Minute * 2
+	// authRetryInterval - delay between connection attempts while the broker rejects the credentials
+	authRetryInterval = time.Minute * 10
+	// connectTimeout - time limit for connecting to a single broker
+	connectTimeout = time.Second * 30
+	// maxTransitions - number of state transitions kept for each server
+	maxTransitions = 20
+)
+
+// ConnTransition - a change of the broker connection state of a server
+type ConnTransition struct {
+	From    ConnState   `json:"from"`
+	To      ConnState   `json:"to"`
+	At      time.Time   `json:"at"`
+	Failure FailureKind `json:"failure,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// ConnHealth - state and history of the broker connection of a server
+type ConnHealth struct {
+	State            ConnState           `json:"state"`
+	Since            time.Time           `json:"since"`                       // time the current state was entered
+	Attempts         int                 `json:"attempts"`                    // consecutive failed connection attempts
+	Failure          FailureKind         `json:"failure,omitempty"`           // class of the last failure
+	LastError        string              `json:"last_error,omitempty"`        // error of the last failure
+	UnreachableSince time.Time           `json:"unreachable_since,omitempty"` // zero while connected or before the first failure
+	NextAttempt      time.Time           `json:"next_attempt,omitempty"`      // set while backing off
+	Failures         map[FailureKind]int `json:"failures,omitempty"`          // total failures by class
+	Transitions      []ConnTransition    `json:"transitions,omitempty"`       // most recent last
+}
+
+// connManager - keeps the broker connection of a server, retrying with exponential backoff and jitter
+type connManager struct {
+	server    string
+	transport transport.Transport
+	pool      *brokerPool
+	lost      chan error
+	mutex     sync.Mutex
+	health    ConnHealth
+}
+
+var (
+	connManagersMutex sync.Mutex
+	connManagers      = make(map[string]*connManager) // indexed by server name
+)
+
+// newConnManager - creates the connection manager of a server, replacing any previous manager of the server
+// onConnect is called after each successful connection attempt
+func newConnManager(server *config.Server, onConnect func(transport.Transport)) (*connManager, error) {
+	pool, err := getBrokerPool(server)
+	if err != nil {
+		return nil, err
+	}
+	m := &connManager{
+		server: server.Name,
+		pool:   pool,
+		lost:   make(chan error, 1),
+		health: ConnHealth{Failures: make(map[FailureKind]int)},
+	}
+	m.transport, err = newTransport(server, transport.Callbacks{
+		OnConnect: onConnect,
+		OnConnectionLost: func(_ transport.Transport, err error) {
+			select {
+			case m.lost <- err:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	connManagersMutex.Lock()
+	connManagers[server.Name] = m
+	connManagersMutex.Unlock()
+	return m, nil
+}
+
+// connManager.run - connects to the brokers of the server and reconnects when the connection is lost, until ctx is done
+func (m *connManager) run(ctx context.Context) {
+	defer func() {
+		connManagersMutex.Lock()
+		if connManagers[m.server] == m {
+			delete(connManagers, m.server)
+		}
+		connManagersMutex.Unlock()
+	}()
+	for {
+		m.transition(ConnConnecting, "", nil, time.Time{})
+		m.pool.takeError() // discard failures of previous attempts
+		err := m.transport.Connect(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			logger.Log(0, "connected to broker of server", m.server)
+			m.transition(ConnConnected, "", nil, time.Time{})
+			select {
+			case <-ctx.Done():
+				return
+			case err = <-m.lost:
+			}
+			if err == nil {
+				err = errors.New("connection lost")
+			}
+		} else if attemptErr := m.pool.takeError(); attemptErr != nil && !isAuthFailure(err) {
+			// paho reports network errors as text, use the error of the last broker tried instead
+			err = attemptErr
+		}
+		failure := classifyFailure(err)
+		if failure != FailureAuth {
+			// the broker may have moved to an address that is not kept off the internet gateway
+			wireguard.RefreshGatewayExclusions()
+		}
+		state := ConnBackoff
+		delay := backoffDelay(m.failures()+1, connBackoff, maxConnBackoff, rand.Int63n)
+		if failure == FailureAuth {
+			state = ConnAuthFailed
+			delay = jitter(authRetryInterval, rand.Int63n)
+		}
+		logger.Log(0, "broker connection for server", m.server, "failed", fmt.Sprintf("(%s)", failure), err.Error(),
+			"retrying in", delay.Round(time.Second).String())
+		m.transition(state, failure, err, time.Now().Add(delay))
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// connManager.failures - number of consecutive failures
+func (m *connManager) failures() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.health.Attempts
+}
+
+// connManager.transition - records a change of state, publishing it if the state changed
+func (m *connManager) transition(to ConnState, failure FailureKind, err error, next time.Time) {
+	m.mutex.Lock()
+	from := m.health.State
+	m.health.record(to, failure, err, next, time.Now())
+	m.mutex.Unlock()
+	if from == to {
+		return
+	}
+	event := events.BrokerStateChanged{Server: m.server, From: string(from), To: string(to)}
+	if to == ConnConnected {
+		event.Broker = m.pool.status(true).Active
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	bus.Publish(event)
+}
+
+// connManager.status - a copy of the connection health
+func (m *connManager) status() ConnHealth {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	health := m.health
+	health.Failures = make(map[FailureKind]int, len(m.health.Failures))
+	for k, v := range m.health.Failures {
+		health.Failures[k] = v
+	}
+	health.Transitions = append([]ConnTransition{}, m.health.Transitions...)
+	return health
+}
+
+// ConnHealth.record - records a change of state at time now
+func (h *ConnHealth) record(to ConnState, failure FailureKind, err error, next, now time.Time) {
+	t := ConnTransition{From: h.State, To: to, At: now, Failure: failure}
+	if err != nil {
+		t.Error = err.Error()
+	}
+	switch to {
+	case ConnConnected:
+		h.Attempts = 0
+		h.UnreachableSince = time.Time{}
+	case ConnBackoff, ConnAuthFailed:
+		h.Attempts++
+		h.Failure = failure
+		h.LastError = t.Error
+		if h.Failures == nil {
+			h.Failures = make(map[FailureKind]int)
+		}
+		h.Failures[failure]++
+		if h.UnreachableSince.IsZero() {
+			h.UnreachableSince = now
+		}
+	}
+	h.NextAttempt = next
+	if h.State != to {
+		h.Since = now
+	}
+	h.State = to
+	h.Transitions = append(h.Transitions, t)
+	if over := len(h.Transitions) - maxTransitions; over > 0 {
+		h.Transitions = h.Transitions[over:]
+	}
+}
+
+// backoffDelay - delay before the next connection attempt after the given number of consecutive failures
+// the delay doubles with each failure up to max, with jitter so hosts do not reconnect in lockstep after a broker restart
+func backoffDelay(failures int, base, max time.Duration, random func(int64) int64) time.Duration {
+	delay := max
+	if failures < 1 {
+		failures = 1
+	}
+	if failures < 32 {
+		if d := base << (failures - 1); d > 0 && d < max {
+			delay = d
+		}
+	}
+	return jitter(delay, random)
+}
+
+// jitter - randomizes a delay to between half and all of it
+func jitter(delay time.Duration, random func(int64) int64) time.Duration {
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + random(half+1))
+}
+
+// classifyFailure - determines the class of a broker connection failure
+func classifyFailure(err error) FailureKind {
+	if err == nil {
+		return FailureOther
+	}
+	if isAuthFailure(err) {
+		return FailureAuth
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return FailureDNS
+	}
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+		recordHeader     tls.RecordHeaderError
+	)
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid) ||
+		errors.As(err, &recordHeader) || strings.HasPrefix(err.Error(), "tls: ") || strings.HasPrefix(err.Error(), "x509: ") {
+		return FailureTLS
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, errBrokerSkipped) ||
+		strings.HasPrefix(err.Error(), packets.ErrorNetworkError.Error()) {
+		return FailureTCP
+	}
+	return FailureOther
+}
+
+// isAuthFailure - checks if the broker rejected the credentials
+func isAuthFailure(err error) bool {
+	return errors.Is(err, packets.ErrorRefusedBadUsernameOrPassword) ||
+		errors.Is(err, packets.ErrorRefusedNotAuthorised)
+}
+
+// getConnHealth - connection health of a server, if the daemon manages its connection
+func getConnHealth(server string) (ConnHealth, bool) {
+	connManagersMutex.Lock()
+	m, ok := connManagers[server]
+	connManagersMutex.Unlock()
+	if !ok {
+		return ConnHealth{}, false
+	}
+	return m.status(), true
+}
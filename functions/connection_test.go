@@ -0,0 +1,116 @@
+package functions
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/gravitl/netclient/config"
+	"github.com/matryer/is"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	is := is.New(t)
+	max := func(n int64) int64 { return n - 1 }
+	min := func(n int64) int64 { return 0 }
+	is.Equal(backoffDelay(1, time.Second*2, time.Minute*2, max), time.Second*2)
+	is.Equal(backoffDelay(1, time.Second*2, time.Minute*2, min), time.Second)
+	is.Equal(backoffDelay(3, time.Second*2, time.Minute*2, max), time.Second*8)
+	is.Equal(backoffDelay(3, time.Second*2, time.Minute*2, min), time.Second*4)
+	// capped, including failure counts that would overflow the shift
+	is.Equal(backoffDelay(10, time.Second*2, time.Minute*2, max), time.Minute*2)
+	is.Equal(backoffDelay(100, time.Second*2, time.Minute*2, max), time.Minute*2)
+	is.Equal(backoffDelay(100, time.Second*2, time.Minute*2, min), time.Minute)
+	is.Equal(backoffDelay(0, time.Second*2, time.Minute*2, max), time.Second*2)
+}
+
+func TestClassifyFailure(t *testing.T) {
+	is := is.New(t)
+	dnsErr := &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "broker.invalid"}}
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	is.Equal(classifyFailure(dnsErr), FailureDNS)
+	is.Equal(classifyFailure(refused), FailureTCP)
+	is.Equal(classifyFailure(fmt.Errorf("wrapped %w", refused)), FailureTCP)
+	is.Equal(classifyFailure(errBrokerSkipped), FailureTCP)
+	is.Equal(classifyFailure(fmt.Errorf("%s : %s", packets.ErrorNetworkError, "EOF")), FailureTCP)
+	is.Equal(classifyFailure(x509.UnknownAuthorityError{}), FailureTLS)
+	is.Equal(classifyFailure(errors.New("tls: handshake failure")), FailureTLS)
+	is.Equal(classifyFailure(packets.ErrorRefusedBadUsernameOrPassword), FailureAuth)
+	is.Equal(classifyFailure(packets.ErrorRefusedNotAuthorised), FailureAuth)
+	is.Equal(classifyFailure(packets.ErrorRefusedServerUnavailable), FailureOther)
+}
+
+func TestConnHealthRecord(t *testing.T) {
+	is := is.New(t)
+	start := time.Now()
+	h := ConnHealth{}
+	h.record(ConnConnecting, "", nil, time.Time{}, start)
+	is.True(h.UnreachableSince.IsZero())
+	h.record(ConnBackoff, FailureDNS, errors.New("no such host"), start.Add(time.Second*2), start.Add(time.Second))
+	h.record(ConnConnecting, "", nil, time.Time{}, start.Add(time.Second*3))
+	h.record(ConnAuthFailed, FailureAuth, packets.ErrorRefusedNotAuthorised, time.Time{}, start.Add(time.Second*4))
+	is.Equal(h.State, ConnAuthFailed)
+	is.Equal(h.Attempts, 2)
+	is.Equal(h.Failure, FailureAuth)
+	is.Equal(h.UnreachableSince, start.Add(time.Second)) // unreachable since the first failure
+	is.Equal(h.Failures, map[FailureKind]int{FailureDNS: 1, FailureAuth: 1})
+	is.Equal(h.Transitions[1], ConnTransition{From: ConnConnecting, To: ConnBackoff, At: start.Add(time.Second),
+		Failure: FailureDNS, Error: "no such host"})
+
+	h.record(ConnConnecting, "", nil, time.Time{}, start.Add(time.Second*5))
+	h.record(ConnConnected, "", nil, time.Time{}, start.Add(time.Second*6))
+	is.Equal(h.Attempts, 0)
+	is.True(h.UnreachableSince.IsZero())
+	is.Equal(h.Since, start.Add(time.Second*6))
+	for i := 0; i < maxTransitions; i++ {
+		h.record(ConnConnected, "", nil, time.Time{}, start.Add(time.Second*7))
+	}
+	is.Equal(len(h.Transitions), maxTransitions)
+	is.Equal(h.Since, start.Add(time.Second*6)) // repeated transitions to the same state keep its start
+}
+
+func TestConnManager(t *testing.T) {
+	is := is.New(t)
+	// a port nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	addr := listener.Addr().String()
+	listener.Close()
+	server := config.Server{Name: "manager.example.com"}
+	server.Brokers = []string{"tcp://" + addr}
+	manager, err := setupMQTT(&server)
+	is.NoErr(err)
+	defer deleteServerClient(server.Name)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		manager.run(ctx)
+	}()
+	var health ConnHealth
+	deadline := time.Now().Add(time.Second * 10)
+	for time.Now().Before(deadline) {
+		var ok bool
+		if health, ok = getConnHealth(server.Name); ok && health.State == ConnBackoff {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	is.Equal(health.State, ConnBackoff)
+	is.Equal(health.Failure, FailureTCP)
+	is.True(strings.Contains(health.LastError, "refused"))
+	is.True(!health.UnreachableSince.IsZero())
+	is.True(health.NextAttempt.After(time.Now()))
+	cancel()
+	wg.Wait()
+	_, ok := getConnHealth(server.Name)
+	is.True(!ok) // the manager is removed when it stops
+}
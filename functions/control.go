@@ -0,0 +1,422 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/daemon"
+	"github.com/gravitl/netclient/events"
+	"github.com/gravitl/netclient/ncutils"
+	"github.com/gravitl/netclient/transport"
+	"github.com/gravitl/netmaker/logger"
+	"github.com/gravitl/netmaker/models"
+)
+
+const (
+	controlStatus     = "/status"
+	controlConnect    = "/connect"
+	controlDisconnect = "/disconnect"
+	controlPull       = "/pull"
+	controlProxy      = "/proxy"
+	controlReload     = "/reload"
+	controlHost       = "/host"
+	// controlTrafficKeys - rotates the traffic keys or changes their rotation schedule
+	controlTrafficKeys = "/traffickeys"
+	// controlEvents - streams the events published by the daemon as json lines
+	controlEvents = "/events"
+	// eventBuffer - events buffered for a client streaming events, further events are dropped until it catches up
+	eventBuffer = 256
+	// controlTimeout - time limit for a cli request to the daemon, long enough to allow for api calls made by pull
+	controlTimeout = time.Minute
+)
+
+var controlMutex = sync.Mutex{} // serializes control requests handled by the daemon
+
+// restartDaemon - restarts the daemon when it does not serve the control socket, replaced in tests
+var restartDaemon = daemon.Restart
+
+// controlSocketPath - path of the control socket on unix, replaced in tests
+var controlSocketPath = ncutils.ControlSocket
+
+// controlRequest - body of a request sent to the daemon over the control socket
+type controlRequest struct {
+	Network string        `json:"network,omitempty"`
+	Proxy   bool          `json:"proxy,omitempty"`
+	Host    *HostSettings `json:"host,omitempty"`
+	// Rotate and Interval - traffic key rotation, see TrafficKeys
+	Rotate   bool           `json:"rotate,omitempty"`
+	Interval *time.Duration `json:"interval,omitempty"`
+}
+
+// controlError - error response returned by the daemon over the control socket
+type controlError struct {
+	Message string `json:"message"`
+}
+
+// DaemonStatus - status of a running daemon as reported over the control socket
+type DaemonStatus struct {
+	Version      string                  `json:"version"`
+	PID          int                     `json:"pid"`
+	ProxyEnabled bool                    `json:"proxy_enabled"`
+	Networks     map[string]bool         `json:"networks"`      // connected status indexed by network name
+	Brokers      map[string]bool         `json:"brokers"`       // broker connection status indexed by server name
+	BrokerStatus map[string]BrokerStatus `json:"broker_status"` // active broker and broker health indexed by server name
+	PeerModes    map[string]string       `json:"peer_modes"`    // proxy mode of proxied/relayed peers indexed by public key
+}
+
+// controlSocket - returns the path to the control socket
+func controlSocket() string {
+	if ncutils.IsWindows() {
+		return config.GetNetclientPath() + "netclient.sock"
+	}
+	return controlSocketPath
+}
+
+// startControlServer - serves the local control api on the control socket
+// reload requests are delivered to the daemon on the same channel as SIGHUP
+func startControlServer(reset chan os.Signal) (*http.Server, error) {
+	socket := controlSocket()
+	if daemonRunning() {
+		return nil, errors.New("control socket is in use by another process")
+	}
+	// remove socket left behind by a daemon that did not shut down cleanly
+	if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	// event streams end when the server shuts down rather than holding up the shutdown
+	shutdown, stopStreams := context.WithCancel(context.Background())
+	mux := http.NewServeMux()
+	mux.HandleFunc(controlStatus, handleStatus)
+	mux.HandleFunc(controlEvents, eventsHandler(shutdown))
+	mux.HandleFunc(controlConnect, controlHandler(func(r controlRequest) (any, error) {
+		return controlSetConnected(r.Network, true)
+	}))
+	mux.HandleFunc(controlDisconnect, controlHandler(func(r controlRequest) (any, error) {
+		return controlSetConnected(r.Network, false)
+	}))
+	mux.HandleFunc(controlPull, controlHandler(func(r controlRequest) (any, error) {
+		node, err := pull(r.Network)
+		if err != nil {
+			return nil, err
+		}
+		return node, refreshInterface()
+	}))
+	mux.HandleFunc(controlProxy, controlHandler(func(r controlRequest) (any, error) {
+		if err := controlSetProxy(r.Proxy); err != nil {
+			return nil, err
+		}
+		// the reload restarts the proxy and resets the peer endpoints
+		requestReload(reset)
+		return nil, nil
+	}))
+	mux.HandleFunc(controlHost, controlHandler(func(r controlRequest) (any, error) {
+		if r.Host == nil {
+			return nil, errors.New("no host settings provided")
+		}
+		return nil, controlSetHost(r.Host)
+	}))
+	mux.HandleFunc(controlTrafficKeys, controlHandler(func(r controlRequest) (any, error) {
+		return updateTrafficKeys(&r)
+	}))
+	mux.HandleFunc(controlReload, controlHandler(func(r controlRequest) (any, error) {
+		logger.Log(0, "reload requested over control socket")
+		requestReload(reset)
+		return nil, nil
+	}))
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * 5,
+	}
+	server.RegisterOnShutdown(stopStreams)
+	go func() {
+		if err := server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Log(0, "control server stopped", err.Error())
+		}
+	}()
+	logger.Log(1, "serving local control api on", socket)
+	return server, nil
+}
+
+// requestReload - delivers a reload to the daemon on the channel used for SIGHUP
+func requestReload(reset chan os.Signal) {
+	select {
+	case reset <- syscall.SIGHUP:
+	default:
+		// a reload is already pending
+	}
+}
+
+// stopControlServer - shuts down the control server and removes the socket
+func stopControlServer(server *http.Server) {
+	if server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Log(0, "error shutting down control server", err.Error())
+	}
+	_ = os.Remove(controlSocket())
+}
+
+// controlHandler - wraps a control operation as a http handler
+// operations are serialized as they mutate the daemon configuration
+func controlHandler(op func(controlRequest) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeControlResponse(w, http.StatusMethodNotAllowed, controlError{Message: "method not allowed"})
+			return
+		}
+		var request controlRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeControlResponse(w, http.StatusBadRequest, controlError{Message: err.Error()})
+			return
+		}
+		controlMutex.Lock()
+		response, err := op(request)
+		controlMutex.Unlock()
+		if err != nil {
+			writeControlResponse(w, http.StatusInternalServerError, controlError{Message: err.Error()})
+			return
+		}
+		writeControlResponse(w, http.StatusOK, response)
+	}
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeControlResponse(w, http.StatusMethodNotAllowed, controlError{Message: "method not allowed"})
+		return
+	}
+	// status only reads the daemon state, so it does not wait for control operations such as a pull
+	status := DaemonStatus{
+		Version:      config.Version,
+		PID:          os.Getpid(),
+		ProxyEnabled: config.Netclient().ProxyEnabled,
+		Networks:     make(map[string]bool),
+		Brokers:      make(map[string]bool),
+		PeerModes:    proxyPeerModes(),
+		BrokerStatus: getBrokerStatus(),
+	}
+	for network, node := range config.GetNodes() {
+		status.Networks[network] = node.Connected
+	}
+	for server, mqclient := range serverClients() {
+		status.Brokers[server] = mqclient != nil && mqclient.State() != transport.StateDisconnected
+	}
+	writeControlResponse(w, http.StatusOK, status)
+}
+
+// eventsHandler - streams the events published by the daemon as json lines until the client disconnects or
+// shutdown is done; the kinds of events to stream may be given as kind query parameters
+func eventsHandler(shutdown context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeControlResponse(w, http.StatusMethodNotAllowed, controlError{Message: "method not allowed"})
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeControlResponse(w, http.StatusInternalServerError, controlError{Message: "streaming not supported"})
+			return
+		}
+		var kinds []events.Kind
+		for _, kind := range r.URL.Query()["kind"] {
+			kinds = append(kinds, events.Kind(kind))
+		}
+		records, stop := bus.Listen(eventBuffer, kinds...)
+		defer stop()
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		encoder := json.NewEncoder(w)
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-shutdown.Done():
+				return
+			case record := <-records:
+				if err := encoder.Encode(record); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// StreamEvents - copies the events published by the running daemon to w as json lines until the daemon stops,
+// limited to the given kinds if any
+func StreamEvents(w io.Writer, kinds []string) error {
+	if !daemonRunning() {
+		return errors.New("daemon is not running")
+	}
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", controlSocket())
+			},
+		},
+	}
+	query := url.Values{"kind": kinds}
+	resp, err := client.Get("http://netclient" + controlEvents + "?" + query.Encode())
+	if err != nil {
+		return fmt.Errorf("could not reach daemon %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var errResp controlError
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+			return fmt.Errorf("daemon returned %s", resp.Status)
+		}
+		return errors.New(errResp.Message)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func writeControlResponse(w http.ResponseWriter, code int, response any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.Log(0, "error writing control response", err.Error())
+	}
+}
+
+// controlSetConnected - daemon side of connect/disconnect; uses the daemon's broker connection
+// and reconfigures the interface in place rather than restarting the daemon
+func controlSetConnected(network string, connected bool) (*config.Node, error) {
+	node, err := setConnected(network, connected)
+	if err != nil {
+		return nil, err
+	}
+	if err := PublishNodeUpdate(node); err != nil {
+		return nil, err
+	}
+	return node, refreshInterface()
+}
+
+// controlSetProxy - daemon side of proxy on/off, saves the setting and publishes it to the servers
+// the proxy is restarted by the reload requested afterwards
+func controlSetProxy(status bool) error {
+	logger.Log(1, fmt.Sprint("changing proxy status to ", status))
+	if err := config.Update(func(state *config.State) error {
+		state.Host.ProxyEnabled = status
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := PublishGlobalHostUpdate(models.UpdateHost); err != nil {
+		return err
+	}
+	bus.Publish(events.ProxyStateChanged{Enabled: status})
+	return nil
+}
+
+// controlSetHost - daemon side of host setting changes made by apply
+func controlSetHost(settings *HostSettings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	if err := setHostSettings(settings); err != nil {
+		return err
+	}
+	return refreshInterface()
+}
+
+// refreshInterface - applies the in memory configuration to the existing netmaker interface
+func refreshInterface() error {
+	if err := configureInterface(); err != nil {
+		return fmt.Errorf("could not configure netmaker interface %w", err)
+	}
+	return setPeers()
+}
+
+// daemonRunning - checks if a daemon is serving the control socket
+func daemonRunning() bool {
+	conn, err := net.DialTimeout("unix", controlSocket(), time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// GetDaemonStatus - retrieves the status of the running daemon over the control socket
+func GetDaemonStatus() (*DaemonStatus, error) {
+	var status DaemonStatus
+	if err := callDaemon(http.MethodGet, controlStatus, nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// reloadDaemon - asks the running daemon to reload its configuration,
+// falls back to restarting the daemon service if it can not be reached
+func reloadDaemon() error {
+	if daemonRunning() {
+		return callDaemon(http.MethodPost, controlReload, &controlRequest{}, nil)
+	}
+	return restartDaemon()
+}
+
+// callDaemon - sends a request to the daemon over the control socket and decodes the response into response
+func callDaemon(method, route string, request *controlRequest, response any) error {
+	client := http.Client{
+		Timeout: controlTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", controlSocket())
+			},
+		},
+	}
+	var body bytes.Buffer
+	if request != nil {
+		if err := json.NewEncoder(&body).Encode(request); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, "http://netclient"+route, &body)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not reach daemon %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var errResp controlError
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+			return fmt.Errorf("daemon returned %s", resp.Status)
+		}
+		return errors.New(errResp.Message)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
@@ -0,0 +1,180 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/transport"
+	"github.com/gravitl/netmaker/models"
+	"github.com/matryer/is"
+)
+
+// useTestSocket - serves the control socket from a scratch directory for the rest of the test
+// the directory is kept short as unix socket paths are limited to about 100 bytes
+func useTestSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	controlSocketPath = filepath.Join(dir, "netclient.sock")
+}
+
+// startTestControl - serves the control api of a test daemon, returning the channel reloads are requested on
+func startTestControl(t *testing.T) chan os.Signal {
+	is := is.New(t)
+	useTestSocket(t)
+	reset := make(chan os.Signal, 1)
+	server, err := startControlServer(reset)
+	is.NoErr(err)
+	t.Cleanup(func() { stopControlServer(server) })
+	is.True(daemonRunning())
+	return reset
+}
+
+// controlStatusCode - sends a raw request to the control socket and returns the status code of the response
+func controlStatusCode(t *testing.T, method, route, body string) int {
+	is := is.New(t)
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", controlSocket())
+			},
+		},
+	}
+	req, err := http.NewRequest(method, "http://netclient"+route, strings.NewReader(body))
+	is.NoErr(err)
+	resp, err := client.Do(req)
+	is.NoErr(err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestControlServer(t *testing.T) {
+	d := startTestDaemon(t)
+	reset := startTestControl(t)
+	nodeTopic := fmt.Sprintf("update/%s", config.GetNode("net1").ID)
+
+	t.Run("in use", func(t *testing.T) {
+		is := is.New(t)
+		_, err := startControlServer(make(chan os.Signal, 1))
+		is.True(err != nil) // a second daemon does not take over the socket
+		is.True(daemonRunning())
+	})
+	t.Run("status", func(t *testing.T) {
+		is := is.New(t)
+		// status does not wait for a control operation in progress
+		controlMutex.Lock()
+		defer controlMutex.Unlock()
+		status, err := GetDaemonStatus()
+		is.NoErr(err)
+		is.Equal(status.PID, os.Getpid())
+		is.Equal(status.Networks, map[string]bool{"net1": true})
+		is.Equal(status.Brokers, map[string]bool{d.name: true})
+	})
+	t.Run("method", func(t *testing.T) {
+		is := is.New(t)
+		is.Equal(controlStatusCode(t, http.MethodGet, controlDisconnect, ""), http.StatusMethodNotAllowed)
+		is.Equal(controlStatusCode(t, http.MethodPost, controlStatus, ""), http.StatusMethodNotAllowed)
+		is.Equal(controlStatusCode(t, http.MethodPost, controlDisconnect, "{"), http.StatusBadRequest)
+	})
+	t.Run("disconnect", func(t *testing.T) {
+		is := is.New(t)
+		received := d.receive(t, "update/#")
+		configured := d.configured
+		is.NoErr(Disconnect("net1"))
+		is.True(!config.GetNode("net1").Connected)
+		is.Equal(d.configured, configured+1) // interface reconfigured in place
+		var node config.Node
+		is.NoErr(json.Unmarshal(received()[nodeTopic], &node))
+		is.True(!node.Connected)
+		is.NoErr(config.ReadNodeConfig())
+		is.True(!config.GetNode("net1").Connected) // saved
+
+		err := Disconnect("net1")
+		is.True(err != nil) // error of the daemon returned to the cli
+		is.Equal(err.Error(), "node is already disconnected")
+		is.Equal(Connect("nonet").Error(), "no such network")
+	})
+	t.Run("connect", func(t *testing.T) {
+		is := is.New(t)
+		received := d.receive(t, "update/#")
+		is.NoErr(Connect("net1"))
+		is.True(config.GetNode("net1").Connected)
+		var node config.Node
+		is.NoErr(json.Unmarshal(received()[nodeTopic], &node))
+		is.True(node.Connected)
+	})
+	t.Run("reload", func(t *testing.T) {
+		is := is.New(t)
+		is.NoErr(reloadDaemon())
+		// a reload requested while one is pending is not queued twice and does not block
+		is.NoErr(reloadDaemon())
+		select {
+		case <-reset:
+		case <-time.After(time.Second):
+			t.Fatal("no reload requested")
+		}
+		select {
+		case <-reset:
+			t.Fatal("reload requested twice")
+		default:
+		}
+	})
+	t.Run("proxy", func(t *testing.T) {
+		is := is.New(t)
+		received := d.receive(t, "host/serverupdate/#")
+		is.NoErr(ChangeProxyStatus(true))
+		is.True(config.Netclient().ProxyEnabled)
+		host, err := config.ReadNetclientConfig()
+		is.NoErr(err)
+		is.True(host.ProxyEnabled) // saved
+		var update models.HostUpdate
+		is.NoErr(json.Unmarshal(received()["host/serverupdate/"+config.Netclient().ID.String()], &update))
+		is.Equal(update.Action, models.HostMqAction(models.UpdateHost))
+		is.True(update.Host.ProxyEnabled)
+		select {
+		case <-reset: // the reload restarts the proxy
+		case <-time.After(time.Second):
+			t.Fatal("no reload requested")
+		}
+	})
+}
+
+func TestControlFallback(t *testing.T) {
+	is := is.New(t)
+	d := startTestDaemon(t)
+	useTestSocket(t)
+	is.True(!daemonRunning())
+	// the cli connects to the broker itself and restarts the daemon
+	newSingletonTransport = func(_ *mqtt.ClientOptions, callbacks transport.Callbacks) transport.Transport {
+		return d.broker.Client(callbacks)
+	}
+	restarts := 0
+	restartDaemon = func() error {
+		restarts++
+		return nil
+	}
+	received := d.receive(t, "update/#")
+	is.NoErr(Disconnect("net1"))
+	is.Equal(restarts, 1)
+	is.NoErr(config.ReadNodeConfig())
+	is.True(!config.GetNode("net1").Connected)
+	var node config.Node
+	is.NoErr(json.Unmarshal(received()[fmt.Sprintf("update/%s", config.GetNode("net1").ID)], &node))
+	is.True(!node.Connected)
+
+	is.NoErr(reloadDaemon())
+	is.Equal(restarts, 2)
+}
@@ -12,23 +12,61 @@ import (
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/events"
 	"github.com/gravitl/netclient/local"
 	"github.com/gravitl/netclient/ncutils"
 	"github.com/gravitl/netclient/nmproxy"
-	proxy_cfg "github.com/gravitl/netclient/nmproxy/config"
+	"github.com/gravitl/netclient/transport"
 	"github.com/gravitl/netclient/wireguard"
 	"github.com/gravitl/netmaker/logger"
 	"github.com/gravitl/netmaker/models"
-	"github.com/gravitl/netmaker/mq"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 const lastNodeUpdate = "lnu"
 
 var messageCache = new(sync.Map)
-var ServerSet = make(map[string]mqtt.Client)
+
+// serverSet - the transports of the servers, by server name
+var serverSet = struct {
+	sync.RWMutex
+	clients map[string]transport.Transport
+}{clients: make(map[string]transport.Transport)}
+
 var ProxyManagerChan = make(chan *models.HostPeerUpdate, 50)
 
+// serverClient - the transport of a server, nil if there is none
+func serverClient(name string) transport.Transport {
+	serverSet.RLock()
+	defer serverSet.RUnlock()
+	return serverSet.clients[name]
+}
+
+// setServerClient - sets the transport of a server
+func setServerClient(name string, client transport.Transport) {
+	serverSet.Lock()
+	defer serverSet.Unlock()
+	serverSet.clients[name] = client
+}
+
+// deleteServerClient - removes the transport of a server
+func deleteServerClient(name string) {
+	serverSet.Lock()
+	defer serverSet.Unlock()
+	delete(serverSet.clients, name)
+}
+
+// serverClients - a copy of the transports of the servers, by server name
+func serverClients() map[string]transport.Transport {
+	serverSet.RLock()
+	defer serverSet.RUnlock()
+	clients := make(map[string]transport.Transport, len(serverSet.clients))
+	for name, client := range serverSet.clients {
+		clients[name] = client
+	}
+	return clients
+}
+
 type cachedMessage struct {
 	Message  string
 	LastSeen time.Time
@@ -46,6 +84,16 @@ func startProxy(wg *sync.WaitGroup) context.CancelFunc {
 	return cancel
 }
 
+// SetWireGuardMode - forces the wireguard mode of the interface created by the daemon, overriding the host config
+func SetWireGuardMode(mode string) error {
+	m, err := wireguard.ParseMode(mode)
+	if err != nil {
+		return err
+	}
+	wireguard.SetMode(m)
+	return nil
+}
+
 // Daemon runs netclient daemon
 func Daemon() {
 	logger.Log(0, "netclient daemon started -- version:", config.Version)
@@ -55,122 +103,86 @@ func Daemon() {
 	if err := local.SetIPForwarding(); err != nil {
 		logger.Log(0, "unable to set IPForwarding", err.Error())
 	}
-	wg := sync.WaitGroup{}
 	quit := make(chan os.Signal, 1)
 	reset := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGTERM, os.Interrupt)
 	signal.Notify(reset, syscall.SIGHUP)
-	cancel := startGoRoutines(&wg)
-	stopProxy := startProxy(&wg)
+	unsubscribe := subscribeSubsystems()
+	defer unsubscribe()
+	routines, ifaceErr := startGoRoutines()
+	// resume a traffic key rotation interrupted before all servers confirmed the new key
+	go announceTrafficKey()
+	controlServer, err := startControlServer(reset)
+	if err != nil {
+		logger.Log(0, "unable to start local control server", err.Error())
+	}
+	// the daemon is ready once the interface is configured and a broker is connected, the start timeout of the
+	// service allows for slow brokers; broker state changes are watched so readiness is reported without delay
+	brokerChanges, stopBrokerChanges := bus.Listen(16, events.KindBrokerStateChanged)
+	defer stopBrokerChanges()
+	ready := false
+	ticker := time.NewTicker(notifyInterval())
+	defer ticker.Stop()
 	for {
+		if !ready && ifaceErr == nil && routines.ready() {
+			ready = true
+			logger.Log(0, "netclient daemon ready")
+			notify("READY=1\nSTATUS=" + routines.status(ifaceErr))
+		}
 		select {
 		case <-quit:
 			logger.Log(0, "shutting down netclient daemon")
-			closeRoutines([]context.CancelFunc{
-				cancel,
-				stopProxy,
-			}, &wg)
+			notify("STOPPING=1")
+			stopControlServer(controlServer)
+			routines.stop()
 			logger.Log(0, "shutdown complete")
 			return
 		case <-reset:
-			logger.Log(0, "received reset")
-			closeRoutines([]context.CancelFunc{
-				cancel,
-				stopProxy,
-			}, &wg)
-			logger.Log(0, "restarting daemon")
-			cancel = startGoRoutines(&wg)
-			if !proxy_cfg.GetCfg().ProxyStatus {
-				stopProxy = startProxy(&wg)
+			logger.Log(0, "received reset, reloading configuration")
+			notify("RELOADING=1")
+			routines, ifaceErr = routines.reload()
+			// as on start, ready again once the interface is configured and a broker is connected
+			ready = false
+		case <-brokerChanges:
+		case <-ticker.C:
+			if ifaceErr != nil {
+				logger.Log(0, "retrying set up of netmaker interface")
+				if ifaceErr = createInterface(); ifaceErr != nil {
+					logger.Log(0, ifaceErr.Error())
+				}
 			}
-
-		}
-	}
-}
-
-func closeRoutines(closers []context.CancelFunc, wg *sync.WaitGroup) {
-	for i := range closers {
-		closers[i]()
-	}
-	for _, mqclient := range ServerSet {
-		if mqclient != nil {
-			mqclient.Disconnect(250)
-		}
-	}
-	wg.Wait()
-	logger.Log(0, "closing netmaker interface")
-	iface := wireguard.GetInterface()
-	iface.Close()
-}
-
-// startGoRoutines starts the daemon goroutines
-func startGoRoutines(wg *sync.WaitGroup) context.CancelFunc {
-	ctx, cancel := context.WithCancel(context.Background())
-	if _, err := config.ReadNetclientConfig(); err != nil {
-		logger.Log(0, "error reading neclient config file", err.Error())
-	}
-	if err := config.ReadNodeConfig(); err != nil {
-		logger.Log(0, "error reading node map from disk", err.Error())
-	}
-	if err := config.ReadServerConf(); err != nil {
-		logger.Log(0, "errors reading server map from disk", err.Error())
-	}
-	nodes := config.GetNodes()
-	logger.Log(3, "configuring netmaker wireguard interface")
-	nc := wireguard.NewNCIface(config.Netclient(), nodes)
-	nc.Create()
-	nc.Configure()
-	wireguard.SetPeers()
-	if len(config.Servers) == 0 {
-		ProxyManagerChan <- &models.HostPeerUpdate{
-			ProxyUpdate: models.ProxyManagerPayload{
-				Action: models.ProxyDeleteAllPeers,
-			},
+			state := "STATUS=" + routines.status(ifaceErr)
+			if watchdogInterval() > 0 {
+				if err := routines.alive(); err != nil {
+					logger.Log(0, "liveness check failed", err.Error())
+				} else {
+					state = "WATCHDOG=1\n" + state
+				}
+			}
+			notify(state)
 		}
 	}
-	for _, server := range config.Servers {
-		logger.Log(1, "started daemon for server ", server.Name)
-		// see https://www.evanjones.ca/go-gotcha-loop-variables.html
-		server := server
-		wg.Add(1)
-		go messageQueue(ctx, wg, &server)
-	}
-	wg.Add(1)
-	go Checkin(ctx, wg)
-	return cancel
 }
 
 // sets up Message Queue and subsribes/publishes updates to/from server
 // the client should subscribe to ALL nodes that exist on server locally
+// the connection to the brokers of the server is kept until ctx is done
 func messageQueue(ctx context.Context, wg *sync.WaitGroup, server *config.Server) {
 	defer wg.Done()
 	logger.Log(0, "netclient message queue started for server:", server.Name)
-	err := setupMQTT(server)
+	manager, err := setupMQTT(server)
 	if err != nil {
-		logger.Log(0, "unable to connect to broker", server.Broker, err.Error())
+		logger.Log(0, "unable to set up connection to brokers of server", server.Name, err.Error())
 		return
 	}
-	defer ServerSet[server.Name].Disconnect(250)
-	<-ctx.Done()
+	defer manager.transport.Disconnect()
+	manager.run(ctx)
 	logger.Log(0, "shutting down message queue for server", server.Name)
 }
 
-// setupMQTT creates a connection to broker
-func setupMQTT(server *config.Server) error {
-	opts := mqtt.NewClientOptions()
-	broker := server.Broker
-	port := server.MQPort
-	opts.AddBroker(fmt.Sprintf("wss://%s:%s", broker, port))
-	opts.SetUsername(server.MQUserName)
-	opts.SetPassword(server.MQPassword)
-	//opts.SetClientID(ncutils.MakeRandomString(23))
-	opts.SetClientID(server.MQID.String())
-	opts.SetAutoReconnect(true)
-	opts.SetConnectRetry(true)
-	opts.SetConnectRetryInterval(time.Second << 2)
-	opts.SetKeepAlive(time.Minute >> 1)
-	opts.SetWriteTimeout(time.Minute)
-	opts.SetOnConnectHandler(func(client mqtt.Client) {
+// setupMQTT creates the transport of a server and the manager keeping its connection to the brokers
+func setupMQTT(server *config.Server) (*connManager, error) {
+	manager, err := newConnManager(server, func(client transport.Transport) {
 		logger.Log(0, "mqtt connect handler")
 		nodes := config.GetNodes()
 		for _, node := range nodes {
@@ -178,43 +190,49 @@ func setupMQTT(server *config.Server) error {
 			setSubscriptions(client, &node)
 		}
 		setHostSubscription(client, server.Name)
+		// deliver the messages queued while the broker was unreachable
+		go replayOutbox(server.Name)
 	})
+	if err != nil {
+		return nil, err
+	}
+	setServerClient(server.Name, manager.transport)
+	return manager, nil
+}
+
+// newTransport - creates the transport of a server managed by the daemon, replaced by tests to use an in-process broker
+var newTransport = newPahoTransport
+
+// newPahoTransport - creates a paho transport connecting to the brokers of a server
+// the connection manager handles reconnects, so auto reconnect and connect retry are disabled
+func newPahoTransport(server *config.Server, callbacks transport.Callbacks) (transport.Transport, error) {
+	opts := mqtt.NewClientOptions()
+	opts.SetUsername(server.MQUserName)
+	opts.SetPassword(server.MQPassword)
+	//opts.SetClientID(ncutils.MakeRandomString(23))
+	opts.SetClientID(server.MQID.String())
+	opts.SetKeepAlive(time.Minute >> 1)
+	opts.SetWriteTimeout(time.Minute)
 	opts.SetOrderMatters(true)
 	opts.SetResumeSubs(true)
-	opts.SetConnectionLostHandler(func(c mqtt.Client, e error) {
-		logger.Log(0, "detected broker connection lost for", server.Broker)
-	})
-	mqclient := mqtt.NewClient(opts)
-	ServerSet[server.Name] = mqclient
-	var connecterr error
-	for count := 0; count < 3; count++ {
-		connecterr = nil
-		if token := mqclient.Connect(); !token.WaitTimeout(30*time.Second) || token.Error() != nil {
-			logger.Log(0, "unable to connect to broker, retrying ...")
-			if token.Error() == nil {
-				connecterr = errors.New("connect timeout")
-			} else {
-				connecterr = token.Error()
-			}
-			if err := checkBroker(server.Broker, server.MQPort); err != nil {
-				logger.Log(0, "could not connect to broker", server.Broker, err.Error())
-			}
-		}
-	}
-	if connecterr != nil {
-		logger.Log(0, "failed to establish connection to broker: ", connecterr.Error())
-		return connecterr
+	opts.SetAutoReconnect(false)
+	opts.SetConnectRetry(false)
+	opts.SetConnectTimeout(connectTimeout)
+	if err := setBrokers(opts, server); err != nil {
+		return nil, err
 	}
-	return nil
+	return transport.NewPaho(opts, callbacks), nil
+}
+
+// newSingletonTransport - creates the transport used by cli commands, replaced by tests to use an in-process broker
+var newSingletonTransport = func(opts *mqtt.ClientOptions, callbacks transport.Callbacks) transport.Transport {
+	return transport.NewPaho(opts, callbacks)
 }
 
 // func setMQTTSingenton creates a connection to broker for single use (ie to publish a message)
 // only to be called from cli (eg. connect/disconnect, join, leave) and not from daemon ---
 func setupMQTTSingleton(server *config.Server, publishOnly bool) error {
 	opts := mqtt.NewClientOptions()
-	broker := server.Broker
-	port := server.MQPort
-	opts.AddBroker(fmt.Sprintf("wss://%s:%s", broker, port))
 	opts.SetUsername(server.MQUserName)
 	opts.SetPassword(server.MQPassword)
 	opts.SetClientID(server.MQID.String())
@@ -223,61 +241,58 @@ func setupMQTTSingleton(server *config.Server, publishOnly bool) error {
 	opts.SetConnectRetryInterval(time.Second << 2)
 	opts.SetKeepAlive(time.Minute >> 1)
 	opts.SetWriteTimeout(time.Minute)
-	opts.SetOnConnectHandler(func(client mqtt.Client) {
-		if !publishOnly {
-			logger.Log(0, "mqtt connect handler")
-			nodes := config.GetNodes()
-			for _, node := range nodes {
-				node := node
-				setSubscriptions(client, &node)
-			}
-			setHostSubscription(client, server.Name)
-		}
-	})
 	opts.SetOrderMatters(true)
 	opts.SetResumeSubs(true)
-	opts.SetConnectionLostHandler(func(c mqtt.Client, e error) {
-		logger.Log(0, "detected broker connection lost for", server.Broker)
+	if err := setBrokers(opts, server); err != nil {
+		return err
+	}
+	mqclient := newSingletonTransport(opts, transport.Callbacks{
+		OnConnect: func(client transport.Transport) {
+			if !publishOnly {
+				logger.Log(0, "mqtt connect handler")
+				nodes := config.GetNodes()
+				for _, node := range nodes {
+					node := node
+					setSubscriptions(client, &node)
+				}
+				setHostSubscription(client, server.Name)
+			}
+		},
 	})
-	mqclient := mqtt.NewClient(opts)
-	ServerSet[server.Name] = mqclient
-	var connecterr error
-	if token := mqclient.Connect(); !token.WaitTimeout(30*time.Second) || token.Error() != nil {
+	setServerClient(server.Name, mqclient)
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+	if err := mqclient.Connect(ctx); err != nil {
 		logger.Log(0, "unable to connect to broker, retrying ...")
-		if token.Error() == nil {
-			connecterr = errors.New("connect timeout")
-		} else {
-			connecterr = token.Error()
+		if errors.Is(err, context.DeadlineExceeded) {
+			return errors.New("connect timeout")
 		}
+		return err
 	}
-	return connecterr
+	return nil
 }
 
 // setHostSubscription sets MQ client subscriptions for host
 // should be called for each server host is registered on.
-func setHostSubscription(client mqtt.Client, server string) {
+func setHostSubscription(client transport.Transport, server string) {
 	hostID := config.Netclient().ID
 	logger.Log(3, fmt.Sprintf("subscribed to host peer updates  peers/host/%s/%s", hostID.String(), server))
-	if token := client.Subscribe(fmt.Sprintf("peers/host/%s/%s", hostID.String(), server), 0, mqtt.MessageHandler(HostPeerUpdate)); token.Wait() && token.Error() != nil {
-		logger.Log(0, "MQ host sub: ", hostID.String(), token.Error().Error())
+	if err := client.Subscribe(fmt.Sprintf("peers/host/%s/%s", hostID.String(), server), 0, HostPeerUpdate); err != nil {
+		logger.Log(0, "MQ host sub: ", hostID.String(), err.Error())
 		return
 	}
 	logger.Log(3, fmt.Sprintf("subscribed to host updates  host/update/%s/%s", hostID.String(), server))
-	if token := client.Subscribe(fmt.Sprintf("host/update/%s/%s", hostID.String(), server), 0, mqtt.MessageHandler(HostUpdate)); token.Wait() && token.Error() != nil {
-		logger.Log(0, "MQ host sub: ", hostID.String(), token.Error().Error())
+	if err := client.Subscribe(fmt.Sprintf("host/update/%s/%s", hostID.String(), server), 0, HostUpdate); err != nil {
+		logger.Log(0, "MQ host sub: ", hostID.String(), err.Error())
 		return
 	}
 }
 
 // setSubcriptions sets MQ client subscriptions for a specific node config
 // should be called for each node belonging to a given server
-func setSubscriptions(client mqtt.Client, node *config.Node) {
-	if token := client.Subscribe(fmt.Sprintf("update/%s/%s", node.Network, node.ID), 0, mqtt.MessageHandler(NodeUpdate)); token.WaitTimeout(mq.MQ_TIMEOUT*time.Second) && token.Error() != nil {
-		if token.Error() == nil {
-			logger.Log(0, "network:", node.Network, "connection timeout")
-		} else {
-			logger.Log(0, "network:", node.Network, token.Error().Error())
-		}
+func setSubscriptions(client transport.Transport, node *config.Node) {
+	if err := client.Subscribe(fmt.Sprintf("update/%s/%s", node.Network, node.ID), 0, NodeUpdate); err != nil {
+		logger.Log(0, "network:", node.Network, err.Error())
 		return
 	}
 	logger.Log(3, fmt.Sprintf("subscribed to peer updates peers/%s/%s", node.Network, node.ID))
@@ -288,13 +303,6 @@ func decryptMsg(serverName string, msg []byte) ([]byte, error) {
 	if len(msg) <= 24 { // make sure message is of appropriate length
 		return nil, fmt.Errorf("recieved invalid message from broker %v", msg)
 	}
-	host := config.Netclient()
-	// setup the keys
-	diskKey, err := ncutils.ConvertBytesToKey(host.TrafficKeyPrivate)
-	if err != nil {
-		return nil, err
-	}
-
 	server := config.GetServer(serverName)
 	if server == nil {
 		return nil, errors.New("nil server for " + serverName)
@@ -303,7 +311,11 @@ func decryptMsg(serverName string, msg []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return DeChunk(msg, serverPubKey, diskKey)
+	decrypted, err := openMessage(serverName, msg, serverPubKey)
+	if err != nil {
+		return nil, err
+	}
+	return checkReplay(server, decrypted)
 }
 
 func read(network, which string) string {
@@ -332,54 +344,47 @@ func insert(network, which, cache string) {
 
 // on a delete usually, pass in the nodecfg to unsubscribe client broker communications
 // for the node in nodeCfg
-func unsubscribeNode(client mqtt.Client, node *config.Node) {
-	client.Unsubscribe(fmt.Sprintf("update/%s/%s", node.Network, node.ID))
-	var ok = true
-	if token := client.Unsubscribe(fmt.Sprintf("update/%s/%s", node.Network, node.ID)); token.WaitTimeout(mq.MQ_TIMEOUT*time.Second) && token.Error() != nil {
-		if token.Error() == nil {
-			logger.Log(1, "network:", node.Network, "unable to unsubscribe from updates for node ", node.ID.String(), "\n", "connection timeout")
-		} else {
-			logger.Log(1, "network:", node.Network, "unable to unsubscribe from updates for node ", node.ID.String(), "\n", token.Error().Error())
-		}
-		ok = false
+func unsubscribeNode(client transport.Transport, node *config.Node) {
+	if err := client.Unsubscribe(fmt.Sprintf("update/%s/%s", node.Network, node.ID)); err != nil {
+		logger.Log(1, "network:", node.Network, "unable to unsubscribe from updates for node ", node.ID.String(), "\n", err.Error())
+		return
 	} // peer updates belong to host now
-
-	if ok {
-		logger.Log(1, "network:", node.Network, "successfully unsubscribed node ", node.ID.String())
-	}
+	logger.Log(1, "network:", node.Network, "successfully unsubscribed node ", node.ID.String())
 }
 
 // unsubscribe client broker communications for host topics
-func unsubscribeHost(client mqtt.Client, server string) {
+func unsubscribeHost(client transport.Transport, server string) {
 	hostID := config.Netclient().ID
 	logger.Log(3, fmt.Sprintf("removing subscription for host peer updates peers/host/%s/%s", hostID.String(), server))
-	if token := client.Unsubscribe(fmt.Sprintf("peers/host/%s/%s", hostID.String(), server)); token.WaitTimeout(mq.MQ_TIMEOUT*time.Second) && token.Error() != nil {
-		logger.Log(0, "unable to unsubscribe from host peer updates: ", hostID.String(), token.Error().Error())
+	if err := client.Unsubscribe(fmt.Sprintf("peers/host/%s/%s", hostID.String(), server)); err != nil {
+		logger.Log(0, "unable to unsubscribe from host peer updates: ", hostID.String(), err.Error())
 		return
 	}
 	logger.Log(3, fmt.Sprintf("removing subscription for host updates  host/update/%s/%s", hostID.String(), server))
-	if token := client.Unsubscribe(fmt.Sprintf("host/update/%s/%s", hostID.String(), server)); token.WaitTimeout(mq.MQ_TIMEOUT*time.Second) && token.Error() != nil {
-		logger.Log(0, "unable to unsubscribe from host updates: ", hostID.String(), token.Error().Error())
+	if err := client.Unsubscribe(fmt.Sprintf("host/update/%s/%s", hostID.String(), server)); err != nil {
+		logger.Log(0, "unable to unsubscribe from host updates: ", hostID.String(), err.Error())
 		return
 	}
 }
 
 // UpdateKeys -- updates private key and returns new publickey
-func UpdateKeys(node *config.Node, host *config.Config, client mqtt.Client) error {
-	var err error
+func UpdateKeys(node *config.Node, client transport.Transport) error {
 	logger.Log(0, "received message to update wireguard keys for network ", node.Network)
-	host.PrivateKey, err = wgtypes.GeneratePrivateKey()
+	privateKey, err := wgtypes.GeneratePrivateKey()
 	if err != nil {
 		logger.Log(0, "network:", node.Network, "error generating privatekey ", err.Error())
 		return err
 	}
 	file := config.GetNetclientPath() + "netmaker.conf"
-	if err := wireguard.UpdatePrivateKey(file, host.PrivateKey.String()); err != nil {
+	if err := wireguard.UpdatePrivateKey(file, privateKey.String()); err != nil {
 		logger.Log(0, "network:", node.Network, "error updating wireguard key ", err.Error())
 		return err
 	}
-	host.PublicKey = host.PrivateKey.PublicKey()
-	if err := config.WriteNetclientConfig(); err != nil {
+	if err := config.Update(func(state *config.State) error {
+		state.Host.PrivateKey = privateKey
+		state.Host.PublicKey = privateKey.PublicKey()
+		return nil
+	}); err != nil {
 		logger.Log(0, "error saving netclient config", err.Error())
 	}
 	PublishNodeUpdate(node)
@@ -389,5 +394,5 @@ func UpdateKeys(node *config.Node, host *config.Config, client mqtt.Client) erro
 // RemoveServer - removes a server from server conf given a specific node
 func RemoveServer(node *config.Node) {
 	logger.Log(0, "removing server", node.Server, "from mq")
-	delete(ServerSet, node.Server)
+	deleteServerClient(node.Server)
 }
@@ -2,28 +2,29 @@ package functions
 
 import (
 	"fmt"
-	"os"
 	"strings"
 
 	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/lock"
 	"github.com/gravitl/netclient/ncutils"
 	"github.com/guumaster/hostctl/pkg/file"
 	"github.com/guumaster/hostctl/pkg/parser"
 	"github.com/guumaster/hostctl/pkg/types"
 )
 
+// hostsLock - name of the lock controlling access to the hosts file
+const hostsLock = "hosts"
+
 func removeHostDNS(network string) error {
 	etchosts := "/etc/hosts"
-	temp := os.TempDir()
-	lockfile := temp + "/netclient-lock"
 	if ncutils.IsWindows() {
 		etchosts = "c:\\windows\\system32\\drivers\\etc\\hosts"
-		lockfile = temp + "\\netclient-lock"
 	}
-	if err := config.Lock(lockfile); err != nil {
-		return fmt.Errorf("could not create lock file %w", err)
+	l, err := lock.AcquireTimeout(hostsLock, lock.Exclusive, config.Timeout)
+	if err != nil {
+		return fmt.Errorf("could not lock hosts file %w", err)
 	}
-	defer config.Unlock(lockfile)
+	defer l.Release()
 	hosts, err := file.NewFile(etchosts)
 	if err != nil {
 		return err
@@ -42,16 +43,14 @@ func removeHostDNS(network string) error {
 
 func setHostDNS(dns, network string) error {
 	etchosts := "/etc/hosts"
-	temp := os.TempDir()
-	lockfile := temp + "/netclient-lock"
 	if ncutils.IsWindows() {
 		etchosts = "c:\\windows\\system32\\drivers\\etc\\hosts"
-		lockfile = temp + "\\netclient-lock"
 	}
-	if err := config.Lock(lockfile); err != nil {
-		return fmt.Errorf("could not create lock file %w", err)
+	l, err := lock.AcquireTimeout(hostsLock, lock.Exclusive, config.Timeout)
+	if err != nil {
+		return fmt.Errorf("could not lock hosts file %w", err)
 	}
-	defer config.Unlock(lockfile)
+	defer l.Release()
 	dnsdata := strings.NewReader(dns)
 	profile, err := parser.ParseProfile(dnsdata)
 	if err != nil {
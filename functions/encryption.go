@@ -3,6 +3,7 @@ package functions
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 
@@ -26,6 +27,9 @@ func BoxEncrypt(message []byte, recipientPubKey *[32]byte, senderPrivateKey *[32
 
 // BoxDecrypt - decrypts traffic box
 func BoxDecrypt(encrypted []byte, senderPublicKey *[32]byte, recipientPrivateKey *[32]byte) ([]byte, error) {
+	if len(encrypted) < 24+box.Overhead {
+		return nil, fmt.Errorf("could not decrypt message, %d bytes is too short", len(encrypted))
+	}
 	var decryptNonce [24]byte
 	copy(decryptNonce[:], encrypted[:24])
 	decrypted, ok := box.Open(nil, encrypted[24:], &decryptNonce, senderPublicKey, recipientPrivateKey)
@@ -35,8 +39,31 @@ func BoxDecrypt(encrypted []byte, senderPublicKey *[32]byte, recipientPrivateKey
 	return decrypted, nil
 }
 
-// Chunk - chunks a message and encrypts each chunk
+// Chunk - chunks a message and encrypts each chunk, joining the chunks with the legacy delimiter
+// used until the server decodes envelopes, see ChunkEnvelope
 func Chunk(message []byte, recipientPubKey *[32]byte, senderPrivateKey *[32]byte) ([]byte, error) {
+	chunks, err := sealChunks(message, recipientPubKey, senderPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	chunkedMsg, err := convertBytesToMsg(chunks) // encode the array into some bytes to decode on receiving end
+	if err != nil {
+		return nil, err
+	}
+	return chunkedMsg, nil
+}
+
+// ChunkEnvelope - chunks a message and encrypts each chunk into a length-prefixed envelope
+func ChunkEnvelope(message []byte, recipientPubKey *[32]byte, senderPrivateKey *[32]byte) ([]byte, error) {
+	chunks, err := sealChunks(message, recipientPubKey, senderPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return encodeEnvelope(chunks), nil
+}
+
+// sealChunks - splits a message into chunks of at most chunkSize bytes and encrypts each chunk
+func sealChunks(message []byte, recipientPubKey *[32]byte, senderPrivateKey *[32]byte) ([][]byte, error) {
 	var chunks [][]byte
 	for i := 0; i < len(message); i += chunkSize {
 		end := i + chunkSize
@@ -52,17 +79,15 @@ func Chunk(message []byte, recipientPubKey *[32]byte, senderPrivateKey *[32]byte
 
 		chunks = append(chunks, encryptedMsgSlice)
 	}
-
-	chunkedMsg, err := convertBytesToMsg(chunks) // encode the array into some bytes to decode on receiving end
-	if err != nil {
-		return nil, err
-	}
-	return chunkedMsg, nil
+	return chunks, nil
 }
 
-// DeChunk - "de" chunks and decrypts a message
+// DeChunk - "de" chunks and decrypts a message in either the envelope or the legacy format
 func DeChunk(chunkedMsg []byte, senderPublicKey *[32]byte, recipientPrivateKey *[32]byte) ([]byte, error) {
-	chunks, err := convertMsgToBytes(chunkedMsg) // convert the message to it's original chunks form
+	chunks, err := decodeEnvelope(chunkedMsg)
+	if errors.Is(err, errNotEnvelope) {
+		chunks, err = convertMsgToBytes(chunkedMsg) // convert the message to it's original chunks form
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,87 @@
+package functions
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// envelope format, all integers are big endian:
+//
+//	magic   4 bytes "NMEV"
+//	version 1 byte
+//	count   uint32, number of chunks
+//	count times:
+//	  length uint32, length of the sealed chunk
+//	  chunk  length bytes, nonce followed by the nacl box
+//
+// legacy messages start with a random nonce, so a legacy message is mistaken for an envelope
+// only if its first 5 bytes happen to match the magic and version
+
+const (
+	// envelopeVersion - version of the envelope format written by ChunkEnvelope
+	envelopeVersion = 1
+	// envelopeHeaderLen - length of magic, version and chunk count
+	envelopeHeaderLen = 4 + 1 + 4
+)
+
+var (
+	envelopeMagic = []byte("NMEV")
+	// errNotEnvelope - the message is not an envelope, it may be in the legacy format
+	errNotEnvelope = errors.New("not an envelope")
+)
+
+// encodeEnvelope - frames sealed chunks into an envelope
+func encodeEnvelope(chunks [][]byte) []byte {
+	size := envelopeHeaderLen
+	for _, chunk := range chunks {
+		size += 4 + len(chunk)
+	}
+	buf := make([]byte, 0, size)
+	buf = append(buf, envelopeMagic...)
+	buf = append(buf, envelopeVersion)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(chunks)))
+	for _, chunk := range chunks {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(chunk)))
+		buf = append(buf, chunk...)
+	}
+	return buf
+}
+
+// decodeEnvelope - splits an envelope into its sealed chunks
+// returns errNotEnvelope if msg does not start with the envelope magic
+func decodeEnvelope(msg []byte) ([][]byte, error) {
+	if !bytes.HasPrefix(msg, envelopeMagic) {
+		return nil, errNotEnvelope
+	}
+	if len(msg) < envelopeHeaderLen {
+		return nil, fmt.Errorf("truncated envelope header, %d bytes", len(msg))
+	}
+	if version := msg[len(envelopeMagic)]; version != envelopeVersion {
+		return nil, fmt.Errorf("unsupported envelope version %d", version)
+	}
+	count := binary.BigEndian.Uint32(msg[len(envelopeMagic)+1:])
+	rest := msg[envelopeHeaderLen:]
+	// bound the count by the remaining length before allocating, each chunk has at least its length
+	if uint64(count) > uint64(len(rest)/4) {
+		return nil, fmt.Errorf("envelope of %d bytes can not hold %d chunks", len(msg), count)
+	}
+	chunks := make([][]byte, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(rest) < 4 {
+			return nil, fmt.Errorf("truncated envelope, chunk %d has no length", i)
+		}
+		length := binary.BigEndian.Uint32(rest)
+		rest = rest[4:]
+		if uint64(length) > uint64(len(rest)) {
+			return nil, fmt.Errorf("truncated envelope, chunk %d needs %d bytes, %d left", i, length, len(rest))
+		}
+		chunks = append(chunks, rest[:length])
+		rest = rest[length:]
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after envelope", len(rest))
+	}
+	return chunks, nil
+}
@@ -0,0 +1,148 @@
+package functions
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/matryer/is"
+	"golang.org/x/crypto/nacl/box"
+)
+
+type testKeys struct {
+	senderPub, senderPriv, recipientPub, recipientPriv *[32]byte
+}
+
+func newTestKeys(t testing.TB) testKeys {
+	t.Helper()
+	senderPub, senderPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipientPub, recipientPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKeys{senderPub, senderPriv, recipientPub, recipientPriv}
+}
+
+// payloadOf - a payload of size bytes repeating seed
+func payloadOf(seed []byte, size int) []byte {
+	if len(seed) == 0 {
+		seed = []byte{0}
+	}
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = seed[i%len(seed)]
+	}
+	return payload
+}
+
+func TestEnvelope(t *testing.T) {
+	is := is.New(t)
+	keys := newTestKeys(t)
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, chunkSize*3 + 17} {
+		payload := payloadOf([]byte("peer update"), size)
+		msg, err := ChunkEnvelope(payload, keys.recipientPub, keys.senderPriv)
+		is.NoErr(err)
+		is.True(bytes.HasPrefix(msg, envelopeMagic))
+		decrypted, err := DeChunk(msg, keys.senderPub, keys.recipientPriv)
+		is.NoErr(err)
+		is.True(bytes.Equal(decrypted, payload))
+	}
+}
+
+func TestEnvelopeDelimiterInCiphertext(t *testing.T) {
+	is := is.New(t)
+	// sealed chunks containing the legacy delimiter split incorrectly in the legacy format
+	chunks := [][]byte{
+		append(payloadOf([]byte{1}, 24+box.Overhead), splitKey...),
+		append(append(payloadOf([]byte{2}, 30), splitKey...), payloadOf([]byte{3}, 30)...),
+	}
+	legacy, err := convertMsgToBytes(mustConvert(t, chunks))
+	is.NoErr(err)
+	is.True(len(legacy) != len(chunks))
+	decoded, err := decodeEnvelope(encodeEnvelope(chunks))
+	is.NoErr(err)
+	is.Equal(decoded, chunks)
+}
+
+func mustConvert(t *testing.T, chunks [][]byte) []byte {
+	t.Helper()
+	msg, err := convertBytesToMsg(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestLegacyFormat(t *testing.T) {
+	is := is.New(t)
+	keys := newTestKeys(t)
+	payload := payloadOf([]byte("legacy"), chunkSize*2+5)
+	msg, err := Chunk(payload, keys.recipientPub, keys.senderPriv)
+	is.NoErr(err)
+	decrypted, err := DeChunk(msg, keys.senderPub, keys.recipientPriv)
+	is.NoErr(err)
+	is.True(bytes.Equal(decrypted, payload))
+}
+
+func TestDecodeEnvelopeErrors(t *testing.T) {
+	is := is.New(t)
+	valid := encodeEnvelope([][]byte{payloadOf([]byte{7}, 24+box.Overhead)})
+	_, err := decodeEnvelope([]byte("legacy message"))
+	is.Equal(err, errNotEnvelope)
+	for name, msg := range map[string][]byte{
+		"header":   valid[:envelopeHeaderLen-1],
+		"version":  append(append([]byte{}, envelopeMagic...), append([]byte{9}, valid[len(envelopeMagic)+1:]...)...),
+		"length":   valid[:envelopeHeaderLen+2],
+		"chunk":    valid[:len(valid)-1],
+		"trailing": append(append([]byte{}, valid...), 0),
+		"count":    append(append([]byte{}, valid[:len(envelopeMagic)+1]...), 0xff, 0xff, 0xff, 0xff),
+	} {
+		_, err := decodeEnvelope(msg)
+		if err == nil || err == errNotEnvelope {
+			t.Errorf("%s: expected framing error, got %v", name, err)
+		}
+	}
+}
+
+func FuzzEnvelope(f *testing.F) {
+	keys := newTestKeys(f)
+	f.Add([]byte("peer update"), uint32(0))
+	f.Add([]byte{}, uint32(1))
+	f.Add(splitKey, uint32(chunkSize))
+	f.Add([]byte{0xff, 0x00}, uint32(chunkSize+1))
+	f.Add(envelopeMagic, uint32(chunkSize*4))
+	f.Fuzz(func(t *testing.T, seed []byte, size uint32) {
+		// payload sizes up to a few chunks, beyond the size of the fuzz input
+		payload := payloadOf(seed, int(size%(chunkSize*5)))
+		msg, err := ChunkEnvelope(payload, keys.recipientPub, keys.senderPriv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := DeChunk(msg, keys.senderPub, keys.recipientPriv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, payload) {
+			t.Fatalf("round trip of %d bytes returned %d bytes", len(payload), len(decrypted))
+		}
+	})
+}
+
+func FuzzDecodeEnvelope(f *testing.F) {
+	f.Add(encodeEnvelope(nil))
+	f.Add(encodeEnvelope([][]byte{payloadOf([]byte{1}, 24+box.Overhead), splitKey}))
+	f.Add([]byte("NMEV\x01\xff\xff\xff\xff"))
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		chunks, err := decodeEnvelope(msg)
+		if err != nil {
+			return
+		}
+		// a decoded envelope encodes back to the same bytes
+		if !bytes.Equal(encodeEnvelope(chunks), msg) {
+			t.Fatalf("envelope %x does not round trip", msg)
+		}
+	})
+}
@@ -0,0 +1,184 @@
+package functions
+
+import (
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/events"
+	"github.com/gravitl/netclient/local"
+	"github.com/gravitl/netclient/wireguard"
+	"github.com/gravitl/netmaker/logger"
+	"github.com/gravitl/netmaker/models"
+)
+
+// bus - the events published by the message handlers, consumed by the subsystems of the daemon
+var bus = events.New()
+
+// Events - the event bus of the daemon, for the gui, metrics and hooks
+func Events() *events.Bus {
+	return bus
+}
+
+// subscribeSubsystems - subscribes the subsystems of the daemon to the events they act on and returns the
+// function to unsubscribe them
+// the wireguard interface subscribes first, so the proxy and dns see peers that are already configured
+func subscribeSubsystems() func() {
+	unsubscribe := []func(){
+		bus.Subscribe("wireguard", wireguardEvents, events.KindPeersUpdated, events.KindNodeUpdated,
+			events.KindProxyStateChanged, events.KindHostUpdated, events.KindHostDeleted),
+		bus.Subscribe("proxy", proxyEvents, events.KindPeersUpdated),
+		bus.Subscribe("dns", dnsEvents, events.KindPeersUpdated, events.KindNodeUpdated, events.KindNodeDeleted),
+		bus.Subscribe("firewall", firewallEvents, events.KindGatewayRoleChanged),
+		bus.Subscribe("daemon", daemonEvents, events.KindNodeJoined, events.KindHostUpdated),
+	}
+	return func() {
+		for _, u := range unsubscribe {
+			u()
+		}
+	}
+}
+
+// wireguardEvents - applies peer, node and proxy changes to the netmaker interface
+// configuring the interface also reconciles its peers, so they are not set again
+func wireguardEvents(event events.Event) {
+	switch e := event.(type) {
+	case events.PeersUpdated:
+		if err := configureInterface(); err != nil {
+			logger.Log(0, "could not configure netmaker interface", err.Error())
+		}
+	case events.NodeUpdated:
+		if err := configureInterface(); err != nil {
+			logger.Log(0, "could not configure netmaker interface", err.Error())
+			return
+		}
+		node := config.GetNode(e.Network)
+		if err := wireguard.UpdateWgInterface(&node, config.Netclient()); err != nil {
+			logger.Log(0, "error updating wireguard config "+err.Error())
+			return
+		}
+		if e.KeepaliveChanged {
+			wireguard.UpdateKeepAlive(int(node.PersistentKeepalive.Seconds()))
+		}
+	case events.ProxyStateChanged:
+		if err := setPeers(); err != nil {
+			logger.Log(0, "failed to set peers", err.Error())
+		}
+	case events.HostUpdated:
+		// the interface is recreated by the restart when the ports changed
+		if e.MTUChanged && !e.PortsChanged {
+			resetInterface()
+		}
+	case events.HostDeleted:
+		resetInterface()
+	}
+}
+
+// resetInterface - recreates the netmaker interface and sets the peers of the remaining servers
+func resetInterface() {
+	if err := recreateInterface(); err != nil {
+		logger.Log(0, "could not configure netmaker interface", err.Error())
+		return
+	}
+	if err := setPeers(); err != nil {
+		logger.Log(0, "failed to set peers", err.Error())
+	}
+}
+
+// daemonEvents - restarts the daemon when the host joined a network or its ports changed
+func daemonEvents(event events.Event) {
+	switch e := event.(type) {
+	case events.NodeJoined:
+	case events.HostUpdated:
+		if !e.PortsChanged {
+			return
+		}
+	default:
+		return
+	}
+	if err := restartDaemon(); err != nil {
+		logger.Log(0, "failed to restart daemon: ", err.Error())
+	}
+}
+
+// proxyEvents - sends peer updates to the proxy manager
+func proxyEvents(event events.Event) {
+	e, ok := event.(events.PeersUpdated)
+	if !ok || e.Update == nil {
+		return
+	}
+	update := *e.Update
+	if !config.Netclient().ProxyEnabled {
+		update.ProxyUpdate.Action = models.NoProxy
+	}
+	update.ProxyUpdate.Server = e.Server
+	ProxyManagerChan <- &update
+}
+
+// dnsEvents - keeps the host entries of the networks with dns enabled
+func dnsEvents(event events.Event) {
+	switch e := event.(type) {
+	case events.PeersUpdated:
+		if e.Update == nil {
+			return
+		}
+		for network, networkInfo := range e.Update.Network {
+			node := config.GetNode(network)
+			if node.DNSOn {
+				if err := setHostDNS(networkInfo.DNS, network); err != nil {
+					logger.Log(0, "network:", network, "error updating /etc/hosts "+err.Error())
+				}
+			} else {
+				if err := removeHostDNS(network); err != nil {
+					logger.Log(0, "network:", network, "error removing profile from /etc/hosts "+err.Error())
+				}
+			}
+		}
+	case events.NodeUpdated:
+		if node := config.GetNode(e.Network); node.DNSOn && e.DNSChanged {
+			logger.Log(0, "network:", e.Network, "settng DNS off")
+			if err := removeHostDNS(e.Network); err != nil {
+				logger.Log(0, "network:", e.Network, "error removing netmaker profile from /etc/hosts "+err.Error())
+			}
+		}
+	case events.NodeDeleted:
+		if err := removeHostDNS(e.Network); err != nil {
+			logger.Log(0, "network:", e.Network, "error removing profile from /etc/hosts "+err.Error())
+		}
+	}
+}
+
+// firewallEvents - enables forwarding when a node becomes a gateway
+func firewallEvents(event events.Event) {
+	e, ok := event.(events.GatewayRoleChanged)
+	if !ok || (!e.Ingress && !e.Egress) {
+		return
+	}
+	if err := local.SetIPForwarding(); err != nil {
+		logger.Log(0, "network:", e.Network, "unable to set IPForwarding", err.Error())
+	}
+}
+
+// gatewayRoleChanged - the gateway role event of a node, nil if its role did not change
+func gatewayRoleChanged(old, next *config.Node) events.Event {
+	if old.IsIngressGateway == next.IsIngressGateway && old.IsEgressGateway == next.IsEgressGateway &&
+		equalStrings(old.EgressGatewayRanges, next.EgressGatewayRanges) {
+		return nil
+	}
+	return events.GatewayRoleChanged{
+		Network:      next.Network,
+		Ingress:      next.IsIngressGateway,
+		Egress:       next.IsEgressGateway,
+		EgressRanges: next.EgressGatewayRanges,
+	}
+}
+
+// equalStrings - checks if two lists of strings are equal
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
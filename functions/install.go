@@ -29,7 +29,9 @@ func Install() error {
 		logger.Log(0, "error installing daemon", err.Error())
 		return err
 	}
-	config.Netclient().DaemonInstalled = true
-	config.WriteNetclientConfig()
+	config.Update(func(state *config.State) error {
+		state.Host.DaemonInstalled = true
+		return nil
+	})
 	return daemon.Restart()
 }
@@ -17,7 +17,6 @@ import (
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/gravitl/netclient/config"
-	"github.com/gravitl/netclient/daemon"
 	"github.com/gravitl/netclient/ncutils"
 	"github.com/gravitl/netclient/wireguard"
 	"github.com/gravitl/netmaker/logger"
@@ -81,7 +80,7 @@ func Join(flags *viper.Viper) error {
 		logger.Log(0, "error saving wireguard conf", err.Error())
 	}
 	fmt.Println("joined", node.Network)
-	if err := daemon.Restart(); err != nil {
+	if err := reloadDaemon(); err != nil {
 		logger.Log(3, "daemon restart failed:", err.Error())
 	}
 	return nil
@@ -243,7 +242,8 @@ func JoinNetwork(flags *viper.Viper) (*config.Node, *config.Server, error) {
 	if flags.GetString("network") == "" {
 		return nil, nil, errors.New("no network provided")
 	}
-	host := config.Netclient()
+	hostCfg := *config.Netclient()
+	host := &hostCfg
 	host.Name = flags.GetString("name")
 	node := config.GetNode(flags.GetString("network"))
 	node.Network = flags.GetString("network")
@@ -295,8 +295,8 @@ func JoinNetwork(flags *viper.Viper) (*config.Node, *config.Server, error) {
 	if err != nil {
 		return nil, nil, fmt.Errorf("error occurred before joining - %v", err)
 	}
-	if shouldUpdate {
-		host = config.Netclient()
+	if !shouldUpdate {
+		config.UpdateNetclient(*host)
 	}
 
 	serverHost, serverNode := config.Convert(host, &node)
@@ -308,7 +308,7 @@ func JoinNetwork(flags *viper.Viper) (*config.Node, *config.Server, error) {
 	joinData.Key = flags.GetString("accesskey")
 	logger.Log(2, "joining "+node.Network+" at "+url)
 	api := httpclient.JSONEndpoint[models.NodeJoinResponse, models.ErrorResponse]{
-		URL:           "https://" + url,
+		URL:           ncutils.APIURL(url),
 		Route:         "/api/nodes/" + node.Network,
 		Method:        http.MethodPost,
 		Authorization: "Bearer " + joinData.Key,
@@ -346,7 +346,9 @@ func JoinNetwork(flags *viper.Viper) (*config.Node, *config.Server, error) {
 		logger.Log(0, "failed to update wg peers", err.Error())
 	}
 	if internetGateway != nil {
-		config.Netclient().InternetGateway = *internetGateway
+		host := *config.Netclient()
+		host.InternetGateway = *internetGateway
+		config.UpdateNetclient(host)
 	}
 	return &newNode, server, nil
 }
@@ -9,6 +9,8 @@ import (
 
 	"github.com/devilcove/httpclient"
 	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/ncutils"
+	"github.com/gravitl/netclient/policy"
 	"github.com/gravitl/netmaker/logger"
 	"github.com/gravitl/netmaker/models"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
@@ -21,20 +23,27 @@ type output struct {
 	Ipv4Addr  string    `json:"ipv4_addr"`
 	Ipv6Addr  string    `json:"ipv6_addr"`
 	Peers     []peerOut `json:"peers"`
+	Routes    []string  `json:"routes,omitempty"` // ranges outside the network routed through the interface
 }
 
 type peerOut struct {
 	PublicKey  string   `json:"public_key"`
 	Endpoint   string   `json:"endpoint"`
 	AllowedIps []string `json:"allowed_ips"`
+	DroppedIps []string `json:"dropped_ips,omitempty"` // advertised ranges dropped by the split-tunnel policy
 }
 
 // List - list network details for specified networks
-// long flag passed passed to cmd line will list additional details about network including peers
+// long flag passed passed to cmd line will list additional details about network including peers, with their
+// allowed ips and routes after the split-tunnel policy of the host is applied
 func List(net string, long bool) {
 	listOutput := []output{}
 	found := false
 	nodes := config.GetNodes()
+	splitTunnel, err := policy.Read()
+	if err != nil {
+		logger.Log(0, "failed to read split-tunnel policy", err.Error())
+	}
 	for network := range nodes {
 		if network == net || net == "" {
 			found = true
@@ -60,14 +69,22 @@ func List(net string, long bool) {
 					logger.Log(1, "no peers present on network", node.Network)
 					continue
 				}
+				routes := make(map[string]bool)
 				for _, peer := range peers {
 					p := peerOut{
 						PublicKey: peer.PublicKey.String(),
 						Endpoint:  peer.Endpoint.String(),
 					}
-
-					for _, cidr := range peer.AllowedIPs {
+					kept, dropped := splitTunnel.Filter(p.PublicKey, peerNetworks(p.PublicKey, node.Network), peer.AllowedIPs)
+					for _, cidr := range kept {
 						p.AllowedIps = append(p.AllowedIps, cidr.String())
+						if !node.NetworkRange.Contains(cidr.IP) && !node.NetworkRange6.Contains(cidr.IP) && !routes[cidr.String()] {
+							routes[cidr.String()] = true
+							output.Routes = append(output.Routes, cidr.String())
+						}
+					}
+					for _, cidr := range dropped {
+						p.DroppedIps = append(p.DroppedIps, cidr.String())
 					}
 					output.Peers = append(output.Peers, p)
 				}
@@ -86,6 +103,17 @@ func List(net string, long bool) {
 	}
 }
 
+// peerNetworks - the networks of a peer known to the host, including the network it was listed for
+func peerNetworks(publicKey, network string) []string {
+	networks := policy.HostPeerNetworks(publicKey)
+	for _, n := range networks {
+		if n == network {
+			return networks
+		}
+	}
+	return append(networks, network)
+}
+
 // GetNodePeers returns the peers for a given node
 func GetNodePeers(node config.Node) ([]wgtypes.PeerConfig, error) {
 
@@ -99,7 +127,7 @@ func GetNodePeers(node config.Node) ([]wgtypes.PeerConfig, error) {
 		return nil, err
 	}
 	endpoint := httpclient.JSONEndpoint[models.NodeGet, models.ErrorResponse]{
-		URL:           "https://" + server.API,
+		URL:           ncutils.APIURL(server.API),
 		Route:         "/api/nodes/" + node.Network + "/" + node.ID.String(),
 		Method:        http.MethodGet,
 		Authorization: "Bearer " + token,
@@ -10,25 +10,72 @@ import (
 	"github.com/devilcove/httpclient"
 	"github.com/gravitl/netclient/config"
 	"github.com/gravitl/netclient/daemon"
+	"github.com/gravitl/netclient/ncutils"
 	"github.com/gravitl/netclient/wireguard"
 	"github.com/gravitl/netmaker/logger"
 	"github.com/gravitl/netmaker/models"
 	"github.com/kr/pretty"
+	"github.com/spf13/viper"
 )
 
-// Migrate update data from older versions of netclient to new format
-func Migrate() {
-	if _, err := os.Stat("/etc/netclient/config"); err != nil {
+// stopDaemon - stops the daemon before migrating, replaced in tests
+var stopDaemon = daemon.Stop
+
+// legacyConfigPath - config directory of pre v0.18.0 versions of netclient
+func legacyConfigPath() string {
+	return config.GetNetclientPath() + config.LegacyDir
+}
+
+func init() {
+	// the first migration step converts pre v0.18.0 config, the nodes are migrated by the servers
+	config.SetLegacyMigration(migrateLegacy)
+}
+
+// MigrateConfig - displays the pending migrations of the config files and the pre v0.18.0 config and applies
+// them unless dryRun is set
+func MigrateConfig(dryRun bool) error {
+	plans, err := config.MigrateConfig(true)
+	if err != nil {
+		return err
+	}
+	if len(plans) == 0 {
+		fmt.Println("config files are at schema version", config.SchemaVersion)
+	}
+	for _, plan := range plans {
+		fmt.Printf("%s: schema version %d -> %d\n", plan.File, plan.From, plan.To)
+		for _, step := range plan.Steps {
+			fmt.Printf("\t%d: %s\n", step.Version, step.Description)
+		}
+	}
+	if dryRun {
+		fmt.Println("dry run, no changes made")
+		return nil
+	}
+	// the migrations are applied while the config is loaded, the pre v0.18.0 config once the host config is
+	config.InitConfig(viper.New())
+	pending, err := config.MigrateConfig(true)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return errors.New("migration incomplete, see the log for details")
+	}
+	return nil
+}
+
+// migrateLegacy - converts the config of pre v0.18.0 versions of netclient to the current format
+// the nodes are migrated by their servers; the old config is removed afterwards
+func migrateLegacy() error {
+	if _, err := os.Stat(legacyConfigPath()); err != nil {
 		//nothing to migrate ... exiting"
-		return
+		return nil
 	}
 	logger.Log(0, "migration to v0.18.0 started")
 	networks, err := config.GetSystemNetworks()
 	if err != nil {
-		fmt.Println("error reading network data ", err.Error())
-		return
+		return fmt.Errorf("error reading network data %w", err)
 	}
-	if err := daemon.Stop(); err != nil {
+	if err := stopDaemon(); err != nil {
 		logger.Log(0, "failed to stop daemon", err.Error())
 	}
 	for _, network := range networks {
@@ -65,7 +112,7 @@ func Migrate() {
 			pretty.Println(migrationData)
 		}
 		api := httpclient.JSONEndpoint[models.NodeJoinResponse, models.ErrorResponse]{
-			URL:    "https://" + cfg.Server.API,
+			URL:    ncutils.APIURL(cfg.Server.API),
 			Route:  "/api/nodes/" + cfg.Node.Network + "/" + cfg.Node.ID + "/migrate",
 			Method: http.MethodPost,
 			Headers: []httpclient.Header{
@@ -83,8 +130,8 @@ func Migrate() {
 			logger.Log(0, "err migrating data", err.Error())
 			if errors.Is(err, httpclient.ErrStatus) {
 				logger.Log(0, "error joining network", strconv.Itoa(errData.Code), errData.Message)
-				continue
 			}
+			continue
 		}
 		//process server response
 		if !IsVersionComptatible(joinResponse.ServerConfig.Version) {
@@ -112,12 +159,14 @@ func Migrate() {
 			logger.Log(0, "failed to update wg peers", err.Error())
 		}
 		if internetGateway != nil {
-			config.Netclient().InternetGateway = *internetGateway
+			host := *config.Netclient()
+			host.InternetGateway = *internetGateway
+			config.UpdateNetclient(host)
 		}
 		//save new configurations
-		config.UpdateNodeMap(node.Network, *node)
-		config.UpdateServer(node.Server, *server)
-		if err := config.SaveServer(node.Server, *server); err != nil {
+		config.UpdateNodeMap(newNode.Network, newNode)
+		config.UpdateServer(server.Name, *server)
+		if err := config.SaveServer(server.Name, *server); err != nil {
 			logger.Log(0, "failed to save server", err.Error())
 		}
 		if err := config.WriteNetclientConfig(); err != nil {
@@ -132,7 +181,8 @@ func Migrate() {
 	}
 	//delete old config dir
 	logger.Log(3, "removing old config files")
-	if err := os.RemoveAll(config.GetNetclientPath() + "config/"); err != nil {
+	if err := os.RemoveAll(legacyConfigPath()); err != nil {
 		logger.Log(0, "failed to delete old configuration files ", err.Error())
 	}
+	return nil
 }
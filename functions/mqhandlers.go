@@ -3,32 +3,70 @@ package functions
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"sort"
 	"strings"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/gravitl/netclient/config"
-	"github.com/gravitl/netclient/daemon"
+	"github.com/gravitl/netclient/events"
+	"github.com/gravitl/netclient/policy"
+	"github.com/gravitl/netclient/transport"
 	"github.com/gravitl/netclient/wireguard"
 	"github.com/gravitl/netmaker/logger"
 	"github.com/gravitl/netmaker/models"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 // MQTimeout - time out for mqtt connections
 const MQTimeout = 30
 
+// netmaker interface operations of the handlers, replaced by tests so messages can be handled without a device
+var (
+	// createInterface - creates the netmaker interface when the daemon starts and sets its peers
+	createInterface = func() error {
+		nc := wireguard.NewNCIface(config.Netclient(), config.GetNodes())
+		if err := nc.Create(); err != nil {
+			return fmt.Errorf("could not create netmaker interface %w", err)
+		}
+		if err := nc.Configure(); err != nil {
+			return fmt.Errorf("could not configure netmaker interface %w", err)
+		}
+		return wireguard.SetPeers()
+	}
+	// configureInterface - applies the host, node and peer configuration to the netmaker interface, changing only
+	// the peers that differ from the device
+	configureInterface = func() error {
+		return wireguard.NewNCIface(config.Netclient(), config.GetNodes()).Configure()
+	}
+	// recreateInterface - closes the netmaker interface and creates it with the current configuration
+	recreateInterface = func() error {
+		nc := wireguard.GetInterface()
+		nc.Close()
+		nc = wireguard.NewNCIface(config.Netclient(), config.GetNodes())
+		nc.Create()
+		return nc.Configure()
+	}
+	// setPeers - makes the peers of the netmaker interface match the peers of all servers
+	setPeers = wireguard.SetPeers
+)
+
 // All -- mqtt message hander for all ('#') topics
-var All mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+var All transport.Handler = func(client transport.Transport, msg transport.Message) {
 	logger.Log(0, "default message handler -- received message but not handling")
 	logger.Log(0, "topic: "+string(msg.Topic()))
 }
 
 // NodeUpdate -- mqtt message handler for /update/<NodeID> topic
-func NodeUpdate(client mqtt.Client, msg mqtt.Message) {
+func NodeUpdate(client transport.Transport, msg transport.Message) {
 	network := parseNetworkFromTopic(msg.Topic())
 	logger.Log(0, "processing node update for network", network)
 	node := config.GetNode(network)
-	server := config.Servers[node.Server]
+	server := config.GetServer(node.Server)
+	if server == nil {
+		logger.Log(0, "server ", node.Server, " not found in config")
+		return
+	}
 	data, err := decryptMsg(server.Name, msg.Payload())
 	if err != nil {
 		logger.Log(0, "error decrypting message", err.Error())
@@ -66,15 +104,13 @@ func NodeUpdate(client mqtt.Client, msg mqtt.Message) {
 			}
 		}
 		logger.Log(0, newNode.ID.String(), "was removed from network", newNode.Network)
+		bus.Publish(events.NodeDeleted{Network: newNode.Network, Server: node.Server, NodeID: newNode.ID.String()})
 		return
 	case models.NODE_UPDATE_KEY:
-		// == get the current key for node ==
-		oldPrivateKey := config.Netclient().PrivateKey
-		if err := UpdateKeys(&newNode, config.Netclient(), client); err != nil {
+		// the current key is kept if the update fails
+		if err := UpdateKeys(&newNode, client); err != nil {
 			logger.Log(0, "err updating wireguard keys, reusing last key\n", err.Error())
-			config.Netclient().PrivateKey = oldPrivateKey
 		}
-		config.Netclient().PublicKey = config.Netclient().PrivateKey.PublicKey()
 		ifaceDelta = true
 	case models.NODE_FORCE_UPDATE:
 		ifaceDelta = true
@@ -83,25 +119,24 @@ func NodeUpdate(client mqtt.Client, msg mqtt.Message) {
 	}
 	// Save new config
 	newNode.Action = models.NODE_NOOP
-	config.UpdateNodeMap(network, newNode)
-	if err := config.WriteNodeConfig(); err != nil {
+	if err := config.Update(func(state *config.State) error {
+		state.Nodes[network] = newNode
+		return nil
+	}); err != nil {
 		logger.Log(0, newNode.Network, "error updating node configuration: ", err.Error())
 	}
-	nc := wireguard.NewNCIface(config.Netclient(), config.GetNodes())
-	if err := nc.Configure(); err != nil {
-		logger.Log(0, "could not configure netmaker interface", err.Error())
-		return
-	}
-
-	wireguard.SetPeers()
-	if err := wireguard.UpdateWgInterface(&newNode, config.Netclient()); err != nil {
-
-		logger.Log(0, "error updating wireguard config "+err.Error())
-		return
-	}
-	if keepaliveChange {
-		wireguard.UpdateKeepAlive(int(newNode.PersistentKeepalive.Seconds()))
+	nodeEvents := []events.Event{events.NodeUpdated{
+		Network:          network,
+		Server:           server.Name,
+		NodeID:           newNode.ID.String(),
+		InterfaceChanged: ifaceDelta,
+		KeepaliveChanged: keepaliveChange,
+		DNSChanged:       shouldDNSChange,
+	}}
+	if event := gatewayRoleChanged(&node, &newNode); event != nil {
+		nodeEvents = append(nodeEvents, event)
 	}
+	bus.Publish(nodeEvents...)
 	time.Sleep(time.Second)
 	if ifaceDelta { // if a change caused an ifacedelta we need to notify the server to update the peers
 		doneErr := publishSignal(&newNode, DONE)
@@ -111,21 +146,10 @@ func NodeUpdate(client mqtt.Client, msg mqtt.Message) {
 			logger.Log(0, "network:", newNode.Network, "signalled finished interface update to server")
 		}
 	}
-	//deal with DNS
-	if newNode.DNSOn && shouldDNSChange {
-		logger.Log(0, "network:", newNode.Network, "settng DNS off")
-		if err := removeHostDNS(newNode.Network); err != nil {
-			logger.Log(0, "network:", newNode.Network, "error removing netmaker profile from /etc/hosts "+err.Error())
-		}
-		//		_, err := ncutils.RunCmd("/usr/bin/resolvectl revert "+nodeCfg.Node.Interface, true)
-		//		if err != nil {
-		//			logger.Log(0, "error applying dns" + err.Error())
-		//		}
-	}
 }
 
 // HostPeerUpdate - mq handler for host peer update peers/host/<HOSTID>/<SERVERNAME>
-func HostPeerUpdate(client mqtt.Client, msg mqtt.Message) {
+func HostPeerUpdate(client transport.Transport, msg transport.Message) {
 	var peerUpdate models.HostPeerUpdate
 	var err error
 	if len(config.GetNodes()) == 0 {
@@ -153,59 +177,48 @@ func HostPeerUpdate(client mqtt.Client, msg mqtt.Message) {
 	}
 	if peerUpdate.ServerVersion != server.Version {
 		logger.Log(1, "updating server version")
-		server.Version = peerUpdate.ServerVersion
-		config.WriteServerConfig()
+		if err := config.Update(func(state *config.State) error {
+			if server, ok := state.Servers[serverName]; ok {
+				server.Version = peerUpdate.ServerVersion
+				state.Servers[serverName] = server
+			}
+			return nil
+		}); err != nil {
+			logger.Log(0, "failed to save server version", err.Error())
+		}
+	}
+	var oldPeers []wgtypes.PeerConfig
+	if err := config.Update(func(state *config.State) error {
+		oldPeers = state.Host.HostPeers[serverName]
+		state.Host.HostPeers[serverName] = peerUpdate.Peers
+		state.Host.PeerIDs[serverName] = peerUpdate.PeerIDs
+		return nil
+	}); err != nil {
+		logger.Log(0, "failed to save host peers", err.Error())
 	}
-	internetGateway, err := wireguard.UpdateWgPeers(peerUpdate.Peers)
+	// the internet gateway is taken from the peers the policy keeps, which looks up their networks in the saved peer
+	// ids; a gateway the policy denies is no gateway of the host
+	internetGateway, err := wireguard.UpdateWgPeers(filterPeers(serverName, peerUpdate.Peers))
 	if err != nil {
 		logger.Log(0, "error updating wireguard peers"+err.Error())
 		return
 	}
-
-	config.UpdateHostPeers(serverName, peerUpdate.Peers)
-	config.WriteNetclientConfig()
-	nc := wireguard.NewNCIface(config.Netclient(), config.GetNodes())
-	nc.Configure()
-	wireguard.SetPeers()
-
-	if config.Netclient().ProxyEnabled {
-		time.Sleep(time.Second * 2) // sleep required to avoid race condition
-	} else {
-		peerUpdate.ProxyUpdate.Action = models.NoProxy
-	}
-	peerUpdate.ProxyUpdate.Server = serverName
-	ProxyManagerChan <- &peerUpdate
-
-	for network, networkInfo := range peerUpdate.Network {
-		//check if internet gateway has changed
-		node := config.GetNode(network)
-		oldGateway := node.InternetGateway
-		if (internetGateway == nil && oldGateway != nil) || (internetGateway != nil && internetGateway.String() != oldGateway.String()) {
-			node.InternetGateway = internetGateway
-			config.UpdateNodeMap(node.Network, node)
-			if err := config.WriteNodeConfig(); err != nil {
-				logger.Log(0, "failed to save internet gateway", err.Error())
-			}
+	for network := range peerUpdate.Network {
+		if err := updateInternetGateway(network, internetGateway); err != nil {
+			logger.Log(0, "failed to save internet gateway", err.Error())
 		}
+		node := config.GetNode(network)
 		logger.Log(0, "network:", node.Network, "received peer update for node "+node.ID.String()+" "+node.Network)
-		if node.DNSOn {
-			if err := setHostDNS(networkInfo.DNS, node.Network); err != nil {
-				logger.Log(0, "network:", node.Network, "error updating /etc/hosts "+err.Error())
-				return
-			}
-		} else {
-			if err := removeHostDNS(node.Network); err != nil {
-				logger.Log(0, "network:", node.Network, "error removing profile from /etc/hosts "+err.Error())
-				return
-			}
-		}
 	}
+	// the subsystems configure the interface, then the proxy and dns, in the order they subscribed
+	bus.Publish(append(events.PeerChanges(serverName, oldPeers, peerUpdate.Peers),
+		events.PeersUpdated{Server: serverName, Peers: len(peerUpdate.Peers), Update: &peerUpdate})...)
 	_ = UpdateHostSettings()
 
 }
 
 // HostUpdate - mq handler for host update host/update/<HOSTID>/<SERVERNAME>
-func HostUpdate(client mqtt.Client, msg mqtt.Message) {
+func HostUpdate(client transport.Transport, msg transport.Message) {
 	var hostUpdate models.HostUpdate
 	var err error
 	serverName := parseServerFromTopic(msg.Topic())
@@ -224,95 +237,143 @@ func HostUpdate(client mqtt.Client, msg mqtt.Message) {
 		return
 	}
 	logger.Log(3, fmt.Sprintf("---> received host update [ action: %v ] for host from %s ", hostUpdate.Action, serverName))
-	var resetInterface, sendHostUpdate, restartDaemon bool
 	switch hostUpdate.Action {
 	case models.JoinHostToNetwork:
 		commonNode := hostUpdate.Node.CommonNode
 		nodeCfg := config.Node{
 			CommonNode: commonNode,
 		}
-		config.UpdateNodeMap(hostUpdate.Node.Network, nodeCfg)
-		server := config.GetServer(serverName)
-		if server == nil {
+		if err := config.Update(func(state *config.State) error {
+			server, ok := state.Servers[serverName]
+			if !ok {
+				return fmt.Errorf("server %s not found in config", serverName)
+			}
+			state.Nodes[hostUpdate.Node.Network] = nodeCfg
+			server.Nodes[hostUpdate.Node.Network] = true
+			state.Servers[serverName] = server
+			return nil
+		}); err != nil {
+			logger.Log(0, "failed to save node", hostUpdate.Node.Network, err.Error())
 			return
 		}
-		server.Nodes[hostUpdate.Node.Network] = true
-		config.UpdateServer(serverName, *server)
-		config.WriteNodeConfig()
-		config.WriteServerConfig()
-		restartDaemon = true
+		// the daemon restarts on the event, the update must not be delivered again
+		clearRetainedMsg(client, msg.Topic())
+		bus.Publish(events.NodeJoined{Network: nodeCfg.Network, Server: serverName, NodeID: nodeCfg.ID.String()})
 	case models.DeleteHost:
 		clearRetainedMsg(client, msg.Topic())
 		unsubscribeHost(client, serverName)
 		deleteHostCfg(client, serverName)
-		config.WriteNodeConfig()
-		config.WriteServerConfig()
-		resetInterface = true
+		bus.Publish(events.HostDeleted{Server: serverName})
 	case models.UpdateHost:
-		resetInterface, restartDaemon = updateHostConfig(&hostUpdate.Host)
+		confirmedTrafficKey(serverName, &hostUpdate.Host)
+		updated := updateHostConfig(&hostUpdate.Host)
+		updated.Server = serverName
+		if updated.PortsChanged {
+			clearRetainedMsg(client, msg.Topic())
+		}
+		bus.Publish(updated)
 	default:
 		logger.Log(1, "unknown host action")
 		return
 	}
-	config.WriteNetclientConfig()
-	if sendHostUpdate {
-		if err := PublishHostUpdate(serverName, models.UpdateHost); err != nil {
-			logger.Log(0, "failed to send host update to server ", serverName, err.Error())
+}
+
+func deleteHostCfg(client transport.Transport, server string) {
+	var deleted []events.Event
+	for _, node := range config.GetNodes() {
+		node := node
+		if node.Server == server {
+			unsubscribeNode(client, &node)
+			deleted = append(deleted, events.NodeDeleted{Network: node.Network, Server: server, NodeID: node.ID.String()})
 		}
 	}
-	if restartDaemon {
-		clearRetainedMsg(client, msg.Topic())
-		if err := daemon.Restart(); err != nil {
-			logger.Log(0, "failed to restart daemon: ", err.Error())
+	if err := config.Update(func(state *config.State) error {
+		delete(state.Host.PeerIDs, server)
+		delete(state.Host.HostPeers, server)
+		for network, node := range state.Nodes {
+			if node.Server == server {
+				delete(state.Nodes, network)
+			}
 		}
-		return
+		delete(state.Servers, server)
+		return nil
+	}); err != nil {
+		logger.Log(0, "failed to remove config of server", server, err.Error())
 	}
-	if resetInterface {
-		nc := wireguard.GetInterface()
-		nc.Close()
-		nc = wireguard.NewNCIface(config.Netclient(), config.GetNodes())
-		nc.Create()
-		if err := nc.Configure(); err != nil {
-			logger.Log(0, "could not configure netmaker interface", err.Error())
-			return
-		}
-		wireguard.SetPeers()
+	bus.Publish(deleted...)
+	// delete mq client of the server
+	deleteServerClient(server)
+	// sequence numbers start over if the host registers with the server again
+	if err := getReplayGuard().Forget(server); err != nil {
+		logger.Log(0, "failed to remove replay state of server", server, err.Error())
 	}
-
 }
 
-func deleteHostCfg(client mqtt.Client, server string) {
-	config.DeleteServerHostPeerCfg(server)
-	nodes := config.GetNodes()
-	for k, node := range nodes {
-		node := node
-		if node.Server == server {
-			unsubscribeNode(client, &node)
-			config.DeleteNode(k)
+// updateHostConfig - saves the host settings sent by a server, returning what changed
+func updateHostConfig(host *models.Host) (updated events.HostUpdated) {
+	if host == nil {
+		return
+	}
+	if err := config.Update(func(state *config.State) error {
+		hostCfg := &state.Host
+		if hostCfg.ListenPort != host.ListenPort || hostCfg.ProxyListenPort != host.ProxyListenPort {
+			updated.PortsChanged = true
+		}
+		if hostCfg.MTU != host.MTU {
+			updated.MTUChanged = true
 		}
+		// store password before updating
+		host.HostPass = hostCfg.HostPass
+		hostCfg.Host = *host
+		return nil
+	}); err != nil {
+		logger.Log(0, "failed to save host update", err.Error())
 	}
-	config.DeleteServer(server)
-	// delete mq client from ServerSet map
-	delete(ServerSet, server)
+	return
 }
 
-func updateHostConfig(host *models.Host) (resetInterface, restart bool) {
-	hostCfg := config.Netclient()
-	if hostCfg == nil || host == nil {
-		return
+// filterPeers - the peers of a server with the split-tunnel policy of the host applied, the advertised ranges if it
+// can not be read; a warning is logged for the ranges it drops
+func filterPeers(server string, peers []wgtypes.PeerConfig) []wgtypes.PeerConfig {
+	p, err := policy.Read()
+	if err != nil {
+		logger.Log(0, "failed to read split-tunnel policy, using advertised ranges", err.Error())
+		return peers
 	}
-	if hostCfg.ListenPort != host.ListenPort || hostCfg.ProxyListenPort != host.ProxyListenPort {
-		restart = true
+	filtered, dropped := p.Apply(peers, policy.HostPeerNetworks)
+	keys := make([]string, 0, len(dropped))
+	for key := range dropped {
+		keys = append(keys, key)
 	}
-	if hostCfg.MTU != host.MTU {
-		resetInterface = true
+	sort.Strings(keys)
+	for _, key := range keys {
+		ranges := make([]string, 0, len(dropped[key]))
+		for _, ipNet := range dropped[key] {
+			ranges = append(ranges, ipNet.String())
+		}
+		logger.Log(0, "warning: split-tunnel policy dropped", strings.Join(ranges, ", "), "advertised by server",
+			server, "for peer", key)
 	}
-	// store password before updating
-	host.HostPass = hostCfg.HostPass
-	hostCfg.Host = *host
-	config.UpdateNetclient(*hostCfg)
-	config.WriteNetclientConfig()
-	return
+	return filtered
+}
+
+// updateInternetGateway - saves the internet gateway of the node of a network if it changed
+// with the kill switch enabled a gateway that is gone stays recorded, so the kill switch holds until the network is
+// left or the kill switch is disabled
+func updateInternetGateway(network string, gateway *net.UDPAddr) error {
+	return config.Update(func(state *config.State) error {
+		node, ok := state.Nodes[network]
+		if !ok || node.InternetGateway.String() == gateway.String() {
+			return nil
+		}
+		if gateway == nil && state.Host.KillSwitch {
+			logger.Log(0, "network:", network, "internet gateway", node.InternetGateway.String(), "is gone, keeping the kill switch")
+			return nil
+		}
+		node.InternetGateway = gateway
+		state.Nodes[network] = node
+		return nil
+	})
 }
 
 func parseNetworkFromTopic(topic string) string {
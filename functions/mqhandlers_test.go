@@ -0,0 +1,577 @@
+package functions
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/events"
+	"github.com/gravitl/netclient/lock"
+	"github.com/gravitl/netclient/ncutils"
+	"github.com/gravitl/netclient/policy"
+	"github.com/gravitl/netclient/replay"
+	"github.com/gravitl/netclient/transport"
+	"github.com/gravitl/netclient/wireguard"
+	"github.com/gravitl/netmaker/models"
+	"github.com/matryer/is"
+	"golang.org/x/crypto/nacl/box"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// testDaemon - a daemon connected to a server through an in-process broker, with the config in a scratch directory
+type testDaemon struct {
+	broker    *transport.Broker
+	server    *transport.Client // client of the server
+	name      string            // name of the server
+	serverKey *[32]byte         // private traffic key of the server
+	hostKey   *[32]byte         // public traffic key of the host
+	// netmaker interface operations
+	configured int
+	recreated  int
+	peers      []wgtypes.PeerConfig
+	restarts   int // daemon restarts
+}
+
+// startTestDaemon - writes the config of a host with one node and starts the message queue of its server
+func startTestDaemon(t *testing.T) *testDaemon {
+	is := is.New(t)
+	t.Setenv(config.ConfigDirEnv, t.TempDir())
+	t.Setenv(lock.RuntimeDirEnv, t.TempDir())
+	restoreGlobals(t)
+	d := &testDaemon{broker: transport.NewBroker(), name: "netmaker.example.com"}
+	newTransport = func(server *config.Server, callbacks transport.Callbacks) (transport.Transport, error) {
+		return d.broker.Client(callbacks), nil
+	}
+	configureInterface = func() error {
+		d.configured++
+		d.peers = config.GetHostPeerList()
+		return nil
+	}
+	recreateInterface = func() error {
+		d.recreated++
+		return nil
+	}
+	setPeers = func() error {
+		d.peers = config.GetHostPeerList()
+		return nil
+	}
+	restartDaemon = func() error {
+		d.restarts++
+		return nil
+	}
+	t.Cleanup(subscribeSubsystems())
+
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	is.NoErr(err)
+	trafficPrivate, trafficPublic, err := config.GenerateTrafficKeys()
+	is.NoErr(err)
+	d.hostKey, err = ncutils.ConvertBytesToKey(trafficPublic)
+	is.NoErr(err)
+	host := config.Config{
+		PrivateKey:        privateKey,
+		TrafficKeyPrivate: trafficPrivate,
+		TrafficKeyPublic:  trafficPublic,
+		HostPeers:         make(map[string][]wgtypes.PeerConfig),
+		PeerIDs:           make(map[string]models.HostPeerMap),
+	}
+	host.ID = uuid.New()
+	host.Host.TrafficKeyPublic = trafficPublic
+	host.Name = "host1"
+	host.ListenPort = 51821
+	host.MTU = 1420
+	host.HostPass = "hostpass"
+	config.UpdateNetclient(host)
+	is.NoErr(config.WriteNetclientConfig())
+
+	serverPublic, serverPrivate, err := box.GenerateKey(rand.Reader)
+	is.NoErr(err)
+	d.serverKey = serverPrivate
+	server := config.Server{Name: d.name, MQID: uuid.New(), Nodes: map[string]bool{"net1": true}}
+	server.Brokers = []string{"tcp://broker.example.com"}
+	server.TrafficKey, err = ncutils.ConvertKeyToBytes(serverPublic)
+	is.NoErr(err)
+	server.Version = "v0.18.0"
+	state := config.Snapshot()
+	state.Servers = map[string]config.Server{d.name: server}
+
+	var node config.Node
+	node.ID = uuid.New()
+	node.Network = "net1"
+	node.Server = d.name
+	node.Address = net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(24, 32)}
+	node.NetworkRange = net.IPNet{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(24, 32)}
+	node.Connected = true
+	state.Nodes = config.NodeMap{"net1": node}
+	config.Replace(state)
+	is.NoErr(config.WriteServerConfig())
+	is.NoErr(config.WriteNodeConfig())
+	is.NoErr(wireguard.WriteWgConfig(config.Netclient(), config.GetNodes()))
+
+	d.server = d.broker.Client(transport.Callbacks{})
+	is.NoErr(d.server.Connect(context.Background()))
+
+	manager, err := setupMQTT(&server)
+	is.NoErr(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		manager.run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+		manager.transport.Disconnect()
+		deleteServerClient(d.name)
+	})
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		if health, ok := getConnHealth(d.name); ok && health.State == ConnConnected {
+			break
+		}
+		is.True(time.Now().Before(deadline)) // daemon connects to the broker
+		time.Sleep(time.Millisecond * 10)
+	}
+	drainProxyUpdates()
+	return d
+}
+
+// restoreGlobals - restores the in memory config and the replaced functions when the test ends
+func restoreGlobals(t *testing.T) {
+	state := config.Snapshot()
+	transportFn, configureFn, recreateFn, setPeersFn, stopFn, restartFn := newTransport, configureInterface, recreateInterface, setPeers, stopDaemon, restartDaemon
+	singletonFn, socketPath, devicePeersFn := newSingletonTransport, controlSocketPath, getDevicePeers
+	t.Cleanup(func() {
+		config.Replace(state)
+		newTransport, configureInterface, recreateInterface, setPeers, stopDaemon, restartDaemon = transportFn, configureFn, recreateFn, setPeersFn, stopFn, restartFn
+		newSingletonTransport, controlSocketPath, getDevicePeers = singletonFn, socketPath, devicePeersFn
+		drainProxyUpdates()
+	})
+}
+
+// drainProxyUpdates - discards the messages sent to the proxy manager
+func drainProxyUpdates() {
+	for {
+		select {
+		case <-ProxyManagerChan:
+		default:
+			return
+		}
+	}
+}
+
+// testDaemon.seal - encodes and encrypts a message from the server to the host
+// the message is prefixed with a sequence header if seq is not 0
+func (d *testDaemon) seal(t *testing.T, msg any, seq uint64) []byte {
+	is := is.New(t)
+	data, err := json.Marshal(msg)
+	is.NoErr(err)
+	if seq != 0 {
+		data = replay.Seal(replay.Header{Seq: seq, Time: time.Now()}, data)
+	}
+	sealed, err := ChunkEnvelope(data, d.hostKey, d.serverKey)
+	is.NoErr(err)
+	return sealed
+}
+
+// testDaemon.publish - publishes a message from the server, returning once the host handled it
+func (d *testDaemon) publish(t *testing.T, topic string, payload []byte, retained bool) {
+	is := is.New(t)
+	is.NoErr(d.server.Publish(topic, 0, retained, payload))
+}
+
+// testDaemon.receive - decrypts the messages the host publishes on topics matching filter, keyed by topic
+// the broker delivers synchronously, so a message is recorded once the publish returns
+func (d *testDaemon) receive(t *testing.T, filter string) func() map[string][]byte {
+	is := is.New(t)
+	var mutex sync.Mutex
+	received := make(map[string][]byte)
+	is.NoErr(d.server.Subscribe(filter, 0, func(_ transport.Transport, msg transport.Message) {
+		data, err := DeChunk(msg.Payload(), d.hostKey, d.serverKey)
+		if err != nil {
+			t.Errorf("could not decrypt message on %s: %v", msg.Topic(), err)
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		received[msg.Topic()] = data
+	}))
+	return func() map[string][]byte {
+		mutex.Lock()
+		defer mutex.Unlock()
+		messages := make(map[string][]byte, len(received))
+		for topic, data := range received {
+			messages[topic] = data
+		}
+		return messages
+	}
+}
+
+func (d *testDaemon) peerTopic() string {
+	return fmt.Sprintf("peers/host/%s/%s", config.Netclient().ID, d.name)
+}
+
+func (d *testDaemon) hostTopic() string {
+	return fmt.Sprintf("host/update/%s/%s", config.Netclient().ID, d.name)
+}
+
+// testPeerUpdate - a peer update with one peer
+func testPeerUpdate(t *testing.T) (models.HostPeerUpdate, wgtypes.Key) {
+	is := is.New(t)
+	peerKey, err := wgtypes.GeneratePrivateKey()
+	is.NoErr(err)
+	keepalive := time.Second * 20
+	peer := wgtypes.PeerConfig{
+		PublicKey:                   peerKey.PublicKey(),
+		Endpoint:                    &net.UDPAddr{IP: net.ParseIP("203.0.113.5"), Port: 51821},
+		AllowedIPs:                  []net.IPNet{{IP: net.ParseIP("10.0.0.2"), Mask: net.CIDRMask(32, 32)}},
+		PersistentKeepaliveInterval: &keepalive,
+	}
+	return models.HostPeerUpdate{
+		ServerVersion: "v0.18.1",
+		Peers:         []wgtypes.PeerConfig{peer},
+		PeerIDs: models.HostPeerMap{
+			peer.PublicKey.String(): {"node2": {ID: "node2", Address: "10.0.0.2", Name: "host2", Network: "net1"}},
+		},
+	}, peer.PublicKey
+}
+
+// nextProxyUpdate - the next message sent to the proxy manager
+func nextProxyUpdate(t *testing.T) *models.HostPeerUpdate {
+	select {
+	case update := <-ProxyManagerChan:
+		return update
+	case <-time.After(time.Second * 5):
+		t.Fatal("no message sent to the proxy manager")
+	}
+	return nil
+}
+
+func TestHostPeerUpdate(t *testing.T) {
+	is := is.New(t)
+	d := startTestDaemon(t)
+	update, peerKey := testPeerUpdate(t)
+	d.publish(t, d.peerTopic(), d.seal(t, update, 0), false)
+
+	proxyUpdate := nextProxyUpdate(t)
+	is.Equal(proxyUpdate.ProxyUpdate.Action, models.NoProxy)
+	is.Equal(proxyUpdate.ProxyUpdate.Server, d.name)
+	is.Equal(len(proxyUpdate.Peers), 1)
+	is.Equal(proxyUpdate.Peers[0].PublicKey, peerKey)
+
+	// wireguard interface
+	is.Equal(d.configured, 1)
+	is.Equal(len(d.peers), 1)
+	is.Equal(d.peers[0].PublicKey, peerKey)
+	wgConf, err := os.ReadFile(config.GetNetclientPath() + "netmaker.conf")
+	is.NoErr(err)
+	for _, line := range []string{
+		"PublicKey           = " + peerKey.String(),
+		"AllowedIps          = 10.0.0.2/32",
+		"Endpoint            = 203.0.113.5:51821",
+		"PersistentKeepalive = 20",
+	} {
+		is.True(strings.Contains(string(wgConf), line)) // peer in netmaker.conf
+	}
+
+	// config files
+	config.UpdateNetclient(config.Config{})
+	host, err := config.ReadNetclientConfig()
+	is.NoErr(err)
+	is.Equal(len(host.HostPeers[d.name]), 1)
+	is.Equal(host.HostPeers[d.name][0].PublicKey, peerKey)
+	is.Equal(host.PeerIDs[d.name][peerKey.String()]["node2"].Address, "10.0.0.2")
+	is.NoErr(config.ReadServerConf())
+	is.Equal(config.GetServer(d.name).Version, "v0.18.1")
+}
+
+func TestHostPeerUpdateGateway(t *testing.T) {
+	is := is.New(t)
+	d := startTestDaemon(t)
+	is.NoErr(config.Update(func(state *config.State) error {
+		state.Host.KillSwitch = true
+		return nil
+	}))
+	// the policy denies the default route the peer advertises
+	is.NoErr(os.WriteFile(filepath.Join(config.GetNetclientPath(), policy.FileName),
+		[]byte("networks:\n  net1:\n    deny: [0.0.0.0/0]\n"), 0600))
+	update, _ := testPeerUpdate(t)
+	update.Network = map[string]models.NetworkInfo{"net1": {}}
+	update.Peers[0].AllowedIPs = append(update.Peers[0].AllowedIPs, net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)})
+	d.publish(t, d.peerTopic(), d.seal(t, update, 0), false)
+	nextProxyUpdate(t)
+	is.Equal(config.GetNode("net1").InternetGateway, (*net.UDPAddr)(nil)) // no gateway, the kill switch does not hold
+	wgConf, err := os.ReadFile(config.GetNetclientPath() + "netmaker.conf")
+	is.NoErr(err)
+	is.True(!strings.Contains(string(wgConf), "0.0.0.0/0"))
+
+	// without the policy the peer is the gateway
+	is.NoErr(os.Remove(filepath.Join(config.GetNetclientPath(), policy.FileName)))
+	d.publish(t, d.peerTopic(), d.seal(t, update, 1), false)
+	nextProxyUpdate(t)
+	is.Equal(config.GetNode("net1").InternetGateway.String(), update.Peers[0].Endpoint.String())
+}
+
+func TestHostPeerUpdateRejected(t *testing.T) {
+	is := is.New(t)
+	d := startTestDaemon(t)
+	update, _ := testPeerUpdate(t)
+
+	// sealed by another server
+	_, otherKey, err := box.GenerateKey(rand.Reader)
+	is.NoErr(err)
+	data, err := json.Marshal(update)
+	is.NoErr(err)
+	forged, err := ChunkEnvelope(data, d.hostKey, otherKey)
+	is.NoErr(err)
+	d.publish(t, d.peerTopic(), forged, false)
+	is.Equal(d.configured, 0)
+
+	// replayed
+	sealed := d.seal(t, update, 1)
+	d.publish(t, d.peerTopic(), sealed, false)
+	d.publish(t, d.peerTopic(), sealed, false)
+	is.Equal(d.configured, 1)
+	nextProxyUpdate(t)
+	is.Equal(len(ProxyManagerChan), 0)
+	stats, err := replayStats()
+	is.NoErr(err)
+	is.Equal(stats[d.name].Replayed, uint64(1))
+}
+
+func TestHostUpdate(t *testing.T) {
+	is := is.New(t)
+	d := startTestDaemon(t)
+	host := config.Netclient().Host
+	host.MTU = 1280
+	host.HostPass = "" // not sent by the server
+	d.publish(t, d.hostTopic(), d.seal(t, models.HostUpdate{Action: models.UpdateHost, Host: host}, 0), false)
+
+	is.Equal(d.recreated, 1) // the mtu changed
+	is.Equal(d.restarts, 0)
+	config.UpdateNetclient(config.Config{})
+	saved, err := config.ReadNetclientConfig()
+	is.NoErr(err)
+	is.Equal(saved.MTU, 1280)
+	is.Equal(saved.HostPass, "hostpass")
+
+	// the daemon restarts when the ports change, which recreates the interface
+	records, stop := bus.Listen(10, events.KindHostUpdated)
+	defer stop()
+	host.ListenPort = 51822
+	host.MTU = 1380
+	d.publish(t, d.hostTopic(), d.seal(t, models.HostUpdate{Action: models.UpdateHost, Host: host}, 0), true)
+	is.Equal(d.restarts, 1)
+	is.Equal(d.recreated, 1)
+	is.Equal((<-records).Event, events.HostUpdated{Server: d.name, PortsChanged: true, MTUChanged: true})
+	_, retained := d.broker.Retained(d.hostTopic())
+	is.True(!retained) // not handled again after the restart
+
+	// nothing changed
+	d.publish(t, d.hostTopic(), d.seal(t, models.HostUpdate{Action: models.UpdateHost, Host: host}, 0), false)
+	is.Equal((<-records).Event, events.HostUpdated{Server: d.name})
+	is.Equal(d.restarts, 1)
+	is.Equal(d.recreated, 1)
+}
+
+func TestHostUpdateJoin(t *testing.T) {
+	is := is.New(t)
+	d := startTestDaemon(t)
+	records, stop := bus.Listen(10, events.KindNodeJoined)
+	defer stop()
+	var node models.Node
+	node.ID = uuid.New()
+	node.Network = "net2"
+	node.Server = d.name
+	d.publish(t, d.hostTopic(), d.seal(t, models.HostUpdate{Action: models.JoinHostToNetwork, Node: node}, 0), true)
+	is.Equal((<-records).Event, events.NodeJoined{Network: "net2", Server: d.name, NodeID: node.ID.String()})
+	is.Equal(d.restarts, 1) // the daemon restarts to subscribe to the node
+	is.Equal(config.GetNode("net2").ID, node.ID)
+	is.True(config.GetServer(d.name).Nodes["net2"])
+	_, retained := d.broker.Retained(d.hostTopic())
+	is.True(!retained)
+}
+
+func TestHostUpdateDeleteHost(t *testing.T) {
+	is := is.New(t)
+	d := startTestDaemon(t)
+	update, _ := testPeerUpdate(t)
+	d.publish(t, d.peerTopic(), d.seal(t, update, 0), false)
+	nextProxyUpdate(t)
+
+	// the server retains the delete so the host receives it when it connects
+	d.publish(t, d.hostTopic(), d.seal(t, models.HostUpdate{Action: models.DeleteHost}, 0), true)
+	_, retained := d.broker.Retained(d.hostTopic())
+	is.True(!retained) // retained delete is cleared
+	is.Equal(d.recreated, 1)
+	is.Equal(d.restarts, 0)
+	ok := serverClient(d.name) != nil
+	is.True(!ok)
+
+	is.NoErr(config.ReadServerConf())
+	is.Equal(config.GetServer(d.name), nil)
+	is.NoErr(config.ReadNodeConfig())
+	is.Equal(len(config.GetNodes()), 0)
+	config.UpdateNetclient(config.Config{})
+	host, err := config.ReadNetclientConfig()
+	is.NoErr(err)
+	is.Equal(len(host.HostPeers[d.name]), 0)
+
+	// the host no longer handles messages of the server
+	d.publish(t, d.peerTopic(), d.seal(t, update, 0), false)
+	is.Equal(len(ProxyManagerChan), 0)
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	is := is.New(t)
+	d := startTestDaemon(t)
+	configureInterface = func() error { return nil }
+	recreateInterface = func() error { return nil }
+	setPeers = func() error {
+		_ = config.GetHostPeerList()
+		return nil
+	}
+	node := config.GetNode("net1")
+	nodeTopic := fmt.Sprintf("update/%s/%s", node.Network, node.ID)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		update, _ := testPeerUpdate(t)
+		update.ServerVersion = fmt.Sprintf("v0.18.%d", i+1)
+		serverNode := models.Node{CommonNode: node.CommonNode}
+		serverNode.EgressGatewayRanges = []string{fmt.Sprintf("192.168.%d.0/24", i)}
+		host := config.Netclient().Host
+		host.MTU = 1400 + i
+		host.HostPass = ""
+		messages := map[string][]byte{
+			d.peerTopic(): d.seal(t, update, 0),
+			nodeTopic:     d.seal(t, serverNode, 0),
+			d.hostTopic(): d.seal(t, models.HostUpdate{Action: models.UpdateHost, Host: host}, 0),
+		}
+		for topic, payload := range messages {
+			topic, payload := topic, payload
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := d.server.Publish(topic, 0, false, payload); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = config.Netclient().MTU
+			_ = config.GetNodes()
+			_ = config.GetServerMap()
+			_ = config.GetHostPeerList()
+		}()
+	}
+	wg.Wait()
+
+	// the config files match the in memory config
+	state := config.Snapshot()
+	is.NoErr(config.ReadNodeConfig())
+	is.NoErr(config.ReadServerConf())
+	config.UpdateNetclient(config.Config{})
+	_, err := config.ReadNetclientConfig()
+	is.NoErr(err)
+	saved := config.Snapshot()
+	is.Equal(saved.Host.MTU, state.Host.MTU)
+	is.Equal(saved.Host.HostPass, "hostpass")
+	is.Equal(len(saved.Host.HostPeers[d.name]), 1)
+	is.Equal(saved.Nodes["net1"].EgressGatewayRanges, state.Nodes["net1"].EgressGatewayRanges)
+	is.Equal(saved.Servers[d.name].Version, state.Servers[d.name].Version)
+}
+
+func TestHostPeerUpdateEvents(t *testing.T) {
+	is := is.New(t)
+	d := startTestDaemon(t)
+	var configuredFirst bool
+	configureFn := configureInterface
+	configureInterface = func() error {
+		configuredFirst = len(ProxyManagerChan) == 0
+		return configureFn()
+	}
+	records, stop := bus.Listen(10)
+	defer stop()
+	update, peerKey := testPeerUpdate(t)
+	d.publish(t, d.peerTopic(), d.seal(t, update, 0), false)
+	nextProxyUpdate(t)
+	is.True(configuredFirst) // the interface is configured before the proxy is updated
+	is.Equal((<-records).Event, events.PeerAdded{
+		Server:     d.name,
+		PublicKey:  peerKey.String(),
+		Endpoint:   "203.0.113.5:51821",
+		AllowedIPs: []string{"10.0.0.2/32"},
+	})
+	is.Equal((<-records).Kind, events.KindPeersUpdated)
+
+	update.Peers[0].Endpoint = &net.UDPAddr{IP: net.ParseIP("203.0.113.6"), Port: 51821}
+	d.publish(t, d.peerTopic(), d.seal(t, update, 0), false)
+	nextProxyUpdate(t)
+	is.Equal((<-records).Event, events.PeerEndpointChanged{
+		Server:    d.name,
+		PublicKey: peerKey.String(),
+		Old:       "203.0.113.5:51821",
+		New:       "203.0.113.6:51821",
+	})
+	is.Equal((<-records).Kind, events.KindPeersUpdated)
+
+	nodeID := config.GetNode("net1").ID.String()
+	d.publish(t, d.hostTopic(), d.seal(t, models.HostUpdate{Action: models.DeleteHost}, 0), false)
+	is.Equal((<-records).Event, events.NodeDeleted{Network: "net1", Server: d.name, NodeID: nodeID})
+	is.Equal((<-records).Event, events.HostDeleted{Server: d.name})
+}
+
+func TestEventsHandler(t *testing.T) {
+	is := is.New(t)
+	shutdown, stopStreams := context.WithCancel(context.Background())
+	server := httptest.NewServer(eventsHandler(shutdown))
+	defer server.Close()
+	defer stopStreams()
+	resp, err := http.Get(server.URL + "?kind=" + string(events.KindNodeJoined))
+	is.NoErr(err)
+	defer resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusOK)
+	bus.Publish(events.NodeDeleted{Network: "net1"}, events.NodeJoined{Network: "net1", Server: "server1"})
+	var record struct {
+		Kind  events.Kind       `json:"kind"`
+		Event events.NodeJoined `json:"event"`
+	}
+	is.NoErr(json.NewDecoder(resp.Body).Decode(&record))
+	is.Equal(record.Kind, events.KindNodeJoined) // other kinds are not streamed
+	is.Equal(record.Event, events.NodeJoined{Network: "net1", Server: "server1"})
+}
+
+func TestUpdateInternetGateway(t *testing.T) {
+	is := is.New(t)
+	api := startTestAPI(t)
+	addTestNode(api, "net1")
+	gateway := &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51821}
+	is.NoErr(updateInternetGateway("net1", gateway))
+	is.Equal(config.GetNode("net1").InternetGateway.String(), gateway.String())
+	is.NoErr(updateInternetGateway("net1", nil))
+	is.Equal(config.GetNode("net1").InternetGateway, (*net.UDPAddr)(nil))
+
+	// with the kill switch, a gateway that is gone stays recorded so the kill switch holds
+	is.NoErr(config.Update(func(state *config.State) error {
+		state.Host.KillSwitch = true
+		return nil
+	}))
+	is.NoErr(updateInternetGateway("net1", gateway))
+	is.NoErr(updateInternetGateway("net1", nil))
+	is.Equal(config.GetNode("net1").InternetGateway.String(), gateway.String())
+}
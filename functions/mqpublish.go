@@ -11,19 +11,18 @@ import (
 	"sync"
 	"time"
 
-	"github.com/cloverstd/tcping/ping"
 	"github.com/devilcove/httpclient"
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/daemon"
+	"github.com/gravitl/netclient/events"
 	"github.com/gravitl/netclient/ncutils"
 	proxyCfg "github.com/gravitl/netclient/nmproxy/config"
+	"github.com/gravitl/netclient/transport"
 	"github.com/gravitl/netmaker/logger"
 	"github.com/gravitl/netmaker/logic/metrics"
 	"github.com/gravitl/netmaker/models"
 )
 
-var metricsCache = new(sync.Map)
-
 const (
 	// ACK - acknowledgement signal for MQ
 	ACK = 1
@@ -46,19 +45,26 @@ func Checkin(ctx context.Context, wg *sync.WaitGroup) {
 		case <-ctx.Done():
 			logger.Log(0, "checkin routine closed")
 			return
+		case reply := <-checkinPing:
+			close(reply)
 		case <-ticker.C:
-			for server, mqclient := range ServerSet {
-				if !mqclient.IsConnected() {
+			// deliver messages queued by the cli while the daemon was connected
+			for server := range serverClients() {
+				replayOutbox(server)
+			}
+			for server, mqclient := range serverClients() {
+				if mqclient.State() == transport.StateDisconnected {
 					logger.Log(0, "MQ client is not connected, skipping checkin for server", server)
 					continue
 				}
 			}
-			for server, mqclient := range ServerSet {
+			for server, mqclient := range serverClients() {
 				if mqclient == nil {
 					logger.Log(0, "MQ client is not configured, skipping checkin for server", server)
 					continue
 				}
 			}
+			checkTrafficKeys()
 			checkin()
 		}
 	}
@@ -81,7 +87,7 @@ func checkin() {
 				}
 				if config.Netclient().EndpointIP.String() != extIP && extIP != "" {
 					logger.Log(1, "network:", network, "endpoint has changed from ", config.Netclient().EndpointIP.String(), " to ", extIP)
-					config.Netclient().EndpointIP = net.ParseIP(extIP)
+					setEndpointIP(net.ParseIP(extIP))
 					if err := PublishNodeUpdate(&node); err != nil {
 						logger.Log(0, "network:", network, "could not publish endpoint change")
 					}
@@ -94,7 +100,7 @@ func checkin() {
 				}
 				if !config.Netclient().EndpointIP.Equal(intIP.IP) {
 					logger.Log(1, "network:", network, "endpoint has changed from "+config.Netclient().EndpointIP.String()+" to ", intIP.IP.String())
-					config.Netclient().EndpointIP = intIP.IP
+					setEndpointIP(intIP.IP)
 					if err := PublishNodeUpdate(&node); err != nil {
 						logger.Log(0, "network:", network, "could not publish localip change")
 					}
@@ -115,6 +121,30 @@ func checkin() {
 	_ = UpdateHostSettings()
 }
 
+// setEndpointIP - saves a changed endpoint of the host
+func setEndpointIP(ip net.IP) {
+	var old net.IP
+	if err := config.Update(func(state *config.State) error {
+		old = state.Host.EndpointIP
+		state.Host.EndpointIP = ip
+		return nil
+	}); err != nil {
+		logger.Log(0, "failed to save endpoint", err.Error())
+		return
+	}
+	if !old.Equal(ip) {
+		bus.Publish(events.EndpointIPChanged{Old: ipString(old), New: ipString(ip)})
+	}
+}
+
+// ipString - an ip as text, empty if it is not set
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
 // PublishNodeUpdate -- pushes node to broker
 func PublishNodeUpdate(node *config.Node) error {
 	server := config.GetServer(node.Server)
@@ -125,7 +155,7 @@ func PublishNodeUpdate(node *config.Node) error {
 	if err != nil {
 		return err
 	}
-	if err = publish(node.Server, fmt.Sprintf("update/%s", node.ID), data, 1); err != nil {
+	if err = publishDurable(node.Server, fmt.Sprintf("update/%s", node.ID), "", data, 1, nil); err != nil {
 		return err
 	}
 
@@ -146,7 +176,7 @@ func PublishGlobalHostUpdate(hostAction models.HostMqAction) error {
 		return err
 	}
 	for _, server := range servers {
-		if err = publish(server, fmt.Sprintf("host/serverupdate/%s", hostCfg.ID.String()), data, 1); err != nil {
+		if err = publishDurable(server, fmt.Sprintf("host/serverupdate/%s", hostCfg.ID.String()), string(hostAction), data, 1, nil); err != nil {
 			logger.Log(1, "failed to publish host update to: ", server, err.Error())
 			continue
 		}
@@ -165,7 +195,7 @@ func PublishHostUpdate(server string, hostAction models.HostMqAction) error {
 	if err != nil {
 		return err
 	}
-	if err = publish(server, fmt.Sprintf("host/serverupdate/%s", hostCfg.ID.String()), data, 1); err != nil {
+	if err = publishDurable(server, fmt.Sprintf("host/serverupdate/%s", hostCfg.ID.String()), string(hostAction), data, 1, nil); err != nil {
 		return err
 	}
 	return nil
@@ -182,9 +212,11 @@ func Hello(node *config.Node) {
 	} else {
 		// just in case getInterfaces() returned nil, nil
 		if ip != nil {
-			config.Netclient().Interfaces = *ip
-			if err := config.WriteNodeConfig(); err != nil {
-				logger.Log(0, "error saving node map", err.Error())
+			if err := config.Update(func(state *config.State) error {
+				state.Host.Interfaces = *ip
+				return nil
+			}); err != nil {
+				logger.Log(0, "error saving interfaces", err.Error())
 			}
 		}
 	}
@@ -197,9 +229,10 @@ func Hello(node *config.Node) {
 	if err := publish(node.Server, fmt.Sprintf("ping/%s", node.ID), data, 0); err != nil {
 		logger.Log(0, fmt.Sprintf("Network: %s error publishing ping, %v", node.Network, err))
 		logger.Log(0, "running pull on "+node.Network+" to reconnect")
-		_, err := Pull(node.Network, true)
-		if err != nil {
+		if _, err := pull(node.Network); err != nil {
 			logger.Log(0, "could not run pull on "+node.Network+", error: "+err.Error())
+		} else if err := daemon.Restart(); err != nil {
+			logger.Log(0, "could not restart daemon after pull on "+node.Network, err.Error())
 		}
 	} else {
 		logger.Log(3, "checkin for", node.Network, "complete")
@@ -214,7 +247,7 @@ func publishMetrics(node *config.Node) {
 		logger.Log(1, "failed to authenticate when publishing metrics", err.Error())
 		return
 	}
-	url := fmt.Sprintf("https://%s/api/nodes/%s/%s", server.API, node.Network, node.ID)
+	url := fmt.Sprintf("%s/api/nodes/%s/%s", ncutils.APIURL(server.API), node.Network, node.ID)
 	endpoint := httpclient.JSONEndpoint[models.NodeGet, models.ErrorResponse]{
 		URL:           url,
 		Method:        http.MethodGet,
@@ -246,35 +279,11 @@ func publishMetrics(node *config.Node) {
 		logger.Log(0, "something went wrong when marshalling metrics data for node", config.Netclient().Name, err.Error())
 	}
 
-	if err = publish(node.Server, fmt.Sprintf("metrics/%s", node.ID), data, 1); err != nil {
+	if err = publishDurable(node.Server, fmt.Sprintf("metrics/%s", node.ID), "", data, 1, mergeMetrics); err != nil {
 		logger.Log(0, "error occurred during publishing of metrics on node", config.Netclient().Name, err.Error())
-		logger.Log(0, "aggregating metrics locally until broker connection re-established")
-		val, ok := metricsCache.Load(node.ID)
-		if !ok {
-			metricsCache.Store(node.ID, data)
-		} else {
-			var oldMetrics models.Metrics
-			err = json.Unmarshal(val.([]byte), &oldMetrics)
-			if err == nil {
-				for k := range oldMetrics.Connectivity {
-					currentMetric := metrics.Connectivity[k]
-					if currentMetric.Latency == 0 {
-						currentMetric.Latency = oldMetrics.Connectivity[k].Latency
-					}
-					currentMetric.Uptime += oldMetrics.Connectivity[k].Uptime
-					currentMetric.TotalTime += oldMetrics.Connectivity[k].TotalTime
-					metrics.Connectivity[k] = currentMetric
-				}
-				newData, err := json.Marshal(metrics)
-				if err == nil {
-					metricsCache.Store(node.ID, newData)
-				}
-			}
-		}
-	} else {
-		metricsCache.Delete(node.ID)
-		logger.Log(0, "published metrics for node", config.Netclient().Name)
+		return
 	}
+	logger.Log(0, "published metrics for node", config.Netclient().Name)
 }
 
 func publish(serverName, dest string, msg []byte, qos byte) error {
@@ -284,61 +293,25 @@ func publish(serverName, dest string, msg []byte, qos byte) error {
 	if err != nil {
 		return err
 	}
-	privateKey, err := ncutils.ConvertBytesToKey(config.Netclient().TrafficKeyPrivate)
+	privateKey, err := ncutils.ConvertBytesToKey(config.Netclient().TrafficKeyFor(serverName))
 	if err != nil {
 		return err
 	}
-	encrypted, err := Chunk(msg, serverPubKey, privateKey)
+	seal := Chunk
+	if server.Envelope {
+		seal = ChunkEnvelope
+	}
+	encrypted, err := seal(msg, serverPubKey, privateKey)
 	if err != nil {
 		return err
 	}
-	mqclient, ok := ServerSet[serverName]
-	if !ok {
+	mqclient := serverClient(serverName)
+	if mqclient == nil {
 		return errors.New("unable to publish ... no mqclient")
 	}
-	if token := mqclient.Publish(dest, qos, false, encrypted); !token.WaitTimeout(30*time.Second) || token.Error() != nil {
+	if err := mqclient.Publish(dest, qos, false, encrypted); err != nil {
 		logger.Log(0, "could not connect to broker at "+serverName)
-		var err error
-		if token.Error() == nil {
-			err = errors.New("connection timeout")
-		} else {
-			err = token.Error()
-		}
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func checkBroker(broker string, port string) error {
-	if broker == "" {
-		return errors.New("error: broker address is blank")
-	}
-	if port == "" {
-		return errors.New("error: broker port is blank")
-	}
-	_, err := net.LookupIP(broker)
-	if err != nil {
-		return errors.New("nslookup failed for broker ... check dns records")
-	}
-	pinger := ping.NewTCPing()
-	intPort, err := strconv.Atoi(port)
-	if err != nil {
-		logger.Log(1, "error converting port to int: "+err.Error())
-	}
-	pinger.SetTarget(&ping.Target{
-		Protocol: ping.TCP,
-		Host:     broker,
-		Port:     intPort,
-		Counter:  3,
-		Interval: 1 * time.Second,
-		Timeout:  2 * time.Second,
-	})
-	pingerDone := pinger.Start()
-	<-pingerDone
-	if pinger.Result().SuccessCounter == 0 {
-		return errors.New("unable to connect to broker port ... check netmaker server and firewalls")
+		return err
 	}
 	return nil
 }
@@ -348,48 +321,48 @@ func UpdateHostSettings() error {
 	var err error
 	publishMsg := false
 	ifacename := ncutils.GetInterfaceName()
-	var proxylistenPort int
-	var proxypublicport int
-	if config.Netclient().ProxyEnabled {
-		proxylistenPort = proxyCfg.GetCfg().HostInfo.PrivPort
-		proxypublicport = proxyCfg.GetCfg().HostInfo.PubPort
-		if proxylistenPort == 0 {
-			proxylistenPort = models.NmProxyPort
-		}
-		if proxypublicport == 0 {
-			proxypublicport = models.NmProxyPort
-		}
+	proxylistenPort := proxyCfg.GetCfg().HostInfo.PrivPort
+	proxypublicport := proxyCfg.GetCfg().HostInfo.PubPort
+	if proxylistenPort == 0 {
+		proxylistenPort = models.NmProxyPort
+	}
+	if proxypublicport == 0 {
+		proxypublicport = models.NmProxyPort
 	}
+	behindNAT := proxyCfg.GetCfg().IsBehindNAT()
 	localPort, err := GetLocalListenPort(ifacename)
 	if err != nil {
 		logger.Log(1, "error encountered checking local listen port: ", ifacename, err.Error())
-	} else if config.Netclient().ListenPort != localPort && localPort != 0 {
-		logger.Log(1, "local port has changed from ", strconv.Itoa(config.Netclient().ListenPort), " to ", strconv.Itoa(localPort))
-		config.Netclient().ListenPort = localPort
-		publishMsg = true
 	}
-	if config.Netclient().ProxyEnabled {
-
-		if config.Netclient().ProxyListenPort != proxylistenPort {
-			logger.Log(1, fmt.Sprint("proxy listen port has changed from ", config.Netclient().ProxyListenPort, " to ", proxylistenPort))
-			config.Netclient().ProxyListenPort = proxylistenPort
+	if saveErr := config.Update(func(state *config.State) error {
+		host := &state.Host
+		if err == nil && host.ListenPort != localPort && localPort != 0 {
+			logger.Log(1, "local port has changed from ", strconv.Itoa(host.ListenPort), " to ", strconv.Itoa(localPort))
+			host.ListenPort = localPort
 			publishMsg = true
 		}
-		if config.Netclient().PublicListenPort != proxypublicport {
-			logger.Log(1, fmt.Sprint("public listen port has changed from ", config.Netclient().PublicListenPort, " to ", proxypublicport))
-			config.Netclient().PublicListenPort = proxypublicport
+		if host.ProxyEnabled {
+			if host.ProxyListenPort != proxylistenPort {
+				logger.Log(1, fmt.Sprint("proxy listen port has changed from ", host.ProxyListenPort, " to ", proxylistenPort))
+				host.ProxyListenPort = proxylistenPort
+				publishMsg = true
+			}
+			if host.PublicListenPort != proxypublicport {
+				logger.Log(1, fmt.Sprint("public listen port has changed from ", host.PublicListenPort, " to ", proxypublicport))
+				host.PublicListenPort = proxypublicport
+				publishMsg = true
+			}
+		}
+		if behindNAT && !host.ProxyEnabled {
+			logger.Log(0, "Host is behind NAT, enabling proxy...")
+			host.ProxyEnabled = true
 			publishMsg = true
 		}
-	}
-	if proxyCfg.GetCfg().IsBehindNAT() && !config.Netclient().ProxyEnabled {
-		logger.Log(0, "Host is behind NAT, enabling proxy...")
-		config.Netclient().ProxyEnabled = true
-		publishMsg = true
+		return nil
+	}); saveErr != nil {
+		return saveErr
 	}
 	if publishMsg {
-		if err := config.WriteNetclientConfig(); err != nil {
-			return err
-		}
 		logger.Log(0, "publishing global host update for port changes")
 		if err := PublishGlobalHostUpdate(models.UpdateHost); err != nil {
 			logger.Log(0, "could not publish local port change", err.Error())
@@ -408,8 +381,8 @@ func publishSignal(node *config.Node, signal byte) error {
 }
 
 // publishes a blank message to the topic to clear the unwanted retained message
-func clearRetainedMsg(client mqtt.Client, topic string) {
-	if token := client.Publish(topic, 0, true, []byte{}); token.Error() != nil {
-		logger.Log(0, "failed to clear retained message: ", topic, token.Error().Error())
+func clearRetainedMsg(client transport.Transport, topic string) {
+	if err := client.Publish(topic, 0, true, []byte{}); err != nil {
+		logger.Log(0, "failed to clear retained message: ", topic, err.Error())
 	}
 }
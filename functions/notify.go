@@ -0,0 +1,174 @@
+package functions
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/ncutils"
+	"github.com/gravitl/netclient/transport"
+	"github.com/gravitl/netclient/wireguard"
+	"github.com/gravitl/netmaker/logger"
+)
+
+const (
+	// notifySocketEnv - socket the service manager listens on for notifications (systemd Type=notify)
+	notifySocketEnv = "NOTIFY_SOCKET"
+	// watchdogUsecEnv - watchdog timeout set by the service manager when WatchdogSec is configured
+	watchdogUsecEnv = "WATCHDOG_USEC"
+	// watchdogPidEnv - pid the watchdog settings are intended for
+	watchdogPidEnv = "WATCHDOG_PID"
+	// statusInterval - interval at which status is reported once the daemon is ready
+	statusInterval = time.Second * 5
+	// handshakeTimeout - peers that have not completed a handshake within this time are not counted as handshaking
+	handshakeTimeout = time.Minute * 3
+	// livenessTimeout - time a daemon goroutine has to respond to a liveness check
+	livenessTimeout = time.Second * 5
+)
+
+// checkinPing - liveness check of the checkin goroutine, the goroutine closes the channel it receives
+var checkinPing = make(chan chan struct{})
+
+// sdNotify - sends a state notification to the service manager
+// a no-op when the daemon was not started by systemd with Type=notify
+func sdNotify(state string) error {
+	socket := os.Getenv(notifySocketEnv)
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:] // abstract namespace socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notify - sends a state notification to the service manager, logging failures
+func notify(state string) {
+	if err := sdNotify(state); err != nil {
+		logger.Log(0, "failed to notify service manager", err.Error())
+	}
+}
+
+// watchdogInterval - interval at which WATCHDOG=1 must be sent, 0 when the watchdog is disabled
+// notifications are sent at half the timeout configured by WatchdogSec
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv(watchdogUsecEnv), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv(watchdogPidEnv); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// notifyInterval - interval of the daemon's status and liveness loop once ready
+func notifyInterval() time.Duration {
+	if watchdog := watchdogInterval(); watchdog > 0 && watchdog < statusInterval {
+		return watchdog
+	}
+	return statusInterval
+}
+
+// daemonRoutines.alive - checks the checkin, message queue and connection manager goroutines are running and responsive
+// a message queue that stopped, eg. as the broker url of its server is invalid, would stop again if the daemon was
+// restarted, so it is reported as degraded in the status rather than failing the check
+func (d *daemonRoutines) alive() error {
+	reply := make(chan struct{})
+	select {
+	case checkinPing <- reply:
+	case <-time.After(livenessTimeout):
+		return errors.New("checkin routine is not responding")
+	}
+	select {
+	case <-reply:
+	case <-time.After(livenessTimeout):
+		return errors.New("checkin routine is not responding")
+	}
+	for name, routine := range d.servers {
+		if routine.stopped() {
+			continue
+		}
+		// an unreachable broker is retried by the connection manager and does not fail the check
+		if _, ok := getConnHealth(name); !ok {
+			return fmt.Errorf("connection manager for server %s is not running", name)
+		}
+	}
+	return nil
+}
+
+// serverRoutine.stopped - checks if the message queue goroutine exited before it was stopped by the daemon
+func (r *serverRoutine) stopped() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// daemonRoutines.ready - checks if a broker is connected, or none can be as the message queues of all servers
+// stopped; the daemon reports ready once this holds and the netmaker interface is configured
+func (d *daemonRoutines) ready() bool {
+	running := 0
+	for name, routine := range d.servers {
+		if routine.stopped() {
+			continue
+		}
+		running++
+		if client := serverClient(name); client != nil && client.State() == transport.StateConnected {
+			return true
+		}
+	}
+	return running == 0
+}
+
+// daemonRoutines.status - summary of the daemon state reported to the service manager
+// ifaceErr is the error setting up the netmaker interface, if any
+func (d *daemonRoutines) status(ifaceErr error) string {
+	handshaking, total := 0, 0
+	if peers, err := wireguard.GetDevicePeers(ncutils.GetInterfaceName()); err == nil {
+		total = len(peers)
+		for _, peer := range peers {
+			if time.Since(peer.LastHandshakeTime) < handshakeTimeout {
+				handshaking++
+			}
+		}
+	}
+	connected := 0
+	stopped := []string{}
+	for name, routine := range d.servers {
+		if routine.stopped() {
+			stopped = append(stopped, name)
+			continue
+		}
+		if client := serverClient(name); client != nil && client.State() == transport.StateConnected {
+			connected++
+		}
+	}
+	status := fmt.Sprintf("%d networks, %d/%d peers handshaking, %d/%d brokers connected",
+		len(config.GetNodes()), handshaking, total, connected, len(d.servers))
+	if len(stopped) > 0 {
+		sort.Strings(stopped)
+		status = "degraded, message queue stopped for " + strings.Join(stopped, ",") + ", " + status
+	}
+	if connected == 0 && len(d.servers) > len(stopped) {
+		status = "waiting for brokers, " + status
+	}
+	if ifaceErr != nil {
+		status = "interface not configured: " + ifaceErr.Error() + ", " + status
+	}
+	return status
+}
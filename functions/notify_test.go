@@ -0,0 +1,131 @@
+package functions
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/transport"
+	"github.com/matryer/is"
+)
+
+func TestSdNotify(t *testing.T) {
+	is := is.New(t)
+	t.Setenv(notifySocketEnv, "")
+	is.NoErr(sdNotify("READY=1")) // not run by systemd
+
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	is.NoErr(err)
+	defer conn.Close()
+	t.Setenv(notifySocketEnv, socket)
+	is.NoErr(sdNotify("READY=1\nSTATUS=1 networks"))
+	buf := make([]byte, 256)
+	is.NoErr(conn.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := conn.Read(buf)
+	is.NoErr(err)
+	is.Equal(string(buf[:n]), "READY=1\nSTATUS=1 networks")
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	is := is.New(t)
+	t.Setenv(watchdogUsecEnv, "")
+	t.Setenv(watchdogPidEnv, "")
+	is.Equal(watchdogInterval(), time.Duration(0))
+	is.Equal(notifyInterval(), statusInterval)
+
+	t.Setenv(watchdogUsecEnv, "60000000")
+	is.Equal(watchdogInterval(), time.Second*30)
+	is.Equal(notifyInterval(), statusInterval)
+
+	t.Setenv(watchdogUsecEnv, "4000000")
+	is.Equal(notifyInterval(), time.Second*2)
+
+	// watchdog intended for another process
+	t.Setenv(watchdogPidEnv, strconv.Itoa(os.Getpid()+1))
+	is.Equal(watchdogInterval(), time.Duration(0))
+}
+
+func TestDaemonStatus(t *testing.T) {
+	is := is.New(t)
+	restoreGlobals(t)
+	config.Replace(&config.State{Nodes: config.NodeMap{"net1": {}}, Servers: make(map[string]config.Server)})
+	d := &daemonRoutines{servers: make(map[string]*serverRoutine)}
+	is.Equal(d.status(nil), "1 networks, 0/0 peers handshaking, 0/0 brokers connected")
+	is.Equal(d.status(errors.New("no tun device")), "interface not configured: no tun device, 1 networks, 0/0 peers handshaking, 0/0 brokers connected")
+
+	// the daemon waits for a broker before it is ready, which is reported in the status
+	d.servers["netmaker.test"] = &serverRoutine{done: make(chan struct{})}
+	defer deleteServerClient("netmaker.test")
+	is.Equal(d.status(nil), "waiting for brokers, 1 networks, 0/0 peers handshaking, 0/1 brokers connected")
+
+	client := transport.NewBroker().Client(transport.Callbacks{})
+	is.NoErr(client.Connect(context.Background()))
+	defer client.Disconnect()
+	setServerClient("netmaker.test", client)
+	is.Equal(d.status(nil), "1 networks, 0/0 peers handshaking, 1/1 brokers connected")
+
+	// a message queue that stopped is reported as degraded
+	stopped := &serverRoutine{done: make(chan struct{})}
+	close(stopped.done)
+	d.servers["invalid.test"] = stopped
+	is.Equal(d.status(nil), "degraded, message queue stopped for invalid.test, 1 networks, 0/0 peers handshaking, 1/2 brokers connected")
+	client.Disconnect()
+	is.Equal(d.status(nil), "waiting for brokers, degraded, message queue stopped for invalid.test, 1 networks, 0/0 peers handshaking, 0/2 brokers connected")
+}
+
+func TestDaemonReady(t *testing.T) {
+	is := is.New(t)
+	restoreGlobals(t)
+	d := &daemonRoutines{servers: make(map[string]*serverRoutine)}
+	is.True(d.ready()) // no servers to connect to
+
+	d.servers["netmaker.test"] = &serverRoutine{done: make(chan struct{})}
+	defer deleteServerClient("netmaker.test")
+	is.True(!d.ready()) // waiting for the broker
+	client := transport.NewBroker().Client(transport.Callbacks{})
+	setServerClient("netmaker.test", client)
+	is.True(!d.ready())
+	is.NoErr(client.Connect(context.Background()))
+	defer client.Disconnect()
+	is.True(d.ready())
+
+	// a server whose message queue stopped does not hold up readiness, a running one does
+	stopped := &serverRoutine{done: make(chan struct{})}
+	close(stopped.done)
+	d.servers = map[string]*serverRoutine{"invalid.test": stopped}
+	is.True(d.ready())
+	d.servers["netmaker.test"] = &serverRoutine{done: make(chan struct{})}
+	client.Disconnect()
+	is.True(!d.ready())
+}
+
+func TestDaemonAlive(t *testing.T) {
+	is := is.New(t)
+	pings := make(chan struct{})
+	defer close(pings)
+	go func() {
+		for {
+			select {
+			case reply := <-checkinPing:
+				close(reply)
+			case <-pings:
+				return
+			}
+		}
+	}()
+	// a message queue that stopped, eg. on an invalid broker url, does not fail the check
+	stopped := &serverRoutine{done: make(chan struct{})}
+	close(stopped.done)
+	d := &daemonRoutines{servers: map[string]*serverRoutine{"invalid.test": stopped}}
+	is.NoErr(d.alive())
+	// a running message queue without a connection manager does
+	d.servers["netmaker.test"] = &serverRoutine{done: make(chan struct{})}
+	is.True(d.alive() != nil)
+}
@@ -0,0 +1,133 @@
+package functions
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/outbox"
+	"github.com/gravitl/netclient/transport"
+	"github.com/gravitl/netmaker/logger"
+	"github.com/gravitl/netmaker/models"
+)
+
+const (
+	// outboxFile - file in the config dir holding messages waiting for a broker
+	outboxFile = "outbox.json"
+	// outboxLock - name of the lock serializing access to the outbox between netclient processes
+	outboxLock = "outbox"
+)
+
+// getOutbox - returns the outbox; payloads are encrypted with the secret store of the config files
+func getOutbox() (*outbox.Outbox, error) {
+	store, err := config.SecretStore()
+	if err != nil {
+		return nil, fmt.Errorf("outbox unavailable %w", err)
+	}
+	return &outbox.Outbox{
+		File:   config.GetNetclientPath() + outboxFile,
+		Lock:   outboxLock,
+		Limit:  outbox.DefaultLimit,
+		Sealer: store,
+	}, nil
+}
+
+// publishDurable - publishes a message, queuing it in the outbox if the broker can not be reached
+// a message for a server with undelivered messages is queued behind them so messages are delivered in order
+// queued messages for the same topic and key are replaced by the new message, or combined with it by merge
+func publishDurable(serverName, dest, key string, msg []byte, qos byte, merge outbox.MergeFunc) error {
+	box, err := getOutbox()
+	if err != nil {
+		logger.Log(1, err.Error())
+		return publish(serverName, dest, msg, qos)
+	}
+	pending, err := box.Pending(serverName)
+	if err != nil {
+		logger.Log(0, "failed to read outbox", err.Error())
+	}
+	if pending == 0 {
+		err := publish(serverName, dest, msg, qos)
+		if err == nil {
+			return nil
+		}
+		logger.Log(0, "failed to publish to", serverName, err.Error())
+	}
+	if err := box.Enqueue(outbox.Message{Server: serverName, Topic: dest, Key: key, QoS: qos, Payload: msg}, merge); err != nil {
+		return fmt.Errorf("failed to queue message for %s %w", serverName, err)
+	}
+	logger.Log(0, "queued", dest, "until the broker for", serverName, "is reachable")
+	if pending > 0 {
+		replayOutbox(serverName)
+	}
+	return nil
+}
+
+// replayMutex - serializes replays within the process, so a queued message is not sent twice by the connect
+// handler and a publish
+var replayMutex sync.Mutex
+
+// replayOutbox - sends the messages queued for a server if its broker is connected
+func replayOutbox(serverName string) {
+	mqclient := serverClient(serverName)
+	if mqclient == nil || mqclient.State() != transport.StateConnected {
+		return
+	}
+	box, err := getOutbox()
+	if err != nil {
+		logger.Log(1, err.Error())
+		return
+	}
+	replayMutex.Lock()
+	defer replayMutex.Unlock()
+	if pending, err := box.Pending(serverName); err != nil || pending == 0 {
+		return
+	}
+	sent, err := box.Replay(serverName, func(msg *outbox.Message) error {
+		return publish(msg.Server, msg.Topic, msg.Payload, msg.QoS)
+	})
+	if sent > 0 {
+		logger.Log(0, "replayed", fmt.Sprint(sent), "queued messages to", serverName)
+	}
+	if err != nil {
+		logger.Log(0, "failed to replay queued messages to", serverName, err.Error())
+	}
+}
+
+// outboxStats - depth and counters of the outbox
+func outboxStats() (*outbox.Stats, error) {
+	box, err := getOutbox()
+	if err != nil {
+		return nil, err
+	}
+	stats, err := box.Stats()
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// mergeMetrics - aggregates queued metrics with newer metrics for the same node
+func mergeMetrics(queued, payload []byte) ([]byte, error) {
+	var oldMetrics, metrics models.Metrics
+	if err := json.Unmarshal(queued, &oldMetrics); err != nil {
+		// keep the newer metrics
+		return payload, nil
+	}
+	if err := json.Unmarshal(payload, &metrics); err != nil {
+		return nil, err
+	}
+	if metrics.Connectivity == nil {
+		metrics.Connectivity = make(map[string]models.Metric)
+	}
+	for k := range oldMetrics.Connectivity {
+		currentMetric := metrics.Connectivity[k]
+		if currentMetric.Latency == 0 {
+			currentMetric.Latency = oldMetrics.Connectivity[k].Latency
+		}
+		currentMetric.Uptime += oldMetrics.Connectivity[k].Uptime
+		currentMetric.TotalTime += oldMetrics.Connectivity[k].TotalTime
+		metrics.Connectivity[k] = currentMetric
+	}
+	return json.Marshal(metrics)
+}
@@ -2,15 +2,22 @@ package functions
 
 import (
 	"fmt"
+	"net/http"
 
 	"github.com/gravitl/netclient/config"
-	"github.com/gravitl/netclient/daemon"
 	"github.com/gravitl/netmaker/logger"
 	"github.com/gravitl/netmaker/models"
 )
 
 // ChangeProxyStatus - updates proxy status on host and publishes global host update
 func ChangeProxyStatus(status bool) error {
+	if daemonRunning() {
+		if err := callDaemon(http.MethodPost, controlProxy, &controlRequest{Proxy: status}, nil); err != nil {
+			return err
+		}
+		printProxyStatus(status)
+		return nil
+	}
 	logger.Log(1, fmt.Sprint("changing proxy status to ", status))
 	servers := config.GetServers()
 	for _, server := range servers {
@@ -23,20 +30,26 @@ func ChangeProxyStatus(status bool) error {
 			logger.Log(0, "failed to set up mq conn for server ", server)
 		}
 	}
-	config.Netclient().ProxyEnabled = status
-	if err := config.WriteNetclientConfig(); err != nil {
+	if err := config.Update(func(state *config.State) error {
+		state.Host.ProxyEnabled = status
+		return nil
+	}); err != nil {
 		return err
 	}
 	if err := PublishGlobalHostUpdate(models.UpdateHost); err != nil {
 		return err
 	}
+	printProxyStatus(status)
+	if err := restartDaemon(); err != nil {
+		logger.Log(0, "failed to restart daemon: ", err.Error())
+	}
+	return nil
+}
+
+func printProxyStatus(status bool) {
 	if status {
 		fmt.Println("proxy is switched on")
 	} else {
 		fmt.Println("proxy is switched off")
 	}
-	if err := daemon.Restart(); err != nil {
-		logger.Log(0, "failed to restart daemon: ", err.Error())
-	}
-	return nil
 }
@@ -8,13 +8,35 @@ import (
 	"github.com/devilcove/httpclient"
 	"github.com/gravitl/netclient/config"
 	"github.com/gravitl/netclient/daemon"
+	"github.com/gravitl/netclient/ncutils"
 	"github.com/gravitl/netclient/wireguard"
 	"github.com/gravitl/netmaker/logger"
 	"github.com/gravitl/netmaker/models"
 )
 
 // Pull - pulls the latest config from the server, if manual it will overwrite
+// if a daemon is running the pull is performed by the daemon, otherwise the daemon is restarted
 func Pull(network string, iface bool) (*config.Node, error) {
+	if daemonRunning() {
+		var node config.Node
+		if err := callDaemon(http.MethodPost, controlPull, &controlRequest{Network: network}, &node); err != nil {
+			return nil, err
+		}
+		return &node, nil
+	}
+	newNode, err := pull(network)
+	if err != nil {
+		return nil, err
+	}
+	logger.Log(3, "restarting daemon")
+	if err := daemon.Restart(); err != nil {
+		return newNode, err
+	}
+	return newNode, nil
+}
+
+// pull - retrieves the node for the given network from the server and saves the node and host peers
+func pull(network string) (*config.Node, error) {
 	node := config.GetNode(network)
 	if node.Network == "" {
 		return nil, errors.New("no such network")
@@ -25,7 +47,7 @@ func Pull(network string, iface bool) (*config.Node, error) {
 		return nil, err
 	}
 	endpoint := httpclient.JSONEndpoint[models.NodeGet, models.ErrorResponse]{
-		URL:           "https://" + server.API,
+		URL:           ncutils.APIURL(server.API),
 		Route:         "/api/nodes/" + node.Network + "/" + node.ID.String(),
 		Method:        http.MethodGet,
 		Authorization: "Bearer " + token,
@@ -46,16 +68,16 @@ func Pull(network string, iface bool) (*config.Node, error) {
 	}
 	config.WriteNodeConfig()
 	//update wg config
-	config.UpdateHostPeers(node.Server, nodeGet.HostPeers)
 	internetGateway, err := wireguard.UpdateWgPeers(nodeGet.HostPeers)
-	if internetGateway != nil && err != nil {
-		config.Netclient().InternetGateway = *internetGateway
+	if err := config.Update(func(state *config.State) error {
+		state.Host.HostPeers[node.Server] = nodeGet.HostPeers
+		if internetGateway != nil && err != nil {
+			state.Host.InternetGateway = *internetGateway
+		}
+		return nil
+	}); err != nil {
+		logger.Log(0, "failed to save netclient config", err.Error())
 	}
-	config.WriteNetclientConfig()
 	logger.Log(1, "node settings for network ", network)
-	logger.Log(3, "restarting daemon")
-	if err := daemon.Restart(); err != nil {
-		return newNode, err
-	}
-	return newNode, err
+	return newNode, nil
 }
@@ -0,0 +1,340 @@
+package functions
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gravitl/netclient/config"
+	proxy_cfg "github.com/gravitl/netclient/nmproxy/config"
+	"github.com/gravitl/netclient/policy"
+	"github.com/gravitl/netclient/transport"
+	"github.com/gravitl/netclient/wireguard"
+	"github.com/gravitl/netmaker/logger"
+	"github.com/gravitl/netmaker/models"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// daemonConfig - snapshot of the configuration the daemon goroutines were started with
+type daemonConfig struct {
+	ListenPort      int
+	PrivateKey      wgtypes.Key
+	MTU             int
+	ProxyEnabled    bool
+	ProxyListenPort int
+	WireGuardMode   string
+	RouteTable      int
+	FirewallMark    int
+	KillSwitch      bool
+	Policy          policy.Policy
+	Nodes           config.NodeMap
+	Servers         map[string]config.Server
+}
+
+// reloadPlan - changes between two daemon configurations
+type reloadPlan struct {
+	Restart        bool     // listen port, private key or wireguard mode changed, the interface must be recreated
+	AddServers     []string // servers to start a message queue for
+	RemoveServers  []string // servers to stop the message queue of
+	RestartServers []string // servers whose broker connection settings changed
+	Subscribe      []config.Node
+	Unsubscribe    []config.Node
+	Interface      bool // node addresses, mtu, route table, fwmark, kill switch or split-tunnel policy changed
+	Proxy          bool // proxy listen port changed
+	ProxyEnabled   bool // proxy setting changed, the proxy is restarted
+}
+
+// serverRoutine - message queue goroutine of a server
+type serverRoutine struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	done   chan struct{} // closed when the goroutine exits
+}
+
+// daemonRoutines - goroutines of the daemon, tracked separately so a reload only restarts what changed
+type daemonRoutines struct {
+	config    daemonConfig
+	servers   map[string]*serverRoutine
+	checkin   context.CancelFunc
+	wg        sync.WaitGroup // checkin goroutine
+	stopProxy context.CancelFunc
+	proxyWg   sync.WaitGroup
+}
+
+// readDaemonConfig - reads the config files into memory
+func readDaemonConfig() {
+	if _, err := config.ReadNetclientConfig(); err != nil {
+		logger.Log(0, "error reading neclient config file", err.Error())
+	}
+	if err := config.ReadNodeConfig(); err != nil {
+		logger.Log(0, "error reading node map from disk", err.Error())
+	}
+	if err := config.ReadServerConf(); err != nil {
+		logger.Log(0, "errors reading server map from disk", err.Error())
+	}
+}
+
+// currentConfig - copies the in memory configuration, with the split-tunnel policy read from its file
+func currentConfig() daemonConfig {
+	state := config.Snapshot()
+	splitTunnel, err := policy.Read()
+	if err != nil {
+		logger.Log(0, "failed to read split-tunnel policy", err.Error())
+	}
+	return daemonConfig{
+		ListenPort:      state.Host.ListenPort,
+		PrivateKey:      state.Host.PrivateKey,
+		MTU:             state.Host.MTU,
+		ProxyEnabled:    state.Host.ProxyEnabled,
+		ProxyListenPort: state.Host.ProxyListenPort,
+		WireGuardMode:   state.Host.WireGuardMode,
+		RouteTable:      state.Host.RouteTable,
+		FirewallMark:    state.Host.FirewallMark,
+		KillSwitch:      state.Host.KillSwitch,
+		Policy:          *splitTunnel,
+		Nodes:           state.Nodes,
+		Servers:         state.Servers,
+	}
+}
+
+// planReload - computes the changes required to move the daemon from the old to the new configuration
+func planReload(old, new daemonConfig) reloadPlan {
+	plan := reloadPlan{
+		Restart: old.ListenPort != new.ListenPort || old.PrivateKey != new.PrivateKey ||
+			old.WireGuardMode != new.WireGuardMode,
+		Interface: old.MTU != new.MTU || old.RouteTable != new.RouteTable ||
+			old.FirewallMark != new.FirewallMark || old.KillSwitch != new.KillSwitch ||
+			!reflect.DeepEqual(old.Policy, new.Policy),
+		Proxy:        old.ProxyListenPort != new.ProxyListenPort,
+		ProxyEnabled: old.ProxyEnabled != new.ProxyEnabled,
+	}
+	if plan.Restart {
+		return plan
+	}
+	// servers whose broker connection is kept
+	kept := make(map[string]bool)
+	for name, server := range new.Servers {
+		oldServer, ok := old.Servers[name]
+		switch {
+		case !ok:
+			plan.AddServers = append(plan.AddServers, name)
+		case brokerChanged(&oldServer, &server):
+			plan.RestartServers = append(plan.RestartServers, name)
+		default:
+			kept[name] = true
+		}
+	}
+	for name := range old.Servers {
+		if _, ok := new.Servers[name]; !ok {
+			plan.RemoveServers = append(plan.RemoveServers, name)
+		}
+	}
+	for network, node := range new.Nodes {
+		oldNode, ok := old.Nodes[network]
+		if !ok || addressChanged(&oldNode, &node) {
+			plan.Interface = true
+		}
+		if ok && oldNode.ID == node.ID && oldNode.Server == node.Server {
+			continue
+		}
+		if ok && kept[oldNode.Server] {
+			plan.Unsubscribe = append(plan.Unsubscribe, oldNode)
+		}
+		if kept[node.Server] {
+			plan.Subscribe = append(plan.Subscribe, node)
+		}
+	}
+	for network, node := range old.Nodes {
+		if _, ok := new.Nodes[network]; ok {
+			continue
+		}
+		plan.Interface = true
+		if kept[node.Server] {
+			plan.Unsubscribe = append(plan.Unsubscribe, node)
+		}
+	}
+	sort.Strings(plan.AddServers)
+	sort.Strings(plan.RemoveServers)
+	sort.Strings(plan.RestartServers)
+	sort.Slice(plan.Subscribe, func(i, j int) bool { return plan.Subscribe[i].Network < plan.Subscribe[j].Network })
+	sort.Slice(plan.Unsubscribe, func(i, j int) bool { return plan.Unsubscribe[i].Network < plan.Unsubscribe[j].Network })
+	return plan
+}
+
+// brokerChanged - checks if the settings used to connect to the broker of a server changed
+func brokerChanged(old, new *config.Server) bool {
+	return old.Broker != new.Broker ||
+		old.MQPort != new.MQPort ||
+		old.MQUserName != new.MQUserName ||
+		old.MQPassword != new.MQPassword ||
+		old.MQID != new.MQID ||
+		strings.Join(old.Brokers, ",") != strings.Join(new.Brokers, ",")
+}
+
+// addressChanged - checks if the addresses of a node on the netmaker interface changed
+func addressChanged(old, new *config.Node) bool {
+	return !ipNetEqual(old.Address, new.Address) ||
+		!ipNetEqual(old.Address6, new.Address6) ||
+		!ipNetEqual(old.NetworkRange, new.NetworkRange) ||
+		!ipNetEqual(old.NetworkRange6, new.NetworkRange6)
+}
+
+func ipNetEqual(a, b net.IPNet) bool {
+	return a.IP.Equal(b.IP) && a.Mask.String() == b.Mask.String()
+}
+
+// startGoRoutines - reads the config, creates the netmaker interface and starts the daemon goroutines
+// the goroutines are started even if the interface could not be set up, the error is returned so the daemon
+// does not report ready until a retry succeeds
+func startGoRoutines() (*daemonRoutines, error) {
+	readDaemonConfig()
+	d := &daemonRoutines{
+		config:  currentConfig(),
+		servers: make(map[string]*serverRoutine),
+	}
+	logger.Log(3, "configuring netmaker wireguard interface")
+	ifaceErr := createInterface()
+	if ifaceErr != nil {
+		logger.Log(0, ifaceErr.Error())
+	}
+	d.clearProxyPeers()
+	for _, server := range config.GetServerMap() {
+		d.startServer(server)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d.checkin = cancel
+	d.wg.Add(1)
+	go Checkin(ctx, &d.wg)
+	if !proxy_cfg.GetCfg().ProxyStatus {
+		d.stopProxy = startProxy(&d.proxyWg)
+	}
+	return d, ifaceErr
+}
+
+// daemonRoutines.reload - re-reads the config and applies the changes to the running daemon
+// the interface and unaffected broker connections are kept unless the listen port or private key changed;
+// an error setting up the interface is returned as by startGoRoutines
+func (d *daemonRoutines) reload() (*daemonRoutines, error) {
+	readDaemonConfig()
+	next := currentConfig()
+	plan := planReload(d.config, next)
+	if plan.Restart {
+		logger.Log(0, "listen port, private key or wireguard mode changed, restarting daemon")
+		d.stop()
+		return startGoRoutines()
+	}
+	for _, name := range plan.RemoveServers {
+		logger.Log(0, "stopping daemon for removed server", name)
+		d.stopServer(name)
+	}
+	for _, name := range plan.RestartServers {
+		logger.Log(0, "broker settings changed, reconnecting to server", name)
+		d.stopServer(name)
+		d.startServer(next.Servers[name])
+	}
+	for _, name := range plan.AddServers {
+		d.startServer(next.Servers[name])
+	}
+	for i := range plan.Unsubscribe {
+		if client := serverClient(plan.Unsubscribe[i].Server); client != nil && client.State() != transport.StateDisconnected {
+			unsubscribeNode(client, &plan.Unsubscribe[i])
+		}
+	}
+	for i := range plan.Subscribe {
+		if client := serverClient(plan.Subscribe[i].Server); client != nil && client.State() != transport.StateDisconnected {
+			setSubscriptions(client, &plan.Subscribe[i])
+		}
+	}
+	var ifaceErr error
+	if plan.Interface {
+		logger.Log(0, "reconfiguring netmaker interface")
+		if err := configureInterface(); err != nil {
+			ifaceErr = fmt.Errorf("could not configure netmaker interface %w", err)
+			logger.Log(0, ifaceErr.Error())
+		}
+	}
+	// restarting the proxy drops its peer connections, the peers are proxied again on the next peer update
+	// from the servers once the proxy is enabled
+	if plan.Proxy || plan.ProxyEnabled {
+		if plan.Proxy {
+			logger.Log(0, "proxy listen port changed, restarting proxy")
+		} else {
+			logger.Log(0, "proxy setting changed, proxy enabled:", fmt.Sprint(next.ProxyEnabled), "restarting proxy")
+		}
+		if d.stopProxy != nil {
+			d.stopProxy()
+			d.proxyWg.Wait()
+		}
+		d.stopProxy = startProxy(&d.proxyWg)
+	}
+	// peer endpoints depend on the proxy setting and may have changed while the daemon was running
+	if err := setPeers(); err != nil {
+		logger.Log(0, "failed to set peers", err.Error())
+		if ifaceErr == nil {
+			ifaceErr = err
+		}
+	}
+	d.clearProxyPeers()
+	d.config = next
+	logger.Log(0, "reload complete")
+	return d, ifaceErr
+}
+
+// daemonRoutines.startServer - starts the message queue goroutine of a server
+func (d *daemonRoutines) startServer(server config.Server) {
+	logger.Log(1, "started daemon for server ", server.Name)
+	ctx, cancel := context.WithCancel(context.Background())
+	routine := &serverRoutine{cancel: cancel, done: make(chan struct{})}
+	d.servers[server.Name] = routine
+	routine.wg.Add(1)
+	go func() {
+		defer close(routine.done)
+		messageQueue(ctx, &routine.wg, &server)
+	}()
+}
+
+// daemonRoutines.stopServer - stops the message queue goroutine of a server and disconnects from its broker
+func (d *daemonRoutines) stopServer(name string) {
+	routine, ok := d.servers[name]
+	if !ok {
+		return
+	}
+	routine.cancel()
+	if client := serverClient(name); client != nil {
+		client.Disconnect()
+	}
+	routine.wg.Wait()
+	delete(d.servers, name)
+	deleteServerClient(name)
+}
+
+// daemonRoutines.clearProxyPeers - removes all proxy peers when the host is not registered with any server
+func (d *daemonRoutines) clearProxyPeers() {
+	if len(config.GetServers()) == 0 {
+		ProxyManagerChan <- &models.HostPeerUpdate{
+			ProxyUpdate: models.ProxyManagerPayload{
+				Action: models.ProxyDeleteAllPeers,
+			},
+		}
+	}
+}
+
+// daemonRoutines.stop - stops all daemon goroutines and closes the netmaker interface
+func (d *daemonRoutines) stop() {
+	d.checkin()
+	if d.stopProxy != nil {
+		d.stopProxy()
+	}
+	for name := range d.servers {
+		d.stopServer(name)
+	}
+	d.wg.Wait()
+	d.proxyWg.Wait()
+	logger.Log(0, "closing netmaker interface")
+	iface := wireguard.GetInterface()
+	iface.Close()
+}
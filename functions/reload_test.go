@@ -0,0 +1,152 @@
+package functions
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/policy"
+	"github.com/matryer/is"
+)
+
+func reloadConfig() daemonConfig {
+	node := func(network, server, address string) config.Node {
+		var n config.Node
+		n.ID = uuid.New()
+		n.Network = network
+		n.Server = server
+		n.Address = net.IPNet{IP: net.ParseIP(address), Mask: net.CIDRMask(24, 32)}
+		return n
+	}
+	server := func(name string) config.Server {
+		s := config.Server{Name: name, MQID: uuid.New()}
+		s.Broker = "broker." + name
+		s.MQPort = "443"
+		return s
+	}
+	return daemonConfig{
+		ListenPort: 51821,
+		MTU:        1420,
+		Nodes: config.NodeMap{
+			"net1": node("net1", "server1", "10.0.1.1"),
+			"net2": node("net2", "server2", "10.0.2.1"),
+		},
+		Servers: map[string]config.Server{
+			"server1": server("server1"),
+			"server2": server("server2"),
+		},
+	}
+}
+
+// copyConfig - copies the maps of a config so they can be changed independently
+func copyConfig(c daemonConfig) daemonConfig {
+	nodes := make(config.NodeMap)
+	for k, v := range c.Nodes {
+		nodes[k] = v
+	}
+	servers := make(map[string]config.Server)
+	for k, v := range c.Servers {
+		servers[k] = v
+	}
+	c.Nodes = nodes
+	c.Servers = servers
+	return c
+}
+
+func TestPlanReload(t *testing.T) {
+	old := reloadConfig()
+	t.Run("unchanged", func(t *testing.T) {
+		is := is.New(t)
+		plan := planReload(old, copyConfig(old))
+		is.Equal(plan, reloadPlan{})
+	})
+	t.Run("listen port", func(t *testing.T) {
+		is := is.New(t)
+		next := copyConfig(old)
+		next.ListenPort = 51822
+		is.True(planReload(old, next).Restart)
+	})
+	t.Run("private key", func(t *testing.T) {
+		is := is.New(t)
+		next := copyConfig(old)
+		next.PrivateKey[0] = 1
+		is.True(planReload(old, next).Restart)
+	})
+	t.Run("wireguard mode", func(t *testing.T) {
+		is := is.New(t)
+		next := copyConfig(old)
+		next.WireGuardMode = "userspace"
+		is.True(planReload(old, next).Restart)
+	})
+	t.Run("mtu", func(t *testing.T) {
+		is := is.New(t)
+		next := copyConfig(old)
+		next.MTU = 1380
+		is.Equal(planReload(old, next), reloadPlan{Interface: true})
+	})
+	t.Run("policy routing", func(t *testing.T) {
+		is := is.New(t)
+		next := copyConfig(old)
+		next.RouteTable = 100
+		next.FirewallMark = 100
+		is.Equal(planReload(old, next), reloadPlan{Interface: true})
+		next = copyConfig(old)
+		next.KillSwitch = true
+		is.Equal(planReload(old, next), reloadPlan{Interface: true})
+		next = copyConfig(old)
+		next.Policy = policy.Policy{Networks: map[string]policy.Rules{"net1": {Deny: []string{"192.168.1.0/24"}}}}
+		is.Equal(planReload(old, next), reloadPlan{Interface: true})
+	})
+	t.Run("proxy", func(t *testing.T) {
+		is := is.New(t)
+		next := copyConfig(old)
+		next.ProxyEnabled = true
+		next.ProxyListenPort = 51722
+		is.Equal(planReload(old, next), reloadPlan{Proxy: true, ProxyEnabled: true})
+	})
+	t.Run("node address", func(t *testing.T) {
+		is := is.New(t)
+		next := copyConfig(old)
+		node := next.Nodes["net1"]
+		node.Address.IP = net.ParseIP("10.0.1.2")
+		next.Nodes["net1"] = node
+		is.Equal(planReload(old, next), reloadPlan{Interface: true})
+	})
+	t.Run("servers", func(t *testing.T) {
+		is := is.New(t)
+		next := copyConfig(old)
+		delete(next.Servers, "server2")
+		delete(next.Nodes, "net2")
+		server1 := next.Servers["server1"]
+		server1.MQPassword = "changed"
+		next.Servers["server1"] = server1
+		next.Servers["server3"] = config.Server{Name: "server3"}
+		plan := planReload(old, next)
+		is.True(!plan.Restart)
+		is.Equal(plan.RemoveServers, []string{"server2"})
+		is.Equal(plan.RestartServers, []string{"server1"})
+		is.Equal(plan.AddServers, []string{"server3"})
+		is.True(plan.Interface)
+		// broker connections that are restarted or stopped subscribe on connect
+		is.Equal(len(plan.Subscribe), 0)
+		is.Equal(len(plan.Unsubscribe), 0)
+	})
+	t.Run("nodes", func(t *testing.T) {
+		is := is.New(t)
+		next := copyConfig(old)
+		delete(next.Nodes, "net1")
+		var node config.Node
+		node.ID = uuid.New()
+		node.Network = "net3"
+		node.Server = "server2"
+		next.Nodes["net3"] = node
+		plan := planReload(old, next)
+		is.Equal(len(plan.AddServers)+len(plan.RemoveServers)+len(plan.RestartServers), 0)
+		is.True(plan.Interface)
+		is.Equal(len(plan.Subscribe), 1)
+		is.Equal(plan.Subscribe[0].Network, "net3")
+		is.Equal(len(plan.Unsubscribe), 1)
+		is.Equal(plan.Unsubscribe[0].Network, "net1")
+	})
+}
@@ -0,0 +1,53 @@
+package functions
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/replay"
+	"github.com/gravitl/netmaker/logger"
+)
+
+const (
+	// replayFile - file in the config dir holding the sequence numbers accepted from each server
+	replayFile = "replay.json"
+	// replayLock - name of the lock serializing access to the replay state between netclient processes
+	replayLock = "replay"
+)
+
+// getReplayGuard - returns the replay guard of the host
+func getReplayGuard() *replay.Guard {
+	return &replay.Guard{File: config.GetNetclientPath() + replayFile, Lock: replayLock}
+}
+
+// replayPolicy - the replay protection configured for a server
+func replayPolicy(server *config.Server) (replay.Policy, error) {
+	mode, err := replay.ParseMode(server.Replay)
+	if err != nil {
+		return replay.Policy{}, err
+	}
+	return replay.Policy{Mode: mode, Skew: time.Duration(server.ReplaySkew) * time.Second}, nil
+}
+
+// checkReplay - rejects replayed and stale messages from a server, returning the payload without its sequence header
+func checkReplay(server *config.Server, payload []byte) ([]byte, error) {
+	policy, err := replayPolicy(server)
+	if err != nil {
+		return nil, err
+	}
+	header, body, err := replay.Open(payload)
+	if err != nil {
+		return nil, err
+	}
+	if err := getReplayGuard().Accept(server.Name, header, policy, time.Now()); err != nil {
+		logger.Log(0, "rejected message from server", server.Name, err.Error())
+		return nil, fmt.Errorf("rejected message from %s %w", server.Name, err)
+	}
+	return body, nil
+}
+
+// replayStats - replay protection counters of each server
+func replayStats() (map[string]replay.Stats, error) {
+	return getReplayGuard().Stats()
+}
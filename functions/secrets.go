@@ -0,0 +1,34 @@
+package functions
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/secrets"
+)
+
+// MigrateSecrets - re-encrypts the secrets in the config files with a new key, protected by
+// a key encryption key from provider; if provider is empty the current provider is used
+func MigrateSecrets(provider string) error {
+	if provider == "" {
+		provider = secrets.DefaultProvider
+		store, err := secrets.Load(config.GetNetclientPath())
+		if err == nil {
+			provider = store.Provider()
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := config.ReencryptSecrets(provider); err != nil {
+		return err
+	}
+	fmt.Println("secrets re-encrypted using", provider, "provider")
+	backup := filepath.Join(config.GetNetclientPath(), "backup")
+	if _, err := os.Stat(backup); err == nil {
+		fmt.Println("WARNING:", backup, "contains copies of config files with secrets in plain text or encrypted with retired keys, remove it once no longer required")
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package functions
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/ncutils"
+	proxy_cfg "github.com/gravitl/netclient/nmproxy/config"
+	"github.com/gravitl/netclient/outbox"
+	"github.com/gravitl/netclient/replay"
+	"github.com/gravitl/netclient/wireguard"
+	"github.com/gravitl/netmaker/logger"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	peerDirect  = "direct"
+	peerProxied = "proxied"
+	peerRelayed = "relayed"
+)
+
+// PeerStatus - live status of a wireguard peer
+type PeerStatus struct {
+	PublicKey     string    `json:"public_key"`
+	Name          string    `json:"name"`
+	Networks      []string  `json:"networks"`
+	NodeIDs       []string  `json:"node_ids"`
+	Endpoint      string    `json:"endpoint"`
+	Mode          string    `json:"mode"`
+	LastHandshake time.Time `json:"last_handshake"`
+	ReceiveBytes  int64     `json:"rx_bytes"`
+	TransmitBytes int64     `json:"tx_bytes"`
+}
+
+// getDevicePeers - reads the peers of the netmaker interface, replaced in tests
+var getDevicePeers = func() ([]wgtypes.Peer, error) {
+	return wireguard.GetDevicePeers(ncutils.GetInterfaceName())
+}
+
+// Status - displays the live status of the peers on the netmaker interface
+// the status is read from the local device and config; no calls are made to the server api
+func Status(jsonOut, watch bool, interval time.Duration) error {
+	if !watch {
+		return printStatus(jsonOut)
+	}
+	if interval <= 0 {
+		interval = time.Second * 2
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if !jsonOut {
+			fmt.Print("\033[H\033[2J")
+		}
+		if err := printStatus(jsonOut); err != nil {
+			return err
+		}
+		select {
+		case <-interrupt:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// StatusReport - live status of the host: the broker used for each server and the peers on the netmaker interface
+type StatusReport struct {
+	Servers map[string]BrokerStatus `json:"servers"` // indexed by server name, only available while the daemon is running
+	Outbox  *outbox.Stats           `json:"outbox,omitempty"`
+	Replay  map[string]replay.Stats `json:"replay,omitempty"` // messages accepted and rejected by replay protection, indexed by server name
+	Peers   []PeerStatus            `json:"peers"`
+}
+
+func printStatus(jsonOut bool) error {
+	report, err := GetStatus()
+	if err != nil {
+		return err
+	}
+	if jsonOut {
+		out, err := json.MarshalIndent(report, "", " ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if len(report.Servers) > 0 {
+		servers := make([]string, 0, len(report.Servers))
+		for server := range report.Servers {
+			servers = append(servers, server)
+		}
+		sort.Strings(servers)
+		fmt.Fprintln(w, "SERVER\tBROKER\tSTATE\tDETAIL")
+		for _, server := range servers {
+			status := report.Servers[server]
+			broker := status.Active
+			if broker == "" {
+				broker = "-"
+			}
+			state, detail := connectionState(status, time.Now())
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", server, broker, state, detail)
+		}
+		fmt.Fprintln(w)
+	}
+	if report.Outbox != nil {
+		queued := 0
+		for _, depth := range report.Outbox.Depth {
+			queued += depth
+		}
+		fmt.Fprintf(w, "OUTBOX\t%d queued\t%d dropped\n\n", queued, report.Outbox.Dropped)
+	}
+	if rejected := rejectedServers(report.Replay); len(rejected) > 0 {
+		fmt.Fprintln(w, "SERVER\tREJECTED\tLAST REJECTED")
+		for _, server := range rejected {
+			stats := report.Replay[server]
+			fmt.Fprintf(w, "%s\t%d\t%s ago: %s\n", server, stats.Rejected(),
+				time.Since(stats.LastReject).Round(time.Second), stats.LastError)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w, "PEER\tNETWORKS\tENDPOINT\tMODE\tHANDSHAKE\tRX\tTX")
+	for _, peer := range report.Peers {
+		name := peer.Name
+		if name == "" {
+			name = peer.PublicKey
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", name, strings.Join(peer.Networks, ","), peer.Endpoint,
+			peer.Mode, handshakeAge(peer.LastHandshake, time.Now()), formatBytes(peer.ReceiveBytes), formatBytes(peer.TransmitBytes))
+	}
+	return w.Flush()
+}
+
+// GetStatus - gets the peer status and, if the daemon is running, the broker status of each server
+func GetStatus() (*StatusReport, error) {
+	// the proxy and broker state lives in the daemon, ask for it if the daemon can be reached
+	var daemonStatus *DaemonStatus
+	if daemonRunning() {
+		status, err := GetDaemonStatus()
+		if err != nil {
+			logger.Log(1, "failed to get status from daemon", err.Error())
+		} else {
+			daemonStatus = status
+		}
+	}
+	report := &StatusReport{Servers: make(map[string]BrokerStatus)}
+	var modes map[string]string
+	if daemonStatus != nil {
+		modes = daemonStatus.PeerModes
+		for server, status := range daemonStatus.BrokerStatus {
+			report.Servers[server] = status
+		}
+	}
+	peers, err := GetPeerStatus(modes)
+	if err != nil {
+		return nil, err
+	}
+	report.Peers = peers
+	if stats, err := outboxStats(); err != nil {
+		logger.Log(1, "failed to read outbox", err.Error())
+	} else {
+		report.Outbox = stats
+	}
+	if stats, err := replayStats(); err != nil {
+		logger.Log(1, "failed to read replay protection state", err.Error())
+	} else {
+		report.Replay = stats
+	}
+	return report, nil
+}
+
+// GetPeerStatus - joins the peers on the netmaker interface with the peer ids received from the server(s)
+// modes holds the proxy mode of proxied and relayed peers reported by the daemon, indexed by public key
+func GetPeerStatus(modes map[string]string) ([]PeerStatus, error) {
+	devicePeers, err := getDevicePeers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read netmaker interface %w", err)
+	}
+	peers := []PeerStatus{}
+	for _, devicePeer := range devicePeers {
+		peer := PeerStatus{
+			PublicKey:     devicePeer.PublicKey.String(),
+			LastHandshake: devicePeer.LastHandshakeTime,
+			ReceiveBytes:  devicePeer.ReceiveBytes,
+			TransmitBytes: devicePeer.TransmitBytes,
+			Mode:          peerMode(devicePeer, modes),
+		}
+		if devicePeer.Endpoint != nil {
+			peer.Endpoint = devicePeer.Endpoint.String()
+		}
+		networks := make(map[string]struct{})
+		for nodeID, idAndAddr := range config.GetHostPeerIDs(peer.PublicKey) {
+			peer.NodeIDs = append(peer.NodeIDs, nodeID)
+			if idAndAddr.Name != "" {
+				peer.Name = idAndAddr.Name
+			}
+			if _, ok := networks[idAndAddr.Network]; !ok && idAndAddr.Network != "" {
+				networks[idAndAddr.Network] = struct{}{}
+				peer.Networks = append(peer.Networks, idAndAddr.Network)
+			}
+		}
+		sort.Strings(peer.NodeIDs)
+		sort.Strings(peer.Networks)
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Name != peers[j].Name {
+			return peers[i].Name < peers[j].Name
+		}
+		return peers[i].PublicKey < peers[j].PublicKey
+	})
+	return peers, nil
+}
+
+// proxyPeerModes - gets the proxy mode of peers managed by the proxy, indexed by public key
+func proxyPeerModes() map[string]string {
+	modes := make(map[string]string)
+	for key, conn := range proxy_cfg.GetCfg().GetAllProxyPeers() {
+		if conn.IsRelayed {
+			modes[key] = peerRelayed
+		} else {
+			modes[key] = peerProxied
+		}
+	}
+	return modes
+}
+
+// peerMode - determines if a peer is direct, proxied or relayed
+// without proxy state from the daemon a peer with a loopback endpoint is assumed to be proxied
+func peerMode(peer wgtypes.Peer, modes map[string]string) string {
+	if mode, ok := modes[peer.PublicKey.String()]; ok {
+		return mode
+	}
+	if peer.Endpoint != nil && peer.Endpoint.IP.IsLoopback() {
+		return peerProxied
+	}
+	return peerDirect
+}
+
+// rejectedServers - sorted names of the servers messages were rejected from
+func rejectedServers(stats map[string]replay.Stats) []string {
+	servers := []string{}
+	for server, s := range stats {
+		if s.Rejected() > 0 {
+			servers = append(servers, server)
+		}
+	}
+	sort.Strings(servers)
+	return servers
+}
+
+// connectionState - state of the broker connection of a server and how long it has been unreachable and why
+func connectionState(status BrokerStatus, now time.Time) (string, string) {
+	health := status.Connection
+	if health == nil {
+		if status.Connected {
+			return string(ConnConnected), "-"
+		}
+		return "disconnected", "-"
+	}
+	if health.State == ConnConnected {
+		return string(health.State), "for " + now.Sub(health.Since).Round(time.Second).String()
+	}
+	if health.UnreachableSince.IsZero() {
+		return string(health.State), "-"
+	}
+	detail := fmt.Sprintf("unreachable for %s (%s: %s)", now.Sub(health.UnreachableSince).Round(time.Second),
+		health.Failure, health.LastError)
+	if !health.NextAttempt.IsZero() && health.NextAttempt.After(now) {
+		detail += ", retry in " + health.NextAttempt.Sub(now).Round(time.Second).String()
+	}
+	return string(health.State), detail
+}
+
+func handshakeAge(handshake, now time.Time) string {
+	if handshake.IsZero() {
+		return "never"
+	}
+	return now.Sub(handshake).Round(time.Second).String() + " ago"
+}
+
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,232 @@
+package functions
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/lock"
+	"github.com/gravitl/netmaker/models"
+	"github.com/matryer/is"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// testDevicePeer - a peer of the netmaker interface with the given endpoint, nil for a peer without one
+func testDevicePeer(t *testing.T, endpoint *net.UDPAddr) wgtypes.Peer {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wgtypes.Peer{PublicKey: key.PublicKey(), Endpoint: endpoint}
+}
+
+// useDevicePeers - makes peers the peers of the netmaker interface for the rest of the test
+func useDevicePeers(t *testing.T, peers ...wgtypes.Peer) {
+	t.Setenv(config.ConfigDirEnv, t.TempDir())
+	t.Setenv(lock.RuntimeDirEnv, t.TempDir())
+	restoreGlobals(t)
+	useTestSocket(t)
+	getDevicePeers = func() ([]wgtypes.Peer, error) {
+		return peers, nil
+	}
+}
+
+func TestPeerMode(t *testing.T) {
+	peer := testDevicePeer(t, &net.UDPAddr{IP: net.ParseIP("203.0.113.5"), Port: 51821})
+	proxied := testDevicePeer(t, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 51722})
+	noEndpoint := testDevicePeer(t, nil)
+	tests := []struct {
+		name  string
+		peer  wgtypes.Peer
+		modes map[string]string
+		mode  string
+	}{
+		{name: "direct", peer: peer, mode: peerDirect},
+		{name: "no endpoint", peer: noEndpoint, mode: peerDirect},
+		{name: "loopback without daemon", peer: proxied, mode: peerProxied},
+		{name: "relayed by daemon", peer: peer, modes: map[string]string{peer.PublicKey.String(): peerRelayed}, mode: peerRelayed},
+		{name: "proxied by daemon", peer: peer, modes: map[string]string{peer.PublicKey.String(): peerProxied}, mode: peerProxied},
+		{name: "other peer proxied", peer: peer, modes: map[string]string{proxied.PublicKey.String(): peerProxied}, mode: peerDirect},
+		// the mode reported by the daemon takes precedence over the guess from a loopback endpoint
+		{name: "loopback relayed by daemon", peer: proxied, modes: map[string]string{proxied.PublicKey.String(): peerRelayed}, mode: peerRelayed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(peerMode(test.peer, test.modes), test.mode)
+		})
+	}
+}
+
+func TestGetPeerStatus(t *testing.T) {
+	is := is.New(t)
+	handshake := time.Now().Add(-time.Minute)
+	named := testDevicePeer(t, &net.UDPAddr{IP: net.ParseIP("203.0.113.5"), Port: 51821})
+	named.LastHandshakeTime = handshake
+	named.ReceiveBytes = 2048
+	named.TransmitBytes = 100
+	relayed := testDevicePeer(t, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 51722})
+	unknown := testDevicePeer(t, nil)
+	useDevicePeers(t, unknown, relayed, named)
+	host := config.Netclient()
+	host.PeerIDs = map[string]models.HostPeerMap{
+		// a peer on two networks of two servers
+		"server1": {named.PublicKey.String(): {
+			"node2": {ID: "node2", Name: "host2", Network: "net1"},
+			"node1": {ID: "node1", Name: "host2", Network: "net1"},
+		}},
+		"server2": {
+			named.PublicKey.String():   {"node3": {ID: "node3", Name: "host2", Network: "net2"}},
+			relayed.PublicKey.String(): {"node4": {ID: "node4", Name: "host3", Network: "net2"}},
+		},
+	}
+	config.UpdateNetclient(*host)
+
+	peers, err := GetPeerStatus(map[string]string{relayed.PublicKey.String(): peerRelayed})
+	is.NoErr(err)
+	is.Equal(len(peers), 3)
+	// peers without a name are listed first, then by name
+	is.Equal(peers[0], PeerStatus{PublicKey: unknown.PublicKey.String(), Mode: peerDirect})
+	is.Equal(peers[1], PeerStatus{
+		PublicKey:     named.PublicKey.String(),
+		Name:          "host2",
+		Networks:      []string{"net1", "net2"},
+		NodeIDs:       []string{"node1", "node2", "node3"},
+		Endpoint:      "203.0.113.5:51821",
+		Mode:          peerDirect,
+		LastHandshake: handshake,
+		ReceiveBytes:  2048,
+		TransmitBytes: 100,
+	})
+	is.Equal(peers[2].Name, "host3")
+	is.Equal(peers[2].NodeIDs, []string{"node4"})
+	is.Equal(peers[2].Endpoint, "127.0.0.1:51722")
+	is.Equal(peers[2].Mode, peerRelayed)
+}
+
+func TestGetStatus(t *testing.T) {
+	proxied := testDevicePeer(t, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 51722})
+	t.Run("offline", func(t *testing.T) {
+		is := is.New(t)
+		useDevicePeers(t, proxied)
+		// without a daemon the broker state is unknown and the proxy mode is guessed from the endpoint
+		report, err := GetStatus()
+		is.NoErr(err)
+		is.Equal(len(report.Servers), 0)
+		is.Equal(len(report.Peers), 1)
+		is.Equal(report.Peers[0].Mode, peerProxied)
+	})
+	t.Run("daemon", func(t *testing.T) {
+		is := is.New(t)
+		d := startTestDaemon(t)
+		startTestControl(t)
+		getDevicePeers = func() ([]wgtypes.Peer, error) {
+			return []wgtypes.Peer{proxied}, nil
+		}
+		report, err := GetStatus()
+		is.NoErr(err)
+		is.Equal(len(report.Servers), 1)
+		status := report.Servers[d.name]
+		is.True(status.Connected)
+		is.Equal(status.Connection.State, ConnConnected)
+		is.Equal(len(report.Peers), 1)
+	})
+}
+
+func TestConnectionState(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		status BrokerStatus
+		state  string
+		detail string
+	}{
+		{name: "cli connected", status: BrokerStatus{Connected: true}, state: "connected", detail: "-"},
+		{name: "cli disconnected", status: BrokerStatus{}, state: "disconnected", detail: "-"},
+		{
+			name:   "connected",
+			status: BrokerStatus{Connection: &ConnHealth{State: ConnConnected, Since: now.Add(-time.Minute * 90)}},
+			state:  "connected",
+			detail: "for 1h30m0s",
+		},
+		{
+			name:   "first attempt",
+			status: BrokerStatus{Connection: &ConnHealth{State: ConnConnecting, Since: now}},
+			state:  "connecting",
+			detail: "-",
+		},
+		{
+			name: "backoff",
+			status: BrokerStatus{Connection: &ConnHealth{
+				State:            ConnBackoff,
+				Failure:          FailureTCP,
+				LastError:        "connection refused",
+				UnreachableSince: now.Add(-time.Second * 30),
+				NextAttempt:      now.Add(time.Second * 4),
+			}},
+			state:  "backoff",
+			detail: "unreachable for 30s (tcp: connection refused), retry in 4s",
+		},
+		{
+			name: "retry due",
+			status: BrokerStatus{Connection: &ConnHealth{
+				State:            ConnConnecting,
+				Failure:          FailureDNS,
+				LastError:        "no such host",
+				UnreachableSince: now.Add(-time.Minute),
+				NextAttempt:      now.Add(-time.Second),
+			}},
+			state:  "connecting",
+			detail: "unreachable for 1m0s (dns: no such host)",
+		},
+		{
+			name: "auth failed",
+			status: BrokerStatus{Connection: &ConnHealth{
+				State:            ConnAuthFailed,
+				Failure:          FailureAuth,
+				LastError:        "not authorized",
+				UnreachableSince: now.Add(-time.Hour),
+				NextAttempt:      now.Add(time.Minute * 10),
+			}},
+			state:  "auth-failed",
+			detail: "unreachable for 1h0m0s (auth: not authorized), retry in 10m0s",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			is := is.New(t)
+			state, detail := connectionState(test.status, now)
+			is.Equal(state, test.state)
+			is.Equal(detail, test.detail)
+		})
+	}
+}
+
+func TestHandshakeAge(t *testing.T) {
+	is := is.New(t)
+	now := time.Now()
+	is.Equal(handshakeAge(time.Time{}, now), "never")
+	is.Equal(handshakeAge(now.Add(-time.Second*1500), now), "25m0s ago")
+	is.Equal(handshakeAge(now.Add(-time.Millisecond*400), now), "0s ago")
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		bytes int64
+		text  string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{1024*1024 - 1, "1024.0 KiB"},
+		{1024 * 1024, "1.0 MiB"},
+		{5 * 1024 * 1024 * 1024, "5.0 GiB"},
+		{1 << 60, "1.0 EiB"},
+	}
+	is := is.New(t)
+	for _, test := range tests {
+		is.Equal(formatBytes(test.bytes), test.text)
+	}
+}
@@ -0,0 +1,211 @@
+package functions
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/ncutils"
+	"github.com/gravitl/netmaker/logger"
+	"github.com/gravitl/netmaker/models"
+)
+
+// trafficKeyOverlap - time the previous traffic key is still accepted after all servers confirmed the new key,
+// for messages sealed to the previous key that were already queued by the broker
+const trafficKeyOverlap = time.Hour
+
+// trafficKeyAnnounce - outbox key of the host update announcing a traffic key, so a queued announcement is not
+// replaced by a later host update without the new key
+const trafficKeyAnnounce = "announce traffic key"
+
+// trafficKeyMutex - serializes changes to the traffic key rotation state
+var trafficKeyMutex sync.Mutex
+
+// TrafficKeyStatus - state of the traffic keys reported by rotate-traffic
+type TrafficKeyStatus struct {
+	Created  time.Time     `json:"created"`
+	Interval time.Duration `json:"interval"`
+	Started  time.Time     `json:"started,omitempty"` // start of the rotation in progress
+	Pending  []string      `json:"pending,omitempty"` // servers that have not confirmed the new key
+}
+
+// TrafficKeys - rotates the traffic keys and/or sets the interval of scheduled rotations, using the daemon if it is running
+// the new key is announced to all servers; interval 0 disables scheduled rotation, nil leaves it unchanged
+func TrafficKeys(rotate bool, interval *time.Duration) (*TrafficKeyStatus, error) {
+	if interval != nil && *interval < 0 {
+		return nil, errors.New("rotation interval can not be negative")
+	}
+	request := &controlRequest{Rotate: rotate, Interval: interval}
+	if daemonRunning() {
+		status := &TrafficKeyStatus{}
+		if err := callDaemon(http.MethodPost, controlTrafficKeys, request, status); err != nil {
+			return nil, err
+		}
+		return status, nil
+	}
+	if rotate {
+		for _, server := range config.GetServers() {
+			serverCfg := config.GetServer(server)
+			if serverCfg == nil {
+				continue
+			}
+			if err := setupMQTTSingleton(serverCfg, true); err != nil {
+				logger.Log(0, "failed to set up mq conn for server ", server)
+			}
+		}
+	}
+	return updateTrafficKeys(request)
+}
+
+// updateTrafficKeys - applies a traffic key request
+func updateTrafficKeys(request *controlRequest) (*TrafficKeyStatus, error) {
+	if request.Interval != nil {
+		trafficKeyMutex.Lock()
+		err := config.Update(func(state *config.State) error {
+			state.Host.TrafficKeyInterval = *request.Interval
+			return nil
+		})
+		trafficKeyMutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if request.Rotate {
+		if err := rotateTrafficKeys(); err != nil {
+			return nil, err
+		}
+	}
+	return trafficKeyStatus(), nil
+}
+
+// rotateTrafficKeys - replaces the traffic keys and announces the new public key to all servers
+// the rotation state is saved before the key is announced so an interrupted rotation is resumed by the daemon
+func rotateTrafficKeys() error {
+	trafficKeyMutex.Lock()
+	err := config.Update(func(state *config.State) error {
+		servers := make([]string, 0, len(state.Servers))
+		for _, server := range state.Servers {
+			servers = append(servers, server.Name)
+		}
+		return state.Host.RotateTrafficKeys(servers, time.Now())
+	})
+	trafficKeyMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	logger.Log(0, "rotated traffic keys")
+	announceTrafficKey()
+	return nil
+}
+
+// announceTrafficKey - publishes the new traffic key to the servers that have not confirmed it
+// the update is sealed with the previous key, which the servers still use until they confirm
+func announceTrafficKey() {
+	host := config.Netclient()
+	if host.TrafficKeyRotation == nil {
+		return
+	}
+	hostUpdate := models.HostUpdate{Action: models.UpdateHost, Host: host.Host}
+	data, err := json.Marshal(hostUpdate)
+	if err != nil {
+		logger.Log(0, "failed to announce traffic key", err.Error())
+		return
+	}
+	for _, server := range append([]string{}, host.TrafficKeyRotation.Pending...) {
+		if err := publishDurable(server, fmt.Sprintf("host/serverupdate/%s", host.ID.String()), trafficKeyAnnounce, data, 1, nil); err != nil {
+			logger.Log(0, "failed to announce traffic key to", server, err.Error())
+		}
+	}
+}
+
+// confirmTrafficKey - records that a server uses the new traffic key
+func confirmTrafficKey(server string) {
+	trafficKeyMutex.Lock()
+	defer trafficKeyMutex.Unlock()
+	confirmed := false
+	if err := config.Update(func(state *config.State) error {
+		confirmed = state.Host.ConfirmTrafficKey(server, time.Now())
+		return nil
+	}); err != nil {
+		logger.Log(0, "failed to save traffic key rotation", err.Error())
+		return
+	}
+	if confirmed {
+		logger.Log(0, "server", server, "confirmed the new traffic key")
+	}
+}
+
+// checkTrafficKeys - removes the previous traffic key once it is no longer needed and starts scheduled rotations
+func checkTrafficKeys() {
+	trafficKeyMutex.Lock()
+	expired := false
+	if err := config.Update(func(state *config.State) error {
+		expired = state.Host.ExpireTrafficKey(trafficKeyOverlap, time.Now())
+		return nil
+	}); err != nil {
+		logger.Log(0, "failed to save traffic key rotation", err.Error())
+	} else if expired {
+		logger.Log(0, "removed previous traffic key")
+	}
+	due := config.Netclient().TrafficKeyRotationDue(time.Now())
+	trafficKeyMutex.Unlock()
+	if due {
+		logger.Log(0, "scheduled traffic key rotation")
+		if err := rotateTrafficKeys(); err != nil {
+			logger.Log(0, "failed to rotate traffic keys", err.Error())
+		}
+	}
+}
+
+// openMessage - decrypts a message from a server with the current traffic key, or the previous key during a rotation
+// a message sealed to the current key confirms that a server which had not confirmed the new key uses it
+func openMessage(server string, msg []byte, serverPubKey *[32]byte) ([]byte, error) {
+	host := config.Netclient()
+	key, err := ncutils.ConvertBytesToKey(host.TrafficKeyPrivate)
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := DeChunk(msg, serverPubKey, key)
+	if err == nil {
+		if host.TrafficKeyPending(server) {
+			confirmTrafficKey(server)
+		}
+		return decrypted, nil
+	}
+	rotation := host.TrafficKeyRotation
+	if rotation == nil {
+		return nil, err
+	}
+	previous, keyErr := ncutils.ConvertBytesToKey(rotation.PreviousPrivate)
+	if keyErr != nil {
+		return nil, err
+	}
+	return DeChunk(msg, serverPubKey, previous)
+}
+
+// confirmedTrafficKey - checks if a host update from a server echoes the new traffic key
+func confirmedTrafficKey(server string, host *models.Host) {
+	current := config.Netclient()
+	if current.TrafficKeyPending(server) && len(host.TrafficKeyPublic) > 0 &&
+		bytes.Equal(host.TrafficKeyPublic, current.TrafficKeyPublic) {
+		confirmTrafficKey(server)
+	}
+}
+
+// trafficKeyStatus - the current traffic key state
+func trafficKeyStatus() *TrafficKeyStatus {
+	trafficKeyMutex.Lock()
+	defer trafficKeyMutex.Unlock()
+	host := config.Netclient()
+	status := &TrafficKeyStatus{Created: host.TrafficKeyCreated, Interval: host.TrafficKeyInterval}
+	if rotation := host.TrafficKeyRotation; rotation != nil {
+		status.Started = rotation.Started
+		status.Pending = append([]string{}, rotation.Pending...)
+	}
+	return status
+}
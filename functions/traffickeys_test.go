@@ -0,0 +1,46 @@
+package functions
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/ncutils"
+	"github.com/gravitl/netmaker/models"
+	"github.com/matryer/is"
+)
+
+func TestTrafficKeyRotation(t *testing.T) {
+	is := is.New(t)
+	d := startTestDaemon(t)
+	topic := "host/serverupdate/" + config.Netclient().ID.String()
+	previous := config.Netclient().TrafficKeyPublic
+	received := d.receive(t, topic)
+
+	// the new key is announced sealed with the previous key, which the server still uses
+	is.NoErr(rotateTrafficKeys())
+	current := config.Netclient().TrafficKeyPublic
+	is.True(string(current) != string(previous))
+	var announcement models.HostUpdate
+	is.NoErr(json.Unmarshal(received()[topic], &announcement))
+	is.Equal(announcement.Host.TrafficKeyPublic, current)
+
+	// once the server confirms, host updates are sealed with the new key and carry it
+	confirmTrafficKey(d.name)
+	is.True(!config.Netclient().TrafficKeyPending(d.name))
+	hostKey, err := ncutils.ConvertBytesToKey(current)
+	is.NoErr(err)
+	d.hostKey = hostKey
+	is.NoErr(PublishHostUpdate(d.name, models.UpdateHost))
+	var update models.HostUpdate
+	is.NoErr(json.Unmarshal(received()[topic], &update))
+	is.Equal(update.Host.TrafficKeyPublic, current)
+	is.NoErr(PublishGlobalHostUpdate(models.UpdateHost))
+	is.NoErr(json.Unmarshal(received()[topic], &update))
+	is.Equal(update.Host.TrafficKeyPublic, current)
+
+	// the key is kept across a reload of the config
+	host, err := config.ReadNetclientConfig()
+	is.NoErr(err)
+	is.Equal(host.Host.TrafficKeyPublic, current)
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/devilcove/httpclient"
 	"github.com/gravitl/netclient/config"
 	"github.com/gravitl/netclient/daemon"
+	"github.com/gravitl/netclient/ncutils"
 	"github.com/gravitl/netclient/wireguard"
 	"github.com/gravitl/netmaker/logger"
 	"github.com/gravitl/netmaker/models"
@@ -19,14 +20,14 @@ import (
 func Uninstall() ([]error, error) {
 	allfaults := []error{}
 	var err error
-	for _, v := range config.Servers {
+	for _, v := range config.GetServerMap() {
 		v := v
 		if err = setupMQTTSingleton(&v, true); err != nil {
 			logger.Log(0, "failed to connect to server on uninstall", v.Name)
 			allfaults = append(allfaults, err)
 			continue
 		}
-		defer ServerSet[v.Name].Disconnect(250)
+		defer serverClient(v.Name).Disconnect()
 		if err = PublishHostUpdate(v.Name, models.DeleteHost); err != nil {
 			logger.Log(0, "failed to notify server", v.Name, "of host removal")
 			allfaults = append(allfaults, err)
@@ -36,13 +37,15 @@ func Uninstall() ([]error, error) {
 	if err = daemon.CleanUp(); err != nil {
 		allfaults = append(allfaults, err)
 	}
+	// the stopped daemon keeps the kill switch of an internet gateway
+	wireguard.RemoveKillSwitch()
 	return allfaults, err
 }
 
 // LeaveNetwork - client exits a network
 func LeaveNetwork(network string, isDaemon bool) ([]error, error) {
 	faults := []error{}
-	node, ok := config.Nodes[network]
+	node, ok := config.GetNodes()[network]
 	if !ok {
 		return faults, fmt.Errorf("not connected to network: %s", network)
 	}
@@ -69,8 +72,8 @@ func LeaveNetwork(network string, isDaemon bool) ([]error, error) {
 				faults = append(faults, fmt.Errorf("issue setting peers after node removal - %v", err.Error()))
 			}
 		}
-	} else { // was called from CLI so restart daemon
-		if err := daemon.Restart(); err != nil {
+	} else { // was called from CLI so reload daemon
+		if err := reloadDaemon(); err != nil {
 			faults = append(faults, fmt.Errorf("could not restart daemon after leave - %v", err.Error()))
 		}
 	}
@@ -91,7 +94,7 @@ func deleteNodeFromServer(node *config.Node) error {
 		return fmt.Errorf("could not read sever config %w", err)
 	}
 	endpoint := httpclient.Endpoint{
-		URL:    "https://" + server.API,
+		URL:    ncutils.APIURL(server.API),
 		Method: http.MethodDelete,
 		Route:  "/api/nodes/" + node.Network + "/" + node.ID.String(),
 		Headers: []httpclient.Header{
@@ -115,24 +118,28 @@ func deleteNodeFromServer(node *config.Node) error {
 }
 
 func deleteLocalNetwork(node *config.Node) error {
-	nodetodelete := config.GetNode(node.Network)
-	if nodetodelete.Network == "" {
-		return errors.New("no such network")
-	}
-	//remove node from nodes map
-	config.DeleteNode(node.Network)
-	server := config.GetServer(node.Server)
-	//remove node from server node map
-	if server != nil {
+	if err := config.Update(func(state *config.State) error {
+		if _, ok := state.Nodes[node.Network]; !ok {
+			return errors.New("no such network")
+		}
+		//remove node from nodes map
+		delete(state.Nodes, node.Network)
+		//remove node from server node map
+		server, ok := state.Servers[node.Server]
+		if !ok {
+			return nil
+		}
 		delete(server.Nodes, node.Network)
+		state.Servers[node.Server] = server
+		if len(server.Nodes) == 0 {
+			logger.Log(3, "removing server peers", server.Name)
+			delete(state.Host.PeerIDs, node.Server)
+			delete(state.Host.HostPeers, node.Server)
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
-	if len(server.Nodes) == 0 {
-		logger.Log(3, "removing server peers", server.Name)
-		config.DeleteServerHostPeerCfg(node.Server)
-	}
-	config.WriteNetclientConfig()
-	config.WriteNodeConfig()
-	config.WriteServerConfig()
 	if len(config.GetNodes()) < 1 {
 		logger.Log(0, "removing wireguard config")
 		os.RemoveAll(config.GetNetclientPath() + "netmaker.conf")
@@ -112,7 +112,7 @@ func (app *App) GoLeaveNetwork(networkName string) (any, error) {
 // App.GoGetRecentServerNames returns names of all known (joined) servers
 func (app *App) GoGetRecentServerNames() ([]string, error) {
 	serverNames := []string{}
-	for name := range config.Servers {
+	for name := range config.GetServerMap() {
 		name := name
 		serverNames = append(serverNames, name)
 	}
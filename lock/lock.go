@@ -0,0 +1,134 @@
+// Package lock provides advisory locking to serialize access to shared files between netclient processes
+// the lock files are kept in RuntimeDir, or the directory named by RuntimeDirEnv, which must be owned by the
+// current user and must not be writable by other users
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Mode - type of lock to acquire
+type Mode int
+
+const (
+	// Shared - lock that can be held by any number of readers at the same time
+	Shared Mode = iota
+	// Exclusive - lock that can only be held by a single writer
+	Exclusive
+)
+
+const (
+	// minRetry - initial interval between attempts to obtain a contended lock
+	minRetry = time.Millisecond * 5
+	// maxRetry - maximum interval between attempts to obtain a contended lock
+	maxRetry = time.Millisecond * 100
+)
+
+// RuntimeDirEnv - environment variable overriding RuntimeDir, eg. NETCLIENT_RUNTIME_DIR=/tmp/netclient-run for a
+// netclient using a scratch config directory or tests that must not touch the locks of the installed netclient
+const RuntimeDirEnv = "NETCLIENT_RUNTIME_DIR"
+
+// ErrTimeout - returned when a lock could not be obtained before the context was done
+var ErrTimeout = errors.New("timeout waiting for lock")
+
+// Lock - a held advisory lock
+// locks are tied to an open file so they are released by the kernel if the holding process dies
+type Lock struct {
+	name string
+	file *os.File
+}
+
+// String - name of the lock and its mode
+func (m Mode) String() string {
+	if m == Exclusive {
+		return "exclusive"
+	}
+	return "shared"
+}
+
+// Acquire - obtains a lock of the given mode on name, waiting until the lock is available or ctx is done
+func Acquire(ctx context.Context, name string, mode Mode) (*Lock, error) {
+	if name == "" || filepath.Base(name) != name {
+		return nil, fmt.Errorf("invalid lock name %q", name)
+	}
+	if err := ensureRuntimeDir(); err != nil {
+		return nil, err
+	}
+	f, err := openLockFile(filepath.Join(Dir(), name+".lck"))
+	if err != nil {
+		return nil, err
+	}
+	retry := minRetry
+	for {
+		locked, err := tryLock(f, mode)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", name, err)
+		}
+		if locked {
+			return &Lock{name: name, file: f}, nil
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, fmt.Errorf("%s lock on %s: %w", mode, name, ErrTimeout)
+		case <-time.After(retry):
+		}
+		if retry *= 2; retry > maxRetry {
+			retry = maxRetry
+		}
+	}
+}
+
+// AcquireTimeout - obtains a lock of the given mode on name, waiting at most timeout
+func AcquireTimeout(name string, mode Mode, timeout time.Duration) (*Lock, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return Acquire(ctx, name, mode)
+}
+
+// Lock.Release - releases the lock
+// the lock file is intentionally left in place as removing it would race with other processes waiting on it
+func (l *Lock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	err := unlock(l.file)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	l.file = nil
+	return err
+}
+
+// Dir - directory containing the lock files, RuntimeDir unless overridden by RuntimeDirEnv
+func Dir() string {
+	if dir := os.Getenv(RuntimeDirEnv); dir != "" {
+		return dir
+	}
+	return RuntimeDir
+}
+
+// ensureRuntimeDir - creates the runtime directory if required and verifies it can not be tampered with by other users
+func ensureRuntimeDir() error {
+	dir := Dir()
+	info, err := os.Lstat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create lock directory %w", err)
+		}
+		info, err = os.Lstat(dir)
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("lock directory %s is not a directory", dir)
+	}
+	return checkOwner(dir, info)
+}
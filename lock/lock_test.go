@@ -0,0 +1,101 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestDir(t *testing.T) {
+	is := is.New(t)
+	t.Setenv(RuntimeDirEnv, "")
+	is.Equal(Dir(), RuntimeDir)
+	dir := t.TempDir()
+	t.Setenv(RuntimeDirEnv, dir)
+	is.Equal(Dir(), dir)
+	l, err := AcquireTimeout("test", Exclusive, time.Second)
+	is.NoErr(err)
+	defer l.Release()
+	matches, err := filepath.Glob(filepath.Join(dir, "test.lck"))
+	is.NoErr(err)
+	is.Equal(len(matches), 1)
+}
+
+func TestContention(t *testing.T) {
+	is := is.New(t)
+	t.Setenv(RuntimeDirEnv, t.TempDir())
+
+	// readers do not block each other
+	first, err := AcquireTimeout("config", Shared, time.Second)
+	is.NoErr(err)
+	second, err := AcquireTimeout("config", Shared, time.Second)
+	is.NoErr(err)
+	// a writer waits for all readers
+	_, err = AcquireTimeout("config", Exclusive, time.Millisecond*50)
+	is.True(errors.Is(err, ErrTimeout))
+	is.NoErr(first.Release())
+	_, err = AcquireTimeout("config", Exclusive, time.Millisecond*50)
+	is.True(errors.Is(err, ErrTimeout))
+	is.NoErr(second.Release())
+	writer, err := AcquireTimeout("config", Exclusive, time.Second)
+	is.NoErr(err)
+	// readers and other writers wait for the writer
+	_, err = AcquireTimeout("config", Shared, time.Millisecond*50)
+	is.True(errors.Is(err, ErrTimeout))
+	_, err = AcquireTimeout("config", Exclusive, time.Millisecond*50)
+	is.True(errors.Is(err, ErrTimeout))
+	// locks on other names are independent
+	other, err := AcquireTimeout("nodes", Exclusive, time.Second)
+	is.NoErr(err)
+	is.NoErr(other.Release())
+
+	// a waiting reader obtains the lock once the writer releases it
+	acquired := make(chan error)
+	go func() {
+		l, err := AcquireTimeout("config", Shared, time.Second*5)
+		if err == nil {
+			err = l.Release()
+		}
+		acquired <- err
+	}()
+	time.Sleep(time.Millisecond * 20)
+	is.NoErr(writer.Release())
+	is.NoErr(<-acquired)
+	is.NoErr(writer.Release()) // releasing twice is a no-op
+}
+
+func TestAcquireContext(t *testing.T) {
+	is := is.New(t)
+	t.Setenv(RuntimeDirEnv, t.TempDir())
+	held, err := AcquireTimeout("config", Exclusive, time.Second)
+	is.NoErr(err)
+	defer held.Release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		cancel()
+	}()
+	start := time.Now()
+	_, err = Acquire(ctx, "config", Shared)
+	is.True(errors.Is(err, ErrTimeout))
+	is.True(time.Since(start) < time.Second) // cancelling the context ends the wait
+
+	start = time.Now()
+	_, err = AcquireTimeout("config", Exclusive, time.Millisecond*100)
+	is.True(errors.Is(err, ErrTimeout))
+	is.True(time.Since(start) >= time.Millisecond*100)
+}
+
+func TestAcquireInvalidName(t *testing.T) {
+	is := is.New(t)
+	t.Setenv(RuntimeDirEnv, t.TempDir())
+	for _, name := range []string{"", "../config", "dir/config"} {
+		_, err := AcquireTimeout(name, Shared, time.Second)
+		is.True(err != nil) // lock names can not leave the runtime directory
+	}
+}
@@ -0,0 +1,60 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// RuntimeDir - root owned directory containing the lock files
+const RuntimeDir = "/var/run/netclient"
+
+func openLockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|syscall.O_NOFOLLOW, 0600)
+}
+
+func tryLock(f *os.File, mode Mode) (bool, error) {
+	how := unix.LOCK_SH
+	if mode == Exclusive {
+		how = unix.LOCK_EX
+	}
+	for {
+		err := unix.Flock(int(f.Fd()), how|unix.LOCK_NB)
+		switch {
+		case err == nil:
+			return true, nil
+		case errors.Is(err, unix.EWOULDBLOCK):
+			return false, nil
+		case errors.Is(err, unix.EINTR):
+			continue
+		default:
+			return false, err
+		}
+	}
+}
+
+func unlock(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_UN)
+}
+
+// checkOwner - verifies the runtime directory is owned by the current user and not writable by others
+func checkOwner(dir string, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if int(stat.Uid) != os.Geteuid() {
+		return fmt.Errorf("lock directory %s is owned by uid %d", dir, stat.Uid)
+	}
+	// lock files planted by other users could be used to hold locks, so the directory is not repaired
+	if info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("lock directory %s is writable by other users, mode %s", dir, info.Mode().Perm())
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package lock
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// holderEnv - set when the test binary is run as a process holding a lock
+const holderEnv = "NETCLIENT_TEST_LOCK_HOLDER"
+
+// TestLockHolder - not a test, holds an exclusive lock until killed when run by TestReleasedOnExit
+func TestLockHolder(t *testing.T) {
+	if os.Getenv(holderEnv) == "" {
+		t.Skip("only run as a lock holder process")
+	}
+	if _, err := AcquireTimeout("config", Exclusive, time.Second); err != nil {
+		os.Exit(1)
+	}
+	os.Stdout.WriteString("locked\n")
+	time.Sleep(time.Minute)
+	os.Exit(0)
+}
+
+func TestReleasedOnExit(t *testing.T) {
+	is := is.New(t)
+	t.Setenv(RuntimeDirEnv, t.TempDir())
+	holder := exec.Command(os.Args[0], "-test.run=^TestLockHolder$")
+	holder.Env = append(os.Environ(), holderEnv+"=1")
+	stdout, err := holder.StdoutPipe()
+	is.NoErr(err)
+	is.NoErr(holder.Start())
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	is.NoErr(err)
+	is.Equal(line, "locked\n")
+	_, err = AcquireTimeout("config", Shared, time.Millisecond*50)
+	is.True(errors.Is(err, ErrTimeout)) // held by the other process
+
+	// the kernel releases the lock of a process that dies without releasing it
+	is.NoErr(holder.Process.Kill())
+	_ = holder.Wait()
+	l, err := AcquireTimeout("config", Exclusive, time.Second)
+	is.NoErr(err)
+	is.NoErr(l.Release())
+}
+
+func TestCheckOwner(t *testing.T) {
+	is := is.New(t)
+	dir := filepath.Join(t.TempDir(), "run")
+	t.Setenv(RuntimeDirEnv, dir)
+	is.NoErr(ensureRuntimeDir()) // created when missing
+	info, err := os.Stat(dir)
+	is.NoErr(err)
+	is.Equal(info.Mode().Perm(), os.FileMode(0700))
+
+	for _, mode := range []os.FileMode{0777, 0720, 0702} {
+		is.NoErr(os.Chmod(dir, mode))
+		is.True(ensureRuntimeDir() != nil) // writable by other users
+		_, err = AcquireTimeout("config", Shared, time.Second)
+		is.True(err != nil)
+	}
+	is.NoErr(os.Chmod(dir, 0755))
+	is.NoErr(ensureRuntimeDir())
+
+	// a symlink could point the lock files anywhere
+	link := filepath.Join(filepath.Dir(dir), "link")
+	is.NoErr(os.Symlink(dir, link))
+	t.Setenv(RuntimeDirEnv, link)
+	is.True(ensureRuntimeDir() != nil)
+
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner of the runtime directory requires root")
+	}
+	t.Setenv(RuntimeDirEnv, dir)
+	is.NoErr(os.Chown(dir, 65534, 65534))
+	is.True(ensureRuntimeDir() != nil) // owned by another user
+	_, err = AcquireTimeout("config", Shared, time.Second)
+	is.True(err != nil)
+}
@@ -117,6 +117,15 @@ func IsEmptyRecord(err error) bool {
 	return strings.Contains(err.Error(), NoDBRecord) || strings.Contains(err.Error(), NoDBRecords)
 }
 
+// APIURL - base url of the api of a server; api is the host[:port] of the api
+// and may include a scheme, otherwise https is used
+func APIURL(api string) string {
+	if strings.Contains(api, "://") {
+		return strings.TrimSuffix(api, "/")
+	}
+	return "https://" + api
+}
+
 // GetPublicIP - gets public ip
 func GetPublicIP(api string) (string, error) {
 
@@ -129,7 +138,7 @@ func GetPublicIP(api string) (string, error) {
 	//		iplist = append([]string{ipService}, iplist...)
 	//}
 	if api != "" {
-		api = "https://" + api + "/api/getip"
+		api = APIURL(api) + "/api/getip"
 		iplist = append([]string{api}, iplist...)
 	}
 
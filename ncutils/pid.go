@@ -9,6 +9,9 @@ import (
 // PidFile - path/name of pid file
 const PidFile = "/var/run/netclient.pid"
 
+// ControlSocket - path/name of the unix socket the daemon serves local control requests on
+const ControlSocket = "/var/run/netclient.sock"
+
 // WindowsPIDError - error returned from pid function on windows
 type WindowsPIDError struct{}
 
@@ -0,0 +1,319 @@
+// Package outbox queues mqtt publishes on disk while the broker of a server is unreachable
+//
+// messages are keyed by server, topic and an optional key; a message replaces (or is merged with)
+// a queued message for the same key, so only the latest host or node update is sent. messages on
+// the same topic with different keys, such as host updates with different actions, are all kept.
+// queued messages are replayed in the order they were last queued. the outbox is not locked while
+// messages are sent, so a message may be sent more than once if processes replay at the same time.
+package outbox
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/gravitl/netclient/lock"
+)
+
+const (
+	// DefaultLimit - default maximum number of queued messages
+	DefaultLimit = 256
+	// filePerm - permissions of the outbox file
+	filePerm = 0600
+	// lockTimeout - time limit for obtaining the outbox lock
+	lockTimeout = time.Second * 5
+)
+
+// Message - a queued publish
+type Message struct {
+	Server  string    `json:"server"`
+	Topic   string    `json:"topic"`
+	Key     string    `json:"key,omitempty"` // distinguishes messages on the same topic that must not replace each other
+	QoS     byte      `json:"qos"`
+	Payload []byte    `json:"-"`
+	Seq     uint64    `json:"seq"`
+	Queued  time.Time `json:"queued"`
+}
+
+// MergeFunc - combines a queued payload with a newer payload for the same server and topic
+type MergeFunc func(queued, payload []byte) ([]byte, error)
+
+// Sealer - encrypts payloads stored on disk
+type Sealer interface {
+	Seal(plaintext []byte) (string, error)
+	Open(sealed string) ([]byte, error)
+}
+
+// Stats - outbox metrics; counters are totals since the outbox file was created
+type Stats struct {
+	Depth     map[string]int `json:"depth"` // queued messages indexed by server
+	Queued    uint64         `json:"queued"`
+	Coalesced uint64         `json:"coalesced"` // messages replaced or merged by a newer message
+	Dropped   uint64         `json:"dropped"`   // messages dropped because the outbox was full or could not be read
+	Replayed  uint64         `json:"replayed"`
+}
+
+// Outbox - a bounded queue of messages stored in a file
+type Outbox struct {
+	File   string
+	Lock   string // name of the lock serializing access between processes, see package lock; no locking if empty
+	Limit  int    // maximum number of queued messages, the oldest message is dropped when full
+	Sealer Sealer // encrypts payloads on disk; stored in plain text if nil
+}
+
+// storedMessage - on disk format of a message
+type storedMessage struct {
+	Message
+	Payload string `json:"payload"`
+}
+
+// contents - on disk format of the outbox
+type contents struct {
+	Seq      uint64          `json:"seq"`
+	Stats    Stats           `json:"stats"`
+	Messages []storedMessage `json:"messages"`
+}
+
+// state - decoded contents of the outbox
+type state struct {
+	seq      uint64
+	stats    Stats
+	messages []Message // ordered by seq
+}
+
+// Outbox.Enqueue - queues a message; a queued message for the same server, topic and key is replaced,
+// or combined with the new message by merge if it is not nil
+func (o *Outbox) Enqueue(msg Message, merge MergeFunc) error {
+	return o.update(func(s *state) error {
+		for i, queued := range s.messages {
+			if queued.Server != msg.Server || queued.Topic != msg.Topic || queued.Key != msg.Key {
+				continue
+			}
+			if merge != nil {
+				payload, err := merge(queued.Payload, msg.Payload)
+				if err != nil {
+					return err
+				}
+				msg.Payload = payload
+			}
+			s.messages = append(s.messages[:i], s.messages[i+1:]...)
+			s.stats.Coalesced++
+			break
+		}
+		s.seq++
+		msg.Seq = s.seq
+		msg.Queued = time.Now()
+		s.messages = append(s.messages, msg)
+		s.stats.Queued++
+		limit := o.Limit
+		if limit <= 0 {
+			limit = DefaultLimit
+		}
+		if over := len(s.messages) - limit; over > 0 {
+			s.messages = s.messages[over:]
+			s.stats.Dropped += uint64(over)
+		}
+		return nil
+	})
+}
+
+// Outbox.Pending - number of messages queued for server
+func (o *Outbox) Pending(server string) (int, error) {
+	stats, err := o.Stats()
+	if err != nil {
+		return 0, err
+	}
+	return stats.Depth[server], nil
+}
+
+// Outbox.Stats - current depth and counters of the outbox
+func (o *Outbox) Stats() (Stats, error) {
+	var stats Stats
+	err := o.view(func(s *state) {
+		stats = s.stats
+		stats.Depth = make(map[string]int)
+		for _, msg := range s.messages {
+			stats.Depth[msg.Server]++
+		}
+	})
+	return stats, err
+}
+
+// Outbox.Replay - sends the messages queued for server in order, stopping at the first failure
+// the messages are read and then sent without holding the lock, so other processes can queue messages
+// meanwhile; they are sent after the replayed messages. sent messages are removed by sequence number, a
+// message that replaced or was merged with a sent message stays queued
+// returns the number of messages sent
+func (o *Outbox) Replay(server string, send func(*Message) error) (int, error) {
+	queued := []Message{}
+	if err := o.view(func(s *state) {
+		for _, msg := range s.messages {
+			if msg.Server == server {
+				queued = append(queued, msg)
+			}
+		}
+	}); err != nil {
+		return 0, err
+	}
+	sent := 0
+	var sendErr error
+	for i := range queued {
+		if sendErr = send(&queued[i]); sendErr != nil {
+			break
+		}
+		sent++
+	}
+	if sent == 0 {
+		return 0, sendErr
+	}
+	acked := make(map[uint64]bool, sent)
+	for _, msg := range queued[:sent] {
+		acked[msg.Seq] = true
+	}
+	if err := o.update(func(s *state) error {
+		remaining := []Message{}
+		for _, msg := range s.messages {
+			if msg.Server == server && acked[msg.Seq] {
+				continue
+			}
+			remaining = append(remaining, msg)
+		}
+		s.messages = remaining
+		s.stats.Replayed += uint64(sent)
+		return nil
+	}); err != nil {
+		return sent, err
+	}
+	return sent, sendErr
+}
+
+// Outbox.view - reads the outbox
+func (o *Outbox) view(f func(*state)) error {
+	l, err := o.lock(lock.Shared)
+	if err != nil {
+		return err
+	}
+	if l != nil {
+		defer l.Release()
+	}
+	s, err := o.read()
+	if err != nil {
+		return err
+	}
+	f(s)
+	return nil
+}
+
+// Outbox.update - reads the outbox, applies f and writes the outbox
+// the outbox is written even if f returns an error so partial progress is kept
+func (o *Outbox) update(f func(*state) error) error {
+	l, err := o.lock(lock.Exclusive)
+	if err != nil {
+		return err
+	}
+	if l != nil {
+		defer l.Release()
+	}
+	s, err := o.read()
+	if err != nil {
+		return err
+	}
+	fErr := f(s)
+	if err := o.write(s); err != nil {
+		return err
+	}
+	return fErr
+}
+
+func (o *Outbox) lock(mode lock.Mode) (*lock.Lock, error) {
+	if o.Lock == "" {
+		return nil, nil
+	}
+	return lock.AcquireTimeout(o.Lock, mode, lockTimeout)
+}
+
+// Outbox.read - reads the outbox file; messages that can not be decrypted are dropped
+func (o *Outbox) read() (*state, error) {
+	s := &state{}
+	data, err := os.ReadFile(o.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c contents
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("invalid outbox %s %w", o.File, err)
+	}
+	s.seq = c.Seq
+	s.stats = c.Stats
+	for _, stored := range c.Messages {
+		msg := stored.Message
+		if msg.Payload, err = o.open(stored.Payload); err != nil {
+			s.stats.Dropped++
+			continue
+		}
+		s.messages = append(s.messages, msg)
+	}
+	sort.SliceStable(s.messages, func(i, j int) bool { return s.messages[i].Seq < s.messages[j].Seq })
+	return s, nil
+}
+
+// Outbox.write - atomically writes the outbox file readable only by its owner
+func (o *Outbox) write(s *state) error {
+	c := contents{Seq: s.seq, Stats: s.stats, Messages: []storedMessage{}}
+	c.Stats.Depth = nil
+	for _, msg := range s.messages {
+		payload, err := o.seal(msg.Payload)
+		if err != nil {
+			return err
+		}
+		c.Messages = append(c.Messages, storedMessage{Message: msg, Payload: payload})
+	}
+	data, err := json.Marshal(&c)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(o.File), "."+filepath.Base(o.File)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(filePerm); err != nil && runtime.GOOS != "windows" {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), o.File)
+}
+
+func (o *Outbox) seal(payload []byte) (string, error) {
+	if o.Sealer == nil {
+		return base64.StdEncoding.EncodeToString(payload), nil
+	}
+	return o.Sealer.Seal(payload)
+}
+
+func (o *Outbox) open(payload string) ([]byte, error) {
+	if o.Sealer == nil {
+		return base64.StdEncoding.DecodeString(payload)
+	}
+	return o.Sealer.Open(payload)
+}
@@ -0,0 +1,183 @@
+package outbox
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gravitl/netclient/lock"
+	"github.com/matryer/is"
+)
+
+func newOutbox(t *testing.T) *Outbox {
+	t.Helper()
+	return &Outbox{File: filepath.Join(t.TempDir(), "outbox.json"), Limit: 4}
+}
+
+func message(server, topic, payload string) Message {
+	return Message{Server: server, Topic: topic, QoS: 1, Payload: []byte(payload)}
+}
+
+// replayAll - replays the messages queued for server, returning their payloads
+func replayAll(t *testing.T, o *Outbox, server string) []string {
+	t.Helper()
+	payloads := []string{}
+	if _, err := o.Replay(server, func(msg *Message) error {
+		payloads = append(payloads, string(msg.Payload))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return payloads
+}
+
+func TestEnqueue(t *testing.T) {
+	is := is.New(t)
+	o := newOutbox(t)
+	is.NoErr(o.Enqueue(message("server1", "update/node1", "node1 v1"), nil))
+	is.NoErr(o.Enqueue(message("server1", "host/serverupdate/host1", "host v1"), nil))
+	is.NoErr(o.Enqueue(message("server2", "host/serverupdate/host1", "host v1"), nil))
+	// latest update wins and is sent after the messages queued before it
+	is.NoErr(o.Enqueue(message("server1", "update/node1", "node1 v2"), nil))
+	stats, err := o.Stats()
+	is.NoErr(err)
+	is.Equal(stats.Depth["server1"], 2)
+	is.Equal(stats.Depth["server2"], 1)
+	is.Equal(stats.Queued, uint64(4))
+	is.Equal(stats.Coalesced, uint64(1))
+
+	is.Equal(replayAll(t, o, "server1"), []string{"host v1", "node1 v2"})
+	pending, err := o.Pending("server1")
+	is.NoErr(err)
+	is.Equal(pending, 0)
+	pending, err = o.Pending("server2")
+	is.NoErr(err)
+	is.Equal(pending, 1)
+	stats, err = o.Stats()
+	is.NoErr(err)
+	is.Equal(stats.Replayed, uint64(2))
+}
+
+func TestMerge(t *testing.T) {
+	is := is.New(t)
+	o := newOutbox(t)
+	merge := func(queued, payload []byte) ([]byte, error) {
+		return append(append(queued, ','), payload...), nil
+	}
+	is.NoErr(o.Enqueue(message("server1", "metrics/node1", "1"), merge))
+	is.NoErr(o.Enqueue(message("server1", "metrics/node1", "2"), merge))
+	is.NoErr(o.Enqueue(message("server1", "metrics/node1", "3"), merge))
+	is.Equal(replayAll(t, o, "server1"), []string{"1,2,3"})
+}
+
+func TestLimit(t *testing.T) {
+	is := is.New(t)
+	o := newOutbox(t)
+	for _, topic := range []string{"a", "b", "c", "d", "e", "f"} {
+		is.NoErr(o.Enqueue(message("server1", topic, topic), nil))
+	}
+	stats, err := o.Stats()
+	is.NoErr(err)
+	is.Equal(stats.Depth["server1"], 4)
+	is.Equal(stats.Dropped, uint64(2))
+	// oldest messages are dropped
+	is.Equal(replayAll(t, o, "server1"), []string{"c", "d", "e", "f"})
+}
+
+func TestReplayFailure(t *testing.T) {
+	is := is.New(t)
+	o := newOutbox(t)
+	for _, topic := range []string{"a", "b", "c"} {
+		is.NoErr(o.Enqueue(message("server1", topic, topic), nil))
+	}
+	sent, err := o.Replay("server1", func(msg *Message) error {
+		if msg.Topic == "b" {
+			return errors.New("broker unreachable")
+		}
+		return nil
+	})
+	is.True(err != nil)
+	is.Equal(sent, 1)
+	// messages after the failure are kept in order
+	is.Equal(replayAll(t, o, "server1"), []string{"b", "c"})
+}
+
+// testSealer - reversible encoding standing in for the secret store
+type testSealer struct{}
+
+func (testSealer) Seal(plaintext []byte) (string, error) {
+	return "sealed:" + base64.StdEncoding.EncodeToString(plaintext), nil
+}
+
+func (testSealer) Open(sealed string) ([]byte, error) {
+	if !strings.HasPrefix(sealed, "sealed:") {
+		return nil, errors.New("not sealed")
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, "sealed:"))
+}
+
+func TestPersistence(t *testing.T) {
+	is := is.New(t)
+	o := newOutbox(t)
+	o.Sealer = testSealer{}
+	is.NoErr(o.Enqueue(message("server1", "host/serverupdate/host1", `{"hostpass":"secret"}`), nil))
+	data, err := os.ReadFile(o.File)
+	is.NoErr(err)
+	is.True(!strings.Contains(string(data), "secret")) // payloads are encrypted on disk
+	info, err := os.Stat(o.File)
+	is.NoErr(err)
+	is.Equal(info.Mode().Perm(), os.FileMode(filePerm))
+
+	// messages survive a restart
+	reopened := &Outbox{File: o.File, Sealer: testSealer{}}
+	is.Equal(replayAll(t, reopened, "server1"), []string{`{"hostpass":"secret"}`})
+
+	// messages that can not be decrypted are dropped
+	is.NoErr(o.Enqueue(message("server1", "update/node1", "node1"), nil))
+	unsealed := &Outbox{File: o.File}
+	is.Equal(replayAll(t, unsealed, "server1"), []string{})
+	stats, err := unsealed.Stats()
+	is.NoErr(err)
+	is.Equal(stats.Dropped, uint64(1))
+}
+
+func TestEnqueueKey(t *testing.T) {
+	is := is.New(t)
+	o := newOutbox(t)
+	deleteHost := Message{Server: "server1", Topic: "host/serverupdate/host1", Key: "DELETE_HOST", Payload: []byte("delete")}
+	updateHost := Message{Server: "server1", Topic: "host/serverupdate/host1", Key: "UPDATE_HOST", Payload: []byte("update v1")}
+	is.NoErr(o.Enqueue(deleteHost, nil))
+	is.NoErr(o.Enqueue(updateHost, nil))
+	// a later update with the same key still replaces the queued one
+	updateHost.Payload = []byte("update v2")
+	is.NoErr(o.Enqueue(updateHost, nil))
+	stats, err := o.Stats()
+	is.NoErr(err)
+	is.Equal(stats.Coalesced, uint64(1))
+	is.Equal(replayAll(t, o, "server1"), []string{"delete", "update v2"})
+}
+
+func TestReplayUnlocked(t *testing.T) {
+	is := is.New(t)
+	t.Setenv(lock.RuntimeDirEnv, t.TempDir())
+	o := newOutbox(t)
+	o.Lock = "outbox"
+	is.NoErr(o.Enqueue(message("server1", "a", "a"), nil))
+	is.NoErr(o.Enqueue(message("server1", "b", "b"), nil))
+	sent, err := o.Replay("server1", func(msg *Message) error {
+		if msg.Topic != "a" {
+			return nil
+		}
+		// another process queues messages while the outbox is replayed
+		is.NoErr(o.Enqueue(message("server1", "c", "c"), nil))
+		is.NoErr(o.Enqueue(message("server1", "b", "b v2"), nil))
+		return nil
+	})
+	is.NoErr(err)
+	is.Equal(sent, 2)
+	// the sent messages are removed, the messages queued meanwhile are kept
+	is.Equal(replayAll(t, o, "server1"), []string{"c", "b v2"})
+}
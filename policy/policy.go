@@ -0,0 +1,278 @@
+// Package policy filters the ranges servers advertise for peers with a host-local split-tunnel policy
+//
+// the policy has allow and deny lists of ranges for the peers of a network and for single peers. the allowed
+// ips of a peer are cut down to the parts inside the allowed ranges, if any are listed, and the parts inside
+// denied ranges are removed, so the routes and allowed ips reaching the kernel never cover a denied range.
+// the address ranges of the networks of a peer are always allowed, so allow lists never cut off the peer itself.
+package policy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netmaker/logger"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gopkg.in/yaml.v3"
+)
+
+// FileName - name of the policy file in the netclient config directory
+const FileName = "policy.yml"
+
+// Rules - ranges allowed and denied for the peers of a network or for a single peer
+type Rules struct {
+	// Allow - if set, only the parts of advertised ranges inside these ranges are kept
+	Allow []string `yaml:"allow,omitempty"`
+	// Deny - the parts of advertised ranges inside these ranges are dropped, even if allowed
+	Deny []string `yaml:"deny,omitempty"`
+}
+
+// Policy - the split-tunnel policy of the host
+type Policy struct {
+	Networks map[string]Rules `yaml:"networks,omitempty"` // indexed by network name
+	Peers    map[string]Rules `yaml:"peers,omitempty"`    // indexed by public key of the peer
+}
+
+// Read - reads the policy file in the netclient config directory
+func Read() (*Policy, error) {
+	return Load(filepath.Join(config.GetNetclientPath(), FileName))
+}
+
+// Load - reads and validates a policy file, a missing file is an empty policy
+func Load(path string) (*Policy, error) {
+	p := &Policy{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return p, err
+	}
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return &Policy{}, fmt.Errorf("invalid policy file %s %w", path, err)
+	}
+	if err := p.Validate(); err != nil {
+		return &Policy{}, fmt.Errorf("invalid policy file %s %w", path, err)
+	}
+	return p, nil
+}
+
+// Policy.Validate - checks that all ranges of the policy are valid cidrs
+func (p *Policy) Validate() error {
+	check := func(kind, name string, rules Rules) error {
+		for _, cidr := range append(append([]string{}, rules.Allow...), rules.Deny...) {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("%s %s: %w", kind, name, err)
+			}
+		}
+		return nil
+	}
+	for network, rules := range p.Networks {
+		if err := check("network", network, rules); err != nil {
+			return err
+		}
+	}
+	for peer, rules := range p.Peers {
+		if err := check("peer", peer, rules); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Policy.Empty - checks if the policy has no rules
+func (p *Policy) Empty() bool {
+	return len(p.Networks) == 0 && len(p.Peers) == 0
+}
+
+// Policy.Filter - the parts of the allowed ips of a peer kept by the rules of the peer and its networks, and the
+// parts dropped; allowed ranges of the peer and its networks are combined, as are the denied ranges, and the address
+// ranges of its networks are allowed as well
+func (p *Policy) Filter(publicKey string, networks []string, allowedIPs []net.IPNet) (kept, dropped []net.IPNet) {
+	var allow, deny []net.IPNet
+	add := func(rules Rules) {
+		allow = append(allow, parseCIDRs(rules.Allow)...)
+		deny = append(deny, parseCIDRs(rules.Deny)...)
+	}
+	for _, network := range networks {
+		add(p.Networks[network])
+	}
+	add(p.Peers[publicKey])
+	if len(allow) == 0 && len(deny) == 0 {
+		return allowedIPs, nil
+	}
+	if len(allow) > 0 {
+		allow = append(allow, networkRanges(networks)...)
+	}
+	for _, ipNet := range allowedIPs {
+		ipNet = canonical(ipNet)
+		parts := []net.IPNet{ipNet}
+		if len(allow) > 0 {
+			parts = nil
+			for _, a := range allow {
+				if part, ok := intersect(ipNet, a); ok {
+					parts = append(parts, part)
+				}
+			}
+			parts = merge(parts)
+		}
+		for _, d := range deny {
+			parts = subtractAll(parts, d)
+		}
+		kept = append(kept, parts...)
+		rest := []net.IPNet{ipNet}
+		for _, part := range parts {
+			rest = subtractAll(rest, part)
+		}
+		dropped = append(dropped, rest...)
+	}
+	return kept, dropped
+}
+
+// Policy.Apply - the peers with their allowed ips filtered, and the dropped ranges indexed by public key of the peer
+// networks returns the networks a peer is on
+func (p *Policy) Apply(peers []wgtypes.PeerConfig, networks func(publicKey string) []string) ([]wgtypes.PeerConfig, map[string][]net.IPNet) {
+	if p.Empty() {
+		return peers, nil
+	}
+	filtered := make([]wgtypes.PeerConfig, 0, len(peers))
+	dropped := make(map[string][]net.IPNet)
+	for _, peer := range peers {
+		key := peer.PublicKey.String()
+		kept, drops := p.Filter(key, networks(key), peer.AllowedIPs)
+		if len(drops) > 0 {
+			dropped[key] = drops
+		}
+		peer.AllowedIPs = kept
+		filtered = append(filtered, peer)
+	}
+	return filtered, dropped
+}
+
+// HostPeerNetworks - the networks a peer of the host is on, from the peer ids sent by the servers
+func HostPeerNetworks(publicKey string) []string {
+	var networks []string
+	for _, idAndAddr := range config.GetHostPeerIDs(publicKey) {
+		networks = append(networks, idAndAddr.Network)
+	}
+	sort.Strings(networks)
+	return networks
+}
+
+// HostPeers - the peers of the host with the policy file applied, the advertised ranges if it can not be read
+func HostPeers() []wgtypes.PeerConfig {
+	peers := config.GetHostPeerList()
+	p, err := Read()
+	if err != nil {
+		logger.Log(0, "failed to read split-tunnel policy, using advertised ranges", err.Error())
+		return peers
+	}
+	peers, _ = p.Apply(peers, HostPeerNetworks)
+	return peers
+}
+
+// == private ==
+
+// networkRanges - the ipv4 and ipv6 address ranges of the networks of the host, in canonical form
+func networkRanges(networks []string) []net.IPNet {
+	var ipNets []net.IPNet
+	for _, network := range networks {
+		node := config.GetNode(network)
+		for _, ipNet := range []net.IPNet{node.NetworkRange, node.NetworkRange6} {
+			if ipNet.IP != nil && ipNet.Mask != nil {
+				ipNets = append(ipNets, canonical(ipNet))
+			}
+		}
+	}
+	return ipNets
+}
+
+// parseCIDRs - the valid ranges of a list, in canonical form
+func parseCIDRs(cidrs []string) []net.IPNet {
+	var ipNets []net.IPNet
+	for _, cidr := range cidrs {
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+			ipNets = append(ipNets, canonical(*ipNet))
+		}
+	}
+	return ipNets
+}
+
+// canonical - a range with its host bits cleared and ipv4 in 4 byte form
+func canonical(ipNet net.IPNet) net.IPNet {
+	ip := ipNet.IP
+	if ip4 := ip.To4(); ip4 != nil && len(ipNet.Mask) == net.IPv4len {
+		ip = ip4
+	}
+	return net.IPNet{IP: ip.Mask(ipNet.Mask), Mask: ipNet.Mask}
+}
+
+// contains - checks if range a contains range b, ranges of different families never contain each other
+func contains(a, b net.IPNet) bool {
+	onesA, bitsA := a.Mask.Size()
+	onesB, bitsB := b.Mask.Size()
+	return bitsA == bitsB && onesA <= onesB && a.Contains(b.IP)
+}
+
+// intersect - the overlap of two ranges, which is the smaller one if they overlap at all
+func intersect(a, b net.IPNet) (net.IPNet, bool) {
+	switch {
+	case contains(a, b):
+		return b, true
+	case contains(b, a):
+		return a, true
+	}
+	return net.IPNet{}, false
+}
+
+// subtract - the parts of range a outside range b
+func subtract(a, b net.IPNet) []net.IPNet {
+	if contains(b, a) {
+		return nil
+	}
+	if !contains(a, b) {
+		return []net.IPNet{a}
+	}
+	// b is inside a, split a in halves until the half containing b is b
+	ones, bits := a.Mask.Size()
+	mask := net.CIDRMask(ones+1, bits)
+	low := net.IPNet{IP: a.IP, Mask: mask}
+	high := net.IPNet{IP: append(net.IP{}, a.IP...), Mask: mask}
+	high.IP[ones/8] |= 0x80 >> (ones % 8)
+	return append(subtract(low, b), subtract(high, b)...)
+}
+
+// subtractAll - the parts of the ranges outside range b
+func subtractAll(ipNets []net.IPNet, b net.IPNet) []net.IPNet {
+	var rest []net.IPNet
+	for _, ipNet := range ipNets {
+		rest = append(rest, subtract(ipNet, b)...)
+	}
+	return rest
+}
+
+// merge - the ranges, largest first, without the ranges contained in others
+func merge(ipNets []net.IPNet) []net.IPNet {
+	sort.Slice(ipNets, func(i, j int) bool {
+		onesI, _ := ipNets[i].Mask.Size()
+		onesJ, _ := ipNets[j].Mask.Size()
+		return onesI < onesJ
+	})
+	var merged []net.IPNet
+	for _, ipNet := range ipNets {
+		inside := false
+		for _, m := range merged {
+			if contains(m, ipNet) {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			merged = append(merged, ipNet)
+		}
+	}
+	return merged
+}
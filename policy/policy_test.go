@@ -0,0 +1,146 @@
+package policy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/matryer/is"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func cidrs(list ...string) []net.IPNet {
+	var ipNets []net.IPNet
+	for _, cidr := range list {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		ipNets = append(ipNets, *ipNet)
+	}
+	return ipNets
+}
+
+func cidrStrings(ipNets []net.IPNet) []string {
+	var list []string
+	for _, ipNet := range ipNets {
+		list = append(list, ipNet.String())
+	}
+	return list
+}
+
+func TestLoad(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+	p, err := Load(filepath.Join(dir, FileName))
+	is.NoErr(err)
+	is.True(p.Empty()) // no file
+
+	path := filepath.Join(dir, FileName)
+	is.NoErr(os.WriteFile(path, []byte(`
+networks:
+  net1:
+    deny: [192.168.1.0/24]
+peers:
+  key1:
+    allow: [10.0.0.0/8, "fd00::/8"]
+`), 0600))
+	p, err = Load(path)
+	is.NoErr(err)
+	is.Equal(p.Networks["net1"].Deny, []string{"192.168.1.0/24"})
+	is.Equal(p.Peers["key1"].Allow, []string{"10.0.0.0/8", "fd00::/8"})
+
+	is.NoErr(os.WriteFile(path, []byte("networks:\n  net1:\n    deny: [192.168.1.0]\n"), 0600))
+	p, err = Load(path)
+	is.True(err != nil)
+	is.True(p.Empty())
+}
+
+func TestFilter(t *testing.T) {
+	p := &Policy{
+		Networks: map[string]Rules{
+			"home": {Deny: []string{"192.168.1.0/24"}},
+			"lab":  {Allow: []string{"10.10.0.0/16", "10.0.0.0/8"}},
+		},
+		Peers: map[string]Rules{
+			"key1": {Deny: []string{"10.10.5.0/24"}},
+		},
+	}
+	t.Run("no rules", func(t *testing.T) {
+		is := is.New(t)
+		kept, dropped := p.Filter("key2", []string{"other"}, cidrs("192.168.0.0/16"))
+		is.Equal(cidrStrings(kept), []string{"192.168.0.0/16"})
+		is.Equal(len(dropped), 0)
+	})
+	t.Run("deny inside range", func(t *testing.T) {
+		is := is.New(t)
+		kept, dropped := p.Filter("key2", []string{"home"}, cidrs("192.168.0.0/22", "10.77.0.5/32"))
+		is.Equal(cidrStrings(kept), []string{"192.168.0.0/24", "192.168.2.0/23", "10.77.0.5/32"})
+		is.Equal(cidrStrings(dropped), []string{"192.168.1.0/24"})
+	})
+	t.Run("range inside deny", func(t *testing.T) {
+		is := is.New(t)
+		kept, dropped := p.Filter("key2", []string{"home"}, cidrs("192.168.1.128/25"))
+		is.Equal(len(kept), 0)
+		is.Equal(cidrStrings(dropped), []string{"192.168.1.128/25"})
+	})
+	t.Run("allow", func(t *testing.T) {
+		is := is.New(t)
+		kept, dropped := p.Filter("key2", []string{"lab"}, cidrs("10.1.0.0/16", "172.16.0.0/12", "0.0.0.0/0"))
+		is.Equal(cidrStrings(kept), []string{"10.1.0.0/16", "10.0.0.0/8"})
+		is.Equal(len(dropped), 1+8) // all of 172.16.0.0/12, and 0.0.0.0/0 split around 10.0.0.0/8
+		is.Equal(dropped[0].String(), "172.16.0.0/12")
+	})
+	t.Run("peer and network rules combined", func(t *testing.T) {
+		is := is.New(t)
+		kept, dropped := p.Filter("key1", []string{"lab", "home"}, cidrs("10.10.0.0/20", "192.168.1.0/24"))
+		is.Equal(cidrStrings(kept), []string{"10.10.0.0/22", "10.10.4.0/24", "10.10.6.0/23", "10.10.8.0/21"})
+		is.Equal(cidrStrings(dropped), []string{"10.10.5.0/24", "192.168.1.0/24"})
+	})
+	t.Run("allow keeps the network", func(t *testing.T) {
+		is := is.New(t)
+		state := config.Snapshot()
+		defer config.Replace(state)
+		var node config.Node
+		node.Network = "office"
+		node.NetworkRange = cidrs("100.64.0.0/24")[0]
+		node.NetworkRange6 = cidrs("fd77::/64")[0]
+		config.Replace(&config.State{Nodes: config.NodeMap{"office": node}})
+		office := &Policy{Networks: map[string]Rules{"office": {Allow: []string{"192.168.10.0/24"}, Deny: []string{"100.64.0.9/32"}}}}
+		// the address of the peer stays allowed, denied addresses inside the network are still dropped
+		kept, dropped := office.Filter("key2", []string{"office"}, cidrs("100.64.0.8/31", "fd77::2/128", "192.168.0.0/16"))
+		is.Equal(cidrStrings(kept), []string{"100.64.0.8/32", "fd77::2/128", "192.168.10.0/24"})
+		is.Equal(cidrStrings(dropped)[0], "100.64.0.9/32")
+		// other networks are not affected
+		kept, _ = office.Filter("key2", []string{"office", "lab"}, cidrs("100.65.0.1/32"))
+		is.Equal(len(kept), 0)
+	})
+	t.Run("ipv6", func(t *testing.T) {
+		is := is.New(t)
+		v6 := &Policy{Peers: map[string]Rules{"key1": {Deny: []string{"fd00:1::/32", "192.168.0.0/16"}}}}
+		kept, _ := v6.Filter("key1", nil, cidrs("fd00::/16", "::/0"))
+		is.Equal(len(kept), 16+32) // fd00::/16 and ::/0 split around fd00:1::/32
+		for _, ipNet := range kept {
+			is.True(!ipNet.Contains(net.ParseIP("fd00:1::1")))
+		}
+	})
+}
+
+func TestApply(t *testing.T) {
+	is := is.New(t)
+	key1, key2 := wgtypes.Key{1}, wgtypes.Key{2}
+	p := &Policy{Networks: map[string]Rules{"net1": {Deny: []string{"192.168.1.0/24"}}}}
+	peers := []wgtypes.PeerConfig{
+		{PublicKey: key1, AllowedIPs: cidrs("10.77.0.2/32", "192.168.1.0/24")},
+		{PublicKey: key2, AllowedIPs: cidrs("10.78.0.2/32", "192.168.1.0/24")},
+	}
+	networks := map[string][]string{key1.String(): {"net1"}, key2.String(): {"net2"}}
+	filtered, dropped := p.Apply(peers, func(key string) []string { return networks[key] })
+	is.Equal(cidrStrings(filtered[0].AllowedIPs), []string{"10.77.0.2/32"})
+	is.Equal(cidrStrings(filtered[1].AllowedIPs), []string{"10.78.0.2/32", "192.168.1.0/24"})
+	is.Equal(len(dropped), 1)
+	is.Equal(cidrStrings(dropped[key1.String()]), []string{"192.168.1.0/24"})
+	is.Equal(cidrStrings(peers[0].AllowedIPs), []string{"10.77.0.2/32", "192.168.1.0/24"}) // not modified
+}
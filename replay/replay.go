@@ -0,0 +1,322 @@
+// Package replay protects against replayed control plane messages
+//
+// a sequenced message carries a header with a sequence number and timestamp inside the encrypted payload,
+// so both are authenticated by the sealed box of the server. the highest sequence number accepted from each
+// server and a window of recently accepted numbers below it are persisted, so a captured message is rejected
+// even after a restart, while messages delivered out of order on different topics are still accepted.
+package replay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/gravitl/netclient/lock"
+)
+
+// Mode - how messages from a server are checked
+type Mode string
+
+const (
+	// ModeAuto - messages without a header are accepted until the server sends a sequenced message,
+	// compatibility mode for servers that do not sequence messages
+	ModeAuto Mode = "auto"
+	// ModeRequired - messages without a header are rejected
+	ModeRequired Mode = "required"
+	// ModeOff - no checks, headers are stripped
+	ModeOff Mode = "off"
+)
+
+const (
+	// DefaultSkew - default maximum difference between the timestamp of a message and the local clock
+	DefaultSkew = time.Minute * 5
+	// Window - number of sequence numbers below the highest accepted number that may still arrive out of order
+	Window = 64
+	// headerLen - length of magic, version, sequence number and timestamp
+	headerLen = 4 + 1 + 8 + 8
+	// headerVersion - version of the header format
+	headerVersion = 1
+	// filePerm - permissions of the state file
+	filePerm = 0600
+	// lockTimeout - time limit for obtaining the state lock
+	lockTimeout = time.Second * 5
+)
+
+var magic = []byte("NMSQ")
+
+// reasons a message is rejected
+var (
+	// ErrReplayed - the sequence number was already accepted
+	ErrReplayed = errors.New("replayed message")
+	// ErrTooOld - the sequence number is below the window of the highest accepted number
+	ErrTooOld = errors.New("sequence number too old")
+	// ErrSkew - the timestamp is outside the skew window
+	ErrSkew = errors.New("timestamp outside skew window")
+	// ErrUnsequenced - the message has no header but one is required
+	ErrUnsequenced = errors.New("message has no sequence number")
+)
+
+// ParseMode - parses a replay protection mode, an empty string is ModeAuto
+func ParseMode(mode string) (Mode, error) {
+	switch Mode(mode) {
+	case "", ModeAuto:
+		return ModeAuto, nil
+	case ModeRequired, ModeOff:
+		return Mode(mode), nil
+	}
+	return "", fmt.Errorf("invalid replay protection mode %s, must be one of auto, required or off", mode)
+}
+
+// Header - sequence number and timestamp of a message
+type Header struct {
+	Seq  uint64
+	Time time.Time
+}
+
+// Seal - prepends a header to a payload
+func Seal(header Header, payload []byte) []byte {
+	buf := make([]byte, 0, headerLen+len(payload))
+	buf = append(buf, magic...)
+	buf = append(buf, headerVersion)
+	buf = binary.BigEndian.AppendUint64(buf, header.Seq)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(header.Time.UnixMilli()))
+	return append(buf, payload...)
+}
+
+// Open - splits a decrypted payload into its header and body
+// the header is nil for payloads without a header, which are returned unchanged
+func Open(payload []byte) (*Header, []byte, error) {
+	if !bytes.HasPrefix(payload, magic) {
+		return nil, payload, nil
+	}
+	if len(payload) < headerLen {
+		return nil, nil, fmt.Errorf("truncated sequence header, %d bytes", len(payload))
+	}
+	if version := payload[len(magic)]; version != headerVersion {
+		return nil, nil, fmt.Errorf("unsupported sequence header version %d", version)
+	}
+	header := &Header{
+		Seq:  binary.BigEndian.Uint64(payload[len(magic)+1:]),
+		Time: time.UnixMilli(int64(binary.BigEndian.Uint64(payload[len(magic)+9:]))),
+	}
+	return header, payload[headerLen:], nil
+}
+
+// Policy - checks applied to the messages of a server
+type Policy struct {
+	Mode Mode
+	Skew time.Duration // DefaultSkew if 0
+}
+
+// Stats - accepted and rejected messages of a server
+type Stats struct {
+	Accepted    uint64    `json:"accepted"`
+	Replayed    uint64    `json:"replayed"`
+	TooOld      uint64    `json:"too_old"`
+	Skewed      uint64    `json:"skewed"`
+	Unsequenced uint64    `json:"unsequenced"`
+	LastReject  time.Time `json:"last_reject,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Rejected - total number of rejected messages
+func (s Stats) Rejected() uint64 {
+	return s.Replayed + s.TooOld + s.Skewed + s.Unsequenced
+}
+
+// server - persisted state of a server
+type server struct {
+	High   uint64 `json:"high"`   // highest accepted sequence number, 0 until a sequenced message is accepted
+	Bitmap uint64 `json:"bitmap"` // bit n is set if High-n was accepted
+	Stats  Stats  `json:"stats"`
+}
+
+// Guard - checks messages against the state persisted in File
+type Guard struct {
+	File string
+	Lock string // name of the lock serializing access between processes, see package lock; no locking if empty
+}
+
+// Guard.Accept - checks a message from server; the state of the server is updated if it is accepted
+// header is nil for messages without a header
+func (g *Guard) Accept(serverName string, header *Header, policy Policy, now time.Time) error {
+	if policy.Mode == ModeOff {
+		return nil
+	}
+	skew := policy.Skew
+	if skew <= 0 {
+		skew = DefaultSkew
+	}
+	return g.update(func(servers map[string]*server) error {
+		s, ok := servers[serverName]
+		if !ok {
+			s = &server{}
+			servers[serverName] = s
+		}
+		err := s.accept(header, policy.Mode, skew, now)
+		if err != nil {
+			s.Stats.LastReject = now
+			s.Stats.LastError = err.Error()
+			switch {
+			case errors.Is(err, ErrReplayed):
+				s.Stats.Replayed++
+			case errors.Is(err, ErrTooOld):
+				s.Stats.TooOld++
+			case errors.Is(err, ErrSkew):
+				s.Stats.Skewed++
+			case errors.Is(err, ErrUnsequenced):
+				s.Stats.Unsequenced++
+			}
+			return err
+		}
+		s.Stats.Accepted++
+		return nil
+	})
+}
+
+// server.accept - checks a message against the sliding window of the server
+func (s *server) accept(header *Header, mode Mode, skew time.Duration, now time.Time) error {
+	if header == nil {
+		if mode == ModeRequired {
+			return ErrUnsequenced
+		}
+		if s.High > 0 {
+			// the server sequences its messages, an unsequenced message is a downgrade
+			return fmt.Errorf("%w after sequence %d", ErrUnsequenced, s.High)
+		}
+		return nil
+	}
+	if diff := now.Sub(header.Time); diff > skew || diff < -skew {
+		return fmt.Errorf("%w, sent %s, local time %s", ErrSkew, header.Time.UTC().Format(time.RFC3339), now.UTC().Format(time.RFC3339))
+	}
+	if header.Seq == 0 {
+		return fmt.Errorf("%w, sequence numbers start at 1", ErrTooOld)
+	}
+	if header.Seq > s.High {
+		shift := header.Seq - s.High
+		if shift >= Window {
+			s.Bitmap = 0
+		} else {
+			s.Bitmap <<= shift
+		}
+		s.Bitmap |= 1
+		s.High = header.Seq
+		return nil
+	}
+	diff := s.High - header.Seq
+	if diff >= Window {
+		return fmt.Errorf("%w, %d is more than %d below %d", ErrTooOld, header.Seq, Window, s.High)
+	}
+	if s.Bitmap&(1<<diff) != 0 {
+		return fmt.Errorf("%w, sequence %d", ErrReplayed, header.Seq)
+	}
+	s.Bitmap |= 1 << diff
+	return nil
+}
+
+// Guard.Forget - removes the state of a server, eg. when the host leaves it
+func (g *Guard) Forget(serverName string) error {
+	return g.update(func(servers map[string]*server) error {
+		delete(servers, serverName)
+		return nil
+	})
+}
+
+// Guard.Stats - counters of each server, indexed by server name
+func (g *Guard) Stats() (map[string]Stats, error) {
+	l, err := g.lock(lock.Shared)
+	if err != nil {
+		return nil, err
+	}
+	if l != nil {
+		defer l.Release()
+	}
+	servers, err := g.read()
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]Stats)
+	for name, s := range servers {
+		stats[name] = s.Stats
+	}
+	return stats, nil
+}
+
+// Guard.update - reads the state, applies f and writes the state
+// the state is written even if f returns an error so rejections are counted
+func (g *Guard) update(f func(map[string]*server) error) error {
+	l, err := g.lock(lock.Exclusive)
+	if err != nil {
+		return err
+	}
+	if l != nil {
+		defer l.Release()
+	}
+	servers, err := g.read()
+	if err != nil {
+		return err
+	}
+	fErr := f(servers)
+	if err := g.write(servers); err != nil {
+		return err
+	}
+	return fErr
+}
+
+func (g *Guard) lock(mode lock.Mode) (*lock.Lock, error) {
+	if g.Lock == "" {
+		return nil, nil
+	}
+	return lock.AcquireTimeout(g.Lock, mode, lockTimeout)
+}
+
+// Guard.read - reads the state file
+func (g *Guard) read() (map[string]*server, error) {
+	servers := make(map[string]*server)
+	data, err := os.ReadFile(g.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return servers, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &servers); err != nil {
+		return nil, fmt.Errorf("invalid replay state %s %w", g.File, err)
+	}
+	return servers, nil
+}
+
+// Guard.write - atomically writes the state file readable only by its owner
+func (g *Guard) write(servers map[string]*server) error {
+	data, err := json.Marshal(servers)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(g.File), "."+filepath.Base(g.File)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(filePerm); err != nil && runtime.GOOS != "windows" {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), g.File)
+}
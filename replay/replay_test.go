@@ -0,0 +1,114 @@
+package replay
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func newGuard(t *testing.T) *Guard {
+	t.Helper()
+	return &Guard{File: filepath.Join(t.TempDir(), "replay.json")}
+}
+
+func TestSealOpen(t *testing.T) {
+	is := is.New(t)
+	sent := time.UnixMilli(time.Now().UnixMilli())
+	header, body, err := Open(Seal(Header{Seq: 42, Time: sent}, []byte(`{"action":"delete"}`)))
+	is.NoErr(err)
+	is.Equal(header.Seq, uint64(42))
+	is.True(header.Time.Equal(sent))
+	is.Equal(string(body), `{"action":"delete"}`)
+
+	// payloads of legacy servers have no header
+	header, body, err = Open([]byte(`{"action":"delete"}`))
+	is.NoErr(err)
+	is.True(header == nil)
+	is.Equal(string(body), `{"action":"delete"}`)
+
+	_, _, err = Open([]byte("NMSQ\x01short"))
+	is.True(err != nil)
+	sealed := Seal(Header{Seq: 1, Time: sent}, nil)
+	sealed[len(magic)] = 2
+	_, _, err = Open(sealed)
+	is.True(err != nil)
+}
+
+func TestAccept(t *testing.T) {
+	is := is.New(t)
+	g := newGuard(t)
+	now := time.Now()
+	policy := Policy{Mode: ModeAuto}
+	accept := func(seq uint64) error {
+		return g.Accept("server1", &Header{Seq: seq, Time: now}, policy, now)
+	}
+	is.NoErr(accept(1))
+	is.NoErr(accept(3))
+	is.NoErr(accept(2)) // out of order within the window
+	is.True(errors.Is(accept(2), ErrReplayed))
+	is.True(errors.Is(accept(3), ErrReplayed))
+	is.NoErr(accept(100))
+	is.True(errors.Is(accept(3), ErrTooOld))
+	is.NoErr(accept(100 - Window + 1))
+	is.True(errors.Is(accept(100-Window+1), ErrReplayed))
+	is.True(errors.Is(accept(0), ErrTooOld))
+
+	// timestamps outside the skew window are rejected without changing the window
+	err := g.Accept("server1", &Header{Seq: 101, Time: now.Add(-DefaultSkew - time.Second)}, policy, now)
+	is.True(errors.Is(err, ErrSkew))
+	err = g.Accept("server1", &Header{Seq: 101, Time: now.Add(time.Minute * 2)}, Policy{Mode: ModeAuto, Skew: time.Minute}, now)
+	is.True(errors.Is(err, ErrSkew))
+	is.NoErr(accept(101))
+
+	// the server sequences its messages, unsequenced messages are a downgrade
+	is.True(errors.Is(g.Accept("server1", nil, policy, now), ErrUnsequenced))
+	is.NoErr(g.Accept("server1", nil, Policy{Mode: ModeOff}, now))
+
+	stats, err := g.Stats()
+	is.NoErr(err)
+	is.Equal(stats["server1"].Accepted, uint64(6))
+	is.Equal(stats["server1"].Replayed, uint64(3))
+	is.Equal(stats["server1"].TooOld, uint64(2))
+	is.Equal(stats["server1"].Skewed, uint64(2))
+	is.Equal(stats["server1"].Unsequenced, uint64(1))
+	is.Equal(stats["server1"].Rejected(), uint64(8))
+}
+
+func TestCompatibility(t *testing.T) {
+	is := is.New(t)
+	g := newGuard(t)
+	now := time.Now()
+	// legacy servers do not sequence messages
+	is.NoErr(g.Accept("legacy", nil, Policy{Mode: ModeAuto}, now))
+	is.NoErr(g.Accept("legacy", nil, Policy{Mode: ModeAuto}, now))
+	is.True(errors.Is(g.Accept("strict", nil, Policy{Mode: ModeRequired}, now), ErrUnsequenced))
+
+	mode, err := ParseMode("")
+	is.NoErr(err)
+	is.Equal(mode, ModeAuto)
+	mode, err = ParseMode("required")
+	is.NoErr(err)
+	is.Equal(mode, ModeRequired)
+	_, err = ParseMode("strict")
+	is.True(err != nil)
+}
+
+func TestPersistence(t *testing.T) {
+	is := is.New(t)
+	g := newGuard(t)
+	now := time.Now()
+	header := &Header{Seq: 7, Time: now}
+	is.NoErr(g.Accept("server1", header, Policy{}, now))
+
+	// a captured message is rejected after a restart
+	restarted := &Guard{File: g.File}
+	is.True(errors.Is(restarted.Accept("server1", header, Policy{}, now), ErrReplayed))
+	is.True(errors.Is(restarted.Accept("server1", nil, Policy{}, now), ErrUnsequenced))
+
+	// state is removed when the host leaves the server
+	is.NoErr(restarted.Forget("server1"))
+	is.NoErr(restarted.Accept("server1", header, Policy{}, now))
+}
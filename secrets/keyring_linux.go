@@ -0,0 +1,22 @@
+package secrets
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// readKeyring - reads the payload of a user key from the user keyring
+func readKeyring(description string) ([]byte, error) {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", description, 0)
+	if err != nil {
+		return nil, err
+	}
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, size)
+	if _, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, payload, 0); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
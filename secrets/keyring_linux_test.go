@@ -0,0 +1,24 @@
+package secrets
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+	"golang.org/x/sys/unix"
+)
+
+func TestKeyringProvider(t *testing.T) {
+	is := is.New(t)
+	if _, err := readKeyring(KeyringDescription); err == nil {
+		t.Skip("the keyring already holds a netclient key")
+	}
+	_, err := Create(t.TempDir(), "keyring")
+	is.True(err != nil) // no key in the keyring
+
+	id, err := unix.AddKey("user", KeyringDescription, []byte("0123456789abcdef0123456789abcdef"), unix.KEY_SPEC_USER_KEYRING)
+	if err != nil {
+		t.Skip("kernel keyring not available", err)
+	}
+	defer unix.KeyctlInt(unix.KEYCTL_UNLINK, id, unix.KEY_SPEC_USER_KEYRING, 0, 0)
+	roundTrip(t, t.TempDir(), "keyring")
+}
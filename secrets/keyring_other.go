@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package secrets
+
+import "errors"
+
+// readKeyring - the kernel keyring is only available on linux
+func readKeyring(description string) ([]byte, error) {
+	return nil, errors.New("kernel keyring is not supported on this os")
+}
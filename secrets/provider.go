@@ -0,0 +1,182 @@
+package secrets
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// PassphraseEnv - environment variable holding the passphrase for the passphrase provider
+	PassphraseEnv = "NETCLIENT_SECRETS_PASSPHRASE"
+	// CredentialName - name of the systemd credential used by the systemd provider
+	CredentialName = "netclient-secrets"
+	// KeyringDescription - description of the user key in the root user keyring used by the keyring provider
+	KeyringDescription = "netclient:secrets"
+	// kekFile - name of the file holding the key encryption key for the file provider
+	kekFile = "secrets.kek"
+)
+
+// Providers - names of the supported key encryption key providers
+var Providers = []string{"file", "passphrase", "systemd", "keyring"}
+
+// Provider - source of the key encryption key
+type Provider interface {
+	// KEK - returns the key encryption key; salt is random and unique to the key file
+	KEK(salt []byte) (*[32]byte, error)
+}
+
+// NewProvider - returns the named provider for the config files in dir
+func NewProvider(name, dir string) (Provider, error) {
+	switch name {
+	case "file":
+		return fileProvider{file: filepath.Join(dir, kekFile)}, nil
+	case "passphrase":
+		return passphraseProvider{}, nil
+	case "systemd":
+		return systemdProvider{stores: CredentialStores}, nil
+	case "keyring":
+		return keyringProvider{}, nil
+	default:
+		return nil, fmt.Errorf("unknown secrets provider %q, valid providers are %s", name, strings.Join(Providers, ", "))
+	}
+}
+
+// fileProvider - key encryption key stored in a file readable only by root
+// provides backward compatibility for installs without a passphrase, credential or keyring
+type fileProvider struct {
+	file string
+}
+
+func (p fileProvider) KEK(salt []byte) (*[32]byte, error) {
+	data, err := os.ReadFile(p.file)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := randomBytes(32)
+		if err != nil {
+			return nil, err
+		}
+		data = []byte(base64.StdEncoding.EncodeToString(key))
+		if err := writeFile(p.file, data); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %s %w", p.file, err)
+	}
+	return deriveKey(secret, salt)
+}
+
+// passphraseProvider - key encryption key derived from a passphrase supplied in the environment
+type passphraseProvider struct{}
+
+func (passphraseProvider) KEK(salt []byte) (*[32]byte, error) {
+	passphrase := os.Getenv(PassphraseEnv)
+	if passphrase == "" {
+		return nil, fmt.Errorf("%s is not set", PassphraseEnv)
+	}
+	var key [32]byte
+	copy(key[:], argon2.IDKey([]byte(passphrase), salt, 3, 64*1024, 4, 32))
+	return &key, nil
+}
+
+// CredentialStores - directories systemd searches for the encrypted credential of LoadCredentialEncrypted=
+// without a path, searched in the same order by commands run outside the netclient unit
+var CredentialStores = []string{
+	"/etc/credstore.encrypted",
+	"/run/credstore.encrypted",
+	"/usr/local/lib/credstore.encrypted",
+	"/usr/lib/credstore.encrypted",
+}
+
+// decryptCredential - decrypts an encrypted systemd credential file, replaced by tests
+var decryptCredential = func(file string) ([]byte, error) {
+	out, err := exec.Command("systemd-creds", "decrypt", "--name="+CredentialName, file, "-").Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("systemd-creds decrypt failed %w %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// systemdProvider - key encryption key derived from a systemd credential
+// the netclient unit has LoadCredentialEncrypted=netclient-secrets, which passes the credential to the daemon
+// in $CREDENTIALS_DIRECTORY; other netclient commands decrypt it from the credential store with systemd-creds
+// e.g. systemd-creds encrypt --name=netclient-secrets secret.txt /etc/credstore.encrypted/netclient-secrets
+type systemdProvider struct {
+	stores []string
+}
+
+func (p systemdProvider) KEK(salt []byte) (*[32]byte, error) {
+	secret, err := p.credential()
+	if err != nil {
+		return nil, err
+	}
+	return deriveKey(secret, salt)
+}
+
+// systemdProvider.credential - the credential passed by systemd, or decrypted from the first credential store
+// holding it
+func (p systemdProvider) credential() ([]byte, error) {
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" {
+		secret, err := os.ReadFile(filepath.Join(dir, CredentialName))
+		if err == nil {
+			return secret, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read systemd credential %s %w", CredentialName, err)
+		}
+	}
+	for _, store := range p.stores {
+		file := filepath.Join(store, CredentialName)
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		secret, err := decryptCredential(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt systemd credential %s %w", file, err)
+		}
+		return secret, nil
+	}
+	return nil, fmt.Errorf("systemd credential %s not found in $CREDENTIALS_DIRECTORY or %s, create it with "+
+		"systemd-creds encrypt --name=%s <secret file> %s", CredentialName, strings.Join(p.stores, ", "),
+		CredentialName, filepath.Join(CredentialStores[0], CredentialName))
+}
+
+// keyringProvider - key encryption key derived from a key in the root user keyring
+// e.g. keyctl padd user netclient:secrets @u
+type keyringProvider struct{}
+
+func (keyringProvider) KEK(salt []byte) (*[32]byte, error) {
+	secret, err := readKeyring(KeyringDescription)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from kernel keyring %w", KeyringDescription, err)
+	}
+	return deriveKey(secret, salt)
+}
+
+// deriveKey - derives a key encryption key from high entropy secret material
+func deriveKey(secret, salt []byte) (*[32]byte, error) {
+	if len(secret) < 16 {
+		return nil, errors.New("secret is too short, at least 16 bytes are required")
+	}
+	var key [32]byte
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte("netclient secrets")), key[:]); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
@@ -0,0 +1,158 @@
+package secrets
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+// roundTrip - creates a store with provider in dir, seals a value and opens it with a store loaded from dir
+func roundTrip(t *testing.T, dir, provider string) {
+	t.Helper()
+	is := is.New(t)
+	store, err := Create(dir, provider)
+	is.NoErr(err)
+	is.Equal(store.Provider(), provider)
+	sealed, err := store.Seal([]byte("hostpass"))
+	is.NoErr(err)
+	is.True(!strings.Contains(sealed, "hostpass"))
+	loaded, err := Load(dir)
+	is.NoErr(err)
+	is.Equal(loaded.Provider(), provider)
+	plaintext, err := loaded.Open(sealed)
+	is.NoErr(err)
+	is.Equal(string(plaintext), "hostpass")
+	info, err := os.Stat(filepath.Join(dir, KeyFile))
+	is.NoErr(err)
+	is.Equal(info.Mode().Perm(), os.FileMode(filePerm))
+}
+
+func TestFileProvider(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+	roundTrip(t, dir, "file")
+	info, err := os.Stat(filepath.Join(dir, kekFile))
+	is.NoErr(err)
+	is.Equal(info.Mode().Perm(), os.FileMode(filePerm))
+
+	// a different key encryption key can not unwrap the keys
+	is.NoErr(os.WriteFile(filepath.Join(dir, kekFile), []byte("c29tZSBvdGhlciBrZXkgb2YgZW5vdWdoIGxlbmd0aA=="), filePerm))
+	_, err = Load(dir)
+	is.True(err != nil)
+	is.NoErr(os.WriteFile(filepath.Join(dir, kekFile), []byte("not base64"), filePerm))
+	_, err = Load(dir)
+	is.True(err != nil)
+}
+
+func TestPassphraseProvider(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+	t.Setenv(PassphraseEnv, "correct horse battery staple")
+	roundTrip(t, dir, "passphrase")
+
+	t.Setenv(PassphraseEnv, "incorrect horse battery staple")
+	_, err := Load(dir)
+	is.True(err != nil) // wrong passphrase
+	is.True(strings.Contains(err.Error(), "wrong key encryption key"))
+
+	t.Setenv(PassphraseEnv, "")
+	_, err = Load(dir)
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), PassphraseEnv+" is not set"))
+	_, err = Create(t.TempDir(), "passphrase")
+	is.True(err != nil)
+}
+
+func TestSystemdProvider(t *testing.T) {
+	is := is.New(t)
+	stores := CredentialStores
+	decrypt := decryptCredential
+	defer func() {
+		CredentialStores = stores
+		decryptCredential = decrypt
+	}()
+	CredentialStores = []string{filepath.Join(t.TempDir(), "credstore.encrypted")}
+	decryptCredential = func(string) ([]byte, error) {
+		t.Fatal("credential store used while the daemon credential is available")
+		return nil, nil
+	}
+
+	// the daemon reads the credential passed by systemd
+	credentials := t.TempDir()
+	t.Setenv("CREDENTIALS_DIRECTORY", credentials)
+	is.NoErr(os.WriteFile(filepath.Join(credentials, CredentialName), []byte("0123456789abcdef0123456789abcdef"), 0400))
+	dir := t.TempDir()
+	roundTrip(t, dir, "systemd")
+
+	// the credential is missing, eg. a command run outside the netclient unit before the credential is created
+	t.Setenv("CREDENTIALS_DIRECTORY", "")
+	_, err := Load(dir)
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "systemd-creds encrypt --name="+CredentialName))
+
+	// other commands decrypt the credential from the credential store
+	is.NoErr(os.MkdirAll(CredentialStores[0], 0700))
+	encrypted := filepath.Join(CredentialStores[0], CredentialName)
+	is.NoErr(os.WriteFile(encrypted, []byte("encrypted"), 0600))
+	decryptCredential = func(file string) ([]byte, error) {
+		is.Equal(file, encrypted)
+		return []byte("0123456789abcdef0123456789abcdef"), nil
+	}
+	store, err := Load(dir)
+	is.NoErr(err)
+	is.Equal(store.Provider(), "systemd")
+
+	// a credential that can not be decrypted, eg. encrypted on another host
+	decryptCredential = func(string) ([]byte, error) {
+		return nil, errors.New("systemd-creds decrypt failed")
+	}
+	_, err = Load(dir)
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), encrypted))
+
+	// a different credential can not unwrap the keys
+	t.Setenv("CREDENTIALS_DIRECTORY", credentials)
+	is.NoErr(os.Chmod(filepath.Join(credentials, CredentialName), 0600))
+	is.NoErr(os.WriteFile(filepath.Join(credentials, CredentialName), []byte("fedcba9876543210fedcba9876543210"), 0400))
+	_, err = Load(dir)
+	is.True(err != nil)
+	is.NoErr(os.Chmod(filepath.Join(credentials, CredentialName), 0600))
+	is.NoErr(os.WriteFile(filepath.Join(credentials, CredentialName), []byte("short"), 0400))
+	_, err = Load(dir)
+	is.True(err != nil) // too little key material
+}
+
+func TestRotate(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+	store, err := Create(dir, "file")
+	is.NoErr(err)
+	old, err := store.Seal([]byte("old"))
+	is.NoErr(err)
+
+	t.Setenv(PassphraseEnv, "correct horse battery staple")
+	is.NoErr(store.Rotate("passphrase"))
+	current, err := store.Seal([]byte("current"))
+	is.NoErr(err)
+	loaded, err := Load(dir)
+	is.NoErr(err)
+	plaintext, err := loaded.Open(old)
+	is.NoErr(err) // previous keys are kept until pruned
+	is.Equal(string(plaintext), "old")
+
+	is.NoErr(loaded.Prune())
+	_, err = loaded.Open(old)
+	is.True(errors.Is(err, ErrUnknownKey))
+	plaintext, err = loaded.Open(current)
+	is.NoErr(err)
+	is.Equal(string(plaintext), "current")
+	_, err = os.Stat(filepath.Join(dir, kekFile))
+	is.True(errors.Is(err, os.ErrNotExist)) // key material of the file provider is removed
+
+	_, err = NewProvider("vault", dir)
+	is.True(err != nil)
+}
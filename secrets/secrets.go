@@ -0,0 +1,300 @@
+// Package secrets encrypts the sensitive values stored in the netclient config files
+//
+// values are sealed with a data encryption key (dek); the deks are stored in the key file
+// wrapped by a key encryption key (kek) obtained from a pluggable provider
+package secrets
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// KeyFile - name of the file holding the wrapped data encryption keys
+	KeyFile = "secrets.key"
+	// DefaultProvider - provider used by installs that have not selected one
+	DefaultProvider = "file"
+	// filePerm - permissions of key files
+	filePerm = 0600
+	// nonceSize - size of a secretbox nonce
+	nonceSize = 24
+)
+
+// ErrUnknownKey - returned when a value was sealed with a key that is no longer in the key file
+var ErrUnknownKey = errors.New("value was encrypted with an unknown key")
+
+// keyFile - on disk format of the key file
+type keyFile struct {
+	Provider string       `yaml:"provider"`
+	Salt     string       `yaml:"salt"`
+	Primary  string       `yaml:"primary"`
+	Keys     []wrappedKey `yaml:"keys"`
+}
+
+// wrappedKey - a data encryption key sealed with the key encryption key
+type wrappedKey struct {
+	ID  string `yaml:"id"`
+	Key string `yaml:"key"`
+}
+
+// Store - data encryption keys for sealing and opening secret values
+type Store struct {
+	dir      string
+	provider string
+	salt     []byte
+	primary  string
+	keys     map[string]*[32]byte
+}
+
+// Load - loads the key store for the config files in dir
+func Load(dir string) (*Store, error) {
+	data, err := os.ReadFile(filepath.Join(dir, KeyFile))
+	if err != nil {
+		return nil, err
+	}
+	var kf keyFile
+	if err := yaml.Unmarshal(data, &kf); err != nil {
+		return nil, fmt.Errorf("invalid key file %w", err)
+	}
+	salt, err := base64.StdEncoding.DecodeString(kf.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt in key file %w", err)
+	}
+	provider, err := NewProvider(kf.Provider, dir)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := provider.KEK(salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key encryption key from %s provider %w", kf.Provider, err)
+	}
+	store := &Store{
+		dir:      dir,
+		provider: kf.Provider,
+		salt:     salt,
+		primary:  kf.Primary,
+		keys:     make(map[string]*[32]byte),
+	}
+	for _, wrapped := range kf.Keys {
+		sealed, err := base64.StdEncoding.DecodeString(wrapped.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s in key file %w", wrapped.ID, err)
+		}
+		dek, err := open(sealed, kek)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap key %s, wrong key encryption key for %s provider?", wrapped.ID, kf.Provider)
+		}
+		var key [32]byte
+		copy(key[:], dek)
+		store.keys[wrapped.ID] = &key
+	}
+	if _, ok := store.keys[store.primary]; !ok {
+		return nil, fmt.Errorf("primary key %s missing from key file", store.primary)
+	}
+	return store, nil
+}
+
+// Create - creates a new key store for the config files in dir with a single data encryption key
+func Create(dir, provider string) (*Store, error) {
+	store := &Store{
+		dir:  dir,
+		keys: make(map[string]*[32]byte),
+	}
+	if err := store.Rotate(provider); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Store.Provider - name of the provider of the key encryption key
+func (s *Store) Provider() string {
+	return s.provider
+}
+
+// Store.Rotate - adds a new primary data encryption key and wraps all keys with a key encryption key from provider
+// existing keys are retained so values sealed with them can still be opened, until Prune is called
+func (s *Store) Rotate(provider string) error {
+	p, err := NewProvider(provider, s.dir)
+	if err != nil {
+		return err
+	}
+	salt, err := randomBytes(16)
+	if err != nil {
+		return err
+	}
+	kek, err := p.KEK(salt)
+	if err != nil {
+		return fmt.Errorf("failed to get key encryption key from %s provider %w", provider, err)
+	}
+	id, err := randomBytes(8)
+	if err != nil {
+		return err
+	}
+	dek, err := randomBytes(32)
+	if err != nil {
+		return err
+	}
+	var key [32]byte
+	copy(key[:], dek)
+	keys := make(map[string]*[32]byte, len(s.keys)+1)
+	for k, v := range s.keys {
+		keys[k] = v
+	}
+	keys[hex.EncodeToString(id)] = &key
+	next := Store{
+		dir:      s.dir,
+		provider: provider,
+		salt:     salt,
+		primary:  hex.EncodeToString(id),
+		keys:     keys,
+	}
+	if err := next.save(kek); err != nil {
+		return err
+	}
+	*s = next
+	return nil
+}
+
+// Store.Prune - removes all keys other than the primary key from the key file
+// call once all values have been sealed with the primary key
+func (s *Store) Prune() error {
+	p, err := NewProvider(s.provider, s.dir)
+	if err != nil {
+		return err
+	}
+	kek, err := p.KEK(s.salt)
+	if err != nil {
+		return fmt.Errorf("failed to get key encryption key from %s provider %w", s.provider, err)
+	}
+	for id := range s.keys {
+		if id != s.primary {
+			delete(s.keys, id)
+		}
+	}
+	if err := s.save(kek); err != nil {
+		return err
+	}
+	if s.provider != "file" {
+		// key material of the file provider is no longer required
+		if err := os.Remove(filepath.Join(s.dir, kekFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Store.Seal - encrypts a value with the primary key
+// the returned value identifies the key used and is safe to store as text
+func (s *Store) Seal(plaintext []byte) (string, error) {
+	key, ok := s.keys[s.primary]
+	if !ok {
+		return "", ErrUnknownKey
+	}
+	sealed, err := seal(plaintext, key)
+	if err != nil {
+		return "", err
+	}
+	return s.primary + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Store.Open - decrypts a value returned by Seal
+func (s *Store) Open(value string) ([]byte, error) {
+	id, data, ok := strings.Cut(value, ":")
+	if !ok {
+		return nil, errors.New("invalid encrypted value")
+	}
+	key, ok := s.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownKey, id)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted value %w", err)
+	}
+	return open(sealed, key)
+}
+
+// save - writes the key file with the data encryption keys wrapped by kek
+func (s *Store) save(kek *[32]byte) error {
+	kf := keyFile{
+		Provider: s.provider,
+		Salt:     base64.StdEncoding.EncodeToString(s.salt),
+		Primary:  s.primary,
+	}
+	for id, key := range s.keys {
+		sealed, err := seal(key[:], kek)
+		if err != nil {
+			return err
+		}
+		kf.Keys = append(kf.Keys, wrappedKey{ID: id, Key: base64.StdEncoding.EncodeToString(sealed)})
+	}
+	data, err := yaml.Marshal(&kf)
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(s.dir, KeyFile), data)
+}
+
+func seal(plaintext []byte, key *[32]byte) ([]byte, error) {
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], plaintext, &nonce, key), nil
+}
+
+func open(sealed []byte, key *[32]byte) ([]byte, error) {
+	if len(sealed) < nonceSize+secretbox.Overhead {
+		return nil, errors.New("encrypted value is too short")
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], sealed[:nonceSize])
+	plaintext, ok := secretbox.Open(nil, sealed[nonceSize:], &nonce, key)
+	if !ok {
+		return nil, errors.New("failed to decrypt value")
+	}
+	return plaintext, nil
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// writeFile - atomically writes a file readable only by its owner
+func writeFile(file string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(filePerm); err != nil && runtime.GOOS != "windows" {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,222 @@
+package transport
+
+import (
+	"context"
+	"sync"
+)
+
+// Broker - in-process message broker delivering messages between its clients
+// messages are delivered synchronously by the publishing goroutine and qos is ignored, so a publish returns
+// once all subscribers handled the message; sessions are clean, subscriptions end with the connection
+type Broker struct {
+	mutex    sync.Mutex
+	clients  map[*Client]bool // connected clients
+	retained map[string][]byte
+	refuse   error
+}
+
+// Client - a client of an in-process broker
+type Client struct {
+	broker        *Broker
+	callbacks     Callbacks
+	subscriptions []subscription // guarded by the broker mutex
+}
+
+// subscription - a topic filter and its handler
+type subscription struct {
+	filter  string
+	handler Handler
+}
+
+// message - a message delivered by an in-process broker
+type message struct {
+	topic   string
+	payload []byte
+}
+
+func (m *message) Topic() string   { return m.topic }
+func (m *message) Payload() []byte { return m.payload }
+
+// delivery - a message to be handled by a subscriber
+type delivery struct {
+	client  *Client
+	handler Handler
+	msg     *message
+}
+
+// NewBroker - creates an in-process broker
+func NewBroker() *Broker {
+	return &Broker{clients: make(map[*Client]bool), retained: make(map[string][]byte)}
+}
+
+// Broker.Client - creates a client of the broker, which must connect before it can publish or subscribe
+func (b *Broker) Client(callbacks Callbacks) *Client {
+	return &Client{broker: b, callbacks: callbacks}
+}
+
+// Broker.Refuse - makes connection attempts fail with err, nil accepts connections again
+func (b *Broker) Refuse(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refuse = err
+}
+
+// Broker.Drop - drops the connections of all clients, as if the broker was restarted
+func (b *Broker) Drop(err error) {
+	b.mutex.Lock()
+	dropped := make([]*Client, 0, len(b.clients))
+	for client := range b.clients {
+		client.subscriptions = nil
+		dropped = append(dropped, client)
+	}
+	b.clients = make(map[*Client]bool)
+	b.mutex.Unlock()
+	for _, client := range dropped {
+		if client.callbacks.OnConnectionLost != nil {
+			client.callbacks.OnConnectionLost(client, err)
+		}
+	}
+}
+
+// Broker.Retained - the retained message of a topic
+func (b *Broker) Retained(topic string) ([]byte, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	payload, ok := b.retained[topic]
+	return payload, ok
+}
+
+// Broker.publish - delivers a message to the matching subscriptions of all connected clients
+// an empty retained message removes the retained message of the topic
+func (b *Broker) publish(topic string, retained bool, payload []byte) {
+	msg := &message{topic: topic, payload: append([]byte{}, payload...)}
+	b.mutex.Lock()
+	if retained {
+		if len(payload) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = msg.payload
+		}
+	}
+	var deliveries []delivery
+	for client := range b.clients {
+		for _, sub := range client.subscriptions {
+			if Match(sub.filter, topic) {
+				deliveries = append(deliveries, delivery{client: client, handler: sub.handler, msg: msg})
+			}
+		}
+	}
+	b.mutex.Unlock()
+	deliver(deliveries)
+}
+
+// deliver - calls the handlers of deliveries, outside of the broker lock so handlers can publish
+func deliver(deliveries []delivery) {
+	for _, d := range deliveries {
+		d.handler(d.client, d.msg)
+	}
+}
+
+// Client.Connect - connects to the broker, unless it refuses connections
+func (c *Client) Connect(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b := c.broker
+	b.mutex.Lock()
+	if b.refuse != nil {
+		err := b.refuse
+		b.mutex.Unlock()
+		return err
+	}
+	b.clients[c] = true
+	b.mutex.Unlock()
+	if c.callbacks.OnConnect != nil {
+		c.callbacks.OnConnect(c)
+	}
+	return nil
+}
+
+// Client.Disconnect - disconnects from the broker, the connection lost callback is not called
+func (c *Client) Disconnect() {
+	b := c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.clients, c)
+	c.subscriptions = nil
+}
+
+// Client.Publish - publishes a message to the broker
+func (c *Client) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	if c.State() != StateConnected {
+		return ErrNotConnected
+	}
+	c.broker.publish(topic, retained, payload)
+	return nil
+}
+
+// Client.Subscribe - subscribes to a topic filter, replacing an existing subscription of the same filter
+// retained messages matching the filter are delivered before Subscribe returns
+func (c *Client) Subscribe(filter string, qos byte, handler Handler) error {
+	b := c.broker
+	b.mutex.Lock()
+	if !b.clients[c] {
+		b.mutex.Unlock()
+		return ErrNotConnected
+	}
+	sub := subscription{filter: filter, handler: handler}
+	replaced := false
+	for i := range c.subscriptions {
+		if c.subscriptions[i].filter == filter {
+			c.subscriptions[i] = sub
+			replaced = true
+		}
+	}
+	if !replaced {
+		c.subscriptions = append(c.subscriptions, sub)
+	}
+	var deliveries []delivery
+	for topic, payload := range b.retained {
+		if Match(filter, topic) {
+			deliveries = append(deliveries, delivery{client: c, handler: handler, msg: &message{topic: topic, payload: payload}})
+		}
+	}
+	b.mutex.Unlock()
+	deliver(deliveries)
+	return nil
+}
+
+// Client.Unsubscribe - removes the subscriptions of topic filters
+func (c *Client) Unsubscribe(filters ...string) error {
+	b := c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.clients[c] {
+		return ErrNotConnected
+	}
+	remaining := c.subscriptions[:0]
+	for _, sub := range c.subscriptions {
+		keep := true
+		for _, filter := range filters {
+			if sub.filter == filter {
+				keep = false
+			}
+		}
+		if keep {
+			remaining = append(remaining, sub)
+		}
+	}
+	c.subscriptions = remaining
+	return nil
+}
+
+// Client.State - connected or disconnected
+func (c *Client) State() State {
+	b := c.broker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.clients[c] {
+		return StateConnected
+	}
+	return StateDisconnected
+}
@@ -0,0 +1,121 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"peers/host/1/server", "peers/host/1/server", true},
+		{"peers/host/1/server", "peers/host/2/server", false},
+		{"peers/host/+/server", "peers/host/2/server", true},
+		{"peers/+", "peers/host/2", false},
+		{"peers/#", "peers/host/2", true},
+		{"peers/#", "peers", true},
+		{"#", "peers/host", true},
+		{"#", "$SYS/broker", false},
+		{"+/broker", "$SYS/broker", false},
+		{"update/net/#/x", "update/net/a/x", false},
+		{"update/net", "update/net/node", false},
+		{"update/net/node", "update/net", false},
+	}
+	for _, test := range tests {
+		t.Run(test.filter+" "+test.topic, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(Match(test.filter, test.topic), test.match)
+		})
+	}
+}
+
+// recorder - records the messages received by a handler
+type recorder struct {
+	messages []string
+}
+
+func (r *recorder) handle(_ Transport, msg Message) {
+	r.messages = append(r.messages, msg.Topic()+" "+string(msg.Payload()))
+}
+
+func TestBroker(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	broker := NewBroker()
+	connects := 0
+	var lost error
+	client := broker.Client(Callbacks{
+		OnConnect:        func(Transport) { connects++ },
+		OnConnectionLost: func(_ Transport, err error) { lost = err },
+	})
+	is.Equal(client.State(), StateDisconnected)
+	is.Equal(client.Publish("a", 0, false, nil), ErrNotConnected)
+	is.Equal(client.Subscribe("a", 0, nil), ErrNotConnected)
+
+	refused := errors.New("not authorized")
+	broker.Refuse(refused)
+	is.Equal(client.Connect(ctx), refused)
+	broker.Refuse(nil)
+	is.NoErr(client.Connect(ctx))
+	is.Equal(client.State(), StateConnected)
+	is.Equal(connects, 1)
+
+	sender := broker.Client(Callbacks{})
+	is.NoErr(sender.Connect(ctx))
+	// retained messages are delivered on subscribe, an empty retained message clears it
+	is.NoErr(sender.Publish("host/update/1", 0, true, []byte("retained")))
+	is.NoErr(sender.Publish("host/update/2", 0, true, []byte("cleared")))
+	is.NoErr(sender.Publish("host/update/2", 0, true, nil))
+	_, ok := broker.Retained("host/update/2")
+	is.True(!ok)
+	var r recorder
+	is.NoErr(client.Subscribe("host/update/+", 0, r.handle))
+	is.Equal(r.messages, []string{"host/update/1 retained"})
+	// delivery is synchronous
+	is.NoErr(sender.Publish("host/update/3", 1, false, []byte("update")))
+	is.NoErr(sender.Publish("peers/host/3", 1, false, []byte("peers")))
+	is.Equal(r.messages, []string{"host/update/1 retained", "host/update/3 update"})
+	// subscribing to the same filter replaces the handler
+	var replaced recorder
+	is.NoErr(client.Subscribe("host/update/+", 0, replaced.handle))
+	is.NoErr(sender.Publish("host/update/4", 0, false, []byte("update")))
+	is.Equal(len(r.messages), 2)
+	is.Equal(replaced.messages, []string{"host/update/1 retained", "host/update/4 update"})
+	is.NoErr(client.Unsubscribe("host/update/+"))
+	is.NoErr(sender.Publish("host/update/5", 0, false, []byte("update")))
+	is.Equal(len(replaced.messages), 2)
+
+	// a dropped connection ends the subscriptions
+	is.NoErr(client.Subscribe("#", 0, r.handle))
+	is.Equal(len(r.messages), 3) // the retained message
+	dropped := errors.New("broker restarted")
+	broker.Drop(dropped)
+	is.Equal(lost, dropped)
+	is.Equal(client.State(), StateDisconnected)
+	is.NoErr(client.Connect(ctx))
+	is.Equal(connects, 2)
+	is.NoErr(sender.Connect(ctx))
+	is.NoErr(sender.Publish("host/update/6", 0, false, []byte("update")))
+	is.Equal(len(r.messages), 3)
+
+	// a handler may publish
+	is.NoErr(client.Subscribe("ping", 0, func(c Transport, msg Message) {
+		is.NoErr(c.Publish("pong", 0, false, msg.Payload()))
+	}))
+	var pong recorder
+	is.NoErr(sender.Subscribe("pong", 0, pong.handle))
+	is.NoErr(sender.Publish("ping", 0, false, []byte("1")))
+	is.Equal(pong.messages, []string{"pong 1"})
+
+	client.Disconnect()
+	is.Equal(client.State(), StateDisconnected)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	is.Equal(client.Connect(cancelled), context.Canceled)
+}
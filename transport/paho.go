@@ -0,0 +1,102 @@
+package transport
+
+import (
+	"context"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// DefaultTimeout - time limit for the broker to acknowledge a publish, subscribe or unsubscribe
+const DefaultTimeout = time.Second * 30
+
+// Paho - transport using the paho mqtt client
+type Paho struct {
+	client  mqtt.Client
+	timeout time.Duration
+}
+
+// NewPaho - creates a paho transport from the client options
+// callbacks are called after the connect and connection lost handlers already set in opts
+func NewPaho(opts *mqtt.ClientOptions, callbacks Callbacks) *Paho {
+	p := &Paho{timeout: DefaultTimeout}
+	onConnect := opts.OnConnect
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		if onConnect != nil {
+			onConnect(client)
+		}
+		if callbacks.OnConnect != nil {
+			callbacks.OnConnect(p)
+		}
+	})
+	onConnectionLost := opts.OnConnectionLost
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		if onConnectionLost != nil {
+			onConnectionLost(client, err)
+		}
+		if callbacks.OnConnectionLost != nil {
+			callbacks.OnConnectionLost(p, err)
+		}
+	})
+	p.client = mqtt.NewClient(opts)
+	return p
+}
+
+// Paho.Connect - connects to the brokers of the client options
+func (p *Paho) Connect(ctx context.Context) error {
+	token := p.client.Connect()
+	select {
+	case <-ctx.Done():
+		// the attempt can not be aborted; drop the connection if it succeeds after all
+		go func() {
+			if token.Wait() && token.Error() == nil {
+				p.client.Disconnect(250)
+			}
+		}()
+		return ctx.Err()
+	case <-token.Done():
+	}
+	return token.Error()
+}
+
+// Paho.Disconnect - closes the connection, waiting up to 250ms for pending work to complete
+func (p *Paho) Disconnect() {
+	p.client.Disconnect(250)
+}
+
+// Paho.Publish - publishes a message
+func (p *Paho) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	return p.wait(p.client.Publish(topic, qos, retained, payload))
+}
+
+// Paho.Subscribe - subscribes to a topic filter
+func (p *Paho) Subscribe(filter string, qos byte, handler Handler) error {
+	return p.wait(p.client.Subscribe(filter, qos, func(_ mqtt.Client, msg mqtt.Message) {
+		handler(p, msg)
+	}))
+}
+
+// Paho.Unsubscribe - unsubscribes from topic filters
+func (p *Paho) Unsubscribe(filters ...string) error {
+	return p.wait(p.client.Unsubscribe(filters...))
+}
+
+// Paho.State - state of the paho client
+func (p *Paho) State() State {
+	switch {
+	case p.client.IsConnectionOpen():
+		return StateConnected
+	case p.client.IsConnected():
+		// paho reports a client that is reconnecting or retrying its first connection as connected
+		return StateConnecting
+	}
+	return StateDisconnected
+}
+
+// Paho.wait - waits for the broker to acknowledge a request
+func (p *Paho) wait(token mqtt.Token) error {
+	if !token.WaitTimeout(p.timeout) {
+		return ErrTimeout
+	}
+	return token.Error()
+}
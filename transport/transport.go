@@ -0,0 +1,84 @@
+// Package transport abstracts the connection of the netclient to the message broker of a server
+//
+// the daemon uses Paho, which connects to the mqtt brokers of the server; Broker is an in-process broker
+// so the message handling of the daemon can be run end to end in tests
+package transport
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// State - state of the connection to the broker
+type State string
+
+const (
+	// StateDisconnected - not connected and no connection attempt in progress
+	StateDisconnected State = "disconnected"
+	// StateConnecting - a connection attempt is in progress, or the connection is being re-established
+	StateConnecting State = "connecting"
+	// StateConnected - connected to the broker
+	StateConnected State = "connected"
+)
+
+var (
+	// ErrNotConnected - the transport is not connected to the broker
+	ErrNotConnected = errors.New("not connected to broker")
+	// ErrTimeout - the broker did not acknowledge a request in time
+	ErrTimeout = errors.New("connection timeout")
+)
+
+// Message - a message received from the broker
+type Message interface {
+	Topic() string
+	Payload() []byte
+}
+
+// Handler - handles the messages of a subscription
+type Handler func(Transport, Message)
+
+// Callbacks - functions called on changes of the connection state, either may be nil
+type Callbacks struct {
+	OnConnect        func(Transport)        // called after each successful connection attempt
+	OnConnectionLost func(Transport, error) // called when an established connection is lost
+}
+
+// Transport - connection to the message broker of a server
+type Transport interface {
+	// Connect - makes a connection attempt, blocking until it succeeds, fails or ctx is done
+	// an attempt abandoned because ctx is done is disconnected should it succeed later
+	Connect(ctx context.Context) error
+	// Disconnect - closes the connection
+	Disconnect()
+	// Publish - sends a message, blocking until the broker acknowledges it for qos > 0
+	Publish(topic string, qos byte, retained bool, payload []byte) error
+	// Subscribe - subscribes handler to the messages matching the topic filter
+	Subscribe(filter string, qos byte, handler Handler) error
+	// Unsubscribe - removes the subscriptions of the topic filters
+	Unsubscribe(filters ...string) error
+	// State - current state of the connection
+	State() State
+}
+
+// Match - checks if topic matches an mqtt topic filter, which may contain the wildcards + and #
+// as in mqtt, wildcards at the start of a filter do not match topics starting with $
+func Match(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return i == len(filterLevels)-1
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,355 @@
+package wireguard
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netclient/ncutils"
+	"github.com/gravitl/netmaker/logger"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// exclusionRulePriority - priority of the rules keeping the traffic to peer endpoints, brokers and apis on the
+	// uplink of the host while all traffic goes through an internet gateway
+	exclusionRulePriority = 32762
+	// dnsRulePriority - priority of the rules sending the traffic to the public nameservers of the host through
+	// the tunnel while all traffic goes through an internet gateway
+	dnsRulePriority = 32763
+	// killSwitchMetric - metric of the unreachable default routes in the netmaker table, used only if the
+	// default routes through the interface are gone
+	killSwitchMetric = 0xffffffff
+	// lookupTimeout - time limit for resolving a broker or api to keep it off the internet gateway
+	lookupTimeout = time.Second * 5
+)
+
+// gatewayState - how the traffic of the host is routed with respect to an internet gateway
+type gatewayState int
+
+const (
+	// gatewayOff - no internet gateway, the traffic not meant for peers leaves through the uplink
+	gatewayOff gatewayState = iota
+	// gatewayUp - all traffic goes through the internet gateway
+	gatewayUp
+	// gatewayBlocked - the routes to the internet gateway are gone and the kill switch drops the traffic, except
+	// to the peer endpoints, brokers, apis and nameservers so the daemon can bring the tunnel back
+	gatewayBlocked
+)
+
+// gatewayMutex - serializes changes to the gateway rules and kill switch routes
+var gatewayMutex sync.Mutex
+
+// current gateway state, kept to refresh the exclusions and to report transitions
+var (
+	currentGateway    = gatewayOff
+	currentKillSwitch = false
+)
+
+// resolvConf - the resolver config of the host, with the upstream nameservers of systemd-resolved as fallback
+// when it only lists the local stub resolver
+var resolvConf = []string{"/etc/resolv.conf", "/run/systemd/resolve/resolv.conf"}
+
+// routeKillSwitch - adds or removes the unreachable default routes of the netmaker table, replaced by tests
+var routeKillSwitch = setKillSwitchRoutes
+
+// lookupIP - resolves a host, replaced by tests
+var lookupIP = func(host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+// nextGatewayState - the gateway state given whether the routes through the interface make a full tunnel, whether
+// the kill switch is enabled and whether a node has an internet gateway recorded
+// the kill switch holds while the gateway is recorded, so it is only released when the network with the gateway is
+// left or the kill switch is disabled
+func nextGatewayState(fullTunnel, killSwitch, recorded bool) gatewayState {
+	switch {
+	case fullTunnel:
+		return gatewayUp
+	case killSwitch && recorded:
+		return gatewayBlocked
+	}
+	return gatewayOff
+}
+
+// gatewayRecorded - checks if a node has an internet gateway recorded
+func gatewayRecorded() bool {
+	for _, node := range config.GetNodes() {
+		if node.InternetGateway != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// setGateway - applies a gateway state when the interface is configured
+func setGateway(table, mark int, state gatewayState, killSwitch bool) error {
+	gatewayMutex.Lock()
+	defer gatewayMutex.Unlock()
+	return applyGateway(table, mark, state, killSwitch)
+}
+
+// applyGateway - sets the kill switch routes and the policy rules of a gateway state, gatewayMutex must be held
+func applyGateway(table, mark int, state gatewayState, killSwitch bool) error {
+	if state != currentGateway {
+		switch state {
+		case gatewayUp:
+			logger.Log(1, "routing all traffic through the internet gateway")
+		case gatewayBlocked:
+			logger.Log(0, "routes to the internet gateway are gone, the kill switch drops traffic until they are back,",
+				"the network is left or the kill switch is disabled")
+		}
+	}
+	if err := routeKillSwitch(table, state == gatewayBlocked || (state == gatewayUp && killSwitch)); err != nil {
+		return err
+	}
+	var exclusions, dns []net.IP
+	switch state {
+	case gatewayUp:
+		var local []net.IP
+		dns, local = splitNameservers(nameservers())
+		if state != currentGateway && len(local) > 0 {
+			logger.Log(1, "queries to the nameservers", ipsString(local), "on the local network stay off the tunnel")
+		}
+		exclusions = gatewayExclusions()
+	case gatewayBlocked:
+		// the nameservers stay reachable through the uplink, so the brokers can be resolved to reconnect
+		exclusions = uniqueIPs(append(gatewayExclusions(), nameservers()...))
+	}
+	if err := setPolicyRules(table, mark, exclusions, dns); err != nil {
+		return err
+	}
+	currentGateway, currentKillSwitch = state, killSwitch
+	return nil
+}
+
+// closeGateway - removes the policy rules and kill switch routes when the interface is closed, unless the kill
+// switch holds: then they are kept so no traffic leaves through the uplink while the daemon is stopped or restarted
+func closeGateway() {
+	gatewayMutex.Lock()
+	defer gatewayMutex.Unlock()
+	killSwitch := config.Netclient().KillSwitch
+	if state := nextGatewayState(false, killSwitch, gatewayRecorded()); state == gatewayBlocked {
+		if err := applyGateway(routeTable(), firewallMark(), state, killSwitch); err != nil {
+			logger.Log(0, "failed to keep kill switch", err.Error())
+		}
+		return
+	}
+	removeGateway()
+}
+
+// removeGateway - removes the policy rules and kill switch routes, gatewayMutex must be held
+func removeGateway() {
+	removePolicyRules()
+	if err := routeKillSwitch(routeTable(), false); err != nil {
+		logger.Log(0, "failed to disable kill switch", err.Error())
+	}
+	currentGateway, currentKillSwitch = gatewayOff, false
+}
+
+// RemoveKillSwitch - removes the policy rules and kill switch routes left after the interface was closed, when the
+// host leaves all networks for good
+func RemoveKillSwitch() {
+	gatewayMutex.Lock()
+	defer gatewayMutex.Unlock()
+	removeGateway()
+}
+
+// RefreshGatewayExclusions - resolves the brokers and apis again and updates the rules keeping them on the uplink
+// while an internet gateway is used or the kill switch holds; their addresses are otherwise only resolved when the
+// interface is configured, so this is called when a broker connection fails
+func RefreshGatewayExclusions() {
+	gatewayMutex.Lock()
+	defer gatewayMutex.Unlock()
+	if currentGateway == gatewayOff {
+		return
+	}
+	if err := applyGateway(routeTable(), firewallMark(), currentGateway, currentKillSwitch); err != nil {
+		logger.Log(0, "failed to refresh the addresses kept off the internet gateway", err.Error())
+	}
+}
+
+// fullTunnel - checks if any of the routes through the interface is a default route, or half of the address space
+// as left of a default route split by the split-tunnel policy, meaning a peer is an internet gateway for the host
+func fullTunnel(dsts []net.IPNet) bool {
+	for _, dst := range dsts {
+		if ones, _ := dst.Mask.Size(); ones <= 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// gatewayRules - the rules of a family keeping the excluded addresses on the uplink and sending the traffic to
+// the nameservers through the netmaker table
+func gatewayRules(family, table int, exclusions, nameservers []net.IP) []netlink.Rule {
+	var rules []netlink.Rule
+	add := func(ips []net.IP, priority, table int) {
+		for _, ip := range ips {
+			if (ip.To4() != nil) != (family == netlink.FAMILY_V4) {
+				continue
+			}
+			rule := netlink.NewRule()
+			rule.Family = family
+			rule.Priority = priority
+			rule.Table = table
+			rule.Dst = hostIPNet(ip)
+			rules = append(rules, *rule)
+		}
+	}
+	add(exclusions, exclusionRulePriority, unix.RT_TABLE_MAIN)
+	add(nameservers, dnsRulePriority, table)
+	return rules
+}
+
+// hostIPNet - the range of a single address
+func hostIPNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// gatewayExclusions - the addresses of the peer endpoints, brokers and apis, sorted and without duplicates
+func gatewayExclusions() []net.IP {
+	var ips []net.IP
+	for _, peer := range config.GetHostPeerList() {
+		if peer.Endpoint != nil && !peer.Endpoint.IP.IsLoopback() {
+			ips = append(ips, peer.Endpoint.IP)
+		}
+	}
+	for _, server := range config.GetServerMap() {
+		hosts := []string{}
+		if api, err := url.Parse(ncutils.APIURL(server.API)); err == nil && server.API != "" {
+			hosts = append(hosts, api.Hostname())
+		}
+		if brokers, err := server.BrokerURLs(); err == nil {
+			for _, broker := range brokers {
+				hosts = append(hosts, broker.Hostname())
+			}
+		}
+		for _, host := range hosts {
+			resolved, err := lookupIP(host)
+			if err != nil {
+				logger.Log(0, "could not resolve", host, "to keep it off the internet gateway", err.Error())
+				continue
+			}
+			ips = append(ips, resolved...)
+		}
+	}
+	return uniqueIPs(ips)
+}
+
+// nameservers - the nameservers of the host that are not on the host itself
+func nameservers() []net.IP {
+	for _, path := range resolvConf {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if ips := parseNameservers(content); len(ips) > 0 {
+			return ips
+		}
+	}
+	return nil
+}
+
+// splitNameservers - splits the nameservers into the ones reached through the tunnel and the ones on a private or
+// link-local network, which the internet gateway cannot reach and so are left to the routes of the main table
+func splitNameservers(ips []net.IP) (tunnel, local []net.IP) {
+	for _, ip := range ips {
+		if ip.IsPrivate() || ip.IsLinkLocalUnicast() {
+			local = append(local, ip)
+			continue
+		}
+		tunnel = append(tunnel, ip)
+	}
+	return tunnel, local
+}
+
+// ipsString - the addresses separated by commas, for logs
+func ipsString(ips []net.IP) string {
+	strs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		strs = append(strs, ip.String())
+	}
+	return strings.Join(strs, ",")
+}
+
+// parseNameservers - the nameservers of a resolver config that are not loopback addresses
+func parseNameservers(content []byte) []net.IP {
+	var ips []net.IP
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		// ipv6 nameservers may have a zone
+		ip := net.ParseIP(strings.Split(fields[1], "%")[0])
+		if ip != nil && !ip.IsLoopback() {
+			ips = append(ips, ip)
+		}
+	}
+	return uniqueIPs(ips)
+}
+
+// uniqueIPs - the addresses sorted and without duplicates
+func uniqueIPs(ips []net.IP) []net.IP {
+	sort.Slice(ips, func(i, j int) bool { return bytes.Compare(ips[i].To16(), ips[j].To16()) < 0 })
+	unique := ips[:0]
+	for _, ip := range ips {
+		if len(unique) == 0 || !unique[len(unique)-1].Equal(ip) {
+			unique = append(unique, ip)
+		}
+	}
+	return unique
+}
+
+// setKillSwitchRoutes - adds or removes the unreachable ipv4 and ipv6 default routes of the netmaker table, which
+// drop the traffic meant for the tunnel instead of letting it leave through the uplink while the default routes
+// through the interface are gone
+func setKillSwitchRoutes(table int, on bool) error {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		route := netlink.Route{
+			Dst:      defaultRoute(family),
+			Table:    table,
+			Type:     unix.RTN_UNREACHABLE,
+			Priority: killSwitchMetric,
+		}
+		routes, err := netlink.RouteListFiltered(family, &route, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_TYPE)
+		if err != nil {
+			if family == netlink.FAMILY_V6 {
+				continue // ipv6 disabled
+			}
+			return err
+		}
+		switch {
+		case on && len(routes) == 0:
+			logger.Log(1, "enabling kill switch for", route.Dst.String())
+			if err := netlink.RouteAdd(&route); err != nil {
+				return err
+			}
+		case !on:
+			for i := range routes {
+				logger.Log(1, "disabling kill switch for", route.Dst.String())
+				routes[i].Dst = route.Dst // listed without a destination
+				if err := netlink.RouteDel(&routes[i]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package wireguard
+
+import (
+	"fmt"
+
+	"github.com/gravitl/netclient/config"
+)
+
+// Mode - the implementation of the netmaker interface
+type Mode string
+
+const (
+	// ModeAuto - kernel wireguard if it is available, userspace wireguard otherwise
+	ModeAuto Mode = "auto"
+	// ModeKernel - kernel wireguard only
+	ModeKernel Mode = "kernel"
+	// ModeUserspace - wireguard-go on a tun device, even if kernel wireguard is available
+	ModeUserspace Mode = "userspace"
+)
+
+// modeOverride - the mode set for the running daemon, takes precedence over the host config
+var modeOverride Mode
+
+// ParseMode - parses a wireguard mode, an empty mode is auto
+func ParseMode(mode string) (Mode, error) {
+	switch Mode(mode) {
+	case "", ModeAuto:
+		return ModeAuto, nil
+	case ModeKernel, ModeUserspace:
+		return Mode(mode), nil
+	}
+	return "", fmt.Errorf("invalid wireguard mode %q, must be one of auto, kernel or userspace", mode)
+}
+
+// SetMode - overrides the wireguard mode of the host config for the interfaces created by this process
+func SetMode(mode Mode) {
+	modeOverride = mode
+}
+
+// GetMode - the wireguard mode used to create the netmaker interface
+func GetMode() Mode {
+	if modeOverride != "" {
+		return modeOverride
+	}
+	mode, err := ParseMode(config.Netclient().WireGuardMode)
+	if err != nil {
+		return ModeAuto
+	}
+	return mode
+}
@@ -0,0 +1,258 @@
+package wireguard
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netmaker/logger"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// defaultRouteTable - routing table of the routes to peers if none is configured
+	defaultRouteTable = 51821
+	// defaultFirewallMark - fwmark of the packets sent by the netmaker interface if none is configured
+	defaultFirewallMark = 51821
+	// suppressRulePriority - priority of the rule looking up the main table without its default routes, so
+	// more specific routes of the host are used before the routes to peers
+	suppressRulePriority = 32764
+	// tableRulePriority - priority of the rule looking up the netmaker table for packets not sent by the
+	// interface itself, so encapsulated packets never loop back into the tunnel
+	tableRulePriority = 32765
+)
+
+// ruleList - lists the rules of a family, replaced by tests
+var ruleList = netlink.RuleList
+
+// ruleAdd - adds a rule, replaced by tests
+var ruleAdd = netlink.RuleAdd
+
+// ruleDel - deletes a rule, replaced by tests
+var ruleDel = netlink.RuleDel
+
+// routeTable - the routing table of the routes to peers
+func routeTable() int {
+	if table := config.Netclient().RouteTable; table > 0 {
+		return table
+	}
+	return defaultRouteTable
+}
+
+// firewallMark - the fwmark set on the packets sent by the netmaker interface
+func firewallMark() int {
+	if mark := config.Netclient().FirewallMark; mark > 0 {
+		return mark
+	}
+	return defaultFirewallMark
+}
+
+// policyRules - the rules sending the traffic of a family to the netmaker table, like wg-quick
+func policyRules(family, table, mark int) []netlink.Rule {
+	suppress := netlink.NewRule()
+	suppress.Family = family
+	suppress.Priority = suppressRulePriority
+	suppress.Table = unix.RT_TABLE_MAIN
+	suppress.SuppressPrefixlen = 0
+	lookup := netlink.NewRule()
+	lookup.Family = family
+	lookup.Priority = tableRulePriority
+	lookup.Table = table
+	lookup.Mark = mark
+	lookup.Invert = true
+	return []netlink.Rule{*suppress, *lookup}
+}
+
+// installedTable and installedMark - table and fwmark of the rules last installed by netclient, so its rules are
+// recognised after the table or fwmark changed; guarded by gatewayMutex
+var installedTable, installedMark int
+
+// setPolicyRules - installs the rules of the netmaker table for ipv4 and ipv6, replacing outdated ones
+// the rules keeping the exclusions on the uplink and sending the traffic to the dns servers through the tunnel are
+// installed as well; rules that are already in place are kept, so it can be called on every configuration
+func setPolicyRules(table, mark int, exclusions, dns []net.IP) error {
+	owner := ruleOwner{tables: []int{table, installedTable}, marks: []int{mark, installedMark}}
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules := append(policyRules(family, table, mark), gatewayRules(family, table, exclusions, dns)...)
+		if err := reconcileRules(family, rules, owner); err != nil {
+			if family == netlink.FAMILY_V4 {
+				return fmt.Errorf("failed to set ipv4 rules %w", err)
+			}
+			// hosts with ipv6 disabled have no rules to set
+			logger.Log(1, "failed to set ipv6 rules", err.Error())
+		}
+	}
+	installedTable, installedMark = table, mark
+	return nil
+}
+
+// removePolicyRules - removes the rules of the netmaker table for ipv4 and ipv6
+func removePolicyRules() {
+	owner := ruleOwner{tables: []int{routeTable(), installedTable}, marks: []int{firewallMark(), installedMark}}
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		if err := reconcileRules(family, nil, owner); err != nil {
+			logger.Log(1, "failed to remove rules of the netmaker table", err.Error())
+		}
+	}
+	installedTable, installedMark = 0, 0
+}
+
+// ruleOwner - the tables and fwmarks of the rules added by netclient
+type ruleOwner struct {
+	tables []int
+	marks  []int
+}
+
+// ruleOwner.owns - checks if a rule at the priorities used by netclient was added by netclient: it looks up the
+// netmaker table, carries its fwmark, or is an exclusion or suppress rule; other rules, eg. the rules wg-quick adds
+// for its own table at the same priorities, are left alone
+func (o ruleOwner) owns(rule *netlink.Rule) bool {
+	for _, table := range o.tables {
+		if table > 0 && rule.Table == table {
+			return true
+		}
+	}
+	for _, mark := range o.marks {
+		if mark > 0 && rule.Mark == mark {
+			return true
+		}
+	}
+	switch rule.Priority {
+	case exclusionRulePriority:
+		return rule.Table == unix.RT_TABLE_MAIN && rule.Dst != nil && isHostRange(rule.Dst)
+	case suppressRulePriority:
+		return rule.Table == unix.RT_TABLE_MAIN && rule.SuppressPrefixlen == 0
+	}
+	return false
+}
+
+// isHostRange - checks if a range holds a single address
+func isHostRange(ipNet *net.IPNet) bool {
+	ones, bits := ipNet.Mask.Size()
+	return bits > 0 && ones == bits
+}
+
+// reconcileRules - makes the rules of a family added by netclient match desired
+// netclient uses the priorities from exclusionRulePriority to tableRulePriority, right before the main table; rules
+// at these priorities not owned by netclient are kept, as are copies of a rule netclient adds, which another
+// program may have added as well: only one copy is removed
+func reconcileRules(family int, desired []netlink.Rule, owner ruleOwner) error {
+	current, err := ruleList(family)
+	if err != nil {
+		return err
+	}
+	present := make([]bool, len(desired))
+	var removed []netlink.Rule
+	for i := range current {
+		rule := current[i]
+		if rule.Priority < exclusionRulePriority || rule.Priority > tableRulePriority || !owner.owns(&rule) {
+			continue
+		}
+		kept := false
+		for j := range desired {
+			if sameRule(&rule, &desired[j]) {
+				present[j], kept = true, true
+				break
+			}
+		}
+		for j := range removed {
+			if sameRule(&rule, &removed[j]) {
+				kept = true
+				break
+			}
+		}
+		if kept {
+			continue
+		}
+		rule.Family = family
+		logger.Log(3, "removing outdated rule", rule.String())
+		if err := ruleDel(&rule); err != nil {
+			return err
+		}
+		removed = append(removed, rule)
+	}
+	for j := range desired {
+		if present[j] {
+			continue
+		}
+		logger.Log(3, "adding rule", desired[j].String())
+		if err := ruleAdd(&desired[j]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameRule - checks if two rules match the same packets and look up the same table
+func sameRule(a, b *netlink.Rule) bool {
+	return a.Priority == b.Priority && a.Table == b.Table && a.Mark == b.Mark && a.Invert == b.Invert &&
+		a.SuppressPrefixlen == b.SuppressPrefixlen && ipNetString(a.Dst) == ipNetString(b.Dst)
+}
+
+// ipNetString - a range as text, empty if there is none
+func ipNetString(ipNet *net.IPNet) string {
+	if ipNet == nil {
+		return ""
+	}
+	return canonicalIPNet(*ipNet)
+}
+
+// linkRoutes - the ipv4 and ipv6 routes through a link in all tables, default routes with their destination set
+func linkRoutes(l netlink.Link) ([]netlink.Route, error) {
+	var routes []netlink.Route
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		familyRoutes, err := netlink.RouteListFiltered(family, &netlink.Route{LinkIndex: l.Attrs().Index},
+			netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return nil, err
+		}
+		for i := range familyRoutes {
+			if familyRoutes[i].Dst == nil {
+				familyRoutes[i].Dst = defaultRoute(family)
+			}
+		}
+		routes = append(routes, familyRoutes...)
+	}
+	return routes, nil
+}
+
+// defaultRoute - the default route of a family
+func defaultRoute(family int) *net.IPNet {
+	if family == netlink.FAMILY_V6 {
+		return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	}
+	return &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+}
+
+// diffRoutes - the routes through the link to delete and the destinations to add, so the netmaker table holds
+// the desired routes and no other table has routes added by netclient; routes the kernel added for the
+// addresses of the link are kept
+func diffRoutes(current []netlink.Route, desired []net.IPNet, table int) ([]netlink.Route, []net.IPNet) {
+	wanted := make(map[string]bool, len(desired))
+	for _, dst := range desired {
+		wanted[canonicalIPNet(dst)] = true
+	}
+	var remove []netlink.Route
+	present := make(map[string]bool)
+	for _, route := range current {
+		if route.Protocol == unix.RTPROT_KERNEL || route.Table == unix.RT_TABLE_LOCAL {
+			continue
+		}
+		key := canonicalIPNet(*route.Dst)
+		if route.Table == table && wanted[key] && !present[key] {
+			present[key] = true
+			continue
+		}
+		remove = append(remove, route)
+	}
+	var add []net.IPNet
+	for _, dst := range desired {
+		key := canonicalIPNet(dst)
+		if !present[key] {
+			present[key] = true
+			add = append(add, dst)
+		}
+	}
+	return remove, add
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package wireguard
+
+// firewallMark - the fwmark set on the packets sent by the netmaker interface, only used on linux
+func firewallMark() int {
+	return 0
+}
+
+// RemoveKillSwitch - removes the kill switch left after the interface was closed, only used on linux
+func RemoveKillSwitch() {}
+
+// RefreshGatewayExclusions - updates the addresses kept off the internet gateway, only used on linux
+func RefreshGatewayExclusions() {}
@@ -0,0 +1,163 @@
+package wireguard
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gravitl/netclient/ncutils"
+	"github.com/gravitl/netmaker/logger"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// peersMutex - serializes reading and changing the peers of the device, so concurrent reconciliations do not act
+// on a stale view of the device
+var peersMutex = sync.Mutex{}
+
+// devicePeers - reads the peers of the netmaker interface, replaced by tests
+var devicePeers = GetDevicePeers
+
+// configurePeers - applies peer changes to the netmaker interface, replaced by tests
+var configurePeers = func(peers []wgtypes.PeerConfig, replace bool) error {
+	return apply(nil, &wgtypes.Config{ReplacePeers: replace, Peers: peers})
+}
+
+// reconcilePeers - makes the peers of the netmaker interface match desired, changing only the peers that differ
+// all peers are replaced if the device can not be read
+func reconcilePeers(desired []wgtypes.PeerConfig) error {
+	peersMutex.Lock()
+	defer peersMutex.Unlock()
+	current, err := devicePeers(ncutils.GetInterfaceName())
+	if err != nil {
+		logger.Log(1, "could not read peers of the interface, replacing all peers", err.Error())
+		return configurePeers(desired, true)
+	}
+	changes := diffPeers(current, desired)
+	if len(changes) == 0 {
+		return nil
+	}
+	logger.Log(3, "applying", strconv.Itoa(len(changes)), "peer changes to the interface")
+	return configurePeers(changes, false)
+}
+
+// diffPeers - the peer changes making the current peers of a device match the desired peers, ordered by public key
+// peers not desired are removed, new peers are added, and only the endpoint, keepalive, preshared key and
+// allowed ips that differ are set for existing peers; allowed ips are added when none were removed and replaced
+// otherwise, as the device can not remove a single allowed ip
+func diffPeers(current []wgtypes.Peer, desired []wgtypes.PeerConfig) []wgtypes.PeerConfig {
+	currentPeers := make(map[wgtypes.Key]*wgtypes.Peer, len(current))
+	for i := range current {
+		currentPeers[current[i].PublicKey] = &current[i]
+	}
+	desiredKeys := make(map[wgtypes.Key]bool, len(desired))
+	var changes []wgtypes.PeerConfig
+	for _, peer := range desired {
+		if desiredKeys[peer.PublicKey] {
+			continue // the first config of a peer wins
+		}
+		desiredKeys[peer.PublicKey] = true
+		existing, ok := currentPeers[peer.PublicKey]
+		if !ok {
+			peer.Remove = false
+			peer.UpdateOnly = false
+			peer.ReplaceAllowedIPs = true
+			changes = append(changes, peer)
+			continue
+		}
+		if change, changed := diffPeer(existing, &peer); changed {
+			changes = append(changes, change)
+		}
+	}
+	for _, peer := range current {
+		if !desiredKeys[peer.PublicKey] {
+			changes = append(changes, wgtypes.PeerConfig{PublicKey: peer.PublicKey, Remove: true})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return bytes.Compare(changes[i].PublicKey[:], changes[j].PublicKey[:]) < 0
+	})
+	return changes
+}
+
+// diffPeer - the change making an existing peer match its desired config, and whether anything differs
+func diffPeer(current *wgtypes.Peer, desired *wgtypes.PeerConfig) (wgtypes.PeerConfig, bool) {
+	change := wgtypes.PeerConfig{PublicKey: desired.PublicKey, UpdateOnly: true}
+	changed := false
+	if desired.Endpoint != nil && !sameEndpoint(current.Endpoint, desired.Endpoint) {
+		change.Endpoint = desired.Endpoint
+		changed = true
+	}
+	keepalive := time.Duration(0)
+	if desired.PersistentKeepaliveInterval != nil {
+		keepalive = *desired.PersistentKeepaliveInterval
+	}
+	if keepalive != current.PersistentKeepaliveInterval {
+		change.PersistentKeepaliveInterval = &keepalive
+		changed = true
+	}
+	presharedKey := wgtypes.Key{}
+	if desired.PresharedKey != nil {
+		presharedKey = *desired.PresharedKey
+	}
+	if presharedKey != current.PresharedKey {
+		change.PresharedKey = &presharedKey
+		changed = true
+	}
+	added, removed := diffAllowedIPs(current.AllowedIPs, desired.AllowedIPs)
+	switch {
+	case removed:
+		change.ReplaceAllowedIPs = true
+		change.AllowedIPs = desired.AllowedIPs
+		changed = true
+	case len(added) > 0:
+		change.AllowedIPs = added
+		changed = true
+	}
+	return change, changed
+}
+
+// diffAllowedIPs - the desired allowed ips a peer does not have yet, and whether it has any that are not desired
+func diffAllowedIPs(current, desired []net.IPNet) (added []net.IPNet, removed bool) {
+	currentIPs := make(map[string]bool, len(current))
+	for _, ipNet := range current {
+		currentIPs[canonicalIPNet(ipNet)] = true
+	}
+	desiredIPs := make(map[string]bool, len(desired))
+	for _, ipNet := range desired {
+		key := canonicalIPNet(ipNet)
+		if desiredIPs[key] {
+			continue
+		}
+		desiredIPs[key] = true
+		if !currentIPs[key] {
+			added = append(added, ipNet)
+		}
+	}
+	for key := range currentIPs {
+		if !desiredIPs[key] {
+			return added, true
+		}
+	}
+	return added, false
+}
+
+// canonicalIPNet - a range as text with its host bits cleared and ipv4 in 4 byte form, as reported by the device
+func canonicalIPNet(ipNet net.IPNet) string {
+	ip := ipNet.IP
+	if ip4 := ip.To4(); ip4 != nil && len(ipNet.Mask) == net.IPv4len {
+		ip = ip4
+	}
+	masked := net.IPNet{IP: ip.Mask(ipNet.Mask), Mask: ipNet.Mask}
+	return masked.String()
+}
+
+// sameEndpoint - checks if two endpoints have the same address and port
+func sameEndpoint(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
@@ -0,0 +1,189 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// testKey - a public key derived from n
+func testKey(n int) wgtypes.Key {
+	return wgtypes.Key{byte(n >> 8), byte(n), 1}
+}
+
+// testPeer - the desired config of peer n, with an endpoint and its address as allowed ip
+func testPeer(n int) wgtypes.PeerConfig {
+	keepalive := time.Second * 20
+	return wgtypes.PeerConfig{
+		PublicKey:                   testKey(n),
+		Endpoint:                    &net.UDPAddr{IP: net.IPv4(203, 0, 113, byte(n)), Port: 51821},
+		PersistentKeepaliveInterval: &keepalive,
+		AllowedIPs:                  []net.IPNet{testIPNet(fmt.Sprintf("10.0.%d.%d/32", n>>8, n&0xff))},
+	}
+}
+
+// devicePeer - a peer as reported by the device for a desired config
+func devicePeer(p wgtypes.PeerConfig) wgtypes.Peer {
+	peer := wgtypes.Peer{PublicKey: p.PublicKey, AllowedIPs: p.AllowedIPs}
+	if p.Endpoint != nil {
+		endpoint := *p.Endpoint
+		endpoint.IP = endpoint.IP.To16() // the device reports ipv4 endpoints in 16 byte form
+		peer.Endpoint = &endpoint
+	}
+	if p.PersistentKeepaliveInterval != nil {
+		peer.PersistentKeepaliveInterval = *p.PersistentKeepaliveInterval
+	}
+	return peer
+}
+
+func testIPNet(cidr string) net.IPNet {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return *ipNet
+}
+
+func TestDiffPeers(t *testing.T) {
+	t.Run("unchanged", func(t *testing.T) {
+		is := is.New(t)
+		desired := []wgtypes.PeerConfig{testPeer(1), testPeer(2)}
+		current := []wgtypes.Peer{devicePeer(desired[1]), devicePeer(desired[0])}
+		is.Equal(len(diffPeers(current, desired)), 0)
+	})
+	t.Run("added and removed", func(t *testing.T) {
+		is := is.New(t)
+		current := []wgtypes.Peer{devicePeer(testPeer(1)), devicePeer(testPeer(2))}
+		changes := diffPeers(current, []wgtypes.PeerConfig{testPeer(2), testPeer(3)})
+		is.Equal(len(changes), 2)
+		is.Equal(changes[0], wgtypes.PeerConfig{PublicKey: testKey(1), Remove: true})
+		added := testPeer(3)
+		added.ReplaceAllowedIPs = true
+		is.Equal(changes[1], added)
+	})
+	t.Run("endpoint and keepalive", func(t *testing.T) {
+		is := is.New(t)
+		current := []wgtypes.Peer{devicePeer(testPeer(1))}
+		desired := testPeer(1)
+		desired.Endpoint = &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 51822}
+		keepalive := time.Duration(0)
+		desired.PersistentKeepaliveInterval = nil
+		changes := diffPeers(current, []wgtypes.PeerConfig{desired})
+		is.Equal(changes, []wgtypes.PeerConfig{{
+			PublicKey:                   testKey(1),
+			UpdateOnly:                  true,
+			Endpoint:                    desired.Endpoint,
+			PersistentKeepaliveInterval: &keepalive,
+		}})
+		// an endpoint learned by the device is kept when none is desired
+		desired = testPeer(1)
+		desired.Endpoint = nil
+		is.Equal(len(diffPeers(current, []wgtypes.PeerConfig{desired})), 0)
+	})
+	t.Run("allowed ips added", func(t *testing.T) {
+		is := is.New(t)
+		current := []wgtypes.Peer{devicePeer(testPeer(1))}
+		desired := testPeer(1)
+		egress := testIPNet("192.168.10.0/24")
+		desired.AllowedIPs = append(desired.AllowedIPs, egress)
+		changes := diffPeers(current, []wgtypes.PeerConfig{desired})
+		is.Equal(len(changes), 1)
+		is.True(!changes[0].ReplaceAllowedIPs)
+		is.Equal(changes[0].AllowedIPs, []net.IPNet{egress}) // only the new range
+		is.Equal(changes[0].Endpoint, nil)
+		is.Equal(changes[0].PersistentKeepaliveInterval, nil)
+	})
+	t.Run("allowed ips removed", func(t *testing.T) {
+		is := is.New(t)
+		previous := testPeer(1)
+		previous.AllowedIPs = append(previous.AllowedIPs, testIPNet("192.168.10.0/24"))
+		current := []wgtypes.Peer{devicePeer(previous)}
+		desired := testPeer(1)
+		changes := diffPeers(current, []wgtypes.PeerConfig{desired})
+		is.Equal(len(changes), 1)
+		is.True(changes[0].ReplaceAllowedIPs)
+		is.Equal(changes[0].AllowedIPs, desired.AllowedIPs)
+	})
+	t.Run("allowed ips compared as ranges", func(t *testing.T) {
+		is := is.New(t)
+		current := testPeer(1)
+		current.AllowedIPs = []net.IPNet{testIPNet("10.0.0.0/24")}
+		desired := testPeer(1)
+		// host bits set and ipv4 in 16 byte form as sent by the server
+		desired.AllowedIPs = []net.IPNet{{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(24, 32)}}
+		is.Equal(len(diffPeers([]wgtypes.Peer{devicePeer(current)}, []wgtypes.PeerConfig{desired})), 0)
+	})
+	t.Run("preshared key", func(t *testing.T) {
+		is := is.New(t)
+		current := devicePeer(testPeer(1))
+		current.PresharedKey = wgtypes.Key{9}
+		changes := diffPeers([]wgtypes.Peer{current}, []wgtypes.PeerConfig{testPeer(1)})
+		is.Equal(len(changes), 1)
+		is.Equal(*changes[0].PresharedKey, wgtypes.Key{}) // removed
+	})
+}
+
+func TestReconcilePeers(t *testing.T) {
+	is := is.New(t)
+	readFn, configureFn := devicePeers, configurePeers
+	defer func() { devicePeers, configurePeers = readFn, configureFn }()
+	device := []wgtypes.Peer{devicePeer(testPeer(1)), devicePeer(testPeer(2))}
+	var readErr error
+	devicePeers = func(string) ([]wgtypes.Peer, error) { return device, readErr }
+	var applied [][]wgtypes.PeerConfig
+	var replaced []bool
+	configurePeers = func(peers []wgtypes.PeerConfig, replace bool) error {
+		applied = append(applied, peers)
+		replaced = append(replaced, replace)
+		return nil
+	}
+
+	is.NoErr(reconcilePeers([]wgtypes.PeerConfig{testPeer(1), testPeer(2)}))
+	is.Equal(len(applied), 0) // nothing changed, nothing applied
+
+	is.NoErr(reconcilePeers([]wgtypes.PeerConfig{testPeer(1)}))
+	is.Equal(applied[0], []wgtypes.PeerConfig{{PublicKey: testKey(2), Remove: true}})
+	is.Equal(replaced[0], false)
+
+	// all peers are replaced if the device can not be read
+	readErr = errors.New("no such device")
+	desired := []wgtypes.PeerConfig{testPeer(3)}
+	is.NoErr(reconcilePeers(desired))
+	is.Equal(applied[1], desired)
+	is.Equal(replaced[1], true)
+}
+
+// benchmarkPeers - desired peers and the device peers of a mesh of n peers where every tenth peer changed
+func benchmarkPeers(n int) ([]wgtypes.Peer, []wgtypes.PeerConfig) {
+	current := make([]wgtypes.Peer, 0, n)
+	desired := make([]wgtypes.PeerConfig, 0, n)
+	for i := 0; i < n; i++ {
+		peer := testPeer(i)
+		peer.AllowedIPs = append(peer.AllowedIPs, testIPNet(fmt.Sprintf("172.16.%d.0/24", i&0xff)))
+		current = append(current, devicePeer(peer))
+		if i%10 == 0 {
+			peer.Endpoint = &net.UDPAddr{IP: net.IPv4(198, 51, 100, byte(i)), Port: 51821}
+		}
+		desired = append(desired, peer)
+	}
+	return current, desired
+}
+
+func BenchmarkDiffPeers(b *testing.B) {
+	for _, n := range []int{100, 1000, 5000} {
+		current, desired := benchmarkPeers(n)
+		b.Run(fmt.Sprintf("%d peers", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if changes := diffPeers(current, desired); len(changes) != (n+9)/10 {
+					b.Fatalf("%d changes", len(changes))
+				}
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/gravitl/netclient/config"
 	"github.com/gravitl/netclient/ncutils"
 	"github.com/gravitl/netclient/nmproxy/peer"
+	"github.com/gravitl/netclient/policy"
 	"github.com/gravitl/netmaker/logger"
 	"github.com/gravitl/netmaker/logic"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
@@ -26,8 +27,8 @@ var wgMutex = sync.Mutex{} // used to mutex functions of the interface
 
 // NewNCIFace - creates a new Netclient interface in memory
 func NewNCIface(host *config.Config, nodes config.NodeMap) *NCIface {
-	firewallMark := 0
-	peers := config.GetHostPeerList()
+	mark := firewallMark()
+	peers := policy.HostPeers()
 	addrs := []ifaceAddress{}
 	for _, node := range nodes {
 		if node.Address.IP != nil {
@@ -55,9 +56,8 @@ func NewNCIface(host *config.Config, nodes config.NodeMap) *NCIface {
 		Addresses: addrs,
 		Config: wgtypes.Config{
 			PrivateKey:   &host.PrivateKey,
-			FirewallMark: &firewallMark,
+			FirewallMark: &mark,
 			ListenPort:   &host.ListenPort,
-			ReplacePeers: true,
 			Peers:        peers,
 		},
 	}
@@ -90,7 +90,13 @@ func (n *NCIface) Configure() error {
 	if err := n.SetMTU(); err != nil {
 		return err
 	}
-	return apply(nil, &n.Config)
+	device := n.Config
+	device.ReplacePeers = false
+	device.Peers = nil
+	if err := apply(nil, &device); err != nil {
+		return err
+	}
+	return reconcilePeers(n.Config.Peers)
 }
 
 func (nc *NCIface) getPeerRoutes() {
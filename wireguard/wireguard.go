@@ -9,23 +9,21 @@ import (
 	"github.com/gravitl/netclient/config"
 	"github.com/gravitl/netclient/ncutils"
 	"github.com/gravitl/netclient/nmproxy/peer"
+	"github.com/gravitl/netclient/policy"
 	"github.com/gravitl/netmaker/logger"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"gopkg.in/ini.v1"
 )
 
-// SetPeers - sets peers on netmaker WireGuard interface
+// SetPeers - sets peers on netmaker WireGuard interface, changing only the peers that differ from the device
+// the allowed ips of the peers are filtered by the split-tunnel policy of the host
 func SetPeers() error {
-	peers := config.GetHostPeerList()
+	peers := policy.HostPeers()
 	if config.Netclient().ProxyEnabled && len(peers) > 0 {
 		peers = peer.SetPeersEndpointToProxy(peers)
 	}
-	config := wgtypes.Config{
-		ReplacePeers: true,
-		Peers:        peers,
-	}
-	return apply(nil, &config)
+	return reconcilePeers(peers)
 }
 
 // GetDevicePeers - gets the current device's peers
@@ -57,11 +55,11 @@ func Configure() error {
 	wgMutex.Lock()
 	defer wgMutex.Unlock()
 	host := config.Netclient()
-	firewallMark := 0
+	mark := firewallMark()
 	config := wgtypes.Config{
 		PrivateKey:   &host.PrivateKey,
 		ReplacePeers: true,
-		FirewallMark: &firewallMark,
+		FirewallMark: &mark,
 		ListenPort:   &host.ListenPort,
 	}
 	return apply(nil, &config)
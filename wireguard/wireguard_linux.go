@@ -1,50 +1,48 @@
 package wireguard
 
 import (
-	"fmt"
+	"errors"
 	"net"
 	"os"
 
+	"github.com/gravitl/netclient/config"
 	"github.com/gravitl/netmaker/logger"
 	"github.com/vishvananda/netlink"
 )
 
+// kernelWireGuardPresent - checks if kernel wireguard is available, replaced by tests
+var kernelWireGuardPresent = isKernelWireGuardPresent
+
+// tunAvailable - checks if tun devices can be created for userspace wireguard, replaced by tests
+var tunAvailable = isTunModuleLoaded
+
 // NCIface.Create - creates a linux WG interface based on a node's host config
+// kernel wireguard is used if available, wireguard-go on a tun device otherwise, unless a mode is forced
 func (nc *NCIface) Create() error {
-	if isKernelWireGuardPresent() {
-		newLink := nc.getKernelLink()
-		if newLink == nil {
-			return fmt.Errorf("failed to create kernel interface")
-		}
-		nc.Iface = newLink
-		l, err := netlink.LinkByName(nc.Name)
-		if err != nil {
-			switch err.(type) {
-			case netlink.LinkNotFoundError:
-				break
-			default:
-				return err
-			}
-		}
-		if l != nil {
-			err = netlink.LinkDel(newLink)
-			if err != nil {
-				return err
-			}
-		}
-		if err = netlink.LinkAdd(newLink); err != nil && !os.IsExist(err) {
-			return err
-		}
-		if err = netlink.LinkSetUp(newLink); err != nil {
-			return err
-		}
-		return nil
-	} else if isTunModuleLoaded() {
+	userspace, err := useUserspace(GetMode())
+	if err != nil {
+		return err
+	}
+	if u, ok := nc.Iface.(*userspaceIface); ok {
+		u.Close()
+	}
+	if err := deleteLink(nc.Name); err != nil {
+		return err
+	}
+	if userspace {
+		logger.Log(0, "using userspace wireguard for", nc.Name)
 		if err := nc.createUserSpaceWG(); err != nil {
 			return err
 		}
+		return netlink.LinkSetUp(nc.getKernelLink())
+	}
+	logger.Log(3, "using kernel wireguard for", nc.Name)
+	newLink := nc.getKernelLink()
+	nc.Iface = newLink
+	if err = netlink.LinkAdd(newLink); err != nil && !os.IsExist(err) {
+		return err
 	}
-	return fmt.Errorf("WireGuard not detected")
+	return netlink.LinkSetUp(newLink)
 }
 
 // NCIface.SetMTU - sets the mtu for the interface
@@ -68,6 +66,11 @@ func (l *netLink) Type() string {
 
 // NCIface.Close closes netmaker interface
 func (n *NCIface) Close() {
+	closeGateway()
+	if u, ok := n.Iface.(*userspaceIface); ok {
+		u.Close()
+		return
+	}
 	link := n.getKernelLink()
 	link.Close()
 }
@@ -78,6 +81,8 @@ func (l *netLink) Close() error {
 }
 
 // netLink.ApplyAddrs - applies the assigned node addresses to given interface (netLink)
+// routes to peers are put in the netmaker table, which is looked up by policy rules for packets not sent by the
+// interface itself; addresses and routes already in place are kept
 func (nc *NCIface) ApplyAddrs() error {
 	l := nc.getKernelLink()
 
@@ -85,50 +90,103 @@ func (nc *NCIface) ApplyAddrs() error {
 	if err != nil {
 		return err
 	}
-	routes, err := netlink.RouteList(l, 0)
+	addrs := make(map[string]bool)
+	var dsts []net.IPNet
+	for _, addr := range nc.Addresses {
+		if addr.AddRoute {
+			dsts = append(dsts, addr.Network)
+		} else if addr.IP != nil {
+			addrs[(&net.IPNet{IP: addr.IP, Mask: addr.Network.Mask}).String()] = true
+		}
+	}
+	for i := range currentAddrs {
+		key := currentAddrs[i].IPNet.String()
+		if addrs[key] {
+			delete(addrs, key)
+			continue
+		}
+		if currentAddrs[i].IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if err = netlink.AddrDel(l, &currentAddrs[i]); err != nil {
+			return err
+		}
+	}
+	for _, addr := range nc.Addresses {
+		ipNet := &net.IPNet{IP: addr.IP, Mask: addr.Network.Mask}
+		if addr.AddRoute || addr.IP == nil || !addrs[ipNet.String()] {
+			continue
+		}
+		logger.Log(3, "adding address", addr.IP.String(), "to netmaker interface")
+		if err := netlink.AddrAdd(l, &netlink.Addr{IPNet: ipNet}); err != nil {
+			logger.Log(0, "error adding addr", err.Error())
+			return err
+		}
+		delete(addrs, ipNet.String())
+	}
+
+	routes, err := linkRoutes(l)
 	if err != nil {
 		return err
 	}
-
-	for i := range routes {
-		err = netlink.RouteDel(&routes[i])
-		if err != nil {
+	table := routeTable()
+	remove, add := diffRoutes(routes, dsts, table)
+	for i := range remove {
+		if err = netlink.RouteDel(&remove[i]); err != nil {
 			return err
 		}
 	}
-
-	if len(currentAddrs) > 0 {
-		for i := range currentAddrs {
-			err = netlink.AddrDel(l, &currentAddrs[i])
-			if err != nil {
-				return err
-			}
+	for i := range add {
+		logger.Log(3, "adding route", add[i].String(), "to netmaker interface")
+		if err := netlink.RouteReplace(&netlink.Route{
+			LinkIndex: l.Attrs().Index,
+			Dst:       &add[i],
+			Table:     table,
+		}); err != nil {
+			logger.Log(0, "error adding route", err.Error())
+			return err
 		}
 	}
-	for _, addr := range nc.Addresses {
-		if !addr.AddRoute && addr.IP != nil {
-			logger.Log(3, "adding address", addr.IP.String(), "to netmaker interface")
-			if err := netlink.AddrAdd(l, &netlink.Addr{IPNet: &net.IPNet{IP: addr.IP, Mask: addr.Network.Mask}}); err != nil {
-				logger.Log(0, "error adding addr", err.Error())
-				return err
-			}
+	killSwitch := config.Netclient().KillSwitch
+	return setGateway(table, firewallMark(), nextGatewayState(fullTunnel(dsts), killSwitch, gatewayRecorded()), killSwitch)
+}
+
+// == private ==
+
+// useUserspace - whether the netmaker interface is a userspace device in the given mode
+func useUserspace(mode Mode) (bool, error) {
+	switch mode {
+	case ModeKernel:
+		if !kernelWireGuardPresent() {
+			return false, errors.New("kernel WireGuard not detected")
 		}
-		if addr.AddRoute {
-			logger.Log(3, "adding route", addr.IP.String(), "to netmaker interface")
-			if err := netlink.RouteAdd(&netlink.Route{
-				LinkIndex: l.Attrs().Index,
-				Dst:       &addr.Network,
-			}); err != nil {
-				logger.Log(0, "error adding addr", err.Error())
-				return err
-			}
+		return false, nil
+	case ModeUserspace:
+		if !tunAvailable() {
+			return false, errors.New("tun device not available for userspace WireGuard")
 		}
-
+		return true, nil
 	}
-	return nil
+	if kernelWireGuardPresent() {
+		return false, nil
+	}
+	if tunAvailable() {
+		return true, nil
+	}
+	return false, errors.New("WireGuard not detected")
 }
 
-// == private ==
+// deleteLink - deletes a link left by a previous interface with the given name, if any
+func deleteLink(name string) error {
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	return netlink.LinkDel(l)
+}
 
 type netLink struct {
 	attrs *netlink.LinkAttrs
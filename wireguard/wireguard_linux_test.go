@@ -0,0 +1,388 @@
+package wireguard
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/gravitl/netclient/config"
+	"github.com/matryer/is"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseMode(t *testing.T) {
+	is := is.New(t)
+	for _, mode := range []string{"", "auto"} {
+		m, err := ParseMode(mode)
+		is.NoErr(err)
+		is.Equal(m, ModeAuto)
+	}
+	m, err := ParseMode("userspace")
+	is.NoErr(err)
+	is.Equal(m, ModeUserspace)
+	_, err = ParseMode("boringtun")
+	is.True(err != nil)
+
+	state := config.Snapshot()
+	defer func() {
+		config.Replace(state)
+		SetMode("")
+	}()
+	config.UpdateNetclient(config.Config{WireGuardMode: "kernel"})
+	is.Equal(GetMode(), ModeKernel)
+	SetMode(ModeUserspace) // the daemon flag wins over the host config
+	is.Equal(GetMode(), ModeUserspace)
+}
+
+func TestUseUserspace(t *testing.T) {
+	kernelFn, tunFn := kernelWireGuardPresent, tunAvailable
+	defer func() { kernelWireGuardPresent, tunAvailable = kernelFn, tunFn }()
+	tests := []struct {
+		name      string
+		mode      Mode
+		kernel    bool
+		tun       bool
+		userspace bool
+		fails     bool
+	}{
+		{name: "auto with kernel", mode: ModeAuto, kernel: true, tun: true},
+		{name: "auto without kernel", mode: ModeAuto, tun: true, userspace: true},
+		{name: "auto without either", mode: ModeAuto, fails: true},
+		{name: "kernel", mode: ModeKernel, kernel: true, tun: true},
+		{name: "kernel missing", mode: ModeKernel, tun: true, fails: true},
+		{name: "userspace with kernel", mode: ModeUserspace, kernel: true, tun: true, userspace: true},
+		{name: "userspace without tun", mode: ModeUserspace, kernel: true, fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			kernelWireGuardPresent = func() bool { return tt.kernel }
+			tunAvailable = func() bool { return tt.tun }
+			userspace, err := useUserspace(tt.mode)
+			is.Equal(err != nil, tt.fails)
+			is.Equal(userspace, tt.userspace)
+		})
+	}
+}
+
+func TestReconcileRules(t *testing.T) {
+	is := is.New(t)
+	listFn, addFn, delFn := ruleList, ruleAdd, ruleDel
+	defer func() { ruleList, ruleAdd, ruleDel = listFn, addFn, delFn }()
+	mainRule := netlink.NewRule()
+	mainRule.Priority = 32766
+	mainRule.Table = unix.RT_TABLE_MAIN
+	// rules of wg-quick and of the admin at the priorities used by netclient
+	wgQuick := policyRules(netlink.FAMILY_V4, 51820, 51820)
+	wgQuick[1].Mask = 0xffffffff
+	subnet := testIPNet("10.20.0.0/16")
+	lan := netlink.NewRule()
+	lan.Priority = exclusionRulePriority
+	lan.Table = unix.RT_TABLE_MAIN
+	lan.Dst = &subnet
+	outdated := policyRules(netlink.FAMILY_V4, 100, 100)[1]
+	outdated.Mask = 0xffffffff // as listed by the kernel
+	rules := []netlink.Rule{*mainRule, wgQuick[1], *lan, outdated}
+	ruleList = func(family int) ([]netlink.Rule, error) {
+		return append([]netlink.Rule{}, rules...), nil
+	}
+	ruleAdd = func(rule *netlink.Rule) error {
+		rules = append(rules, *rule)
+		return nil
+	}
+	ruleDel = func(rule *netlink.Rule) error {
+		for i := range rules {
+			if sameRule(&rules[i], rule) {
+				rules = append(rules[:i], rules[i+1:]...)
+				return nil
+			}
+		}
+		t.Fatalf("deleted missing rule %s", rule)
+		return nil
+	}
+	owner := ruleOwner{tables: []int{defaultRouteTable, 100}, marks: []int{defaultFirewallMark, 100}}
+
+	desired := policyRules(netlink.FAMILY_V4, defaultRouteTable, defaultFirewallMark)
+	is.NoErr(reconcileRules(netlink.FAMILY_V4, desired, owner))
+	is.Equal(len(rules), 5) // the rule of the old table was replaced, the foreign rules kept
+	is.True(sameRule(&rules[0], mainRule))
+	is.True(sameRule(&rules[1], &wgQuick[1]))
+	is.True(sameRule(&rules[2], lan))
+	is.True(sameRule(&rules[3], &desired[0]))
+	is.True(sameRule(&rules[4], &desired[1]))
+
+	ruleAdd = func(rule *netlink.Rule) error {
+		t.Fatalf("added existing rule %s", rule)
+		return nil
+	}
+	// wg-quick adds the same suppress rule as netclient
+	rules = append(rules, wgQuick[0])
+	is.NoErr(reconcileRules(netlink.FAMILY_V4, desired, owner)) // nothing changes
+	is.Equal(len(rules), 6)
+
+	is.NoErr(reconcileRules(netlink.FAMILY_V4, nil, owner))
+	is.Equal(len(rules), 4) // one copy of the suppress rule is kept
+	is.True(sameRule(&rules[0], mainRule))
+	is.True(sameRule(&rules[1], &wgQuick[1]))
+	is.True(sameRule(&rules[2], lan))
+	is.True(sameRule(&rules[3], &wgQuick[0]))
+}
+
+func TestDiffRoutes(t *testing.T) {
+	is := is.New(t)
+	route := func(cidr string, table, protocol int) netlink.Route {
+		dst := testIPNet(cidr)
+		return netlink.Route{Dst: &dst, Table: table, Protocol: protocol}
+	}
+	current := []netlink.Route{
+		route("10.10.0.0/16", unix.RT_TABLE_MAIN, unix.RTPROT_KERNEL),  // subnet of an address
+		route("10.10.0.1/32", unix.RT_TABLE_LOCAL, unix.RTPROT_KERNEL), // the address itself
+		route("192.168.1.0/24", unix.RT_TABLE_MAIN, unix.RTPROT_BOOT),  // added by older versions
+		route("192.168.2.0/24", defaultRouteTable, unix.RTPROT_BOOT),   // still desired
+		route("192.168.3.0/24", defaultRouteTable, unix.RTPROT_BOOT),   // no longer desired
+		route("fd00:10::/64", 100, unix.RTPROT_BOOT),                   // in a previous table
+		route("0.0.0.0/0", defaultRouteTable, unix.RTPROT_BOOT),        // still desired
+	}
+	desired := []net.IPNet{
+		testIPNet("192.168.2.0/24"),
+		testIPNet("192.168.1.0/24"),
+		testIPNet("fd00:10::/64"),
+		{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+	}
+	remove, add := diffRoutes(current, desired, defaultRouteTable)
+	is.Equal(remove, []netlink.Route{current[2], current[4], current[5]})
+	is.Equal(add, []net.IPNet{desired[1], desired[2]})
+}
+
+func TestGatewayRules(t *testing.T) {
+	is := is.New(t)
+	is.True(!fullTunnel([]net.IPNet{testIPNet("192.168.1.0/24"), testIPNet("fd00::/8")}))
+	is.True(fullTunnel([]net.IPNet{testIPNet("192.168.1.0/24"), testIPNet("::/0")}))
+	is.True(fullTunnel([]net.IPNet{testIPNet("0.0.0.0/1"), testIPNet("128.0.0.0/2")}))
+
+	exclusions := []net.IP{net.ParseIP("203.0.113.1"), net.ParseIP("2001:db8::1")}
+	dns := []net.IP{net.ParseIP("192.168.1.1")}
+	rules := gatewayRules(netlink.FAMILY_V4, defaultRouteTable, exclusions, dns)
+	is.Equal(len(rules), 2)
+	is.Equal(rules[0].Priority, exclusionRulePriority)
+	is.Equal(rules[0].Table, unix.RT_TABLE_MAIN)
+	is.Equal(rules[0].Dst.String(), "203.0.113.1/32")
+	is.Equal(rules[1].Priority, dnsRulePriority)
+	is.Equal(rules[1].Table, defaultRouteTable)
+	is.Equal(rules[1].Dst.String(), "192.168.1.1/32")
+	rules = gatewayRules(netlink.FAMILY_V6, defaultRouteTable, exclusions, dns)
+	is.Equal(len(rules), 1)
+	is.Equal(rules[0].Dst.String(), "2001:db8::1/128")
+}
+
+func TestParseNameservers(t *testing.T) {
+	is := is.New(t)
+	ips := parseNameservers([]byte(`# generated
+nameserver 192.168.1.1
+nameserver 127.0.0.53
+nameserver fe80::1%eth0
+nameserver 192.168.1.1
+search example.com
+`))
+	is.Equal(len(ips), 2)
+	is.Equal(ips[0].String(), "192.168.1.1")
+	is.Equal(ips[1].String(), "fe80::1")
+	is.Equal(len(parseNameservers([]byte("nameserver 127.0.0.53\n"))), 0) // only the stub resolver
+}
+
+func TestSplitNameservers(t *testing.T) {
+	is := is.New(t)
+	ips := []net.IP{
+		net.ParseIP("9.9.9.9"),
+		net.ParseIP("192.168.1.1"),
+		net.ParseIP("10.0.0.2"),
+		net.ParseIP("169.254.169.254"),
+		net.ParseIP("2620:fe::fe"),
+		net.ParseIP("fd00::1"),
+		net.ParseIP("fe80::1"),
+	}
+	tunnel, local := splitNameservers(ips)
+	is.Equal(ipsString(tunnel), "9.9.9.9,2620:fe::fe")
+	is.Equal(ipsString(local), "192.168.1.1,10.0.0.2,169.254.169.254,fd00::1,fe80::1")
+}
+
+func TestNextGatewayState(t *testing.T) {
+	tests := []struct {
+		name                           string
+		fullTunnel, killSwitch, record bool
+		state                          gatewayState
+	}{
+		{"no gateway", false, false, false, gatewayOff},
+		{"gateway", true, false, true, gatewayUp},
+		{"gateway with kill switch", true, true, true, gatewayUp},
+		{"gateway routes gone", false, false, true, gatewayOff},
+		{"gateway routes gone with kill switch", false, true, true, gatewayBlocked},
+		{"gateway left with kill switch", false, true, false, gatewayOff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(nextGatewayState(tt.fullTunnel, tt.killSwitch, tt.record), tt.state)
+		})
+	}
+}
+
+// gatewayTest - rules, kill switch routes and name resolution replaced for the gateway tests
+type gatewayTest struct {
+	rules      map[int][]netlink.Rule // by family
+	killSwitch bool
+	resolved   map[string][]net.IP
+}
+
+// newGatewayTest - replaces the rule and route functions, name resolution and the resolver config until the test ends
+func newGatewayTest(t *testing.T) *gatewayTest {
+	is := is.New(t)
+	g := &gatewayTest{
+		rules: make(map[int][]netlink.Rule),
+		resolved: map[string][]net.IP{
+			"api.netmaker.test":    {net.ParseIP("203.0.113.1")},
+			"broker.netmaker.test": {net.ParseIP("203.0.113.2")},
+		},
+	}
+	listFn, addFn, delFn, routeFn, lookupFn, resolvFn := ruleList, ruleAdd, ruleDel, routeKillSwitch, lookupIP, resolvConf
+	state := config.Snapshot()
+	t.Cleanup(func() {
+		ruleList, ruleAdd, ruleDel, routeKillSwitch, lookupIP, resolvConf = listFn, addFn, delFn, routeFn, lookupFn, resolvFn
+		currentGateway, currentKillSwitch = gatewayOff, false
+		config.Replace(state)
+	})
+	ruleList = func(family int) ([]netlink.Rule, error) {
+		return append([]netlink.Rule{}, g.rules[family]...), nil
+	}
+	ruleAdd = func(rule *netlink.Rule) error {
+		g.rules[rule.Family] = append(g.rules[rule.Family], *rule)
+		return nil
+	}
+	ruleDel = func(rule *netlink.Rule) error {
+		rules := g.rules[rule.Family]
+		for i := range rules {
+			if sameRule(&rules[i], rule) {
+				g.rules[rule.Family] = append(rules[:i], rules[i+1:]...)
+				return nil
+			}
+		}
+		t.Fatalf("deleted missing rule %s", rule)
+		return nil
+	}
+	routeKillSwitch = func(table int, on bool) error {
+		g.killSwitch = on
+		return nil
+	}
+	lookupIP = func(host string) ([]net.IP, error) {
+		return g.resolved[host], nil
+	}
+	resolv := filepath.Join(t.TempDir(), "resolv.conf")
+	is.NoErr(os.WriteFile(resolv, []byte("nameserver 192.168.1.1\nnameserver 9.9.9.9\n"), 0600))
+	resolvConf = []string{resolv}
+
+	server := config.Server{Name: "netmaker.test"}
+	server.API = "api.netmaker.test"
+	server.Broker = "broker.netmaker.test"
+	server.MQPort = "8883"
+	var node config.Node
+	node.Network = "net1"
+	node.InternetGateway = &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 51821}
+	host := config.Config{KillSwitch: true}
+	config.Replace(&config.State{
+		Host:    host,
+		Nodes:   config.NodeMap{"net1": node},
+		Servers: map[string]config.Server{"netmaker.test": server},
+	})
+	return g
+}
+
+// ipv4Rules - the sorted destinations of the ipv4 rules with the given priority
+func (g *gatewayTest) ipv4Rules(priority int) []string {
+	dsts := []string{}
+	for _, rule := range g.rules[netlink.FAMILY_V4] {
+		if rule.Priority == priority {
+			dsts = append(dsts, ipNetString(rule.Dst))
+		}
+	}
+	sort.Strings(dsts)
+	return dsts
+}
+
+// apply - configures the interface with or without routes to the gateway, as ApplyAddrs
+func (g *gatewayTest) apply(t *testing.T, fullTunnel bool) {
+	is := is.New(t)
+	killSwitch := config.Netclient().KillSwitch
+	is.NoErr(setGateway(defaultRouteTable, defaultFirewallMark, nextGatewayState(fullTunnel, killSwitch, gatewayRecorded()), killSwitch))
+}
+
+func TestKillSwitch(t *testing.T) {
+	is := is.New(t)
+	g := newGatewayTest(t)
+
+	// all traffic goes through the gateway, dns to public nameservers through the tunnel
+	g.apply(t, true)
+	is.Equal(currentGateway, gatewayUp)
+	is.True(g.killSwitch)
+	is.Equal(g.ipv4Rules(exclusionRulePriority), []string{"203.0.113.1/32", "203.0.113.2/32"})
+	is.Equal(g.ipv4Rules(dnsRulePriority), []string{"9.9.9.9/32"}) // the local nameserver stays local
+	is.Equal(len(g.ipv4Rules(tableRulePriority)), 1)
+
+	// the routes to the gateway are gone, the kill switch holds and the nameservers are reachable through the uplink
+	g.apply(t, false)
+	is.Equal(currentGateway, gatewayBlocked)
+	is.True(g.killSwitch)
+	is.Equal(g.ipv4Rules(exclusionRulePriority), []string{"192.168.1.1/32", "203.0.113.1/32", "203.0.113.2/32", "9.9.9.9/32"})
+	is.Equal(g.ipv4Rules(dnsRulePriority), []string{})
+	is.Equal(len(g.ipv4Rules(tableRulePriority)), 1)
+
+	// closing the interface, as when the daemon stops, keeps the kill switch
+	closeGateway()
+	is.True(g.killSwitch)
+	is.Equal(len(g.ipv4Rules(tableRulePriority)), 1)
+	is.Equal(len(g.ipv4Rules(exclusionRulePriority)), 4)
+
+	// a broker that moved is resolved again
+	g.resolved["broker.netmaker.test"] = []net.IP{net.ParseIP("203.0.113.3")}
+	RefreshGatewayExclusions()
+	is.Equal(g.ipv4Rules(exclusionRulePriority), []string{"192.168.1.1/32", "203.0.113.1/32", "203.0.113.3/32", "9.9.9.9/32"})
+
+	// disabling the kill switch releases it
+	config.Replace(&config.State{Host: config.Config{}, Nodes: config.GetNodes(), Servers: config.GetServerMap()})
+	g.apply(t, false)
+	is.Equal(currentGateway, gatewayOff)
+	is.True(!g.killSwitch)
+	is.Equal(len(g.ipv4Rules(exclusionRulePriority)), 0)
+	is.Equal(len(g.ipv4Rules(tableRulePriority)), 1)
+	closeGateway()
+	is.Equal(len(g.rules[netlink.FAMILY_V4]), 0)
+
+	RefreshGatewayExclusions() // nothing to refresh
+	is.Equal(len(g.rules[netlink.FAMILY_V4]), 0)
+}
+
+func TestKillSwitchLeave(t *testing.T) {
+	is := is.New(t)
+	g := newGatewayTest(t)
+	g.apply(t, false)
+	is.Equal(currentGateway, gatewayBlocked)
+	is.True(g.killSwitch)
+
+	// leaving the network with the gateway releases the kill switch
+	config.Replace(&config.State{Host: *config.Netclient(), Nodes: config.NodeMap{}, Servers: config.GetServerMap()})
+	g.apply(t, false)
+	is.Equal(currentGateway, gatewayOff)
+	is.True(!g.killSwitch)
+
+	// as does removing it when the host is uninstalled
+	var node config.Node
+	node.InternetGateway = &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 51821}
+	config.Replace(&config.State{Host: *config.Netclient(), Nodes: config.NodeMap{"net1": node}, Servers: config.GetServerMap()})
+	g.apply(t, false)
+	is.True(g.killSwitch)
+	RemoveKillSwitch()
+	is.True(!g.killSwitch)
+	is.Equal(len(g.rules[netlink.FAMILY_V4]), 0)
+}
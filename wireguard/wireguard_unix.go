@@ -4,40 +4,70 @@
 package wireguard
 
 import (
+	"errors"
 	"net"
+	"sync"
 
-	"github.com/gravitl/netclient/config"
+	"github.com/gravitl/netmaker/logger"
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/ipc"
 	"golang.zx2c4.com/wireguard/tun"
 )
 
+// userspaceIface - a wireguard-go device on a tun interface, configured by wgctrl through its uapi socket
+type userspaceIface struct {
+	device *device.Device
+	uapi   net.Listener
+	once   sync.Once
+}
+
+// userspaceIface.Close - closes the uapi socket and the device, which removes the tun interface
+// closing it again has no effect
+func (u *userspaceIface) Close() error {
+	var err error
+	u.once.Do(func() {
+		err = u.uapi.Close()
+		u.device.Close()
+	})
+	return err
+}
+
 // == private ==
 
 func (nc *NCIface) createUserSpaceWG() error {
 	wgMutex.Lock()
 	defer wgMutex.Unlock()
 
-	tunIface, err := tun.CreateTUN(nc.Name, config.Netclient().MTU)
+	mtu := nc.MTU
+	if mtu == 0 {
+		mtu = device.DefaultMTU
+	}
+	tunIface, err := tun.CreateTUN(nc.Name, mtu)
 	if err != nil {
 		return err
 	}
-	nc.Iface = tunIface
 	tunDevice := device.NewDevice(tunIface, conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, "[netclient] "))
-	err = tunDevice.Up()
+	uapi, err := getUAPIByInterface(nc.Name)
 	if err != nil {
+		tunDevice.Close()
 		return err
 	}
-	uapi, err := getUAPIByInterface(nc.Name)
-	if err != nil {
+	if err = tunDevice.Up(); err != nil {
+		uapi.Close()
+		tunDevice.Close()
 		return err
 	}
+	nc.Iface = &userspaceIface{device: tunDevice, uapi: uapi}
+	name := nc.Name
 	go func() {
 		for {
 			uapiConn, uapiErr := uapi.Accept()
 			if uapiErr != nil {
-				continue
+				if !errors.Is(uapiErr, net.ErrClosed) {
+					logger.Log(0, "stopped serving the uapi socket of", name, uapiErr.Error())
+				}
+				return
 			}
 			go tunDevice.IpcHandle(uapiConn)
 		}